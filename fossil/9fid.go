@@ -46,6 +46,7 @@ type Fid struct {
 	uname  string
 	db     *DirBuf
 	excl   *Excl
+	hist   []byte     // contents of a versions file; see rTattach
 	alk    sync.Mutex // Tauth/Tattach
 	rpc    *AuthRpc
 	cuname string
@@ -150,6 +151,7 @@ func (fid *Fid) free() {
 		dirBufFree(fid.db)
 		fid.db = nil
 	}
+	fid.hist = nil
 
 	fid.unlock()
 
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/vac"
 	"github.com/floren/fs/venti"
 )
 
@@ -24,7 +25,7 @@ type Fsys struct {
 	venti string
 
 	fs      *Fs
-	session *venti.Session
+	session venti.Store
 	ref     int
 
 	noauth     bool
@@ -63,22 +64,32 @@ var fsyscmd = []struct {
 	{"bfree", fsysBfree, nil},
 	{"block", fsysBlock, nil},
 	{"check", fsysCheck, nil},
+	{"clone", fsysClone, nil},
 	{"clre", fsysClre, nil},
 	{"clri", fsysClri, nil},
 	{"clrp", fsysClrp, nil},
 	{"create", fsysCreate, nil},
 	{"df", fsysDf, nil},
+	{"diff", fsysDiff, nil},
 	{"epoch", fsysEpoch, nil},
 	{"halt", fsysHalt, nil},
+	{"highwater", fsysHighWater, nil},
+	{"history", fsysHistory, nil},
 	{"label", fsysLabel, nil},
 	{"printlocks", fsysPrintLocks, nil},
 	{"remove", fsysRemove, nil},
+	{"restore", fsysRestore, nil},
 	{"snap", fsysSnap, nil},
 	{"snaptime", fsysSnapTime, nil},
 	{"snapclean", fsysSnapClean, nil},
+	{"snapkeep", fsysSnapKeep, nil},
+	{"snaplist", fsysSnapList, nil},
+	{"snapsched", fsysSnapSched, nil},
+	{"snapspace", fsysSnapSpace, nil},
 	{"stat", fsysStat, nil},
 	{"sync", fsysSync, nil},
 	{"unhalt", fsysUnhalt, nil},
+	{"versions", fsysVersions, nil},
 	{"wstat", fsysWstat, nil},
 	{"vac", fsysVac, nil},
 	{"", nil, nil},
@@ -243,19 +254,85 @@ func fsysParseMode(s string) (uint32, bool) {
 	return x | uint32(y), true
 }
 
-func (fsys *Fsys) getRoot(name string) *File {
+// getRoot returns the file named by the path part of an
+// attach name: a file in the root directory, the root itself,
+// for vac:score[/path], the root of the archive with that
+// score or a file in it, and for @time[/path], the newest
+// snapshot taken at or before time or a file in it.
+func (fsys *Fsys) getRoot(name string) (*File, error) {
 	assert(fsys != nil && fsys.fs != nil)
 
+	if strings.HasPrefix(name, "@") {
+		elems := strings.SplitN(name[1:], "/", 2)
+		t, err := parseSnapTime(elems[0], time.Now())
+		if err != nil {
+			return nil, err
+		}
+		path, err := fsys.fs.snapshotAt(t)
+		if err != nil {
+			return nil, err
+		}
+		if len(elems) == 2 {
+			path += "/" + elems[1]
+		}
+		return fsys.fs.openFile(path)
+	}
+
+	if strings.HasPrefix(name, vac.Prefix) {
+		elems := strings.SplitN(name, "/", 2)
+		score, err := vac.ParseScore(elems[0])
+		if err != nil {
+			return nil, err
+		}
+		root, err := fsys.fs.openArchive(score)
+		if err != nil || len(elems) == 1 {
+			return root, err
+		}
+		sub, err := root.walkPath(elems[1], false)
+		root.decRef()
+		return sub, err
+	}
+
 	root := fsys.fs.getRoot()
 	if name == "" {
-		return root
+		return root, nil
 	}
 
-	var sub *File
-	sub, _ = root.walk(name)
+	sub, err := root.walk(name)
 	root.decRef()
 
-	return sub
+	return sub, err
+}
+
+// parseSnapTime parses the time of an @time attach name: a
+// local date and time such as 2026-10-01T12:00, a date alone,
+// meaning its midnight, an RFC 3339 time, or a minus sign and
+// a duration before now, such as -2h or -3d.
+func parseSnapTime(s string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "-") {
+		var d time.Duration
+		var err error
+		if strings.HasSuffix(s, "d") {
+			var n int
+			n, err = strconv.Atoi(s[1 : len(s)-1])
+			d = time.Duration(n) * 24 * time.Hour
+		} else {
+			d, err = time.ParseDuration(s[1:])
+		}
+		if err != nil || d < 0 {
+			return time.Time{}, fmt.Errorf("bad time %q", s)
+		}
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad time %q", s)
 }
 
 func newFsys(name string, dev string) (*Fsys, error) {
@@ -300,7 +377,7 @@ func fsysClose(cons *console.Cons, fsys *Fsys, argv []string) error {
 	fsys.fs.close()
 	fsys.fs = nil
 	if fsys.session != nil {
-		fsys.session.Close()
+		closeStore(fsys.session)
 		fsys.session = nil
 	}
 
@@ -335,6 +412,63 @@ func fsysVac(cons *console.Cons, fsys *Fsys, argv []string) error {
 	return nil
 }
 
+func fsysHistory(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] history [-n count] [vac:score [path ...]]"
+
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	nflag := flags.Int("n", 0, "List at most `count` archives.")
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	argv = flags.Args()
+	argc := flags.NArg()
+
+	if argc == 0 {
+		list, err := fsys.fs.history(*nflag)
+		for _, a := range list {
+			cons.Printf("vac:%v %s %s\n", &a.Score, a.Time.Format("2006/01/02 15:04:05"), a.Name)
+		}
+		return err
+	}
+
+	/*
+	 * Open the archive read-only and stat
+	 * the given paths in it.
+	 */
+	score, err := vac.ParseScore(argv[0])
+	if err != nil {
+		return err
+	}
+	fsys.fs.elk.RLock()
+	defer fsys.fs.elk.RUnlock()
+	root, err := fsys.fs.openArchive(score)
+	if err != nil {
+		return err
+	}
+	defer root.decRef()
+	paths := argv[1:]
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		f, err := root.walkPath(p, false)
+		if err != nil {
+			cons.Printf("%s: %v\n", p, err)
+			continue
+		}
+		de, err := f.getDir()
+		if err != nil {
+			cons.Printf("%s: %v\n", p, err)
+			f.decRef()
+			continue
+		}
+		fsysPrintStat(cons, "\t", p, de)
+		f.decRef()
+	}
+	return nil
+}
+
 func fsysSnap(cons *console.Cons, fsys *Fsys, argv []string) error {
 	usage := "Usage: [fsys name] snap [-a] [-s /active] [-d /archive/yyyy/mmmm]"
 
@@ -355,10 +489,11 @@ func fsysSnap(cons *console.Cons, fsys *Fsys, argv []string) error {
 }
 
 func fsysSnapClean(cons *console.Cons, fsys *Fsys, argv []string) error {
-	usage := "Usage: [fsys name] snapclean [maxminutes]"
+	usage := "Usage: [fsys name] snapclean [-n] [maxminutes]"
 
 	flags := flag.NewFlagSet("snapclean", flag.ContinueOnError)
 	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	nflag := flags.Bool("n", false, "List the snapshots that would be removed, without removing them.")
 	if err := flags.Parse(argv[1:]); err != nil {
 		return EUsage
 	}
@@ -375,14 +510,87 @@ func fsysSnapClean(cons *console.Cons, fsys *Fsys, argv []string) error {
 			return EUsage
 		}
 		life = time.Duration(min) * time.Minute
+	} else if keep := fsys.fs.snap.getKeep(); keep.set() {
+		paths, err := fsys.fs.snapshotExpire(keep, *nflag)
+		if *nflag {
+			for _, p := range paths {
+				cons.Printf("\t%s\n", p)
+			}
+		}
+		return err
 	} else {
 		_, _, life = fsys.fs.snap.getTimes()
 	}
 
+	if *nflag {
+		savetime := uint32(time.Now().Add(-life).Unix())
+		fsys.fs.elk.RLock()
+		for _, s := range fsys.fs.snapshots() {
+			if strings.HasPrefix(s.path, "/snapshot/") && s.mtime < savetime {
+				cons.Printf("\t%s\n", s.path)
+			}
+		}
+		fsys.fs.elk.RUnlock()
+		return nil
+	}
+
 	fsys.fs.snapshotCleanup(life)
 	return nil
 }
 
+func fsysSnapKeep(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] snapkeep [-h hourly] [-d daily] [-w weekly] [-m monthly]"
+
+	flags := flag.NewFlagSet("snapkeep", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	keep := fsys.fs.snap.getKeep()
+	flags.IntVar(&keep.hourly, "h", keep.hourly, "Keep the newest snapshot of each of the last `hourly` hours.")
+	flags.IntVar(&keep.daily, "d", keep.daily, "Keep the newest snapshot of each of the last `daily` days.")
+	flags.IntVar(&keep.weekly, "w", keep.weekly, "Keep the newest snapshot of each of the last `weekly` weeks.")
+	flags.IntVar(&keep.monthly, "m", keep.monthly, "Keep the newest snapshot of each of the last `monthly` months.")
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() > 0 || keep.hourly < 0 || keep.daily < 0 || keep.weekly < 0 || keep.monthly < 0 {
+		flags.Usage()
+		return EUsage
+	}
+
+	if flags.NFlag() > 0 {
+		fsys.fs.snap.setKeep(keep)
+		return nil
+	}
+	cons.Printf("\tsnapkeep %v\n", keep)
+	return nil
+}
+
+func fsysHighWater(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] highwater [-r percent] [-f percent]"
+
+	flags := flag.NewFlagSet("highwater", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	hw := fsys.fs.snap.getHighWater()
+	flags.IntVar(&hw.reclaim, "r", hw.reclaim, "Remove old snapshots once `percent` of the disk is in use.")
+	flags.IntVar(&hw.full, "f", hw.full, "Refuse writes while `percent` of the disk is in use after that.")
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() > 0 || hw.reclaim < 0 || hw.reclaim > 100 || hw.full < 0 || hw.full > 100 {
+		flags.Usage()
+		return EUsage
+	}
+
+	if flags.NFlag() > 0 {
+		if fsys.fs.snap == nil {
+			return fmt.Errorf("no high-water marks on a read-only file system")
+		}
+		fsys.fs.snap.setHighWater(hw)
+		return nil
+	}
+	cons.Printf("\thighwater %v\n", hw)
+	return nil
+}
+
 func fsysSnapTime(cons *console.Cons, fsys *Fsys, argv []string) error {
 	usage := "Usage: [fsys name] snaptime [-a hhmm] [-s snapfreq] [-t snaplife]"
 
@@ -472,6 +680,113 @@ func fsysSnapTime(cons *console.Cons, fsys *Fsys, argv []string) error {
 	return nil
 }
 
+func fsysSnapList(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] snaplist"
+
+	flags := flag.NewFlagSet("snaplist", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return EUsage
+	}
+
+	fsys.fs.elk.RLock()
+	list, err := fsys.fs.snapList()
+	fsys.fs.elk.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, si := range list {
+		cons.Printf("%v\n", si)
+	}
+	return nil
+}
+
+func fsysSnapSched(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] snapsched [-a] [-r] [minute hour mday month wday]"
+
+	flags := flag.NewFlagSet("snapsched", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	var (
+		aflag = flags.Bool("a", false, "Schedule archival snapshots rather than temporary ones.")
+		rflag = flags.Bool("r", false, "Remove the schedule rather than add it.")
+	)
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() == 0 && flags.NFlag() == 0 {
+		for _, sc := range fsys.fs.snap.getScheds() {
+			cons.Printf("\tsnapsched %s\n", sc)
+		}
+		return nil
+	}
+	if flags.NArg() != 5 {
+		flags.Usage()
+		return EUsage
+	}
+
+	c, err := parseCron(flags.Args())
+	if err != nil {
+		return err
+	}
+	if *rflag {
+		return fsys.fs.snap.removeSched(c, *aflag)
+	}
+	return fsys.fs.snap.addSched(c, *aflag)
+}
+
+func fsysSnapSpace(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] snapspace [epoch]"
+
+	flags := flag.NewFlagSet("snapspace", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return EUsage
+	}
+	var epoch uint32
+	if flags.NArg() == 1 {
+		e, err := strconv.ParseUint(flags.Arg(0), 0, 32)
+		if err != nil {
+			flags.Usage()
+			return EUsage
+		}
+		epoch = uint32(e)
+	}
+
+	fs := fsys.fs
+	fs.elk.RLock()
+	defer fs.elk.RUnlock()
+
+	u, err := fs.spaceUsage()
+	if err != nil {
+		return err
+	}
+	for _, r := range u.ranges {
+		cons.Printf("\t%v\n", r)
+	}
+	cons.Printf("\tactive: %s\n", fmtComma(u.active))
+	if epoch == 0 {
+		return nil
+	}
+
+	size, low, held, err := fs.reclaim(u, epoch)
+	if err != nil {
+		return err
+	}
+	cons.Printf("\tdropping snapshots before epoch %d frees %s\n", epoch, fmtComma(size))
+	if held != "" {
+		cons.Printf("\t%s keeps the low epoch at %d\n", held, low)
+	}
+	return nil
+}
+
 func fsysSync(cons *console.Cons, fsys *Fsys, argv []string) error {
 	usage := "Usage: [fsys name] sync"
 
@@ -584,6 +899,38 @@ func fsysRemove(cons *console.Cons, fsys *Fsys, argv []string) error {
 	return nil
 }
 
+func fsysRestore(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] restore /snapshot/.../path /active/path"
+
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return EUsage
+	}
+
+	return fsys.fs.restore(flags.Arg(0), flags.Arg(1), uidadm)
+}
+
+func fsysClone(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] clone snapshot name"
+
+	flags := flag.NewFlagSet("clone", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return EUsage
+	}
+
+	return fsys.fs.clone(flags.Arg(0), flags.Arg(1), uidadm)
+}
+
 func fsysClri(cons *console.Cons, fsys *Fsys, argv []string) error {
 	usage := "Usage: [fsys name] clri path ..."
 
@@ -863,6 +1210,10 @@ func fsysDf(cons *console.Cons, fsys *Fsys, argv []string) error {
 		fmtComma(int64(tot-used)*int64(bsize)),
 		fmtComma(int64(tot)*int64(bsize)),
 		float64(used)*100/float64(tot))
+	if nslot, hits, misses := fs.cache.disk.vcacheStats(); nslot != 0 {
+		cons.Printf("\tventi cache: %s in %d blocks, %d hits, %d misses\n",
+			fmtComma(int64(nslot)*int64(bsize)), nslot, hits, misses)
+	}
 	return nil
 }
 
@@ -1031,6 +1382,39 @@ func fsysEsearch(cons *console.Cons, fs *Fs, path string, elo uint32) int {
 	return fsysEsearch1(cons, f, path, elo)
 }
 
+func fsysDiff(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] diff old new"
+
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return EUsage
+	}
+
+	/*
+	 * Either tree may be given as a path, such as
+	 * /snapshot/2026/1017/1200 or /active, or as the
+	 * epoch of a snapshot.
+	 */
+	fsys.fs.elk.RLock()
+	defer fsys.fs.elk.RUnlock()
+	a, err := fsys.fs.snapshotPath(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	b, err := fsys.fs.snapshotPath(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	return fsys.fs.diff(a, b, func(c *diffChange) {
+		cons.Printf("%v\n", c)
+	})
+}
+
 func fsysEpoch(cons *console.Cons, fsys *Fsys, argv []string) error {
 	var low, old uint32
 	usage := "Usage: [fsys name] epoch [[-ry] low]"
@@ -1221,6 +1605,31 @@ func fsysStat(cons *console.Cons, fsys *Fsys, argv []string) error {
 	return nil
 }
 
+func fsysVersions(cons *console.Cons, fsys *Fsys, argv []string) error {
+	usage := "Usage: [fsys name] versions /active/path"
+
+	flags := flag.NewFlagSet("versions", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
+	if err := flags.Parse(argv[1:]); err != nil {
+		return EUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return EUsage
+	}
+
+	fsys.fs.elk.RLock()
+	list, err := fsys.fs.fileVersions(flags.Arg(0))
+	fsys.fs.elk.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, v := range list {
+		cons.Printf("%v\n", v)
+	}
+	return nil
+}
+
 func fsysWstat(cons *console.Cons, fsys *Fsys, argv []string) error {
 	usage := `Usage: [fsys name] wstat file elem uid gid mode length
   -	Replace any field with - to mean "don't change".`
@@ -1452,7 +1861,7 @@ Out:
 }
 
 func fsysVenti(cons *console.Cons, name string, argv []string) error {
-	usage := "Usage: [fsys name] venti [address]"
+	usage := "Usage: [fsys name] venti [address | dir:/path]"
 
 	flags := flag.NewFlagSet("venti", flag.ContinueOnError)
 	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage); flags.PrintDefaults() }
@@ -1498,16 +1907,14 @@ func fsysVenti(cons *console.Cons, name string, argv []string) error {
 		if fsys.session == nil {
 			return errors.New("file system was opened with -V")
 		}
-		fsys.session.Close()
-		fsys.session, err = venti.Dial(host)
-		return err
+		return fsys.fs.redial(host)
 	}
 
 	/* not yet open: try to dial */
 	if fsys.session != nil {
-		fsys.session.Close()
+		closeStore(fsys.session)
 	}
-	fsys.session, err = venti.Dial(host)
+	fsys.session, err = openStore(host)
 	return err
 }
 
@@ -1556,7 +1963,7 @@ func fsysOpen(cons *console.Cons, name string, argv []string) error {
 
 	if noventi {
 		if fsys.session != nil {
-			fsys.session.Close()
+			closeStore(fsys.session)
 			fsys.session = nil
 		}
 	} else if fsys.session == nil {
@@ -1567,9 +1974,9 @@ func fsysOpen(cons *console.Cons, name string, argv []string) error {
 			host = ""
 		}
 		cons.Printf("dialing venti at %v\n", host)
-		fsys.session, err = venti.Dial(host)
+		fsys.session, err = openStore(host)
 		if err != nil {
-			cons.Printf("error connecting to venti: %v\n", err)
+			cons.Printf("error connecting to venti: %v; will keep trying\n", err)
 		}
 	}
 
@@ -1621,7 +2028,7 @@ func fsysUnconfig(cons *console.Cons, name string, argv []string) error {
 	delete(fsysbox.fsysmap, name)
 
 	if fsys.session != nil {
-		fsys.session.Close()
+		closeStore(fsys.session)
 	}
 
 	return nil
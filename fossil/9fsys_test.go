@@ -56,8 +56,7 @@ func testFsysDf(t *testing.T) {
 }
 
 func testFsysCheck(t *testing.T) {
-	buf := new(bytes.Buffer)
-	cons := console.NewCons(nopCloser{buf}, false)
+	cons, buf := testCons()
 	defer cons.Close()
 
 	if err := console.Exec(cons, "fsys testfs check"); err != nil {
@@ -158,3 +157,34 @@ func TestFsysOpenClose(t *testing.T) {
 		t.Fatalf("unconfig: %v", err)
 	}
 }
+
+func TestParseSnapTime(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 30, 0, 0, time.Local)
+	testCases := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"2026-10-01T12:00", time.Date(2026, 10, 1, 12, 0, 0, 0, time.Local), true},
+		{"2026-10-01T12:00:30", time.Date(2026, 10, 1, 12, 0, 30, 0, time.Local), true},
+		{"2026-10-01", time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), true},
+		{"2026-10-01T12:00:00Z", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC), true},
+		{"-2h", now.Add(-2 * time.Hour), true},
+		{"-90m", now.Add(-90 * time.Minute), true},
+		{"-3d", now.Add(-72 * time.Hour), true},
+		{"--2h", time.Time{}, false},
+		{"-xd", time.Time{}, false},
+		{"2026/10/01", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+
+	for _, c := range testCases {
+		got, err := parseSnapTime(c.s, now)
+		if c.ok && (err != nil || !got.Equal(c.want)) {
+			t.Errorf("parseSnapTime(%q): got %v, %v, want %v", c.s, got, err, c.want)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("parseSnapTime(%q): got %v, want error", c.s, got)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/floren/fs/internal/plan9"
+	"github.com/floren/fs/vac"
 )
 
 /* Topen/Tcreate mode */
@@ -110,6 +111,10 @@ func rTwstat(m *Msg) error {
 		return EPermission
 	}
 
+	if fid.hist != nil {
+		return EReadOnly
+	}
+
 	if fid.file.isRoFs() || !groupWriteMember(fid.uname) {
 		return fmt.Errorf("read-only filesystem")
 	}
@@ -370,6 +375,24 @@ func rTstat(m *Msg) error {
 		return nil
 	}
 
+	if fid.hist != nil {
+		now := uint32(time.Now().Unix())
+		dir := &plan9.Dir{
+			Qid:    fid.qid,
+			Mode:   0444,
+			Atime:  now,
+			Mtime:  now,
+			Length: uint64(len(fid.hist)),
+			Name:   "versions",
+			Uid:    fid.uname,
+			Gid:    fid.uname,
+			Muid:   fid.uname,
+		}
+		m.r.Stat, err = dir.Bytes()
+		fid.put()
+		return err
+	}
+
 	de, err := fid.file.getDir()
 	if err != nil {
 		fid.put()
@@ -390,7 +413,9 @@ func _rTclunk(fid *Fid, remove bool) error {
 	}
 
 	var err error
-	if remove && fid.qid.Type&plan9.QTAUTH == 0 {
+	if remove && fid.hist != nil {
+		err = EReadOnly
+	} else if remove && fid.qid.Type&plan9.QTAUTH == 0 {
 		if err = permParent(fid, PermW); err == nil {
 			err = fid.file.remove(fid.uid)
 		}
@@ -501,6 +526,13 @@ func rTread(m *Msg) error {
 		data, err = dirRead(fid, count, int64(m.t.Offset))
 	} else if fid.qid.Type&plan9.QTAUTH != 0 {
 		data, err = authRead(fid, count)
+	} else if fid.hist != nil {
+		if m.t.Offset < uint64(len(fid.hist)) {
+			data = fid.hist[m.t.Offset:]
+		}
+		if len(data) > count {
+			data = data[:count]
+		}
 	} else {
 		data = make([]byte, count)
 		var n int
@@ -528,6 +560,10 @@ func rTcreate(m *Msg) error {
 		return fmt.Errorf("fid open for I/O")
 	}
 
+	if fid.hist != nil {
+		return ENotDir
+	}
+
 	if fid.file.isRoFs() || !groupWriteMember(fid.uname) {
 		return fmt.Errorf("read-only filesystem")
 	}
@@ -640,6 +676,20 @@ func rTopen(m *Msg) error {
 		goto error
 	}
 
+	/*
+	 * A versions file can only be read.
+	 */
+	if fid.hist != nil {
+		if m.t.Mode != plan9.OREAD {
+			err = EReadOnly
+			goto error
+		}
+		m.r.Qid = fid.qid
+		m.r.Iounit = m.con.msize - plan9.IOHDRSIZE
+		fid.open = FidORead
+		return nil
+	}
+
 	isdir = fid.file.isDir()
 	rofs = fid.file.isRoFs() || !groupWriteMember(fid.uname)
 
@@ -759,6 +809,10 @@ func rTwalk(m *Msg) error {
 		ofid.put()
 		return errors.New("file open for I/O")
 	}
+	if ofid.hist != nil && len(t.Wname) > 0 {
+		ofid.put()
+		return ENotDir
+	}
 
 	/*
 	 * If newfid is not the same as fid, allocate a new file;
@@ -776,7 +830,11 @@ func rTwalk(m *Msg) error {
 		}
 
 		nfid.open = ofid.open &^ FidORclose
-		nfid.file = ofid.file.incRef()
+		if ofid.hist != nil {
+			nfid.hist = ofid.hist
+		} else {
+			nfid.file = ofid.file.incRef()
+		}
 		nfid.qid = ofid.qid
 		nfid.uid = ofid.uid
 		nfid.uname = ofid.uname
@@ -898,12 +956,21 @@ func rTflush(m *Msg) error {
 	return nil
 }
 
+/*
+ * An attach name of versions:/active/path names a synthetic,
+ * read-only file listing the versions of path in the snapshots.
+ */
+const versionsPrefix = "versions:"
+
 func parseAname(aname string) (fsname, path string) {
 	var s string
-	if aname != "" {
-		s = aname
-	} else {
+	switch {
+	case aname == "":
 		s = "main/active"
+	case strings.HasPrefix(aname, vac.Prefix), strings.HasPrefix(aname, "@"), strings.HasPrefix(aname, versionsPrefix):
+		s = "main/" + aname
+	default:
+		s = aname
 	}
 	parts := strings.SplitN(s, "/", 2)
 	fsname = parts[0]
@@ -951,16 +1018,28 @@ func rTattach(m *Msg) error {
 		return err
 	}
 
+	var histQid uint64
 	fsys.fsRlock()
-	fid.file = fsys.getRoot(path)
-	if (fid.file) == nil {
+	if strings.HasPrefix(path, versionsPrefix) {
+		fid.hist, histQid, err = fsys.fs.versionsFile(strings.TrimPrefix(path, versionsPrefix))
+	} else {
+		fid.file, err = fsys.getRoot(path)
+	}
+	if err != nil {
 		fsys.fsRUnlock()
 		fid.clunk()
 		return err
 	}
 	fsys.fsRUnlock()
 
-	fid.qid = plan9.Qid{Path: fid.file.getId(), Type: plan9.QTDIR}
+	switch {
+	case fid.hist != nil:
+		fid.qid = plan9.Qid{Path: histQid, Type: plan9.QTFILE}
+	case fid.file.isDir():
+		fid.qid = plan9.Qid{Path: fid.file.getId(), Type: plan9.QTDIR}
+	default:
+		fid.qid = plan9.Qid{Path: fid.file.getId(), Type: plan9.QTFILE}
+	}
 	m.r.Qid = fid.qid
 
 	fid.put()
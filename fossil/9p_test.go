@@ -2,10 +2,16 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+	"github.com/floren/fs/venti/ventitest"
 )
 
 func TestParseAname(t *testing.T) {
@@ -15,6 +21,11 @@ func TestParseAname(t *testing.T) {
 		{"", "main", "active"},
 		{"main/active", "main", "active"},
 		{"fsname", "fsname", ""},
+		{"vac:da39a3ee5e6b4b0d3255bfef95601890afd80709", "main", "vac:da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{"other/vac:da39a3ee5e6b4b0d3255bfef95601890afd80709/active", "other", "vac:da39a3ee5e6b4b0d3255bfef95601890afd80709/active"},
+		{"@-2h", "main", "@-2h"},
+		{"versions:/active/adm/users", "main", "versions:/active/adm/users"},
+		{"main/@2026-10-01T12:00/active", "main", "@2026-10-01T12:00/active"},
 	}
 
 	for _, c := range testCases {
@@ -56,10 +67,7 @@ func Test9p(t *testing.T) {
 		testdata[i] = 'a'
 	}
 
-	commands := []struct {
-		log, cmd, match string
-		err             bool
-	}{
+	commands := []test9pCommand{
 		{log: "Negotiate version:"},
 		{cmd: "9p Tversion 8192 9P2000", match: "9P2000"},
 
@@ -150,7 +158,21 @@ func Test9p(t *testing.T) {
 		{log: "Close /active:"},
 		{cmd: "9p Tclunk 0"},
 	}
+	testRun9p(t, cons, conn, commands)
 
+	if err := testCleanupFsys(); err != nil {
+		t.Fatalf("testCleanupFsys: %v", err)
+	}
+}
+
+type test9pCommand struct {
+	log, cmd, match string
+	err             bool
+}
+
+// testRun9p runs the 9p console commands, checking
+// their responses.
+func testRun9p(t *testing.T, cons *console.Cons, conn *test9pConn, commands []test9pCommand) {
 	for _, c := range commands {
 		if c.log != "" {
 			t.Log("")
@@ -176,10 +198,6 @@ func Test9p(t *testing.T) {
 			t.Errorf("response %q does not match %q", rout, c.match)
 		}
 	}
-
-	if err := testCleanupFsys(); err != nil {
-		t.Fatalf("testCleanupFsys: %v", err)
-	}
 }
 
 func Benchmark9pWrite(b *testing.B) {
@@ -273,3 +291,167 @@ func Benchmark9pRead(b *testing.B) {
 	}
 
 }
+
+func Test9pVac(t *testing.T) {
+	store := venti.NewMemStore()
+	fault := ventitest.NewFaultStore(store)
+	srv, addr := testServeVenti(t, fault, "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	// an archive written by vac
+	tree := fstest.MapFS{
+		"dir/file": {Data: []byte("from vac"), Mode: 0644, ModTime: time.Unix(1600000000, 0)},
+	}
+	vscore, err := vac.NewWriter(store).Write(tree, ".", "vac")
+	if err != nil {
+		t.Fatalf("vac: %v", err)
+	}
+
+	// and one by fossil
+	conn := new(test9pConn)
+	cons := console.NewCons(conn, false)
+	defer cons.Close()
+	testRun9p(t, cons, conn, []test9pCommand{
+		{cmd: "9p Tversion 8192 9P2000", match: "9P2000"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/active"},
+		{cmd: "9p Twalk 0 1"},
+		{cmd: "9p Tcreate 1 archived 0644 2"},
+		{cmd: "9p Twrite 1 0 from-fossil", match: "count=11"},
+		{cmd: "9p Tclunk 1"},
+		{cmd: "9p Tclunk 0"},
+	})
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	fscore := testSuper(t, fs).last
+	nwrite, _ := fault.Writes()
+
+	testRun9p(t, cons, conn, []test9pCommand{
+		{log: "Attach to the vac archive:"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/vac:" + vscore.String()},
+		{cmd: "9p Twalk 0 1 dir file"},
+		{cmd: "9p Topen 1 0"},
+		{cmd: "9p Tread 1 0 100", match: "from vac"},
+		{cmd: "9p Tclunk 1"},
+		{cmd: "9p Twalk 0 1 .."},
+		{cmd: "9p Tstat 1"},
+		{cmd: "9p Tclunk 1"},
+		{cmd: "9p Twalk 0 1 dir"},
+		{cmd: "9p Tcreate 1 new 0644 2", err: true, match: "read only"},
+		{cmd: "9p Tclunk 1"},
+		{cmd: "9p Tclunk 0"},
+
+		{log: "Attach to a file in the fossil archive:"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/vac:" + fscore.String() + "/active/archived"},
+		{cmd: "9p Topen 0 0"},
+		{cmd: "9p Tread 0 0 100", match: "from-fossil"},
+		{cmd: "9p Twrite 0 0 x", err: true, match: "not open for write"},
+		{cmd: "9p Tclunk 0"},
+
+		{log: "Attach to missing archives:"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/vac:" + venti.Sha1([]byte("none")).String(), err: true, match: "Rerror"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/vac:bogus", err: true, match: "Rerror"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/vac:" + fscore.String() + "/nonexistent", err: true, match: "Rerror"},
+	})
+
+	// attaching to archives only reads from venti
+	if n, _ := fault.Writes(); n != nwrite {
+		t.Errorf("%d blocks written to venti by attaching to archives", n-nwrite)
+	}
+}
+
+func Test9pVersions(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	conn := new(test9pConn)
+	cons := console.NewCons(conn, false)
+	defer cons.Close()
+	testRun9p(t, cons, conn, []test9pCommand{
+		{cmd: "9p Tversion 8192 9P2000"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/active"},
+		{cmd: "9p Twalk 0 1"},
+		{cmd: "9p Tcreate 1 file 0644 1"},
+		{cmd: "9p Twrite 1 0 one", match: "count=3"},
+		{cmd: "9p Tclunk 1"},
+	})
+
+	// t1 and t2 hold the same version, t3 a newer one
+	for _, snap := range []string{"t1", "t2", "t3"} {
+		if snap == "t3" {
+			testRun9p(t, cons, conn, []test9pCommand{
+				{cmd: "9p Twalk 0 1 file"},
+				{cmd: "9p Topen 1 1"},
+				{cmd: "9p Twrite 1 3 two", match: "count=3"},
+				{cmd: "9p Tclunk 1"},
+			})
+		}
+		if err := fs.snapshot("", "/snapshot/"+snap, false); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	fs.elk.RLock()
+	list, err := fs.fileVersions("/active/file")
+	fs.elk.RUnlock()
+	if err != nil {
+		t.Fatalf("versions: %v", err)
+	}
+	if len(list) != 2 || list[0].path != "/snapshot/t3/file" || list[1].path != "/snapshot/t2/file" {
+		t.Fatalf("versions: got %v", list)
+	}
+	if list[0].dir.size != 6 || list[1].dir.size != 3 || list[0].dir.mcount <= list[1].dir.mcount || list[0].dir.mid != "none" {
+		t.Errorf("versions: got %v", list)
+	}
+	fs.elk.RLock()
+	f, err := fs.openFile("/active/file")
+	fs.elk.RUnlock()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	qid := fmt.Sprintf("(%.16x ", f.getId()|qidVersions)
+	f.decRef()
+
+	ccons, out := testCons()
+	defer ccons.Close()
+	if err := console.Exec(ccons, "fsys testfs versions /active/file"); err != nil {
+		t.Fatalf("versions: %v", err)
+	}
+	if !strings.Contains(out.String(), list[0].String()) || !strings.Contains(out.String(), list[1].String()) {
+		t.Errorf("versions: got %q", out.String())
+	}
+	if err := console.Exec(ccons, "fsys testfs versions /snapshot/t1/file"); err == nil {
+		t.Errorf("versions outside /active succeeded")
+	}
+
+	testRun9p(t, cons, conn, []test9pCommand{
+		{cmd: "9p Tclunk 0"},
+		{log: "Read the versions file:"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/versions:/active/file", match: qid},
+		{cmd: "9p Tstat 0", match: "versions"},
+		{cmd: "9p Twalk 0 1 x", err: true, match: "not a directory"},
+		{cmd: "9p Twalk 0 1"},
+		{cmd: "9p Topen 1 1", err: true, match: "read only"},
+		{cmd: "9p Tremove 1", err: true, match: "read only"},
+		{cmd: "9p Topen 0 0"},
+		{cmd: "9p Tread 0 0 1000", match: "count=94"},
+		{cmd: "9p Tread 0 20 19", match: "/snapshot/t3/file 6"},
+		{cmd: "9p Tread 0 67 19", match: "/snapshot/t2/file 3"},
+		{cmd: "9p Tread 0 94 1000", match: "count=0"},
+		{cmd: "9p Tclunk 0"},
+		{log: "A file in no snapshot has no versions:"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/versions:/active/none", match: "(8000000000000000 "},
+		{cmd: "9p Topen 0 0"},
+		{cmd: "9p Tread 0 0 1000", match: "count=0"},
+		{cmd: "9p Tclunk 0"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/versions:/archive", err: true, match: "not in /active"},
+	})
+}
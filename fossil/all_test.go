@@ -6,28 +6,48 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"os/exec"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
 )
 
-var testFossilPath string
+var (
+	testFossilPath  string
+	testVentiStore  venti.Store
+	testVentiServer *venti.Server
+)
+
+// A testConn is the connection of a test console: writes go
+// to the buffer, and reads block until the console is closed,
+// so that it does not read back its own output as commands.
+type testConn struct {
+	io.Writer
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *testConn) Read(p []byte) (int, error) {
+	<-c.done
+	return 0, io.EOF
+}
 
-type nopCloser struct {
-	io.ReadWriter
+func (c *testConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
 }
 
 func testCons() (*console.Cons, *bytes.Buffer) {
 	buf := new(bytes.Buffer)
-	cons := console.NewCons(nopCloser{buf}, false)
+	cons := console.NewCons(&testConn{Writer: buf, done: make(chan struct{})}, false)
 
 	return cons, buf
 }
 
-func (nopCloser) Close() error { return nil }
-
 func TestMain(m *testing.M) {
 	log.SetOutput(ioutil.Discard)
 
@@ -45,11 +65,14 @@ func TestMain(m *testing.M) {
 		}
 	}
 
-	if err := exec.Command("../test/venti.sh").Run(); err != nil {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", venti.VentiPort))
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting venti server for testing: %v\n", err)
-		testCleanup()
 		os.Exit(1)
 	}
+	testVentiStore = venti.NewMemStore()
+	testVentiServer = venti.NewServer(testVentiStore)
+	go testVentiServer.Serve(l)
 
 	path, err := testFormatFossil()
 	if err != nil {
@@ -65,5 +88,95 @@ func TestMain(m *testing.M) {
 
 func testCleanup() {
 	os.Remove(testFossilPath)
-	exec.Command("../test/clean.sh").Run()
+	testVentiServer.Close()
+}
+
+// testOpenFresh formats a new file system, with every block
+// still local, and opens it as testfs using the venti server
+// at addr.
+func testOpenFresh(t *testing.T, addr string) (*Fs, func()) {
+	path, err := testFormatFossil()
+	if err != nil {
+		t.Fatalf("format: %v", err)
+	}
+	return testOpenPath(t, path, addr)
+}
+
+// testOpenPath opens the file system in path as testfs using
+// the venti server at addr, removing path when done.
+func testOpenPath(t *testing.T, path, addr string) (*Fs, func()) {
+	for _, cmd := range []string{
+		"fsys testfs config " + path,
+		"fsys testfs venti " + addr,
+		"fsys testfs open -AWP",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			os.Remove(path)
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+
+	fsys, err := getFsys("testfs")
+	if err != nil {
+		testCleanupFsys()
+		os.Remove(path)
+		t.Fatalf("get fsys: %v", err)
+	}
+	fs := fsys.getFs()
+	fsys.put()
+
+	return fs, func() {
+		testCleanupFsys()
+		os.Remove(path)
+	}
+}
+
+// testExec runs the console commands cmds, failing the test
+// at the first error.
+func testExec(t *testing.T, cmds ...string) {
+	for _, cmd := range cmds {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%.40s: %v", cmd, err)
+		}
+	}
+}
+
+// testWrite writes data to the file name, in the tree of testfs
+// named by tree, over 9P, the pieces one after the other from
+// offset off. A piece must fit in a single Twrite.
+func testWrite(t *testing.T, tree, name string, off int, data ...string) {
+	cmds := []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/" + tree,
+		"9p Twalk 0 1 " + strings.ReplaceAll(name, "/", " "),
+		"9p Topen 1 1",
+	}
+	for _, d := range data {
+		cmds = append(cmds, fmt.Sprintf("9p Twrite 1 %d %s", off, d))
+		off += len(d)
+	}
+	testExec(t, append(cmds, "9p Tclunk 1", "9p Tclunk 0")...)
+}
+
+// testFill returns n pieces for testWrite, each as big as
+// one fits and all of c.
+func testFill(c string, n int) []string {
+	data := make([]string, n)
+	for i := range data {
+		data[i] = strings.Repeat(c, 8000)
+	}
+	return data
+}
+
+// testSuper returns the super block of fs.
+func testSuper(t *testing.T, fs *Fs) Super {
+	fs.elk.RLock()
+	defer fs.elk.RUnlock()
+
+	b, super, err := getSuper(fs.cache)
+	if err != nil {
+		t.Fatalf("get super: %v", err)
+	}
+	b.put()
+	return *super
 }
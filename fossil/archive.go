@@ -16,19 +16,21 @@ type Arch struct {
 	blockSize uint
 	c         *Cache
 	fs        *Fs
-	z         *venti.Session
+	z         venti.Store
 
 	work chan struct{}
+	quit chan struct{}
 	die  chan struct{}
 }
 
-func initArch(c *Cache, disk *Disk, fs *Fs, z *venti.Session) *Arch {
+func initArch(c *Cache, disk *Disk, fs *Fs, z venti.Store) *Arch {
 	a := &Arch{
 		blockSize: uint(disk.blockSize()),
 		c:         c,
 		fs:        fs,
 		z:         z,
-		work:      make(chan struct{}),
+		work:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
 	}
 
 	go a.thread()
@@ -40,14 +42,28 @@ func initArch(c *Cache, disk *Disk, fs *Fs, z *venti.Session) *Arch {
 
 func (a *Arch) close() {
 	a.die = make(chan struct{})
-	close(a.work)
+	close(a.quit)
 	// wait for any ongoing archive to finish
 	<-a.die
 }
 
-func ventiSend(a *Arch, b *Block, data []byte) error {
+/*
+ * A block being written to Venti, not yet known to be safely
+ * stored there.  Until it is, neither the block's label nor the
+ * pointer to it in its parent may change.
+ */
+type archSend struct {
+	w     *ventiWrite
+	score venti.Score
+	addr  uint32
+	typ   BlockType
+	tag   uint32
+	real  bool /* not faked: mark the local block BsVenti once stored */
+}
+
+func ventiSend(a *Arch, b *Block, data []byte) (*archSend, error) {
 	if a.z == nil {
-		return errors.New("no venti session")
+		return nil, errors.New("no venti session")
 	}
 
 	dprintf("sending block %#x (type %s / %s) to venti\n", b.addr, b.l.typ, vtType[b.l.typ])
@@ -55,13 +71,56 @@ func ventiSend(a *Arch, b *Block, data []byte) error {
 	data = venti.ZeroTruncate(vtType[b.l.typ], data)
 	dprintf("block zero-truncated from %d to %d bytes\n", a.blockSize, len(data))
 
-	_, err := vtWriteBlock(a.z, data, vtType[b.l.typ])
-	if err != nil {
-		return fmt.Errorf("venti write block %#x: %v\n", b.addr, err)
-	}
+	/* the write outlives our hold on b */
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	return &archSend{
+		w:     writeAsync(a.z, vtType[b.l.typ], buf),
+		score: *venti.Sha1(buf),
+		addr:  b.addr,
+		typ:   b.l.typ,
+		tag:   b.l.tag,
+	}, nil
+}
 
-	if err := a.z.Sync(); err != nil {
-		return fmt.Errorf("venti sync: %v", err)
+/*
+ * Wait for sends to reach Venti and sync them to its disk.
+ * Only then is it safe to mark the blocks as archived.
+ */
+func archCommit(p *Param, sends []*archSend) error {
+	if len(sends) == 0 {
+		return nil
+	}
+	for _, s := range sends {
+		score, err := s.w.wait()
+		if err != nil {
+			p.nfailsend++
+			return fmt.Errorf("venti write block %#x: %w", s.addr, err)
+		}
+		if *score != s.score {
+			p.nfailsend++
+			return fmt.Errorf("venti write block %#x: score check failed", s.addr)
+		}
+	}
+	if err := p.a.z.Sync(); err != nil {
+		return fmt.Errorf("venti sync: %w", err)
+	}
+	for _, s := range sends {
+		if !s.real {
+			continue
+		}
+		b, err := p.c.localData(s.addr, s.typ, s.tag, OReadWrite, 0)
+		if err != nil {
+			return err
+		}
+		l := b.l
+		l.state |= BsVenti
+		err = b.setLabel(&l, false)
+		b.put()
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -118,6 +177,13 @@ func copyBlock(b *Block, blockSize uint) []byte {
  * We don't archive the snapshots. Instead we zero the
  * entries in a temporary copy of the block and archive that.
  *
+ * The children of a block are walked first, each returning
+ * its own write to Venti still in flight, so that many writes
+ * are outstanding at once.  The block's pointers are updated
+ * and the block itself sent only once its children are safely
+ * stored.  The block's own send is returned to the caller,
+ * which must archCommit it.
+ *
  * Return value is:
  *
  *	ArchFailure	some error occurred
@@ -130,7 +196,21 @@ const (
 	ArchFaked
 )
 
-func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
+/*
+ * A pointer visited by archWalk, recorded until
+ * the child it points at is stored.
+ */
+type archKid struct {
+	n     int /* pointer index + 1 */
+	e     *Entry
+	fake  bool /* snapshot or clone entry; zero it */
+	addr  uint32
+	x     int
+	score venti.Score
+	l     Label
+}
+
+func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, *archSend, error) {
 	p.nvisit++
 
 	b, err := p.c.localData(addr, typ, tag, OReadWrite, 0)
@@ -139,9 +219,9 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 		if err == ELabelMismatch {
 			/* might as well plod on so we write _something_ to Venti */
 			p.score = venti.ZeroScore()
-			return ArchFaked, err
+			return ArchFaked, nil, err
 		}
-		return ArchFailure, err
+		return ArchFailure, nil, err
 	}
 	defer b.put()
 
@@ -154,37 +234,33 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 	}
 
 	data := &b.data
-	var w WalkPtr
+	var send *archSend
 	if b.l.state&BsVenti == 0 {
 		size := p.dsize
 		if b.l.typ != BtDir {
 			size = p.psize
 		}
 
+		/*
+		 * Walk the children, leaving their writes in flight.
+		 */
+		var kids []archKid
+		var sends []*archSend
+		var w WalkPtr
 		var score venti.Score
 		var e *Entry
 		initWalk(&w, b, size)
-		for i := 0; nextWalk(&w, &score, &typ, &tag, &e); i++ {
+		for nextWalk(&w, &score, &typ, &tag, &e) {
+			k := archKid{n: w.n}
 			if e != nil {
 				if e.flags&venti.EntryActive == 0 {
 					continue
 				}
-				if (e.snap != 0 && !e.archive) || (e.flags&venti.EntryNoArchive != 0) {
-					if false {
-						dprintf("snap; faking %#x\n", b.addr)
-					}
-					if data == &b.data {
-						tmp := copyBlock(b, p.blockSize)
-						data = &tmp
-						w.data = tmp
-					}
-
-					e.score = venti.ZeroScore()
-					e.depth = 0
-					e.size = 0
-					e.tag = 0
-					e.flags &^= venti.EntryLocal
-					e.pack(*data, w.n-1)
+				ee := *e
+				k.e = &ee
+				if (e.snap != 0 && !e.archive) || (e.flags&venti.EntryNoArchive != 0) || e.clone != 0 {
+					k.fake = true
+					kids = append(kids, k)
 					continue
 				}
 			}
@@ -201,7 +277,7 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 			}
 
 			b.lk.Unlock()
-			x, err := archWalk(p, addr, typ, tag)
+			x, s, err := archWalk(p, addr, typ, tag)
 			b.lock()
 			if e != nil {
 				p.dsize = uint(dsize)
@@ -211,11 +287,50 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 			for b.iostate != BioClean && b.iostate != BioDirty {
 				b.ioready.Wait()
 			}
-			switch x {
-			case ArchFailure:
-				logf("archWalk %#x failed; ptr is in %#x offset %d\n", addr, b.addr, i)
+			if x == ArchFailure {
+				logf("archWalk %#x failed; ptr is in %#x offset %d\n", addr, b.addr, w.n-1)
 				p.depth--
-				return ArchFailure, err
+				return ArchFailure, nil, err
+			}
+			if s != nil {
+				sends = append(sends, s)
+			}
+			k.addr = addr
+			k.x = x
+			k.score = p.score
+			k.l = p.l
+			kids = append(kids, k)
+		}
+
+		if err := archCommit(p, sends); err != nil {
+			p.depth--
+			return ArchFailure, nil, err
+		}
+
+		/*
+		 * The children are stored; point at them.
+		 */
+		for _, k := range kids {
+			e := k.e
+			if k.fake {
+				if false {
+					dprintf("snap; faking %#x\n", b.addr)
+				}
+				if data == &b.data {
+					tmp := copyBlock(b, p.blockSize)
+					data = &tmp
+				}
+
+				e.score = venti.ZeroScore()
+				e.depth = 0
+				e.size = 0
+				e.tag = 0
+				e.flags &^= venti.EntryLocal
+				e.pack(*data, k.n-1)
+				continue
+			}
+
+			switch k.x {
 			case ArchFaked:
 				/*
 				 * When we're writing the entry for an archive directory
@@ -229,11 +344,10 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 				if e == nil || !e.archive {
 					if data == &b.data {
 						if false {
-							dprintf("faked %#x, faking %#x (%v)\n", addr, b.addr, &p.score)
+							dprintf("faked %#x, faking %#x (%v)\n", k.addr, b.addr, &k.score)
 						}
 						tmp := copyBlock(b, p.blockSize)
 						data = &tmp
-						w.data = tmp
 					}
 				}
 				if false {
@@ -243,11 +357,11 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 
 			case ArchSuccess:
 				if e != nil {
-					e.score = p.score
+					e.score = k.score
 					e.flags &^= venti.EntryLocal
-					e.pack(*data, w.n-1)
+					e.pack(*data, k.n-1)
 				} else {
-					copy((*data)[(w.n-1)*venti.ScoreSize:], p.score[:])
+					copy((*data)[(k.n-1)*venti.ScoreSize:], k.score[:])
 				}
 				if data == &b.data {
 					b.dirty()
@@ -266,37 +380,32 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 					 * are not treated as in the active tree.
 					 */
 					if b.l.state&BsCopied == 0 && (e == nil || e.snap == 0) {
-						b.removeLink(addr, p.l.typ, p.l.tag, false)
+						b.removeLink(k.addr, k.l.typ, k.l.tag, false, 0)
 					}
 				}
 			}
 		}
 
-		if err := ventiSend(p.a, b, *data); err != nil {
+		send, err = ventiSend(p.a, b, *data)
+		if err != nil {
 			p.nfailsend++
 			p.depth--
-			return ArchFailure, err
+			return ArchFailure, nil, err
 		}
 
 		p.nsend++
 		if data != &b.data {
 			p.nfake++
-		}
-		if data == &b.data { /* not faking it, so update state */
+		} else { /* not faking it, so update state once stored */
 			p.nreal++
-			l := b.l
-			l.state |= BsVenti
-			if err := b.setLabel(&l, false); err != nil {
-				p.depth--
-				return ArchFailure, err
-			}
+			send.real = true
 		}
 	}
 
 	sp := shaBlock(b, *data)
 	p.score = *sp
 	if false {
-		dprintf("ventisend %v %p %p %p\n", &p.score, *data, b.data, w.data)
+		dprintf("ventisend %v %p %p\n", &p.score, *data, b.data)
 	}
 	ret := ArchFaked
 	if data == &b.data {
@@ -305,7 +414,7 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 	p.l = b.l
 
 	p.depth--
-	return ret, nil
+	return ret, send, nil
 }
 
 // 1. get the superblock from the cache
@@ -316,14 +425,21 @@ func archWalk(p *Param, addr uint32, typ BlockType, tag uint32) (int, error) {
 // 6. log the vac score
 func (a *Arch) thread() {
 	rbuf := make([]byte, venti.RootSize)
-	for range a.work {
+	for {
+		select {
+		case <-a.quit:
+			a.die <- struct{}{}
+			return
+		case <-a.work:
+		}
+
 		// look for work
 		a.fs.elk.Lock()
 		b, super, err := getSuper(a.c)
 		if err != nil {
 			a.fs.elk.Unlock()
 			logf("(*Arch).thread: getSuper: %v\n", err)
-			time.Sleep(1 * time.Minute)
+			a.retry(err)
 			continue
 		}
 		addr := super.next
@@ -352,13 +468,18 @@ func (a *Arch) thread() {
 			c:         a.c,
 			a:         a,
 		}
-		ret, err := archWalk(&p, addr, BtDir, RootTag)
+		ret, send, err := archWalk(&p, addr, BtDir, RootTag)
+		if ret != ArchFailure && send != nil {
+			if err = archCommit(&p, []*archSend{send}); err != nil {
+				ret = ArchFailure
+			}
+		}
 		switch ret {
 		case ArchSuccess, ArchFaked:
 			break
 		case ArchFailure:
 			logf("failed to archive block %#x: %v\n", addr, err)
-			time.Sleep(1 * time.Minute)
+			a.retry(err)
 			continue
 		default:
 			panic(fmt.Sprintf("bad result from archWalk: %d", ret))
@@ -381,7 +502,7 @@ func (a *Arch) thread() {
 		score, err := vtWriteBlock(a.z, rbuf, venti.RootType)
 		if err != nil {
 			logf("write block %#x to venti failed: %v\n", addr, err)
-			time.Sleep(1 * time.Minute)
+			a.retry(err)
 			continue
 		}
 
@@ -393,7 +514,7 @@ func (a *Arch) thread() {
 		if err != nil {
 			a.fs.elk.Unlock()
 			logf("failed to get super block: %v\n", err)
-			time.Sleep(1 * time.Minute)
+			a.retry(err)
 			continue
 		}
 
@@ -407,9 +528,39 @@ func (a *Arch) thread() {
 		logf("archive vac:%v\n", &p.score)
 		logf("archive took %v\n", time.Since(start))
 	}
-	a.die <- struct{}{}
 }
 
+/*
+ * Wait to try again after a failure: until venti is back,
+ * if that was the trouble, or for archRetryDelay otherwise.
+ * The snapshot being archived stays in super.current
+ * meanwhile, and the latest snapshot taken since waits
+ * behind it in super.next.
+ */
+var archRetryDelay = 1 * time.Minute
+
+func (a *Arch) retry(err error) {
+	var up <-chan struct{}
+	var timeout <-chan time.Time
+	if v, ok := a.z.(*Venti); ok && errors.Is(err, EVentiDown) {
+		logf("archiver waiting for venti\n")
+		up = v.ready()
+	} else {
+		timeout = time.After(archRetryDelay)
+	}
+	select {
+	case <-a.quit:
+		return
+	case <-up:
+	case <-timeout:
+	}
+	a.kick()
+}
+
+// kick wakes the archiver; kicks while it is busy are coalesced.
 func (a *Arch) kick() {
-	a.work <- struct{}{}
+	select {
+	case a.work <- struct{}{}:
+	default:
+	}
 }
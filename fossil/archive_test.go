@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	iofs "io/fs"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+	"github.com/floren/fs/venti/ventitest"
+)
+
+// An orderStore checks that blocks are written to it
+// only after the blocks they point to.
+type orderStore struct {
+	venti.Store
+
+	mu     sync.Mutex
+	writes int
+	errs   []error
+}
+
+func (s *orderStore) Write(typ venti.BlockType, p []byte) (*venti.Score, error) {
+	var kids []venti.Score
+	switch {
+	case typ == venti.RootType:
+		if r, err := venti.UnpackRoot(p); err == nil {
+			kids = append(kids, r.Score)
+		}
+	case typ == venti.DirType:
+		for i := 0; i < len(p)/venti.EntrySize; i++ {
+			e, err := unpackEntry(p, i)
+			if err == nil && e.flags&venti.EntryActive != 0 {
+				kids = append(kids, e.score)
+			}
+		}
+	case typ != venti.DataType:
+		for i := 0; i+venti.ScoreSize <= len(p); i += venti.ScoreSize {
+			var score venti.Score
+			copy(score[:], p[i:])
+			kids = append(kids, score)
+		}
+	}
+
+	buf := make([]byte, venti.MaxBlockSize)
+	for _, score := range kids {
+		if score.IsZero() {
+			continue
+		}
+		// the type is not known here; any type will do
+		found := false
+		for t := venti.RootType; t <= venti.DataType; t++ {
+			if _, err := s.Store.Read(&score, t, buf); err == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s.mu.Lock()
+			s.errs = append(s.errs, fmt.Errorf("%v block written before child %v", typ, &score))
+			s.mu.Unlock()
+		}
+	}
+
+	s.mu.Lock()
+	s.writes++
+	s.mu.Unlock()
+	return s.Store.Write(typ, p)
+}
+
+func TestArchOrder(t *testing.T) {
+	store := &orderStore{Store: venti.NewMemStore()}
+	srv, addr := testServeVenti(t, store, "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	// enough blocks for a pointer block above the data
+	cmds := []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/active",
+		"9p Twalk 0 1",
+		"9p Tcreate 1 big 0644 2",
+	}
+	for i := 0; i < 300; i++ {
+		data := fmt.Sprintf("%d%s", i, strings.Repeat("x", 8000))
+		cmds = append(cmds, fmt.Sprintf("9p Twrite 1 %d %s", i*8192, data))
+	}
+	cmds = append(cmds, "9p Tclunk 1", "9p Tclunk 0")
+	for _, cmd := range cmds {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%.40s: %v", cmd, err)
+		}
+	}
+
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := testWaitArch(fs, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.writes < 300 {
+		t.Errorf("archived %d blocks, want at least 300", store.writes)
+	}
+	for _, err := range store.errs {
+		t.Error(err)
+	}
+}
+
+func TestArchWriteFault(t *testing.T) {
+	defer func(d time.Duration) { archRetryDelay = d }(archRetryDelay)
+	archRetryDelay = 50 * time.Millisecond
+
+	mem := venti.NewMemStore()
+	store := ventitest.NewFaultStore(mem)
+	srv, err := ventitest.NewServer(store)
+	if err != nil {
+		t.Fatalf("serve venti: %v", err)
+	}
+	defer srv.Close()
+	fs, done := testOpenFresh(t, srv.Addr())
+	defer done()
+
+	data := "writefault"
+	score := venti.Sha1([]byte(data))
+	store.FailWrites(score, true)
+	for _, cmd := range []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/active",
+		"9p Twalk 0 1",
+		"9p Tcreate 1 fault 0644 2",
+		"9p Twrite 1 0 " + data,
+		"9p Tclunk 1",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	// the archiver retries, keeping the snapshot
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, failed := store.Writes(); failed >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("archiver did not retry the failed write")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if super := testSuper(t, fs); super.current == NilBlock {
+		t.Errorf("snapshot dropped after failed write")
+	}
+	for _, cmd := range []string{
+		"9p Twalk 0 1 fault",
+		"9p Topen 1 0",
+		"9p Tread 1 0 100",
+		"9p Tclunk 1",
+		"9p Tclunk 0",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%s during failed archive: %v", cmd, err)
+		}
+	}
+
+	store.FailWrites(score, false)
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := mem.Read(score, venti.DataType, buf)
+	if err != nil {
+		t.Fatalf("read archived block: %v", err)
+	}
+	if string(buf[:n]) != data {
+		t.Errorf("archived block: got %q, want %q", buf[:n], data)
+	}
+}
+
+func TestArchDropConns(t *testing.T) {
+	mem := venti.NewMemStore()
+	store := ventitest.NewFaultStore(mem)
+	srv, err := ventitest.NewServer(store)
+	if err != nil {
+		t.Fatalf("serve venti: %v", err)
+	}
+	defer srv.Close()
+	fs, done := testOpenFresh(t, srv.Addr())
+	defer done()
+
+	cmds := []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/active",
+		"9p Twalk 0 1",
+		"9p Tcreate 1 dropped 0644 2",
+	}
+	var blocks []string
+	for i := 0; i < 100; i++ {
+		data := fmt.Sprintf("%d%s", i, strings.Repeat("y", 8000))
+		blocks = append(blocks, data)
+		cmds = append(cmds, fmt.Sprintf("9p Twrite 1 %d %s", i*8192, data))
+	}
+	cmds = append(cmds, "9p Tclunk 1", "9p Tclunk 0")
+	for _, cmd := range cmds {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%.40s: %v", cmd, err)
+		}
+	}
+
+	store.SetLatency(5 * time.Millisecond)
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		time.Sleep(100 * time.Millisecond)
+		srv.DropConns()
+		testWaitVenti(t, fs.z.(*Venti))
+	}
+	store.SetLatency(0)
+
+	if err := testWaitArch(fs, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, venti.MaxBlockSize)
+	for i, data := range blocks {
+		n, err := mem.Read(venti.Sha1([]byte(data)), venti.DataType, buf)
+		if err != nil {
+			t.Fatalf("block %d not archived: %v", i, err)
+		}
+		if string(buf[:n]) != data {
+			t.Errorf("block %d archived wrongly", i)
+		}
+	}
+}
+
+func TestArchVac(t *testing.T) {
+	store := venti.NewMemStore()
+	srv, addr := testServeVenti(t, store, "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	for _, cmd := range []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/active",
+		"9p Twalk 0 1",
+		"9p Tcreate 1 archived 0644 2",
+		"9p Twrite 1 0 readable",
+		"9p Tclunk 1",
+		"9p Tclunk 0",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	last := testSuper(t, fs).last
+	v, err := vac.Open(store, &last)
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	data, err := iofs.ReadFile(v, "active/archived")
+	if err != nil {
+		t.Fatalf("read archived file: %v", err)
+	}
+	if string(data) != "readable" {
+		t.Errorf("read archived file: got %q, want %q", data, "readable")
+	}
+	if err := fstest.TestFS(v, "active/archived"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestArchHistory(t *testing.T) {
+	store := venti.NewMemStore()
+	srv, addr := testServeVenti(t, store, "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	for i, data := range []string{"first", "second"} {
+		cmds := []string{
+			"9p Tversion 8192 9P2000",
+			"9p Tattach 0 ~1 nobody testfs/active",
+			"9p Twalk 0 1",
+		}
+		if i == 0 {
+			cmds = append(cmds, "9p Tcreate 1 version 0644 1")
+		} else {
+			cmds = append(cmds, "9p Twalk 0 1 version", "9p Topen 1 17")
+		}
+		cmds = append(cmds, "9p Twrite 1 0 "+data, "9p Tclunk 1", "9p Tclunk 0")
+		for _, cmd := range cmds {
+			if err := console.Exec(nil, cmd); err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+		}
+		if err := fs.snapshot("", "", true); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		if err := testWaitArch(fs, 10*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := fs.history(0)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("history: got %d archives, want 2", len(list))
+	}
+	if list[0].Score != testSuper(t, fs).last || list[0].Root.Prev != list[1].Score {
+		t.Errorf("history: chain does not start at super.last")
+	}
+	day := time.Now().Format("/archive/2006/0102")
+	if list[0].Name != day+".1" || list[1].Name != day {
+		t.Errorf("history: got names %q and %q", list[0].Name, list[1].Name)
+	}
+	if time.Since(list[1].Time) > time.Minute || list[0].Time.Before(list[1].Time) {
+		t.Errorf("history: got times %v and %v", list[0].Time, list[1].Time)
+	}
+
+	// the older archive still holds the first version
+	fs.elk.RLock()
+	root, err := fs.openArchive(&list[1].Score)
+	fs.elk.RUnlock()
+	if err != nil {
+		t.Fatalf("open archive: %v", err)
+	}
+	f, err := root.walkPath("/active/version", false)
+	if err != nil {
+		root.decRef()
+		t.Fatalf("walk: %v", err)
+	}
+	buf := make([]byte, 100)
+	n, err := f.read(buf, 0)
+	if err != nil || string(buf[:n]) != "first" {
+		t.Errorf("read archived file: got %q, %v", buf[:n], err)
+	}
+	if _, err := f.write([]byte("x"), 1, 0, "nobody"); err == nil {
+		t.Errorf("write to archived file succeeded")
+	}
+	f.decRef()
+	root.decRef()
+
+	cons, out := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, "fsys testfs history"); err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if n := strings.Count(out.String(), "vac:"); n != 2 || !strings.Contains(out.String(), list[1].Score.String()) {
+		t.Errorf("history: got %q", out.String())
+	}
+	out.Reset()
+	if err := console.Exec(cons, "fsys testfs history vac:"+list[0].Score.String()+" /active/version"); err != nil {
+		t.Fatalf("history stat: %v", err)
+	}
+	if !strings.Contains(out.String(), `"version"`) {
+		t.Errorf("history stat: got %q", out.String())
+	}
+}
@@ -28,7 +28,7 @@ type Cache struct {
 
 	disk   *Disk
 	size   int /* block size */
-	z      *venti.Session
+	z      venti.Store
 	now    uint32   /* ticks for usage timestamps */
 	heads  []*Block /* hash table for finding address */
 	nheap  int      /* number of available victims */
@@ -59,14 +59,19 @@ type Cache struct {
 	syncStop   chan struct{}
 
 	// unlink daemon
-	uhead  *BList
-	utail  *BList
-	unlink *sync.Cond
+	uhead      *BList
+	utail      *BList
+	unlink     *sync.Cond
+	nunlink    int /* unlinks in progress */
+	unlinkwait *sync.Cond
 
 	// block counts
 	nused int
 	ndisk int
 
+	// venti blocks made up in memory: see (*Cache).memBlock
+	mem map[venti.Score][]byte
+
 	// for debugging: see block.go:/printLocks/
 	llk      sync.Mutex
 	lockinfo map[*Block]string
@@ -80,7 +85,8 @@ type BList struct {
 	epoch uint32
 	vers  uint32
 
-	recurse bool // for block unlink
+	recurse bool   // for block unlink
+	floor   uint32 // for block unlink: blocks of this epoch or older stay
 
 	// for roll back
 	index int // -1 indicates not valid
@@ -130,7 +136,7 @@ var vtType = [BtMax]venti.BlockType{
 /*
  * Allocate the memory cache.
  */
-func allocCache(disk *Disk, z *venti.Session, nblocks, mode int) *Cache {
+func allocCache(disk *Disk, z venti.Store, nblocks, mode int) *Cache {
 	c := &Cache{
 		ref:      1,
 		disk:     disk,
@@ -182,6 +188,7 @@ func allocCache(disk *Disk, z *venti.Session, nblocks, mode int) *Cache {
 	c.fl = flAlloc(disk.size(PartData))
 
 	c.unlink = sync.NewCond(&c.lk)
+	c.unlinkwait = sync.NewCond(&c.lk)
 	c.flushcond = sync.NewCond(&c.lk)
 	c.flushwait = sync.NewCond(&c.lk)
 	c.heapwait = sync.NewCond(&c.lk)
@@ -622,9 +629,39 @@ func (c *Cache) global(score *venti.Score, typ BlockType, tag uint32, mode int)
 	default:
 		panic("bad iostate")
 	case BioEmpty:
-		// TODO(jnj): hack: format relies on this working for score == venti.ZeroScore,
+		c.lk.Lock()
+		data, ok := c.mem[*score]
+		c.lk.Unlock()
+		if ok {
+			copy(b.data, data)
+			venti.ZeroExtend(vtType[typ], b.data, len(data), c.size)
+			b.setIOState(BioClean)
+			return b, nil
+		}
+
+		// format relies on this working for score == venti.ZeroScore,
 		// even when c.z == nil
-		n, err := c.z.Read(score, vtType[typ], b.data[:c.size])
+		var n int
+		var err error
+		if !score.IsZero() {
+			var ok bool
+			if n, ok = c.disk.vcacheRead(score, vtType[typ], b.data[:c.size]); ok {
+				dprintf("retrieved block from venti cache")
+				venti.ZeroExtend(vtType[typ], b.data, n, c.size)
+				b.setIOState(BioClean)
+				return b, nil
+			}
+		}
+		if c.z != nil {
+			n, err = c.z.Read(score, vtType[typ], b.data[:c.size])
+		} else if !score.IsZero() {
+			err = errors.New("no venti session")
+		}
+		if errors.Is(err, EVentiDown) {
+			/* leave the block empty; read it again once venti is back */
+			b.put()
+			return nil, fmt.Errorf("read block %v: %w", score, err)
+		}
 		if err != nil {
 			b.setIOState(BioVentiError)
 			b.put()
@@ -634,7 +671,10 @@ func (c *Cache) global(score *venti.Score, typ BlockType, tag uint32, mode int)
 		if !score.Check(b.data[:n]) {
 			b.setIOState(BioVentiError)
 			b.put()
-			return nil, fmt.Errorf("venti error: wrong score: %v: %v", score, err)
+			return nil, fmt.Errorf("venti error: wrong score: %v", score)
+		}
+		if !score.IsZero() {
+			c.disk.vcacheWrite(score, vtType[typ], b.data[:n])
 		}
 		dprintf("retrieved block from venti; zero-extending from %d to %d bytes", n, c.size)
 		venti.ZeroExtend(vtType[typ], b.data, n, c.size)
@@ -652,6 +692,25 @@ func (c *Cache) global(score *venti.Score, typ BlockType, tag uint32, mode int)
 	/* NOT REACHED */
 }
 
+/*
+ * Make data readable through global as the venti block with its
+ * score, without writing it to venti. The block stays until the
+ * cache is freed; it is for the few read-only blocks, such as the
+ * top entry of a vac archive, which exist on no disk.
+ */
+func (c *Cache) memBlock(data []byte) *venti.Score {
+	score := venti.Sha1(data)
+
+	c.lk.Lock()
+	if c.mem == nil {
+		c.mem = make(map[venti.Score][]byte)
+	}
+	c.mem[*score] = append([]byte(nil), data...)
+	c.lk.Unlock()
+
+	return score
+}
+
 // allocate a new on-disk block and load it into the memory cache.
 // BUG: if the disk is full, should we flush some of it to Venti?
 func (c *Cache) allocBlock(typ BlockType, tag, epoch, epochLow uint32) (*Block, error) {
@@ -677,7 +736,7 @@ func (c *Cache) allocBlock(typ BlockType, tag, epoch, epochLow uint32) (*Block,
 			nwrap++
 			if nwrap >= 2 {
 				b.put()
-				err := fmt.Errorf("disk is full")
+				err := EFsFill
 
 				/*
 				 * try to avoid a continuous spew of console
@@ -756,7 +815,6 @@ func (c *Cache) dirty() int {
 
 func (c *Cache) countUsed(epochLow uint32, used, total, bsize *uint32) {
 	fl := c.fl
-	n := uint32(c.size / LabelSize)
 	*bsize = uint32(c.size)
 
 	fl.lk.Lock()
@@ -768,17 +826,34 @@ func (c *Cache) countUsed(epochLow uint32, used, total, bsize *uint32) {
 		return
 	}
 
-	var b *Block
 	var nused uint32
-	var addr uint32
+	err := c.scanLabels(epochLow, func(addr uint32, l *Label) {
+		nused++
+	})
+	if err == nil {
+		fl.nused = nused
+		fl.epochLow = epochLow
+	}
+
+	*used = nused
+	*total = fl.end
+	return
+}
+
+// scanLabels calls fn with the label of each block in use,
+// that is, neither free nor reclaimable given epochLow.
+func (c *Cache) scanLabels(epochLow uint32, fn func(addr uint32, l *Label)) error {
+	n := uint32(c.size / LabelSize)
+
+	var b *Block
 	var err error
-	for addr = 0; addr < fl.end; addr++ {
+	for addr := uint32(0); addr < c.fl.end; addr++ {
 		if addr%n == 0 {
 			b.put()
 			b, err = c.local(PartLabel, addr/n, OReadOnly)
 			if err != nil {
-				logf("(*Cache).countUsed: loading %x: %v\n", addr/n, err)
-				break
+				logf("(*Cache).scanLabels: loading %x: %v\n", addr/n, err)
+				return err
 			}
 		}
 
@@ -794,18 +869,11 @@ func (c *Cache) countUsed(epochLow uint32, used, total, bsize *uint32) {
 				continue
 			}
 		}
-		nused++
+		fn(addr, lab)
 	}
 
 	b.put()
-	if addr == fl.end {
-		fl.nused = nused
-		fl.epochLow = epochLow
-	}
-
-	*used = nused
-	*total = fl.end
-	return
+	return nil
 }
 
 func flAlloc(end uint32) *FreeList {
@@ -1294,8 +1362,12 @@ func (b *Block) setIOState(iostate IOState) {
  * still need to know whether a block has been copied, so we
  * set the BsCopied bit in the label and force that to disk *before*
  * the copy gets written out.
+ *
+ * If shared is set, b is shared with a snapshot by a clone and
+ * stays in use after the copy, so (2) never happens and b is not
+ * marked as copied.
  */
-func (b *Block) copy(tag, ehi, elo uint32) (*Block, error) {
+func (b *Block) copy(tag, ehi, elo uint32, shared bool) (*Block, error) {
 	if (b.l.state&BsClosed != 0) || b.l.epoch >= ehi {
 		logf("(*Block).copy %#x %v but fs is [%d,%d]\n", b.addr, b.l, elo, ehi)
 	}
@@ -1312,7 +1384,7 @@ func (b *Block) copy(tag, ehi, elo uint32) (*Block, error) {
 	 * the tree.)  This must follow (*Cache).allocBlock since we
 	 * can't be holding onto lb when we call (*Cache).allocBlock.
 	 */
-	if b.l.state&BsCopied == 0 {
+	if b.l.state&BsCopied == 0 && !shared {
 		if b.part == PartData { /* not the superblock */
 			l := b.l
 			l.state |= BsCopied
@@ -1345,6 +1417,8 @@ func (b *Block) copy(tag, ehi, elo uint32) (*Block, error) {
 /*
  * Block b once pointed at the block bb at addr/type/tag, but no longer does.
  * If recurse is set, we are unlinking all of bb's children as well.
+ * Blocks with epoch at most floor are left alone: they are shared
+ * with the snapshot a clone was made from.
  *
  * We can't reclaim bb (or its kids) until the block b gets written to disk.  We add
  * the relevant information to b's list of unlinked blocks.  Once b is written,
@@ -1352,7 +1426,7 @@ func (b *Block) copy(tag, ehi, elo uint32) (*Block, error) {
  *
  * If b depends on bb, it doesn't anymore, so we remove bb from the prior list.
  */
-func (b *Block) removeLink(addr uint32, typ BlockType, tag uint32, recurse bool) {
+func (b *Block) removeLink(addr uint32, typ BlockType, tag uint32, recurse bool, floor uint32) {
 	var p *BList
 
 	/* remove bb from prior list */
@@ -1377,6 +1451,7 @@ func (b *Block) removeLink(addr uint32, typ BlockType, tag uint32, recurse bool)
 		tag:     tag,
 		epoch:   b.l.epoch,
 		recurse: recurse,
+		floor:   floor,
 	}
 	if b.l.epoch == 0 {
 		assert(b.part == PartSuper)
@@ -1442,6 +1517,11 @@ func doRemoveLink(c *Cache, p *BList) {
 		return
 	}
 
+	if b.l.epoch <= p.floor {
+		b.put()
+		return
+	}
+
 	if recurse {
 		n := c.size / venti.ScoreSize
 		var bl BList
@@ -1456,7 +1536,7 @@ func doRemoveLink(c *Cache, p *BList) {
 			if err != nil {
 				continue
 			}
-			if l.state&BsClosed != 0 {
+			if l.state&BsClosed != 0 || l.epoch <= p.floor {
 				continue
 			}
 
@@ -1468,6 +1548,7 @@ func doRemoveLink(c *Cache, p *BList) {
 			bl.epoch = p.epoch
 			bl.next = nil
 			bl.recurse = true
+			bl.floor = p.floor
 
 			/* give up the block lock - share with others */
 			b.put()
@@ -1670,9 +1751,14 @@ func (c *Cache) unlinkBody() {
 		p = c.uhead
 		c.uhead = p.next
 
+		c.nunlink++
 		c.lk.Unlock()
 		doRemoveLink(c, p)
 		c.lk.Lock()
+		c.nunlink--
+		if c.nunlink == 0 {
+			c.unlinkwait.Broadcast()
+		}
 
 		p.next = c.blfree
 		c.blfree = p
@@ -1865,3 +1951,26 @@ func (c *Cache) flush(wait bool) {
 	}
 	c.lk.Unlock()
 }
+
+/*
+ * Flush the cache and wait for the unlinks queued by the
+ * blocks written, and any they dirty in turn, to be done,
+ * so that the labels of blocks no longer in the active
+ * tree say so.
+ */
+func (c *Cache) flushUnlinks() {
+	c.lk.Lock()
+	for {
+		c.unlinkBody()
+		for c.nunlink != 0 {
+			c.unlinkwait.Wait()
+		}
+		if c.uhead == nil && c.ndirty == 0 {
+			break
+		}
+		c.lk.Unlock()
+		c.flush(true)
+		c.lk.Lock()
+	}
+	c.lk.Unlock()
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"os"
 	"testing"
+	"time"
+
+	"github.com/floren/fs/venti"
+	"github.com/floren/fs/venti/ventitest"
 )
 
 func TestCache(t *testing.T) {
@@ -28,3 +32,60 @@ func testCacheLocal(t *testing.T, c *Cache) {
 	}
 	b.put()
 }
+
+func TestCacheGlobalFaults(t *testing.T) {
+	disk, path, err := testAllocDisk()
+	if err != nil {
+		if path != "" {
+			os.Remove(path)
+		}
+		t.Fatalf("error allocating disk: %v", err)
+	}
+	defer os.Remove(path)
+
+	store := ventitest.NewFaultStore(venti.NewMemStore())
+	cache := allocCache(disk, store, 100, OReadWrite)
+	defer cache.free()
+
+	global := func(score *venti.Score) error {
+		errc := make(chan error, 1)
+		go func() {
+			b, err := cache.global(score, BtData, 0, OReadOnly)
+			if err == nil {
+				b.put()
+			}
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			return err
+		case <-time.After(10 * time.Second):
+			t.Fatalf("cache.global of %v did not return", score)
+			return nil
+		}
+	}
+
+	var scores []*venti.Score
+	for _, s := range []string{"corrupt", "slow"} {
+		score, err := store.Write(venti.DataType, []byte(s))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		scores = append(scores, score)
+	}
+
+	store.Corrupt(scores[0], true)
+	if err := global(scores[0]); err == nil {
+		t.Errorf("cache.global of corrupt block succeeded")
+	}
+
+	store.SetLatency(20 * time.Millisecond)
+	if err := global(scores[1]); err != nil {
+		t.Errorf("cache.global with slow venti: %v", err)
+	}
+	store.SetLatency(0)
+
+	if err := global(venti.Sha1([]byte("not written"))); err == nil {
+		t.Errorf("cache.global of missing block succeeded")
+	}
+}
@@ -165,7 +165,7 @@ func checkEpoch(chk *Fsck, epoch uint32) {
 		return
 	}
 
-	walkEpoch(chk, b, &e.score, BtDir, e.tag, epoch)
+	walkEpoch(chk, b, &e.score, BtDir, e.tag, epoch, 0)
 	e, err = unpackEntry(b.data, 1)
 	if err == nil {
 		chk.hint = venti.GlobalToLocal(&e.score)
@@ -181,8 +181,11 @@ func checkEpoch(chk *Fsck, epoch uint32) {
  * (iv) if b is active then no other active b' points at bb.
  * (v) if b is a past life of b' then only one of b and b' is active
  *	(too hard to check)
+ *
+ * In a clone, blocks of epoch floor or older belong to the snapshot
+ * it was made from and are checked with its epoch instead.
  */
-func walkEpoch(chk *Fsck, b *Block, score *venti.Score, typ BlockType, tag, epoch uint32) bool {
+func walkEpoch(chk *Fsck, b *Block, score *venti.Score, typ BlockType, tag, epoch, floor uint32) bool {
 	if b != nil && chk.walkdepth == 0 && chk.printblocks {
 		chk.printf("%v %d %#.8x %#.8x\n", &b.score, b.l.typ, b.l.tag, b.l.epoch)
 	}
@@ -191,6 +194,13 @@ func walkEpoch(chk *Fsck, b *Block, score *venti.Score, typ BlockType, tag, epoc
 		return true
 	}
 
+	if a := venti.GlobalToLocal(score); floor != 0 && a != NilBlock {
+		l, err := chk.cache.readLabel(a)
+		if err == nil && l.epoch <= floor {
+			return true
+		}
+	}
+
 	chk.walkdepth++
 
 	bb, err := chk.cache.global(score, typ, tag, OReadOnly)
@@ -284,7 +294,7 @@ func walkEpoch(chk *Fsck, b *Block, score *venti.Score, typ BlockType, tag, epoc
 		for i := int(0); i < chk.bsize/venti.ScoreSize; i++ {
 			var score venti.Score
 			copy(score[:], bb.data[i*venti.ScoreSize:])
-			if !walkEpoch(chk, bb, &score, typ-1, tag, epoch) {
+			if !walkEpoch(chk, bb, &score, typ-1, tag, epoch, floor) {
 				setBit(chk.errmap, bb.addr)
 				if err := chk.clrp(chk, bb, i); err != nil {
 					chk.errorf("%v", err)
@@ -318,6 +328,18 @@ func walkEpoch(chk *Fsck, b *Block, score *venti.Score, typ BlockType, tag, epoc
 				dprintf("%x[%d] tag=%x snap=%d score=%v\n", addr, i, e.tag, e.snap, &e.score)
 			}
 			ep = epoch
+			fl := floor
+			if e.clone != 0 {
+				/*
+				 * A clone removed since no longer keeps fs.elo
+				 * down, so the blocks it shared may be gone:
+				 * only the active lives of clones are walked.
+				 */
+				if epoch != chk.fs.ehi {
+					continue
+				}
+				fl = e.clone
+			}
 			if e.snap != 0 {
 				if e.snap >= epoch {
 					// chk.errorf("bad snap in entry: %ux[%d] snap = %d: epoch = %d",
@@ -360,7 +382,7 @@ func walkEpoch(chk *Fsck, b *Block, score *venti.Score, typ BlockType, tag, epoc
 				continue
 			}
 
-			if !walkEpoch(chk, bb, &e.score, EntryType(e), e.tag, ep) {
+			if !walkEpoch(chk, bb, &e.score, EntryType(e), e.tag, ep, fl) {
 				setBit(chk.errmap, bb.addr)
 				if err := chk.clre(chk, bb, i); err != nil {
 					chk.errorf("%v", err)
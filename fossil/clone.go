@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ * A clone is a writable copy of a snapshot at /clone/name. Like
+ * a snapshot, it starts out as a pair of entries pointing at the
+ * blocks of the snapshot's tree, so making one copies no data.
+ * Its entries record the epoch of the snapshot, and every source
+ * below them inherits it as its floor.
+ *
+ * The blocks of that epoch or older may also be in the active
+ * tree, which must hold the only pointer to an open block, and
+ * are in any case still needed by the snapshot. So a clone
+ * copies them on write like any other old block, but never
+ * unlinks them: they are neither marked copied nor closed. In
+ * turn, fs.elo is kept at or below the floor of every clone, so
+ * that those blocks, including the ones closed since by the
+ * active tree, are not reclaimed while a clone points at them.
+ *
+ * Clones are not archived, and cannot be snapshotted: the low
+ * epoch only accounts for the clones in /clone.
+ */
+
+// clone makes a writable copy, at /clone/name, of the snapshot
+// at src, given as a path or as the epoch at which it was taken.
+func (fs *Fs) clone(src, name, uid string) error {
+	assert(fs.mode == OReadWrite)
+
+	if fs.halted {
+		return fmt.Errorf("file system is halted")
+	}
+	if err := checkValidFileName(name); err != nil {
+		return err
+	}
+
+	fs.elk.Lock()
+	defer fs.elk.Unlock()
+
+	src, err := fs.snapshotPath(src)
+	if err != nil {
+		return err
+	}
+	sf, err := fs.openFile(src)
+	if err != nil {
+		return err
+	}
+	defer sf.decRef()
+	de, err := sf.getDir()
+	if err != nil {
+		return err
+	}
+	if de.mode&ModeSnapshot == 0 {
+		return fmt.Errorf("%s: not a snapshot", src)
+	}
+	e, ee, err := sf.getSources()
+	if err != nil {
+		return err
+	}
+
+	dir, err := fs.openFile("/clone")
+	if err != nil {
+		root, err := fs.openFile("/")
+		if err != nil {
+			return err
+		}
+		dir, err = root.create("clone", ModeDir|0555, "adm")
+		root.decRef()
+		if err != nil {
+			return err
+		}
+	}
+	defer dir.decRef()
+
+	f, err := dir.create(name, de.mode&^ModeSnapshot, uid)
+	if err != nil {
+		return err
+	}
+	defer f.decRef()
+
+	/*
+	 * An archived snapshot is all in venti, and its entries
+	 * no longer record its epoch: there is nothing to share.
+	 */
+	floor := e.snap
+	e.snap, e.archive, e.clone = 0, false, floor
+	ee.snap, ee.archive, ee.clone = 0, false, floor
+	if err := setEntry(f.source, e); err != nil {
+		return err
+	}
+	if err := setEntry(f.msource, ee); err != nil {
+		return err
+	}
+	f.source.floor = floor
+	f.msource.floor = floor
+	return nil
+}
+
+// cloneLow returns the lowest floor of the clones in /clone,
+// or ^0 if there are none. Assumes hold elk.
+func (fs *Fs) cloneLow() uint32 {
+	lo := ^uint32(0)
+	for _, floor := range fs.cloneFloors() {
+		if floor < lo {
+			lo = floor
+		}
+	}
+	return lo
+}
+
+// cloneFloors returns the floors of the clones in /clone,
+// by path. Assumes hold elk.
+func (fs *Fs) cloneFloors() map[string]uint32 {
+	dir, err := fs.openFile("/clone")
+	if err != nil {
+		return nil
+	}
+	defer dir.decRef()
+	dee, err := openDee(dir)
+	if err != nil {
+		return nil
+	}
+	defer dee.close()
+
+	floors := make(map[string]uint32)
+	for {
+		var de DirEntry
+		if r, _ := dee.read(&de); r <= 0 {
+			break
+		}
+		f, err := dir.walk(de.elem)
+		if err != nil {
+			continue
+		}
+		e, _, err := f.getSources()
+		f.decRef()
+		if err == nil && e.clone != 0 {
+			floors["/clone/"+de.elem] = e.clone
+		}
+	}
+	return floors
+}
+
+// holdsClones reports whether the tree at p, a clean path,
+// holds clones. Assumes hold elk.
+func (fs *Fs) holdsClones(p string) bool {
+	if p == "/" {
+		f, err := fs.openFile("/clone")
+		if err != nil {
+			return false
+		}
+		f.decRef()
+		return true
+	}
+	return p == "/clone" || strings.HasPrefix(p, "/clone/")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+func TestClone(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	// enough data for a pointer block
+	var big []string
+	for i := 0; i < 40; i++ {
+		big = append(big, fmt.Sprintf("%04d%s", i, strings.Repeat("x", 7996)))
+	}
+	testExec(t, "fsys testfs create /active/d adm adm d775",
+		"fsys testfs create /active/d/x adm adm 664",
+		"fsys testfs create /active/d/big adm adm 664")
+	testWrite(t, "active", "d/x", 0, "hello")
+	testWrite(t, "active", "d/big", 0, big...)
+	if err := fs.snapshot("", "/snapshot/s1", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	floor := fs.ehi - 1
+
+	if err := fs.clone("/snapshot/s1", "c1", "adm"); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if got := testReadFile(t, fs, "/clone/c1/d/x"); got != "hello" {
+		t.Errorf("clone x: got %q", got)
+	}
+
+	// the clone and the active tree diverge independently
+	testWrite(t, "clone", "c1/d/x", 0, "clone")
+	testWrite(t, "active", "d/x", 0, "ACTIVE")
+	testWrite(t, "clone", "c1/d/big", 8000*20, "0020CLONE")
+	testExec(t, "fsys testfs create /clone/c1/d/new adm adm 664")
+	testWrite(t, "clone", "c1/d/new", 0, "new")
+	for path, want := range map[string]string{
+		"/snapshot/s1/d/x": "hello",
+		"/active/d/x":      "ACTIVE",
+		"/clone/c1/d/x":    "clone",
+		"/clone/c1/d/new":  "new",
+	} {
+		if got := testReadFile(t, fs, path); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+	cbig := make([]string, len(big))
+	copy(cbig, big)
+	cbig[20] = "0020CLONE" + big[20][9:]
+	if got := testReadFile(t, fs, "/clone/c1/d/big"); got != strings.Join(cbig, "") {
+		t.Errorf("clone big: got %d bytes", len(got))
+	}
+	if got := testReadFile(t, fs, "/active/d/big"); got != strings.Join(big, "") {
+		t.Errorf("active big: got %d bytes", len(got))
+	}
+	testCheck(t, fs)
+
+	// the blocks shared with the clone outlive the snapshot
+	testExec(t, "fsys testfs remove /active/d/big")
+	time.Sleep(time.Second)
+	testExec(t, "fsys testfs snapclean 0")
+	if fs.elo > floor {
+		t.Errorf("low epoch %d above clone floor %d", fs.elo, floor)
+	}
+	testExec(t, "fsys testfs create /active/other adm adm 664")
+	testWrite(t, "active", "other", 0, big...)
+	if got := testReadFile(t, fs, "/clone/c1/d/big"); got != strings.Join(cbig, "") {
+		t.Errorf("clone big after snapclean: got %d bytes", len(got))
+	}
+	testCheck(t, fs)
+
+	// clones are left out of archives
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	if got := testReadFile(t, fs, "/clone/c1/d/x"); got != "clone" {
+		t.Errorf("clone x after archive: got %q", got)
+	}
+	testCheck(t, fs)
+
+	if err := fs.snapshot("/clone/c1", "/snapshot/s2", false); err == nil {
+		t.Errorf("snapshot of a clone succeeded")
+	}
+	if err := fs.clone("/active/d", "c2", "adm"); err == nil {
+		t.Errorf("clone of active succeeded")
+	}
+	if err := fs.clone("/snapshot/s1", "c1", "adm"); err == nil {
+		t.Errorf("clone over existing clone succeeded")
+	}
+
+	// removing the clone frees its blocks for good
+	testExec(t, "fsys testfs remove /clone/c1/d/new /clone/c1/d/big /clone/c1/d/x /clone/c1/d /clone/c1",
+		"fsys testfs clri /snapshot/s1",
+		"fsys testfs snapclean 0")
+	if fs.elo != fs.ehi {
+		t.Errorf("low epoch %d after removing clone, want %d", fs.elo, fs.ehi)
+	}
+	testCheck(t, fs)
+}
@@ -102,7 +102,7 @@ func bool2int(v bool) int {
 }
 
 func lrand() int {
-	return rand.Intn(231)
+	return int(rand.Int31())
 }
 
 func auth_rpc(rpc *AuthRpc, verb string, a interface{}, na int) uint { panic("unimplemented") }
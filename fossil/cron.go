@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Cron-style snapshot schedules. A schedule has the five fields
+ * of a crontab line: minute (0-59), hour (0-23), day of the month
+ * (1-31), month (1-12) and day of the week (0-6, Sunday is 0).
+ * Each field is *, a number or a range a-b, optionally followed
+ * by a step /n, or a comma-separated list of those. As in cron,
+ * if both day fields are restricted, a day matching either one
+ * will do. Times are in UTC, like the rest of the scheduler.
+ */
+
+type cronSpec struct {
+	fields []string
+	min    uint64
+	hour   uint64
+	mday   uint64
+	month  uint64
+	wday   uint64
+	anyday bool /* mday is * */
+	anywd  bool /* wday is * */
+}
+
+var cronRanges = [5]struct{ lo, hi int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+
+// parseCron parses the five fields of a schedule.
+func parseCron(fields []string) (*cronSpec, error) {
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad schedule %q: want 5 fields", strings.Join(fields, " "))
+	}
+	c := &cronSpec{fields: append([]string(nil), fields...)}
+	for i, p := range []*uint64{&c.min, &c.hour, &c.mday, &c.month, &c.wday} {
+		bits, err := parseCronField(fields[i], cronRanges[i].lo, cronRanges[i].hi)
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %v", strings.Join(fields, " "), err)
+		}
+		*p = bits
+	}
+	c.anyday = fields[2] == "*"
+	c.anywd = fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(s string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		a, b := lo, hi
+		if part != "*" {
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if a, err = strconv.Atoi(r[0]); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			b = a
+			if len(r) == 2 {
+				if b, err = strconv.Atoi(r[1]); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step != 1 {
+				/* a/n means a-hi/n */
+				b = hi
+			}
+		}
+		if a < lo || b > hi || a > b {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := a; v <= b; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSpec) String() string {
+	return strings.Join(c.fields, " ")
+}
+
+func (c *cronSpec) day(t time.Time) bool {
+	mday := c.mday&(1<<uint(t.Day())) != 0
+	wday := c.wday&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.anyday && c.anywd:
+		return true
+	case c.anyday:
+		return wday
+	case c.anywd:
+		return mday
+	}
+	return mday || wday
+}
+
+// next returns the first minute after t matched by c, or the
+// zero time if there is none within the next five years.
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); {
+		y, m, d := t.Date()
+		switch {
+		case c.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.day(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.min&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// A snapSched is a cron schedule for temporary or, if archive
+// is set, archival snapshots.
+type snapSched struct {
+	cron    *cronSpec
+	archive bool
+	last    time.Time /* last run, or when the schedule was set */
+}
+
+func (sc *snapSched) String() string {
+	if sc.archive {
+		return "-a " + sc.cron.String()
+	}
+	return sc.cron.String()
+}
+
+/*
+ * Add a schedule. Its first run is the first one due after
+ * the newest snapshot of its kind, so that runs missed while
+ * the file system was down are caught up with at once.
+ */
+func (s *Snap) addSched(c *cronSpec, archive bool) error {
+	if s == nil {
+		return fmt.Errorf("no snapshots on a read-only file system")
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for _, sc := range s.scheds {
+		if sc.archive == archive && sc.cron.String() == c.String() {
+			return fmt.Errorf("schedule %v exists", sc)
+		}
+	}
+
+	last := s.newest(archive, s.now())
+	s.scheds = append(s.scheds, &snapSched{cron: c, archive: archive, last: last})
+	return nil
+}
+
+func (s *Snap) removeSched(c *cronSpec, archive bool) error {
+	if s == nil {
+		return fmt.Errorf("no snapshots on a read-only file system")
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for i, sc := range s.scheds {
+		if sc.archive == archive && sc.cron.String() == c.String() {
+			s.scheds = append(s.scheds[:i], s.scheds[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no schedule %v", &snapSched{cron: c, archive: archive})
+}
+
+func (s *Snap) getScheds() []string {
+	if s == nil {
+		return nil
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	var l []string
+	for _, sc := range s.scheds {
+		l = append(l, sc.String())
+	}
+	return l
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	for _, tt := range []struct {
+		spec, from, want string
+	}{
+		{"* * * * *", "2024-01-01 10:30", "2024-01-01 10:31"},
+		{"0 * * * *", "2024-01-01 10:30", "2024-01-01 11:00"},
+		{"0 * * * *", "2024-01-01 11:00", "2024-01-01 12:00"},
+		{"*/15 * * * *", "2024-01-01 10:31", "2024-01-01 10:45"},
+		{"5/20 * * * *", "2024-01-01 10:26", "2024-01-01 10:45"},
+		{"0 3 * * *", "2024-01-01 03:00", "2024-01-02 03:00"},
+		{"30 9-17/4 * * *", "2024-01-01 13:31", "2024-01-01 17:30"},
+		{"0 0 1 * *", "2024-01-15 00:00", "2024-02-01 00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 * * 0", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"0 0 1,15 * 5", "2024-01-02 00:00", "2024-01-05 00:00"},
+		{"0 0,12 * 12 1-5", "2024-01-01 12:00", "2024-12-02 00:00"},
+		{"0 0 31 2 *", "2024-01-01 00:00", "0001-01-01 00:00"},
+	} {
+		c, err := parseCron(strings.Fields(tt.spec))
+		if err != nil {
+			t.Errorf("parse %q: %v", tt.spec, err)
+			continue
+		}
+		if got := c.next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q after %s: got %s, want %s", tt.spec, tt.from, got.Format("2006-01-02 15:04"), tt.want)
+		}
+	}
+
+	for _, spec := range []string{"* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 7", "5-1 * * * *", "*/0 * * * *", "a * * * *", "1-2-3 * * * *"} {
+		if _, err := parseCron(strings.Fields(spec)); err == nil {
+			t.Errorf("parse %q succeeded", spec)
+		}
+	}
+}
+
+func TestSnapSched(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	cons, out := testCons()
+	defer cons.Close()
+	exec := func(cmd string) string {
+		out.Reset()
+		if err := console.Exec(cons, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		return out.String()
+	}
+
+	var lk sync.Mutex
+	now, _ := time.Parse("2006-01-02 15:04", "2024-01-01 10:30")
+	setClock := func(s string) {
+		t, _ := time.Parse("2006-01-02 15:04", s)
+		lk.Lock()
+		now = t
+		lk.Unlock()
+	}
+	fs.snap.lk.Lock()
+	fs.snap.now = func() time.Time {
+		lk.Lock()
+		defer lk.Unlock()
+		return now
+	}
+	fs.snap.lk.Unlock()
+	count := func(dir string) int {
+		fs.elk.RLock()
+		defer fs.elk.RUnlock()
+		n := 0
+		for _, s := range fs.snapshots() {
+			if strings.HasPrefix(s.path, dir) {
+				n++
+			}
+		}
+		return n
+	}
+
+	exec("fsys testfs snapsched 0 * * * *")
+	exec("fsys testfs snapsched 30 */2 * * *")
+	exec("fsys testfs snapsched -a 0 3 * * *")
+	if got := exec("fsys testfs snapsched"); got != "\tsnapsched 0 * * * *\n\tsnapsched 30 */2 * * *\n\tsnapsched -a 0 3 * * *\n" {
+		t.Errorf("snapsched: got %q", got)
+	}
+	if err := console.Exec(cons, "fsys testfs snapsched 0 * * * *"); err == nil {
+		t.Errorf("duplicate schedule succeeded")
+	}
+
+	for _, step := range []struct {
+		clock string
+		n     int
+	}{
+		{"2024-01-01 10:59", 0},
+		{"2024-01-01 11:00", 1},
+		{"2024-01-01 11:00", 1},
+		{"2024-01-01 11:59", 1},
+		// both temporary schedules are due: one snapshot
+		{"2024-01-01 12:30", 2},
+		// a stall over several runs: caught up with once
+		{"2024-01-01 16:10", 3},
+		{"2024-01-01 16:20", 3},
+		{"2024-01-01 16:30", 4},
+	} {
+		setClock(step.clock)
+		fs.snap.event()
+		if got := count("/snapshot/"); got != step.n {
+			t.Fatalf("at %s: %d snapshots, want %d", step.clock, got, step.n)
+		}
+	}
+	if got := count("/archive/"); got != 0 {
+		t.Errorf("%d archives before 03:00", got)
+	}
+	setClock("2024-01-02 03:01")
+	fs.snap.event()
+	if got := count("/archive/"); got != 1 {
+		t.Errorf("%d archives after 03:00, want 1", got)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	exec("fsys testfs snapsched -r 30 */2 * * *")
+	exec("fsys testfs snapsched -r 0 * * * *")
+	if err := console.Exec(cons, "fsys testfs snapsched -r 0 * * * *"); err == nil {
+		t.Errorf("removing a missing schedule succeeded")
+	}
+	if err := console.Exec(cons, "fsys testfs snapsched 0 25 * * *"); err == nil {
+		t.Errorf("bad schedule succeeded")
+	}
+
+	// a new schedule picks up from the newest snapshot
+	n := count("/snapshot/")
+	setClock(time.Now().UTC().Add(3 * time.Hour).Format("2006-01-02 15:04"))
+	exec("fsys testfs snapsched 0 * * * *")
+	fs.snap.event()
+	if got := count("/snapshot/"); got != n+1 {
+		t.Errorf("catch-up: %d snapshots, want %d", got, n+1)
+	}
+	fs.snap.event()
+	if got := count("/snapshot/"); got != n+1 {
+		t.Errorf("after catch-up: %d snapshots, want %d", got, n+1)
+	}
+}
+
+func TestSnapFreq(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	var lk sync.Mutex
+	var now time.Time
+	setClock := func(s string) {
+		t, _ := time.Parse("2006-01-02 15:04", s)
+		lk.Lock()
+		now = t
+		lk.Unlock()
+	}
+	setClock("2024-01-01 10:05")
+	fs.snap.lk.Lock()
+	fs.snap.now = func() time.Time {
+		lk.Lock()
+		defer lk.Unlock()
+		return now
+	}
+	fs.snap.lk.Unlock()
+	count := func() int {
+		fs.elk.RLock()
+		defer fs.elk.RUnlock()
+		n := 0
+		for _, s := range fs.snapshots() {
+			if strings.HasPrefix(s.path, "/snapshot/") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// an hourly schedule is due along with snapFreq, and must
+	// not take a second snapshot under the same name
+	testExec(t, "fsys testfs snaptime -s 60", "fsys testfs snapsched 0 * * * *")
+	logs := new(testLogWriter)
+	log.SetOutput(logs)
+	defer log.SetOutput(ioutil.Discard)
+	for _, step := range []struct {
+		clock string
+		n     int
+	}{
+		{"2024-01-01 10:05", 0},
+		{"2024-01-01 10:59", 0},
+		{"2024-01-01 11:00", 1},
+		{"2024-01-01 11:30", 1},
+		// a stall over several snapshots: caught up with once
+		{"2024-01-01 14:20", 2},
+		{"2024-01-01 14:50", 2},
+		{"2024-01-01 15:00", 3},
+	} {
+		setClock(step.clock)
+		fs.snap.event()
+		if got := count(); got != step.n {
+			t.Fatalf("at %s: %d snapshots, want %d", step.clock, got, step.n)
+		}
+	}
+
+	if l := logs.String(); strings.Contains(l, "snap: ") {
+		t.Errorf("log: %s", l)
+	}
+
+	// after a restart, from the newest snapshot
+	testExec(t, "fsys testfs snapsched -r 0 * * * *")
+	fs.snap.lk.Lock()
+	fs.snap.lastSnap = time.Time{}
+	fs.snap.lk.Unlock()
+	setClock(time.Now().UTC().Add(3 * time.Hour).Format("2006-01-02 15:04"))
+	fs.snap.event()
+	if got := count(); got != 4 {
+		t.Errorf("catch-up: %d snapshots, want 4", got)
+	}
+	fs.snap.event()
+	if got := count(); got != 4 {
+		t.Errorf("after catch-up: %d snapshots, want 4", got)
+	}
+}
+
+// A testLogWriter collects log output written from any goroutine.
+type testLogWriter struct {
+	lk  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *testLogWriter) Write(p []byte) (int, error) {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *testLogWriter) String() string {
+	w.lk.Lock()
+	defer w.lk.Unlock()
+	return w.buf.String()
+}
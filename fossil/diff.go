@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+/*
+ * Snapshots share their unchanged blocks copy-on-write, so two
+ * trees of files can be compared by walking them side by side
+ * and skipping every file or directory whose entries point to
+ * the same blocks on both sides.
+ */
+
+const (
+	diffAdded = iota
+	diffRemoved
+	diffModified
+	diffMeta
+)
+
+var diffOps = []string{
+	diffAdded:    "added",
+	diffRemoved:  "removed",
+	diffModified: "modified",
+	diffMeta:     "metadata",
+}
+
+// A diffChange is a difference between two trees of files,
+// at a path relative to their roots.
+type diffChange struct {
+	op   int
+	path string
+	dir  bool
+}
+
+func (c *diffChange) String() string {
+	p := c.path
+	if c.dir {
+		p += "/"
+	}
+	return fmt.Sprintf("%s %s", diffOps[c.op], p)
+}
+
+// snapshotPath returns the path of a snapshot given either
+// as a path or as the epoch at which it was taken.
+// The caller must hold fs.elk.
+func (fs *Fs) snapshotPath(s string) (string, error) {
+	epoch, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return s, nil
+	}
+	for _, sn := range fs.snapshots() {
+		f, err := fs.openFile(sn.path)
+		if err != nil {
+			continue
+		}
+		e, _, err := f.getSources()
+		f.decRef()
+		if err == nil && e.snap == uint32(epoch) {
+			return sn.path, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot of epoch %d", epoch)
+}
+
+// diff compares the trees of files at paths a and b, calling fn
+// with each file added, removed, modified or whose metadata alone
+// changed going from a to b. Added and removed directories are
+// reported without their contents. The caller must hold fs.elk.
+func (fs *Fs) diff(a, b string, fn func(*diffChange)) error {
+	fa, err := fs.openFile(a)
+	if err != nil {
+		return err
+	}
+	defer fa.decRef()
+	fb, err := fs.openFile(b)
+	if err != nil {
+		return err
+	}
+	defer fb.decRef()
+	if !fa.isDir() || !fb.isDir() {
+		return ENotDir
+	}
+
+	same, err := diffSameData(fa, fb)
+	if err != nil || same {
+		return err
+	}
+	return diffDir(fa, fb, "", fn)
+}
+
+/*
+ * Are the data of fa and fb stored in the same blocks?
+ * For directories this covers both the entries and the
+ * meta data of their contents.
+ */
+func diffSameData(fa, fb *File) (bool, error) {
+	ea, eea, err := fa.getSources()
+	if err != nil {
+		return false, err
+	}
+	eb, eeb, err := fb.getSources()
+	if err != nil {
+		return false, err
+	}
+	return ea.score == eb.score && ea.size == eb.size && eea.score == eeb.score && eea.size == eeb.size, nil
+}
+
+/*
+ * Does the metadata of a file differ beyond what a change
+ * to its contents would explain?
+ */
+func diffMetaChanged(a, b *DirEntry) bool {
+	if a.uid != b.uid || a.gid != b.gid || a.mode != b.mode {
+		return true
+	}
+	return a.mode&ModeDir == 0 && a.mtime != b.mtime
+}
+
+func diffReadDir(f *File) ([]DirEntry, error) {
+	dee, err := openDee(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dee.close()
+
+	var des []DirEntry
+	for {
+		var de DirEntry
+		r, err := dee.read(&de)
+		if r < 0 {
+			return nil, err
+		}
+		if r == 0 {
+			break
+		}
+		des = append(des, de)
+	}
+	sort.Slice(des, func(i, j int) bool { return des[i].elem < des[j].elem })
+	return des, nil
+}
+
+func diffDir(da, db *File, path string, fn func(*diffChange)) error {
+	as, err := diffReadDir(da)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path+"/", err)
+	}
+	bs, err := diffReadDir(db)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path+"/", err)
+	}
+
+	for len(as) > 0 || len(bs) > 0 {
+		switch {
+		case len(bs) == 0 || len(as) > 0 && as[0].elem < bs[0].elem:
+			fn(&diffChange{diffRemoved, path + "/" + as[0].elem, as[0].mode&ModeDir != 0})
+			as = as[1:]
+		case len(as) == 0 || bs[0].elem < as[0].elem:
+			fn(&diffChange{diffAdded, path + "/" + bs[0].elem, bs[0].mode&ModeDir != 0})
+			bs = bs[1:]
+		default:
+			if err := diffEntry(da, db, &as[0], &bs[0], path+"/"+as[0].elem, fn); err != nil {
+				return err
+			}
+			as, bs = as[1:], bs[1:]
+		}
+	}
+	return nil
+}
+
+func diffEntry(da, db *File, a, b *DirEntry, path string, fn func(*diffChange)) error {
+	isdir := a.mode&ModeDir != 0
+	if isdir != (b.mode&ModeDir != 0) || a.qid != b.qid {
+		/* replaced by a different file */
+		fn(&diffChange{diffModified, path, b.mode&ModeDir != 0})
+		return nil
+	}
+
+	fa, err := da.walk(a.elem)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	defer fa.decRef()
+	fb, err := db.walk(b.elem)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	defer fb.decRef()
+
+	same, err := diffSameData(fa, fb)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	switch {
+	case !same && !isdir:
+		fn(&diffChange{diffModified, path, false})
+		return nil
+	case diffMetaChanged(a, b):
+		fn(&diffChange{diffMeta, path, isdir})
+	}
+	if !same {
+		return diffDir(fa, fb, path, fn)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func testDiff(t *testing.T, fs *Fs, a, b string) []string {
+	var changes []string
+	fs.elk.RLock()
+	err := fs.diff(a, b, func(c *diffChange) {
+		changes = append(changes, c.String())
+	})
+	fs.elk.RUnlock()
+	if err != nil {
+		t.Fatalf("diff %s %s: %v", a, b, err)
+	}
+	return changes
+}
+
+func TestDiff(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	testExec(t, "fsys testfs create /active/a adm adm 644",
+		"fsys testfs create /active/b adm adm 644",
+		"fsys testfs create /active/d adm adm d755",
+		"fsys testfs create /active/d/x adm adm 644",
+		"fsys testfs create /active/d/y adm adm 644",
+		"fsys testfs create /active/u adm adm d755",
+		"fsys testfs create /active/u/x adm adm 644")
+	testWrite(t, "active", "a", 0, "one")
+	if err := fs.snapshot("", "/snapshot/s1", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	testWrite(t, "active", "a", 0, "two")
+	testExec(t, "fsys testfs wstat /active/b - - - 600 -",
+		"fsys testfs remove /active/d/y",
+		"fsys testfs create /active/d/z adm adm 644",
+		"fsys testfs create /active/e adm adm d755")
+	if err := fs.snapshot("", "/snapshot/s2", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	got := testDiff(t, fs, "/snapshot/s1", "/snapshot/s2")
+	want := []string{"modified /a", "metadata /b", "removed /d/y", "added /d/z", "added /e/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diff: got %q, want %q", got, want)
+	}
+	got = testDiff(t, fs, "/snapshot/s2", "/snapshot/s1")
+	want = []string{"modified /a", "metadata /b", "added /d/y", "removed /d/z", "removed /e/"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("reverse diff: got %q, want %q", got, want)
+	}
+	if got := testDiff(t, fs, "/snapshot/s2", "/active"); len(got) != 0 {
+		t.Errorf("diff with unchanged active: got %q", got)
+	}
+
+	// snapshots can be named by epoch
+	fs.elk.RLock()
+	f, err := fs.openFile("/snapshot/s1")
+	if err != nil {
+		fs.elk.RUnlock()
+		t.Fatalf("open: %v", err)
+	}
+	e, _, err := f.getSources()
+	f.decRef()
+	if err != nil {
+		fs.elk.RUnlock()
+		t.Fatalf("get sources: %v", err)
+	}
+	p, err := fs.snapshotPath(fmt.Sprint(e.snap))
+	fs.elk.RUnlock()
+	if err != nil || p != "/snapshot/s1" {
+		t.Errorf("snapshot of epoch %d: got %q, %v", e.snap, p, err)
+	}
+
+	cons, out := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, fmt.Sprintf("fsys testfs diff %d /snapshot/s2", e.snap)); err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if !strings.Contains(out.String(), "modified /a\n") || !strings.Contains(out.String(), "added /e/\n") {
+		t.Errorf("diff: got %q", out.String())
+	}
+	if err := console.Exec(cons, "fsys testfs diff 99999 /snapshot/s2"); err == nil {
+		t.Errorf("diff with unknown epoch succeeded")
+	}
+}
@@ -16,6 +16,8 @@ type Disk struct {
 
 	queue     chan *Block
 	flushcond *sync.Cond
+
+	vc *Vcache // nil if there is no venti cache
 }
 
 /* disk partitions; keep in sync with []partname */
@@ -24,15 +26,17 @@ const (
 	PartSuper
 	PartLabel
 	PartData
-	PartVenti /* fake partition */
+	PartVenti  /* fake partition */
+	PartVcache /* on-disk cache of venti blocks */
 )
 
 var partname = []string{
-	PartError: "error",
-	PartSuper: "super",
-	PartLabel: "label",
-	PartData:  "data",
-	PartVenti: "venti",
+	PartError:  "error",
+	PartSuper:  "super",
+	PartLabel:  "label",
+	PartData:   "data",
+	PartVenti:  "venti",
+	PartVcache: "vcache",
 }
 
 func allocDisk(fd int) (*Disk, error) {
@@ -53,6 +57,7 @@ func allocDisk(fd int) (*Disk, error) {
 		flushcond: sync.NewCond(new(sync.Mutex)),
 	}
 
+	disk.vcacheInit()
 	go disk.thread()
 
 	return disk, nil
@@ -74,6 +79,8 @@ func (d *Disk) partStart(part int) uint32 {
 		return d.h.label
 	case PartData:
 		return d.h.data
+	case PartVcache:
+		return d.h.vcache
 	}
 }
 
@@ -87,6 +94,8 @@ func (d *Disk) partEnd(part int) uint32 {
 		return d.h.data
 	case PartData:
 		return d.h.end
+	case PartVcache:
+		return d.h.vend
 	}
 }
 
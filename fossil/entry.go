@@ -24,11 +24,12 @@ type Entry struct {
 	tag     uint32 // tag for local blocks: zero if stored on Venti
 	snap    uint32 // non-zero -> entering snapshot of given epoch
 	archive bool   // archive this snapshot: only valid for snap != 0
+	clone   uint32 // non-zero -> writable clone of snapshot of given epoch
 }
 
 func (e *Entry) String() string {
-	return fmt.Sprintf("Entry(gen=%d psize=%d dsize=%d depth=%d flags=%#x size=%d score=%v tag=%d snap=%d arch=%v)",
-		e.gen, e.psize, e.dsize, e.depth, e.flags, e.size, &e.score, e.tag, e.snap, e.archive)
+	return fmt.Sprintf("Entry(gen=%d psize=%d dsize=%d depth=%d flags=%#x size=%d score=%v tag=%d snap=%d arch=%v clone=%d)",
+		e.gen, e.psize, e.dsize, e.depth, e.flags, e.size, &e.score, e.tag, e.snap, e.archive, e.clone)
 }
 
 func (e *Entry) pack(p []byte, index int) {
@@ -48,7 +49,8 @@ func (e *Entry) pack(p []byte, index int) {
 		if venti.GlobalToLocal(&e.score) == NilBlock {
 			panic("bad score")
 		}
-		memset(p[20:27], 0)
+		pack.PutUint32(p[20:], e.clone)
+		memset(p[24:27], 0)
 		pack.PutUint8(p[27:], uint8(bool2int(e.archive)))
 		pack.PutUint32(p[28:], e.snap)
 		pack.PutUint32(p[32:], e.tag)
@@ -71,6 +73,7 @@ func unpackEntry(p []byte, index int) (*Entry, error) {
 	e.size = pack.GetUint48(p[14:])
 
 	if e.flags&venti.EntryLocal != 0 {
+		e.clone = pack.GetUint32(p[20:])
 		e.archive = p[27] != 0
 		e.snap = pack.GetUint32(p[28:])
 		e.tag = pack.GetUint32(p[32:])
@@ -36,5 +36,6 @@ var (
 	ESnapRO        = errors.New("snapshot is read only")
 	ETooBig        = errors.New("file too big")
 	EVentiIO       = errors.New("venti i/o error")
+	EVentiDown     = errors.New("venti is unavailable")
 	EUsage         = errors.New("error parsing command")
 )
@@ -116,24 +116,26 @@ func rootFile(r *Source) (*File, error) {
 	}
 	defer r.unlock()
 
-	r0, err = r.open(0, fs.mode, false)
+	r0, err = r.open(0, r.mode, false)
 	if err != nil {
 		goto Err
 	}
-	r1, err = r.open(1, fs.mode, false)
+	r1, err = r.open(1, r.mode, false)
 	if err != nil {
 		goto Err
 	}
-	r2, err = r.open(2, fs.mode, false)
+	r2, err = r.open(2, r.mode, false)
 	if err != nil {
 		goto Err
 	}
 
 	mr = allocFile(fs)
+	mr.mode = r.mode
 	mr.msource = r2
 	r2 = nil
 
 	root = allocFile(fs)
+	root.mode = r.mode
 	root.boff = 0
 	root.up = mr
 	root.source = r0
@@ -273,16 +275,16 @@ func (f *File) _walk(elem string, partial bool) (*File, error) {
 	} else if ff.dir.mode&ModeDir != 0 {
 		if ff.source, err = f.openSource(ff.dir.entry, ff.dir.gen, true, uint(ff.mode), ff.issnapshot); err != nil {
 			ff.decRef()
-			return nil, fmt.Errorf("open entry source: %v", err)
+			return nil, fmt.Errorf("open entry source: %w", err)
 		}
 		if ff.msource, err = f.openSource(ff.dir.mentry, ff.dir.mgen, false, uint(ff.mode), ff.issnapshot); err != nil {
 			ff.decRef()
-			return nil, fmt.Errorf("open mentry source: %v", err)
+			return nil, fmt.Errorf("open mentry source: %w", err)
 		}
 	} else {
 		if ff.source, err = f.openSource(ff.dir.entry, ff.dir.gen, false, uint(ff.mode), ff.issnapshot); err != nil {
 			ff.decRef()
-			return nil, fmt.Errorf("open entry source: %v", err)
+			return nil, fmt.Errorf("open entry source: %w", err)
 		}
 	}
 
@@ -303,7 +305,11 @@ func (f *File) walk(elem string) (*File, error) {
 }
 
 func (fs *Fs) _openFile(path string, partial bool) (*File, error) {
-	f := fs.file
+	return fs.file.walkPath(path, partial)
+}
+
+// walkPath walks the slash-separated path from f.
+func (f *File) walkPath(path string, partial bool) (*File, error) {
 	f.incRef()
 
 	// iterate through each element of path
@@ -395,6 +401,10 @@ func (f *File) create(elem string, mode uint32, uid string) (*File, error) {
 		err = EReadOnly
 		goto Err1
 	}
+	if f.fs.diskFull() {
+		err = EFsFill
+		goto Err1
+	}
 
 	if err = f.source.lock2(f.msource, -1); err != nil {
 		goto Err1
@@ -577,6 +587,9 @@ func (f *File) write(buf []byte, cnt int, offset int64, uid string) (int, error)
 	if f.source.mode != OReadWrite {
 		return -1, EReadOnly
 	}
+	if f.fs.diskFull() {
+		return -1, EFsFill
+	}
 	if offset < 0 {
 		return -1, EBadOffset
 	}
@@ -820,8 +833,13 @@ func (f *File) isTemporary() bool {
 	return f.dir.mode&ModeTemporary != 0
 }
 
+/*
+ * The root of a tree of files, whether the file system's or an
+ * archive's opened by openArchive, hangs below only the file
+ * holding its meta data.
+ */
 func (f *File) isRoot() bool {
-	return f == f.fs.file
+	return f.up == nil || f.up.up == nil
 }
 
 func (f *File) isRoFs() bool {
@@ -19,13 +19,14 @@ var qid uint64 = 1
 func format(argv []string) {
 	flags := flag.NewFlagSet("format", flag.ExitOnError)
 	flags.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [-b blocksize] [-h host] [-l label] [-v score] [-y] file\n", argv0)
+		fmt.Fprintf(os.Stderr, "Usage: %s [-b blocksize] [-c cachesize] [-h host] [-l label] [-v score] [-y] file\n", argv0)
 		flags.PrintDefaults()
 		os.Exit(1)
 	}
 	var (
 		bflag = flags.String("b", "8K", "Set the file system `blocksize`.")
-		hflag = flags.String("h", "", "Use `host` as the Venti server.")
+		cflag = flags.String("c", "0", "Keep a cache of `cachesize` bytes of venti blocks on disk.")
+		hflag = flags.String("h", "", "Use `host` as the Venti server, or dir:/path for blocks in a local directory.")
 		lflag = flags.String("l", "", "Set the textual label on the file system to `label`.")
 		vflag = flags.String("v", "", "Initialize the file system using the vac file system at `score`.")
 
@@ -41,6 +42,10 @@ func format(argv []string) {
 	if bsize == badSize {
 		flags.Usage()
 	}
+	vsize := unittoull(*cflag)
+	if vsize == badSize {
+		flags.Usage()
+	}
 	buf := make([]byte, bsize)
 
 	host := *hflag
@@ -67,6 +72,7 @@ func format(argv []string) {
 
 	dprintf("format: unpacking header\n")
 	_, err = unpackHeader(buf)
+	syscall.Close(fd)
 	if err == nil && !force && !confirm("fs header block already exists; are you sure?") {
 		return
 	}
@@ -80,17 +86,45 @@ func format(argv []string) {
 	//	return
 	//}
 
+	var z venti.Store
+	if score != "" {
+		z, err = openStore(host)
+		if err != nil {
+			closeStore(z)
+			fatalf("connect to venti: %v", err)
+		}
+		defer closeStore(z)
+	}
+	if err := formatDisk(argv[0], int(bsize), vsize, label, z, score); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+/*
+ * Lay out the file system in file, with vsize bytes of venti
+ * cache.  If score is not empty, the file system starts as the
+ * vac archive with that score, read from z.
+ */
+func formatDisk(file string, bsize int, vsize uint64, label string, z venti.Store, score string) error {
+	fd, err := syscall.Open(file, syscall.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, bsize)
+
 	dprintf("format: partitioning\n")
-	h := partition(fd, int(bsize))
+	h := partition(fd, bsize, vsize)
 	h.pack(buf)
 	if _, err := syscall.Pwrite(fd, buf, HeaderOffset); err != nil {
-		fatalf("could not write fs header: %v", err)
+		syscall.Close(fd)
+		return fmt.Errorf("could not write fs header: %v", err)
 	}
 
 	dprintf("format: allocating disk structure\n")
 	disk, err := allocDisk(fd)
 	if err != nil {
-		fatalf("could not open disk: %v", err)
+		syscall.Close(fd)
+		return fmt.Errorf("could not open disk: %v", err)
 	}
 
 	dprintf("format: writing labels\n")
@@ -100,11 +134,17 @@ func format(argv []string) {
 		disk.blockWrite(PartLabel, bn, buf)
 	}
 
-	var z *venti.Session
+	dprintf("format: clearing venti cache\n")
+	disk.vcacheFormat(buf)
+
 	var root uint32
 	if score != "" {
 		dprintf("format: ventiRoot\n")
-		z, root = disk.ventiRoot(host, score, buf)
+		root, err = disk.ventiRoot(z, score, buf)
+		if err != nil {
+			disk.free()
+			return err
+		}
 	} else {
 		dprintf("format: rootMetaInit\n")
 		e := disk.rootMetaInit(buf)
@@ -120,8 +160,9 @@ func format(argv []string) {
 
 	if score == "" {
 		dprintf("format: populating top-level fs entries\n")
-		topLevel(argv[0], z)
+		topLevel(file, z)
 	}
+	return nil
 }
 
 func confirm(msg string) bool {
@@ -136,7 +177,12 @@ func confirm(msg string) bool {
 	return false
 }
 
-func partition(fd, bsize int) *Header {
+/*
+ * Lay out the partitions: the super block, the labels, the data
+ * blocks and, if vsize is not zero, vsize bytes of venti cache at
+ * the end.
+ */
+func partition(fd, bsize int, vsize uint64) *Header {
 	if bsize%512 != 0 {
 		fatalf("block size must be a multiple of 512 bytes")
 	}
@@ -156,6 +202,14 @@ func partition(fd, bsize int) *Header {
 	}
 
 	nblock := uint32(size / int64(bsize))
+	nvcache := uint32(vsize / uint64(bsize))
+	if vsize != 0 && nvcache < 2 {
+		fatalf("venti cache too small: need at least 2 blocks")
+	}
+	if nvcache >= nblock {
+		fatalf("venti cache too large: %d of %d blocks", nvcache, nblock)
+	}
+	nblock -= nvcache
 
 	/* sanity check */
 	if nblock < uint32((HeaderOffset*10)/bsize) {
@@ -168,6 +222,10 @@ func partition(fd, bsize int) *Header {
 	nlabel := (ndata + lpb - 1) / lpb
 	h.data = h.label + nlabel
 	h.end = h.data + ndata
+	if nvcache != 0 {
+		h.vcache = h.end
+		h.vend = h.vcache + nvcache
+	}
 
 	return &h
 }
@@ -335,7 +393,7 @@ func addFile(root *File, name string, mode uint) {
 	f.decRef()
 }
 
-func topLevel(name string, z *venti.Session) {
+func topLevel(name string, z venti.Store) {
 	/* ok, now we can open as a fs */
 	fs, err := openFs(name, "", z, false, 100, OReadWrite)
 	if err != nil {
@@ -351,36 +409,39 @@ func topLevel(name string, z *venti.Session) {
 	fs.close()
 }
 
-func (d *Disk) ventiRead(z *venti.Session, score *venti.Score, typ venti.BlockType, buf []byte) int {
+func (d *Disk) ventiRead(z venti.Store, score *venti.Score, typ venti.BlockType, buf []byte) (int, error) {
 	n, err := z.Read(score, typ, buf)
 	if err != nil {
-		fatalf("ventiRead %v (%d) failed: %v", score, typ, err)
+		return 0, fmt.Errorf("ventiRead %v (%d) failed: %v", score, typ, err)
+	}
+	if !score.Check(buf[:n]) {
+		return 0, fmt.Errorf("ventiRead %v (%d): wrong score", score, typ)
 	}
 	dprintf("retrieved %v block from venti; zero-extending from %d to %d bytes", typ, n, d.blockSize())
 	venti.ZeroExtend(typ, buf, n, d.blockSize())
-	return n
+	return n, nil
 }
 
-func (d *Disk) ventiRoot(host string, s string, buf []byte) (*venti.Session, uint32) {
+func (d *Disk) ventiRoot(z venti.Store, s string, buf []byte) (uint32, error) {
 	score, err := venti.ParseScore(s)
 	if err != nil {
-		fatalf("bad score %q: %v", s, err)
-	}
-
-	z, err := venti.Dial(host)
-	if err != nil {
-		fatalf("connect to venti: %v", err)
+		return 0, fmt.Errorf("bad score %q: %v", s, err)
 	}
 
 	tag := formatTagGen()
 	addr := d.blockAlloc(BtDir, tag, buf)
 
-	d.ventiRead(z, score, venti.RootType, buf)
+	if _, err := d.ventiRead(z, score, venti.RootType, buf); err != nil {
+		return 0, err
+	}
 	root, err := venti.UnpackRoot(buf)
 	if err != nil {
-		fatalf("corrupted root: %v", err)
+		return 0, fmt.Errorf("corrupted root: %v", err)
+	}
+	n, err := d.ventiRead(z, &root.Score, venti.DirType, buf)
+	if err != nil {
+		return 0, err
 	}
-	n := d.ventiRead(z, &root.Score, venti.DirType, buf)
 
 	/*
 	 * Fossil's vac archives start with an extra layer of source,
@@ -390,9 +451,12 @@ func (d *Disk) ventiRoot(host string, s string, buf []byte) (*venti.Session, uin
 	if n <= 2*venti.EntrySize {
 		e, err := unpackEntry(buf, 0)
 		if err != nil {
-			fatalf("bad root: top entry: %v", err)
+			return 0, fmt.Errorf("bad root: top entry: %v", err)
+		}
+		n, err = d.ventiRead(z, &e.score, venti.DirType, buf)
+		if err != nil {
+			return 0, err
 		}
-		n = d.ventiRead(z, &e.score, venti.DirType, buf)
 	} else {
 		e = new(Entry)
 	}
@@ -403,13 +467,13 @@ func (d *Disk) ventiRoot(host string, s string, buf []byte) (*venti.Session, uin
 	for i := 0; i < 3; i++ {
 		e, err = unpackEntry(buf, i)
 		if err != nil || e.flags&venti.EntryActive == 0 || e.psize < 256 || e.dsize < 256 {
-			fatalf("bad root: entry %d", i)
+			return 0, fmt.Errorf("bad root: entry %d", i)
 		}
 		fmt.Fprintf(os.Stderr, "%v\n", &e.score)
 	}
 
 	if n > 3*venti.EntrySize {
-		fatalf("bad root: entry count")
+		return 0, fmt.Errorf("bad root: entry count")
 	}
 
 	d.blockWrite(PartData, addr, buf)
@@ -417,20 +481,22 @@ func (d *Disk) ventiRoot(host string, s string, buf []byte) (*venti.Session, uin
 	/*
 	 * Maximum qid is recorded in root's msource, entry #2 (conveniently in e).
 	 */
-	d.ventiRead(z, &e.score, venti.DataType, buf)
+	if _, err := d.ventiRead(z, &e.score, venti.DataType, buf); err != nil {
+		return 0, err
+	}
 
 	mb, err := unpackMetaBlock(buf, d.blockSize())
 	if err != nil {
-		fatalf("bad root: unpackMetaBlock: %v", err)
+		return 0, fmt.Errorf("bad root: unpackMetaBlock: %v", err)
 	}
 	var me MetaEntry
 	mb.unpackMetaEntry(&me, 0)
 	de, err := mb.unpackDirEntry(&me)
 	if err != nil {
-		fatalf("bad root: dirUnpack: %v", err)
+		return 0, fmt.Errorf("bad root: dirUnpack: %v", err)
 	}
 	if de.qidSpace == 0 {
-		fatalf("bad root: no qidSpace")
+		return 0, fmt.Errorf("bad root: no qidSpace")
 	}
 	qid = de.qidMax
 
@@ -449,5 +515,5 @@ func (d *Disk) ventiRoot(host string, s string, buf []byte) (*venti.Session, uin
 	e.pack(buf, 0)
 	d.blockWrite(PartData, addr, buf)
 
-	return z, addr
+	return addr, nil
 }
@@ -4,6 +4,13 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+	"github.com/floren/fs/venti/ventitest"
 )
 
 func testFormatFossil() (string, error) {
@@ -14,7 +21,18 @@ func testFormatFossil() (string, error) {
 	}
 
 	// no test device, use a temporary file as a fake device
+	path, err := testTempPartition()
+	if err != nil {
+		return "", err
+	}
 
+	format([]string{"-b", "8K", "-y", path})
+
+	return path, nil
+}
+
+// testTempPartition creates an empty 10k-block file to format.
+func testTempPartition() (string, error) {
 	tmpfile, err := ioutil.TempFile("", "fossil.part")
 	if err != nil {
 		log.Fatal(err)
@@ -32,8 +50,113 @@ func testFormatFossil() (string, error) {
 	}
 
 	tmpfile.Close()
+	return path, nil
+}
 
-	format([]string{"-b", "8K", "-y", path})
+func TestFormatVentiFaults(t *testing.T) {
+	store := ventitest.NewFaultStore(venti.NewMemStore())
+	srv, err := ventitest.NewServer(store)
+	if err != nil {
+		t.Fatalf("serve venti: %v", err)
+	}
+	defer srv.Close()
 
-	return path, nil
+	// an archive to format from
+	fs, done := testOpenFresh(t, srv.Addr())
+	if err := fs.snapshot("", "", true); err != nil {
+		done()
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		done()
+		t.Fatal(err)
+	}
+	last := testSuper(t, fs).last
+	done()
+
+	buf := make([]byte, venti.RootSize)
+	if _, err := store.Read(&last, venti.RootType, buf); err != nil {
+		t.Fatalf("read root: %v", err)
+	}
+	root, err := venti.UnpackRoot(buf)
+	if err != nil {
+		t.Fatalf("unpack root: %v", err)
+	}
+
+	path, err := testTempPartition()
+	if err != nil {
+		t.Fatalf("create partition: %v", err)
+	}
+	defer os.Remove(path)
+
+	missing := venti.Sha1([]byte("missing"))
+	tests := []struct {
+		name  string
+		score *venti.Score
+		fault func(bool)
+		ok    bool
+	}{
+		{"missing root", missing, func(bool) {}, false},
+		{"corrupt root", &last, func(on bool) { store.Corrupt(&last, on) }, false},
+		{"corrupt dir", &last, func(on bool) { store.Corrupt(&root.Score, on) }, false},
+		{"slow venti", &last, func(on bool) {
+			if on {
+				store.SetLatency(10 * time.Millisecond)
+			} else {
+				store.SetLatency(0)
+			}
+		}, true},
+	}
+	for _, tt := range tests {
+		tt.fault(true)
+		err := formatDisk(path, 8*1024, 0, "vfs", store, tt.score.String())
+		tt.fault(false)
+		if tt.ok && err != nil {
+			t.Errorf("%s: format: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: format succeeded", tt.name)
+		}
+	}
+}
+
+func TestFormatVac(t *testing.T) {
+	store := venti.NewMemStore()
+	srv, err := ventitest.NewServer(store)
+	if err != nil {
+		t.Fatalf("serve venti: %v", err)
+	}
+	defer srv.Close()
+
+	mtime := time.Unix(1600000000, 0)
+	tree := fstest.MapFS{
+		"active/hello":   {Data: []byte("hello from vac\n"), Mode: 0644, ModTime: mtime},
+		"active/sub/big": {Data: make([]byte, 100000), Mode: 0644, ModTime: mtime},
+	}
+	score, err := vac.NewWriter(store).Write(tree, ".", "vac")
+	if err != nil {
+		t.Fatalf("vac: %v", err)
+	}
+
+	path, err := testTempPartition()
+	if err != nil {
+		t.Fatalf("create partition: %v", err)
+	}
+	if err := formatDisk(path, 8*1024, 0, "vfs", store, score.String()); err != nil {
+		os.Remove(path)
+		t.Fatalf("format: %v", err)
+	}
+	fs, done := testOpenPath(t, path, srv.Addr())
+	defer done()
+
+	f, err := fs.openFile("/active/hello")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.decRef()
+	buf := make([]byte, 100)
+	n, err := f.read(buf, 0)
+	if err != nil || string(buf[:n]) != "hello from vac\n" {
+		t.Errorf("read: got %q, %v", buf[:n], err)
+	}
 }
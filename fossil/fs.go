@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -20,14 +22,14 @@ const (
 
 // An Fs is a fossil internal filesystem representation.
 type Fs struct {
-	arch       *Arch          // (immutable)
-	cache      *Cache         // (immutable)
-	mode       int            // do not update file access times (immutable)
-	noatimeupd bool           // (immutable)
-	blockSize  int            // (immutable)
-	z          *venti.Session // (immutable)
-	snap       *Snap          // (immutable)
-	name       string         // copy here & Fsys to ease error reporting (immutable)
+	arch       *Arch       // (immutable)
+	cache      *Cache      // (immutable)
+	mode       int         // do not update file access times (immutable)
+	noatimeupd bool        // (immutable)
+	blockSize  int         // (immutable)
+	z          venti.Store // (immutable)
+	snap       *Snap       // (immutable)
+	name       string      // copy here & Fsys to ease error reporting (immutable)
 
 	metaFlushTicker *time.Ticker  // periodically flushes metadata cached in files
 	metaFlushStop   chan struct{} // signal metaFlushTicker goroutine to exit
@@ -45,6 +47,8 @@ type Fs struct {
 	elo    uint32       /* epoch low */
 	halted bool         /* epoch lock is held to halt (console initiated) */
 
+	full int32 /* over the full high-water mark: refuse writes */
+
 	source *Source /* immutable: root of sources */
 	file   *File   /* immutable: root of files */
 }
@@ -55,16 +59,24 @@ type Snap struct {
 	eventTicker *time.Ticker
 	eventStop   chan struct{}
 
+	reclaimlk   sync.Mutex /* held while reclaiming space */
 	lk          sync.Mutex
 	archAfter   time.Duration
 	snapFreq    time.Duration
 	snapLife    time.Duration
+	keep        snapKeep /* replaces snapLife if set */
+	hw          highWater
+	reclaimDue  bool /* check hw at the next event */
+	lastReclaim time.Time
+	scheds      []*snapSched
+	now         func() time.Time /* the clock */
 	lastSnap    time.Time
 	lastArch    time.Time
 	lastCleanup time.Time
+	closed      bool
 }
 
-func openFs(file, name string, z *venti.Session, noatimeupd bool, ncache, mode int) (*Fs, error) {
+func openFs(file, name string, z venti.Store, noatimeupd bool, ncache, mode int) (*Fs, error) {
 	var m int
 	switch mode {
 	default:
@@ -143,7 +155,7 @@ func openFs(file, name string, z *venti.Session, noatimeupd bool, ncache, mode i
 			return nil, errors.New("bad root source block")
 		}
 
-		b, err = b.copy(RootTag, fs.ehi, fs.elo)
+		b, err = b.copy(RootTag, fs.ehi, fs.elo, false)
 		if err != nil {
 			fs.close()
 			return nil, err
@@ -162,7 +174,7 @@ func openFs(file, name string, z *venti.Session, noatimeupd bool, ncache, mode i
 		bs.dependency(b, 0, &oscore, nil)
 		b.put()
 		bs.dirty()
-		bs.removeLink(venti.GlobalToLocal(&oscore), BtDir, RootTag, false)
+		bs.removeLink(venti.GlobalToLocal(&oscore), BtDir, RootTag, false, 0)
 		bs.put()
 		fs.source, err = fs.sourceRoot(super.active, mode)
 		if err != nil {
@@ -207,20 +219,21 @@ func openFs(file, name string, z *venti.Session, noatimeupd bool, ncache, mode i
 }
 
 func (fs *Fs) close() {
-	// first finish up any ongoing archival snapshots
+	// stop taking snapshots, then finish up any ongoing archival snapshots
+	fs.snap.close()
 	if fs.arch != nil {
 		fs.arch.close()
 		fs.arch = nil
 	}
 
-	fs.elk.RLock()
-	defer fs.elk.RUnlock()
+	/* wait for a meta data flush in progress */
+	fs.elk.Lock()
+	defer fs.elk.Unlock()
 
 	if fs.metaFlushTicker != nil {
 		fs.metaFlushTicker.Stop()
 		close(fs.metaFlushStop)
 	}
-	fs.snap.close()
 	if fs.file != nil {
 		fs.file.metaFlush(false)
 		if !fs.file.decRef() {
@@ -234,10 +247,11 @@ func (fs *Fs) close() {
 }
 
 func (fs *Fs) redial(host string) error {
-	fs.z.Close()
-	var err error
-	fs.z, err = venti.Dial(host)
-	return err
+	v, ok := fs.z.(*Venti)
+	if !ok {
+		return errors.New("venti store is not a server")
+	}
+	return v.redial(host)
 }
 
 func (fs *Fs) getRoot() *File {
@@ -407,9 +421,8 @@ func (fs *Fs) openSnapshot(dstpath string, doarchive bool) (*File, error) {
 	}
 }
 
-func (fs *Fs) needArch(archAfter time.Duration) bool {
-	now := time.Now()
-	elapsed := time.Since(now.Truncate(24 * time.Hour))
+func (fs *Fs) needArch(now time.Time, archAfter time.Duration) bool {
+	elapsed := now.Sub(now.Truncate(24 * time.Hour))
 
 	/* back up to yesterday if necessary */
 	if elapsed < archAfter {
@@ -433,6 +446,11 @@ func (fs *Fs) epochLow(low uint32) error {
 	fs.elk.Lock()
 	defer fs.elk.Unlock()
 
+	/* keep the blocks the clones share with their snapshots */
+	if lo := fs.cloneLow(); low > lo {
+		low = lo
+	}
+
 	if low > fs.ehi {
 		return fmt.Errorf("bad low epoch (must be <= %d)", fs.ehi)
 	}
@@ -472,7 +490,7 @@ func (fs *Fs) bumpEpoch(doarchive bool) error {
 		snap:  b.l.epoch,
 	}
 
-	b, err = b.copy(RootTag, fs.ehi+1, fs.elo)
+	b, err = b.copy(RootTag, fs.ehi+1, fs.elo, false)
 	if err != nil {
 		logf("bumpEpoch: blockCopy: %v\n", err)
 		return err
@@ -527,7 +545,7 @@ func (fs *Fs) bumpEpoch(doarchive bool) error {
 	 */
 	superWrite(bs, super, true)
 
-	bs.removeLink(venti.GlobalToLocal(&oscore), BtDir, RootTag, false)
+	bs.removeLink(venti.GlobalToLocal(&oscore), BtDir, RootTag, false, 0)
 	bs.put()
 
 	return nil
@@ -563,6 +581,9 @@ func (fs *Fs) snapshot(srcpath, dstpath string, doarchive bool) error {
 	if srcpath == "" {
 		srcpath = "/active"
 	}
+	if fs.holdsClones(filepath.Clean(srcpath)) {
+		return fmt.Errorf("%s: cannot snapshot clones", srcpath)
+	}
 
 	src, err := fs.openFile(srcpath)
 	if err != nil {
@@ -699,7 +720,10 @@ func (fs *Fs) vac(name string) (*venti.Score, error) {
 	return score, nil
 }
 
-func vtWriteBlock(z *venti.Session, buf []byte, typ venti.BlockType) (*venti.Score, error) {
+func vtWriteBlock(z venti.Store, buf []byte, typ venti.BlockType) (*venti.Score, error) {
+	if z == nil {
+		return nil, errors.New("no venti session")
+	}
 	score, err := z.Write(typ, buf)
 	if err != nil {
 		return nil, err
@@ -710,7 +734,7 @@ func vtWriteBlock(z *venti.Session, buf []byte, typ venti.BlockType) (*venti.Sco
 	return score, nil
 }
 
-func mkVac(z *venti.Session, blockSize uint, pe, pee *Entry, pde *DirEntry) (*venti.Score, error) {
+func mkVac(z venti.Store, blockSize uint, pe, pee *Entry, pde *DirEntry) (*venti.Score, error) {
 	e := *pe
 	ee := *pee
 	de := *pde
@@ -844,6 +868,11 @@ func (fs *Fs) nextQid(qid *uint64) error {
 
 func (fs *Fs) metaFlush() {
 	fs.elk.RLock()
+	if fs.file == nil {
+		/* closed */
+		fs.elk.RUnlock()
+		return
+	}
 	rv := fs.file.metaFlush(true)
 	fs.elk.RUnlock()
 
@@ -919,6 +948,90 @@ func (fs *Fs) esearch(path string, savetime time.Time, plo *uint32) int {
 	return n
 }
 
+/*
+ * A snapshot, temporary or archival, and the time it was
+ * taken: the modification time of its directory.
+ */
+type snap struct {
+	path  string
+	mtime uint32
+}
+
+/*
+ * Collect the snapshots below f that are still
+ * young enough to open.
+ */
+func fsSsearch1(f *File, path string, snaps *[]snap) {
+	dee, err := openDee(f)
+	if err != nil {
+		return
+	}
+
+	for {
+		var de DirEntry
+		r, deeReadErr := dee.read(&de)
+		if r <= 0 {
+			if deeReadErr != nil {
+				dprintf("fsSsearch1: deeRead: %v\n", deeReadErr)
+			}
+			break
+		}
+		if de.mode&ModeSnapshot != 0 {
+			ff, err := f.walk(de.elem)
+			if err == nil {
+				*snaps = append(*snaps, snap{fmt.Sprintf("%s/%s", path, de.elem), de.mtime})
+				ff.decRef()
+			}
+		} else if de.mode&ModeDir != 0 {
+			ff, err := f.walk(de.elem)
+			if err == nil {
+				fsSsearch1(ff, fmt.Sprintf("%s/%s", path, de.elem), snaps)
+				ff.decRef()
+			}
+		}
+		if r < 0 {
+			dprintf("fsSsearch1: deeRead: %v\n", deeReadErr)
+			break
+		}
+	}
+
+	dee.close()
+}
+
+/*
+ * Return the snapshots in /snapshot and /archive,
+ * oldest first. Assumes hold elk.
+ */
+func (fs *Fs) snapshots() []snap {
+	var snaps []snap
+	for _, path := range []string{"/snapshot", "/archive"} {
+		f, err := fs.openFile(path)
+		if err != nil {
+			continue
+		}
+		fsSsearch1(f, path, &snaps)
+		f.decRef()
+	}
+	sort.SliceStable(snaps, func(i, j int) bool {
+		return snaps[i].mtime < snaps[j].mtime
+	})
+	return snaps
+}
+
+/*
+ * Return the path of the newest snapshot, temporary or
+ * archival, taken at or before t. Assumes hold elk.
+ */
+func (fs *Fs) snapshotAt(t time.Time) (string, error) {
+	snaps := fs.snapshots()
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if int64(snaps[i].mtime) <= t.Unix() {
+			return snaps[i].path, nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot at or before %s", t.Format(time.RFC3339))
+}
+
 func (fs *Fs) snapshotCleanup(age time.Duration) {
 	/*
 	 * Find the best low epoch we can use,
@@ -927,7 +1040,7 @@ func (fs *Fs) snapshotCleanup(age time.Duration) {
 	 */
 	fs.elk.RLock()
 	lo := fs.ehi
-	fs.esearch("/archive", time.Time{}, &lo)
+	fs.esearch("/archive", time.Unix(0, 0), &lo)
 	fs.esearch("/snapshot", time.Now().Add(-age), &lo)
 	fs.elk.RUnlock()
 
@@ -958,7 +1071,7 @@ func fsRsearch1(f *File, s string) int {
 			ff, err := f.walk(de.elem)
 			if err == nil {
 				ff.decRef()
-			} else if err == ESnapOld {
+			} else if errors.Is(err, ESnapOld) {
 				if err = f.clri(de.elem, "adm"); err == nil {
 					n--
 				}
@@ -1020,6 +1133,7 @@ func (fs *Fs) initSnap() {
 		archAfter:   -1,
 		snapFreq:    -1,
 		snapLife:    -1,
+		now:         time.Now,
 	}
 
 	go func() {
@@ -1036,25 +1150,84 @@ func (fs *Fs) initSnap() {
 	fs.snap = s
 }
 
+// newest returns the time of the newest temporary or, if archive
+// is set, archival snapshot, or def if there is none.
+func (s *Snap) newest(archive bool, def time.Time) time.Time {
+	dir := "/snapshot/"
+	if archive {
+		dir = "/archive/"
+	}
+	s.fs.elk.RLock()
+	snaps := s.fs.snapshots()
+	s.fs.elk.RUnlock()
+	for i := len(snaps) - 1; i >= 0; i-- {
+		if strings.HasPrefix(snaps[i].path, dir) {
+			return time.Unix(int64(snaps[i].mtime), 0)
+		}
+	}
+	return def
+}
+
 func (s *Snap) event() {
-	now := time.Now()
-	elapsed := time.Since(now.Truncate(24 * time.Hour))
+	/*
+	 * Space comes first: the snapshots below need some.
+	 * Reclaiming it can take a while, so it is done without
+	 * holding s.lk, and the console can still get at s.
+	 * Measuring the space used scans every label, so the
+	 * marks are checked only hourly, after a snapshot or a
+	 * change to them, and while the disk is full, so that
+	 * writes resume soon after space is freed.
+	 */
+	s.reclaimlk.Lock()
+	s.lk.Lock()
+	closed, hw := s.closed, s.hw
+	now := s.now()
+	due := s.reclaimDue || s.lastReclaim.Add(time.Hour).Before(now) || s.fs.diskFull()
+	if due {
+		s.reclaimDue = false
+		s.lastReclaim = now
+	}
+	s.lk.Unlock()
+	if !closed && due {
+		s.fs.reclaimSpace(hw)
+	}
+	s.reclaimlk.Unlock()
 
 	s.lk.Lock()
 	defer s.lk.Unlock()
 
+	if s.closed {
+		return
+	}
+
+	elapsed := now.Sub(now.Truncate(24 * time.Hour))
+
 	/*
-	 * Snapshots happen every snapFreq.
+	 * A temporary and an archival snapshot is all any one
+	 * event takes, whichever of snapFreq, archAfter and
+	 * the cron schedules call for them.
+	 */
+	var done [2]bool
+	took := false
+
+	/*
+	 * Snapshots happen every snapFreq, counting from 00:00.
 	 * If we miss a snapshot (for example, because we
-	 * were down), we wait for the next one.
+	 * were down), we do it as soon as possible, once
+	 * however many were missed.
 	 */
 	if s.snapFreq > 0 {
-		snapminute := int(elapsed.Minutes())%int(s.snapFreq.Minutes()) == 0
-		if snapminute && now.Sub(s.lastSnap) > time.Minute {
+		if s.lastSnap.IsZero() {
+			s.lastSnap = s.newest(false, now)
+		}
+		due := now.Truncate(24 * time.Hour).Add(elapsed.Truncate(s.snapFreq))
+		if s.lastSnap.Before(due) {
 			if err := s.fs.snapshot("", "", false); err != nil {
 				logf("snap: %v\n", err)
 			}
 			s.lastSnap = now
+			took = true
+			done[0] = true
 		}
 	}
 
@@ -1072,7 +1245,7 @@ func (s *Snap) event() {
 		// if s.lastArch hasn't been initialized, check the filesystem
 		if s.lastArch.IsZero() {
 			s.lastArch = s.lastArch.Add(1)
-			if s.fs.needArch(s.archAfter) {
+			if s.fs.needArch(now, s.archAfter) {
 				need = true
 			}
 		}
@@ -1080,11 +1253,56 @@ func (s *Snap) event() {
 		if need {
 			s.fs.snapshot("", "", true)
 			s.lastArch = now
+			done[1] = true
+		}
+	}
+
+	/*
+	 * Cron schedules run when due, and only once however
+	 * many runs were missed since the last one, while the
+	 * file system was down or the scheduler stalled.
+	 */
+	for _, sc := range s.scheds {
+		next := sc.cron.next(sc.last)
+		if next.IsZero() || next.After(now) {
+			continue
+		}
+		sc.last = now
+		if done[bool2int(sc.archive)] {
+			continue
+		}
+		done[bool2int(sc.archive)] = true
+		if err := s.fs.snapshot("", "", sc.archive); err != nil {
+			logf("snap: %v\n", err)
+		}
+		if sc.archive {
+			s.lastArch = now
+		} else {
+			s.lastSnap = now
+			took = true
 		}
 	}
 
+	if done[0] || done[1] {
+		s.reclaimDue = true
+	}
+
 	/*
-	 * Snapshot cleanup happens every snaplife or every day.
+	 * With a retention policy, snapshot cleanup happens
+	 * after each snapshot and at least every hour.
+	 */
+	if s.keep.set() {
+		if took || s.lastCleanup.Add(time.Hour).Before(now) {
+			if _, err := s.fs.snapshotExpire(s.keep, false); err != nil {
+				logf("snap: %v\n", err)
+			}
+			s.lastCleanup = now
+		}
+		return
+	}
+
+	/*
+	 * Otherwise snapshot cleanup happens every snaplife or every day.
 	 */
 	snaplife := s.snapLife
 	if snaplife < 0 {
@@ -1130,4 +1348,11 @@ func (s *Snap) close() {
 	}
 	s.eventTicker.Stop()
 	close(s.eventStop)
+
+	/* wait for an event in progress */
+	s.lk.Lock()
+	s.closed = true
+	s.lk.Unlock()
+	s.reclaimlk.Lock()
+	s.reclaimlk.Unlock()
 }
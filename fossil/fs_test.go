@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,10 +46,32 @@ func TestFs(t *testing.T) {
 	t.Run("fs.snapshot", func(t *testing.T) { testFsSnapshot(t, fs) })
 
 	// wait for archival snapshot to complete
-	time.Sleep(100 * time.Millisecond)
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
 	t.Run("fs.vac", func(t *testing.T) { testFsVac(t, fs) })
 }
 
+// testWaitArch waits for the archiver to finish
+// all outstanding archival snapshots.
+func testWaitArch(fs *Fs, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		fs.elk.RLock()
+		b, super, err := getSuper(fs.cache)
+		fs.elk.RUnlock()
+		if err != nil {
+			return err
+		}
+		b.put()
+		if super.next == NilBlock && super.current == NilBlock && !super.last.IsZero() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("archiver did not finish within %v", timeout)
+}
+
 func testFsSync(t *testing.T, fs *Fs) {
 	if err := fs.sync(); err != nil {
 		t.Errorf("sync: %v", err)
@@ -127,3 +151,71 @@ func testFsVac(t *testing.T, fs *Fs) {
 		t.Logf("fetched entry: %v", e)
 	}
 }
+
+func TestFsSnapshotAt(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	conn := new(test9pConn)
+	cons := console.NewCons(conn, false)
+	defer cons.Close()
+	testRun9p(t, cons, conn, []test9pCommand{
+		{cmd: "9p Tversion 8192 9P2000"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/active"},
+		{cmd: "9p Twalk 0 1"},
+		{cmd: "9p Tcreate 1 when 0644 1"},
+		{cmd: "9p Tclunk 1"},
+	})
+
+	// a temporary snapshot, then an archival one, a second apart
+	var times []time.Time
+	for i, data := range []string{"one", "two", "six"} {
+		testRun9p(t, cons, conn, []test9pCommand{
+			{cmd: "9p Twalk 0 1 when"},
+			{cmd: "9p Topen 1 17"},
+			{cmd: "9p Twrite 1 0 " + data, match: "count=3"},
+			{cmd: "9p Tclunk 1"},
+		})
+		if i == 2 {
+			break
+		}
+		if err := fs.snapshot("", "", i == 1); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		times = append(times, time.Now())
+		time.Sleep(1100 * time.Millisecond)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.elk.RLock()
+	if path, err := fs.snapshotAt(times[0].Add(-time.Hour)); err == nil {
+		t.Errorf("snapshot before the first: got %s", path)
+	}
+	if path, err := fs.snapshotAt(times[0]); err != nil || !strings.HasPrefix(path, "/snapshot/") {
+		t.Errorf("first snapshot: got %s, %v", path, err)
+	}
+	if path, err := fs.snapshotAt(times[1]); err != nil || !strings.HasPrefix(path, "/archive/") {
+		t.Errorf("second snapshot: got %s, %v", path, err)
+	}
+	fs.elk.RUnlock()
+
+	testRun9p(t, cons, conn, []test9pCommand{
+		{cmd: "9p Tclunk 0"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/@" + times[0].Format("2006-01-02T15:04:05") + "/when"},
+		{cmd: "9p Topen 0 0"},
+		{cmd: "9p Tread 0 0 3", match: "one"},
+		{cmd: "9p Tclunk 0"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/@-0s"},
+		{cmd: "9p Twalk 0 1 when"},
+		{cmd: "9p Topen 1 0"},
+		{cmd: "9p Tread 1 0 3", match: "two"},
+		{cmd: "9p Tclunk 1"},
+		{cmd: "9p Tclunk 0"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/@-1d", err: true, match: "no snapshot"},
+		{cmd: "9p Tattach 0 ~1 nobody testfs/@yesterday", err: true, match: "bad time"},
+	})
+}
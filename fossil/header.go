@@ -20,6 +20,8 @@ type Header struct {
 	label     uint32 /* start of labels */
 	data      uint32 /* end of labels - start of data blocks */
 	end       uint32 /* end of data blocks */
+	vcache    uint32 /* start of venti cache; 0 if there is none */
+	vend      uint32 /* end of venti cache */
 }
 
 func (h *Header) pack(p []byte) {
@@ -31,6 +33,8 @@ func (h *Header) pack(p []byte) {
 	pack.PutUint32(p[12:], h.label)
 	pack.PutUint32(p[16:], h.data)
 	pack.PutUint32(p[20:], h.end)
+	pack.PutUint32(p[24:], h.vcache)
+	pack.PutUint32(p[28:], h.vend)
 }
 
 func unpackHeader(p []byte) (*Header, error) {
@@ -50,5 +54,15 @@ func unpackHeader(p []byte) (*Header, error) {
 	h.data = pack.GetUint32(p[16:])
 	h.end = pack.GetUint32(p[20:])
 
+	/*
+	 * The venti cache was added later; older headers
+	 * have zeros here, meaning no cache.
+	 */
+	h.vcache = pack.GetUint32(p[24:])
+	h.vend = pack.GetUint32(p[28:])
+	if h.vcache != 0 && (h.vcache < h.end || h.vend < h.vcache) {
+		return nil, fmt.Errorf("vac header bad venti cache")
+	}
+
 	return h, nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * High-water marks on the data partition. Once the part of it
+ * in use reaches the reclaim mark, the scheduler removes the
+ * oldest temporary snapshots one at a time, raising the low
+ * epoch past each and flushing the unlink queue so the blocks
+ * it held are free, until usage is back under the mark. It
+ * stops early if the low epoch does not move: a clone or an
+ * archival snapshot not yet in venti holds the blocks, and
+ * removing newer snapshots would free nothing. Archival
+ * snapshots are never removed.
+ *
+ * If usage is still at or over the full mark after that, new
+ * writes fail with EFsFill until it drops below again, so
+ * that what space is left goes to the metadata updates,
+ * removals and snapshots that let it drop.
+ */
+
+// A highWater holds the marks, in percent of the data partition
+// in use, at which space is reclaimed and at which writes are
+// refused. Zero disables a mark.
+type highWater struct {
+	reclaim int
+	full    int
+}
+
+func (h highWater) String() string {
+	return fmt.Sprintf("-r %d -f %d", h.reclaim, h.full)
+}
+
+// usedPercent returns the percentage of the data partition in use.
+func (fs *Fs) usedPercent() int {
+	var used, tot, bsize uint32
+
+	fs.elk.RLock()
+	elo := fs.elo
+	fs.elk.RUnlock()
+
+	fs.cache.countUsed(elo, &used, &tot, &bsize)
+	if tot == 0 {
+		return 0
+	}
+	return int(uint64(used) * 100 / uint64(tot))
+}
+
+func (fs *Fs) diskFull() bool {
+	return atomic.LoadInt32(&fs.full) != 0
+}
+
+// reclaimSpace enforces the marks in hw, logging what it does.
+func (fs *Fs) reclaimSpace(hw highWater) {
+	if hw == (highWater{}) && !fs.diskFull() {
+		return
+	}
+	used := fs.usedPercent()
+
+	mark := hw.reclaim
+	if mark == 0 {
+		mark = hw.full
+	}
+	if mark > 0 && used >= mark {
+		logf("%s: %d%% used, over the high-water mark of %d%%\n", fs.name, used, mark)
+		for used >= mark {
+			if !fs.reclaimSnapshot() {
+				break
+			}
+			used = fs.usedPercent()
+			logf("%s: %d%% used\n", fs.name, used)
+		}
+	}
+
+	full := hw.full > 0 && used >= hw.full
+	if full == fs.diskFull() {
+		return
+	}
+	if full {
+		atomic.StoreInt32(&fs.full, 1)
+		logf("%s: disk full: %d%% used, refusing writes\n", fs.name, used)
+	} else {
+		atomic.StoreInt32(&fs.full, 0)
+		logf("%s: %d%% used, accepting writes\n", fs.name, used)
+	}
+}
+
+// reclaimSnapshot removes the oldest temporary snapshot and
+// frees the blocks it held. It reports whether that raised
+// the low epoch, so that removing the next one may free more.
+func (fs *Fs) reclaimSnapshot() bool {
+	fs.elk.RLock()
+	oldest := ""
+	for _, s := range fs.snapshots() {
+		if strings.HasPrefix(s.path, "/snapshot/") {
+			oldest = s.path
+			break
+		}
+	}
+	if oldest == "" {
+		fs.elk.RUnlock()
+		logf("%s: no snapshots left to remove\n", fs.name)
+		return false
+	}
+	if err := fs.fileClriPath(oldest, uidadm); err != nil {
+		fs.elk.RUnlock()
+		logf("%s: removing snapshot %s: %v\n", fs.name, oldest, err)
+		return false
+	}
+	logf("%s: removed snapshot %s\n", fs.name, oldest)
+
+	/* as in snapshotExpire */
+	elo := fs.elo
+	lo := fs.ehi
+	fs.esearch("/archive", time.Unix(0, 0), &lo)
+	fs.esearch("/snapshot", time.Unix(0, 0), &lo)
+	fs.elk.RUnlock()
+
+	if err := fs.epochLow(lo); err != nil {
+		logf("%s: raising the low epoch: %v\n", fs.name, err)
+		return false
+	}
+	fs.snapshotRemove()
+
+	fs.elk.RLock()
+	lo = fs.elo
+	fs.elk.RUnlock()
+	if lo == elo {
+		logf("%s: low epoch held at %d by a clone or an unarchived snapshot\n", fs.name, lo)
+		return false
+	}
+	logf("%s: low epoch raised from %d to %d\n", fs.name, elo, lo)
+
+	fs.cache.flushUnlinks()
+	logf("%s: unlink queue flushed\n", fs.name)
+	return true
+}
+
+func (s *Snap) getHighWater() highWater {
+	if s == nil {
+		return highWater{}
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.hw
+}
+
+func (s *Snap) setHighWater(hw highWater) {
+	if s == nil {
+		return
+	}
+
+	s.lk.Lock()
+	s.hw = hw
+	s.reclaimDue = true
+	s.lk.Unlock()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func TestHighWater(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	// each file takes about 2% of the test disk
+	write := func(name, fill string) {
+		fs.elk.RLock()
+		f, err := fs.openFile("/active/" + name)
+		fs.elk.RUnlock()
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		defer f.decRef()
+		buf := []byte(strings.Repeat(fill, fs.blockSize))
+		for i := 0; i < 250; i++ {
+			if _, err := f.write(buf, len(buf), int64(i*len(buf)), "adm"); err != nil {
+				t.Fatalf("write %s: %v", name, err)
+			}
+		}
+	}
+	used := func() int {
+		fs.metaFlush()
+		fs.cache.flushUnlinks()
+		return fs.usedPercent()
+	}
+	snapshots := func() []string {
+		fs.elk.RLock()
+		defer fs.elk.RUnlock()
+		var l []string
+		for _, s := range fs.snapshots() {
+			l = append(l, s.path)
+		}
+		return l
+	}
+	writeY := func() error {
+		fs.elk.RLock()
+		f, err := fs.openFile("/active/y")
+		fs.elk.RUnlock()
+		if err != nil {
+			t.Fatalf("open y: %v", err)
+		}
+		defer f.decRef()
+		_, err = f.write([]byte("y"), 1, 0, "adm")
+		return err
+	}
+
+	testExec(t, "fsys testfs create /active/x adm adm 664",
+		"fsys testfs create /active/y adm adm 664")
+	write("x", "a")
+	if err := fs.snapshot("", "/snapshot/s1", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	write("x", "b")
+	if err := fs.snapshot("", "/snapshot/s2", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	testExec(t, "fsys testfs remove /active/x")
+	write("y", "c")
+
+	// under the mark, nothing happens
+	u := used()
+	fs.reclaimSpace(highWater{reclaim: u + 1, full: u + 1})
+	if l := snapshots(); len(l) != 2 {
+		t.Fatalf("under the mark: snapshots %v", l)
+	}
+
+	// removing s1 is enough to get under the mark
+	fs.elk.RLock()
+	elo := fs.elo
+	fs.elk.RUnlock()
+	fs.reclaimSpace(highWater{reclaim: u})
+	if l := snapshots(); len(l) != 1 || l[0] != "/snapshot/s2" {
+		t.Fatalf("over the mark: snapshots %v", l)
+	}
+	fs.elk.RLock()
+	if fs.elo <= elo {
+		t.Errorf("low epoch %d, was %d", fs.elo, elo)
+	}
+	fs.elk.RUnlock()
+	if u1 := used(); u1 >= u {
+		t.Errorf("%d%% used, was %d%%", u1, u)
+	}
+	if fs.diskFull() {
+		t.Errorf("disk full under the mark")
+	}
+
+	// with nothing left to remove, writes are refused
+	fs.reclaimSpace(highWater{full: 1})
+	if l := snapshots(); len(l) != 0 {
+		t.Errorf("over the full mark: snapshots %v", l)
+	}
+	if !fs.diskFull() {
+		t.Fatalf("disk not full at %d%%", used())
+	}
+	if err := writeY(); !errors.Is(err, EFsFill) {
+		t.Errorf("write when full: got %v, want %v", err, EFsFill)
+	}
+	if err := console.Exec(nil, "fsys testfs create /active/z adm adm 664"); err == nil {
+		t.Errorf("create when full succeeded")
+	}
+	fs.reclaimSpace(highWater{})
+	if fs.diskFull() {
+		t.Errorf("disk full without marks")
+	}
+	if err := writeY(); err != nil {
+		t.Errorf("write: %v", err)
+	}
+
+	cons, out := testCons()
+	defer cons.Close()
+	for _, cmd := range []string{"fsys testfs highwater -r 90 -f 95", "fsys testfs highwater"} {
+		if err := console.Exec(cons, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if got := out.String(); got != "\thighwater -r 90 -f 95\n" {
+		t.Errorf("highwater: got %q", got)
+	}
+	for _, cmd := range []string{"fsys testfs highwater -r 101", "fsys testfs highwater -f -1", "fsys testfs highwater 90"} {
+		if err := console.Exec(cons, cmd); err == nil {
+			t.Errorf("%s succeeded", cmd)
+		}
+	}
+
+	// the marks are checked after a change to them, then hourly
+	var lk sync.Mutex
+	clock := time.Unix(1700000000, 0)
+	setClock := func(d time.Duration) time.Time {
+		lk.Lock()
+		defer lk.Unlock()
+		clock = clock.Add(d)
+		return clock
+	}
+	fs.snap.lk.Lock()
+	fs.snap.now = func() time.Time {
+		lk.Lock()
+		defer lk.Unlock()
+		return clock
+	}
+	fs.snap.lk.Unlock()
+	checked := func() time.Time {
+		fs.snap.lk.Lock()
+		defer fs.snap.lk.Unlock()
+		return fs.snap.lastReclaim
+	}
+	t0 := setClock(0)
+	fs.snap.event()
+	if c := checked(); !c.Equal(t0) {
+		t.Errorf("after a change: checked at %v, want %v", c, t0)
+	}
+	setClock(10 * time.Minute)
+	fs.snap.event()
+	if c := checked(); !c.Equal(t0) {
+		t.Errorf("10 minutes on: checked at %v, want %v", c, t0)
+	}
+	t1 := setClock(time.Hour)
+	fs.snap.event()
+	if c := checked(); !c.Equal(t1) {
+		t.Errorf("an hour on: checked at %v, want %v", c, t1)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+)
+
+/*
+ * Each archive the archiver writes to venti points back to the
+ * one before it through the Prev score of its root block, starting
+ * from super.last. history walks that chain; openArchive opens any
+ * archive in it as a tree of read-only files.
+ */
+
+// history returns the archives reachable from super.last,
+// newest first, or at most n of them if n > 0.
+func (fs *Fs) history(n int) ([]*vac.Archive, error) {
+	fs.elk.RLock()
+	last, err := fs.lastArchive()
+	fs.elk.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return vac.History(fs.z, &last, n)
+}
+
+// lastArchive returns super.last, the root score of the newest
+// archive. Assumes hold elk.
+func (fs *Fs) lastArchive() (venti.Score, error) {
+	if fs.z == nil {
+		return venti.Score{}, errors.New("no venti session")
+	}
+	b, err := fs.cache.local(PartSuper, 0, OReadOnly)
+	if err != nil {
+		return venti.Score{}, err
+	}
+	super, err := unpackSuper(b.data)
+	b.put()
+	if err != nil {
+		return venti.Score{}, fmt.Errorf("bad super block: %v", err)
+	}
+	return super.last, nil
+}
+
+// openArchive opens the root of the archive, written by fossil
+// or by vac, with the given root score. Its files are read-only,
+// and their blocks are read from venti through the cache.
+// The caller must hold fs.elk.
+func (fs *Fs) openArchive(score *venti.Score) (*File, error) {
+	if fs.z == nil {
+		return nil, errors.New("no venti session")
+	}
+	buf := make([]byte, venti.RootSize)
+	n, err := fs.z.Read(score, venti.RootType, buf)
+	if err != nil {
+		return nil, err
+	}
+	if !score.Check(buf[:n]) {
+		return nil, fmt.Errorf("archive %v: wrong score", score)
+	}
+	root, err := venti.UnpackRoot(buf)
+	if err != nil {
+		return nil, fmt.Errorf("archive %v: %v", score, err)
+	}
+	if int(root.BlockSize) > fs.blockSize {
+		return nil, fmt.Errorf("archive %v: block size %d > %d", score, root.BlockSize, fs.blockSize)
+	}
+
+	/*
+	 * The root block of a fossil archive holds the entry of the
+	 * source of the file system's three root sources, just as
+	 * the block at super.active does on disk. Vac's archives
+	 * lack this layer, so make one up for them in the cache:
+	 * the source loads its entry whenever it is locked.
+	 */
+	b, err := fs.cache.global(&root.Score, BtDir, RootTag, OReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if len(venti.ZeroTruncate(venti.DirType, b.data)) > 2*venti.EntrySize {
+		b.put()
+		e := &Entry{
+			psize: root.BlockSize,
+			dsize: root.BlockSize,
+			flags: venti.EntryActive | venti.EntryDir,
+			size:  3 * venti.EntrySize,
+			score: root.Score,
+		}
+		ebuf := make([]byte, venti.EntrySize)
+		e.pack(ebuf, 0)
+		escore := fs.cache.memBlock(ebuf)
+		if b, err = fs.cache.global(escore, BtDir, RootTag, OReadOnly); err != nil {
+			return nil, err
+		}
+	}
+	r, err := fs.allocSource(b, nil, 0, OReadOnly, true)
+	b.put()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := rootFile(r)
+	if err == nil {
+		r.file = f
+	}
+	r.close()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// A fileVersion is a version of a file as found in a snapshot.
+type fileVersion struct {
+	path  string // of the file in the snapshot
+	dir   DirEntry
+	score venti.Score // of the file's data
+}
+
+func (v *fileVersion) String() string {
+	mtime := time.Unix(int64(v.dir.mtime), 0).Format("2006/01/02 15:04:05")
+	return fmt.Sprintf("%s %s %d %d %s", mtime, v.path, v.dir.size, v.dir.mcount, v.dir.mid)
+}
+
+// fileVersions returns the versions of the file at p, a path
+// under /active, found in the snapshots, newest first. A version
+// unchanged over consecutive snapshots is listed once, as found
+// in the newest of them. The caller must hold fs.elk.
+func (fs *Fs) fileVersions(p string) ([]*fileVersion, error) {
+	p = path.Clean("/" + p)
+	if p != "/active" && !strings.HasPrefix(p, "/active/") {
+		return nil, fmt.Errorf("%s: not in /active", p)
+	}
+	rel := strings.TrimPrefix(p, "/active")
+
+	var list []*fileVersion
+	snaps := fs.snapshots()
+	for i := len(snaps) - 1; i >= 0; i-- {
+		v, err := fs.fileVersion(snaps[i].path + rel)
+		if err != nil {
+			/* not in this snapshot */
+			continue
+		}
+		if n := len(list); n > 0 && list[n-1].score == v.score {
+			continue
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (fs *Fs) fileVersion(p string) (*fileVersion, error) {
+	f, err := fs.openFile(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.decRef()
+	de, err := f.getDir()
+	if err != nil {
+		return nil, err
+	}
+	e, _, err := f.getSources()
+	if err != nil {
+		return nil, err
+	}
+	return &fileVersion{path: p, dir: *de, score: e.score}, nil
+}
+
+// qidVersions is set in the qid path of a versions file, which
+// is otherwise that of the file it lists the versions of, or zero
+// if that is nowhere to be found. The qids of files count up from
+// zero and never reach it.
+const qidVersions = 1 << 63
+
+// versionsFile returns the contents and qid path of the synthetic
+// file listing the versions of the file at p, one per line. The
+// contents are never nil, so that an empty listing still marks a
+// fid as a versions file.
+// The caller must hold fs.elk.
+func (fs *Fs) versionsFile(p string) ([]byte, uint64, error) {
+	list, err := fs.fileVersions(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := []byte{}
+	for _, v := range list {
+		data = append(data, v.String()+"\n"...)
+	}
+
+	var qid uint64
+	if f, err := fs.openFile(p); err == nil {
+		qid = f.getId()
+		f.decRef()
+	} else if len(list) > 0 {
+		qid = list[0].dir.qid
+	}
+	return data, qid | qidVersions, nil
+}
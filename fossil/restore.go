@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/floren/fs/venti"
+)
+
+/*
+ * Restore a file or directory from a snapshot by grafting it
+ * into the active tree, the reverse of (*File).snapshot: the new
+ * file's entries point at the snapshot's blocks, so no data is
+ * copied. Writes to the restored file copy-on-write as usual,
+ * since its blocks are older than the current epoch.
+ *
+ * The blocks of a file no longer in the active tree have been
+ * closed, and will be reclaimed once the snapshots holding them
+ * are gone. Grafting reopens its data blocks. A block still open
+ * is shared with the active tree, as the unchanged blocks of an
+ * older version of a file are with the file, and gets a copy:
+ * nothing counts the pointers to a block, and the first of two
+ * active ones to let go of it would close it under the other.
+ * The pointer and directory blocks above are copied too, since
+ * the snapshot still needs them as they are, and they are few.
+ */
+
+// restore grafts the file or directory at src, in a snapshot,
+// into the active tree at dst, which must not exist yet.
+func (fs *Fs) restore(src, dst, uid string) error {
+	assert(fs.mode == OReadWrite)
+
+	if fs.halted {
+		return fmt.Errorf("file system is halted")
+	}
+
+	fs.elk.Lock()
+	defer fs.elk.Unlock()
+
+	sf, err := fs.openFile(src)
+	if err != nil {
+		return err
+	}
+	defer sf.decRef()
+	if sf.mode != OReadOnly {
+		return fmt.Errorf("%s: not in a snapshot", src)
+	}
+	de, err := sf.getDir()
+	if err != nil {
+		return err
+	}
+	e, ee, err := sf.getSources()
+	if err != nil {
+		return err
+	}
+
+	elem := filepath.Base(dst)
+	if err := checkValidFileName(elem); err != nil {
+		return err
+	}
+	dir, err := fs.openFile(filepath.Dir(dst))
+	if err != nil {
+		return err
+	}
+	defer dir.decRef()
+	if dir.source.floor != 0 {
+		return fmt.Errorf("%s: cannot restore into a clone", dst)
+	}
+
+	/*
+	 * Let the unlinks of files removed from the active
+	 * tree reach the labels of their blocks.
+	 */
+	fs.cache.flushUnlinks()
+
+	f, err := dir.create(elem, de.mode&^ModeSnapshot, uid)
+	if err != nil {
+		return err
+	}
+	defer f.decRef()
+
+	/*
+	 * On failure, put back the labels of the blocks reopened
+	 * or copied and remove the new file. If its sources point
+	 * at the graft by then, the removal's unlinks find the
+	 * copies freed and at most close the reopened blocks in a
+	 * later epoch than they were, which only keeps them longer.
+	 */
+	undo := make(map[uint32]graftLabel)
+	fail := func(err error) error {
+		for addr, g := range undo {
+			fs.setGraftLabel(addr, &g.l, &g.old)
+		}
+		f.remove(uid)
+		return err
+	}
+	for _, x := range []*Entry{e, ee} {
+		if err := fs.graftEntry(x, undo); err != nil {
+			return fail(fmt.Errorf("graft %s: %v", src, err))
+		}
+	}
+
+	/*
+	 * Get the labels and the copies to disk before any
+	 * pointer to them, so that a crash can only leak them.
+	 */
+	fs.cache.flush(true)
+
+	e.snap, e.archive = 0, false
+	if err := setEntry(f.source, e); err != nil {
+		return fail(err)
+	}
+	if f.msource != nil {
+		ee.snap, ee.archive = 0, false
+		if err := setEntry(f.msource, ee); err != nil {
+			return fail(err)
+		}
+	}
+
+	nd, err := f.getDir()
+	if err != nil {
+		return fail(err)
+	}
+	nd.uid = de.uid
+	nd.gid = de.gid
+	nd.mtime = de.mtime
+	nd.atime = de.atime
+	nd.size = de.size
+	if err := f.setDir(nd, uid); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+// graftLabel is the label of a block grafted by restore,
+// and what it was before.
+type graftLabel struct {
+	l, old Label
+}
+
+func (fs *Fs) setGraftLabel(addr uint32, l, nl *Label) error {
+	b, err := fs.cache.localData(addr, l.typ, l.tag, OOverWrite, 0)
+	if err != nil {
+		return err
+	}
+	err = b.setLabel(nl, false)
+	b.put()
+	return err
+}
+
+/*
+ * Graft the tree of the source with entry e, reopening or
+ * copying its blocks, and point e at the result. The labels
+ * changed on the way are recorded in undo.
+ */
+func (fs *Fs) graftEntry(e *Entry, undo map[uint32]graftLabel) error {
+	if e.flags&venti.EntryActive == 0 {
+		return nil
+	}
+	return fs.graftBlock(&e.score, EntryType(e), e.tag, undo)
+}
+
+func (fs *Fs) graftBlock(score *venti.Score, typ BlockType, tag uint32, undo map[uint32]graftLabel) error {
+	addr := venti.GlobalToLocal(score)
+	if addr == NilBlock {
+		/* in venti, or empty */
+		return nil
+	}
+	l, err := fs.cache.readLabel(addr)
+	if err != nil {
+		return err
+	}
+	if l.typ != typ || l.tag != tag {
+		return ELabelMismatch
+	}
+	if typ == BtData && l.state&BsClosed != 0 {
+		nl := *l
+		nl.state &^= BsClosed | BsCopied
+		nl.epochClose = ^uint32(0)
+		if err := fs.setGraftLabel(addr, l, &nl); err != nil {
+			return err
+		}
+		undo[addr] = graftLabel{nl, *l}
+		return nil
+	}
+
+	b, err := fs.cache.localData(addr, typ, tag, OReadOnly, 0)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, len(b.data))
+	copy(data, b.data)
+	b.put()
+
+	switch {
+	case typ == BtDir:
+		for i := 0; i < len(data)/venti.EntrySize; i++ {
+			ce, err := unpackEntry(data, i)
+			if err != nil {
+				return err
+			}
+			if ce.snap != 0 {
+				return fmt.Errorf("cannot restore a tree holding a snapshot")
+			}
+			if err := fs.graftEntry(ce, undo); err != nil {
+				return err
+			}
+			ce.pack(data, i)
+		}
+	case typ != BtData:
+		for i := 0; i < len(data)/venti.ScoreSize; i++ {
+			var s venti.Score
+			copy(s[:], data[i*venti.ScoreSize:])
+			if err := fs.graftBlock(&s, typ-1, tag, undo); err != nil {
+				return err
+			}
+			copy(data[i*venti.ScoreSize:], s[:])
+		}
+	}
+
+	bb, err := fs.cache.allocBlock(typ, tag, fs.ehi, fs.elo)
+	if err != nil {
+		return err
+	}
+	undo[bb.addr] = graftLabel{bb.l, Label{typ: BtMax, state: BsFree}}
+	copy(bb.data, data)
+	bb.dirty()
+	*score = bb.score
+	bb.put()
+	return nil
+}
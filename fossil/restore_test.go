@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func testReadFile(t *testing.T, fs *Fs, path string) string {
+	fs.elk.RLock()
+	defer fs.elk.RUnlock()
+	f, err := fs.openFile(path)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.decRef()
+	var size uint64
+	if err := f.getSize(&size); err != nil {
+		t.Fatalf("size %s: %v", path, err)
+	}
+	buf := make([]byte, size)
+	for off := 0; off < len(buf); {
+		n, err := f.read(buf[off:], int64(off))
+		if err != nil {
+			t.Fatalf("read %s: %v", path, err)
+		}
+		if n == 0 {
+			break
+		}
+		off += n
+	}
+	return string(buf)
+}
+
+func testCheck(t *testing.T, fs *Fs) {
+	/*
+	 * Write out dirty directory entries and let pending
+	 * unlinks close the blocks they free, so the check
+	 * does not race with them.
+	 */
+	fs.metaFlush()
+	fs.cache.flushUnlinks()
+
+	cons, out := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, "fsys testfs check"); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	if !strings.Contains(out.String(), "fsck: 0 clri, 0 clre, 0 clrp, 0 bclose") || strings.Contains(out.String(), "walk:") {
+		t.Errorf("check: %s", out.String())
+	}
+}
+
+func TestRestore(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	// enough data for a pointer block
+	var big []string
+	for i := 0; i < 40; i++ {
+		big = append(big, fmt.Sprintf("%04d%s", i, strings.Repeat("x", 7996)))
+	}
+	testExec(t, "fsys testfs create /active/d adm adm d775",
+		"fsys testfs create /active/d/x adm adm 664",
+		"fsys testfs create /active/d/big adm adm 664",
+		"fsys testfs create /active/d/sub adm adm d775",
+		"fsys testfs create /active/d/sub/y adm adm 664")
+	testWrite(t, "active", "d/x", 0, "hello")
+	testWrite(t, "active", "d/big", 0, big...)
+	testWrite(t, "active", "d/sub/y", 0, "why")
+	if err := fs.snapshot("", "/snapshot/s1", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	if got := testReadFile(t, fs, "/snapshot/s1/d/x"); got != "hello" {
+		t.Errorf("snapshot x before restore: got %q", got)
+	}
+	testExec(t, "fsys testfs remove /active/d/sub/y /active/d/sub /active/d/x /active/d/big /active/d")
+	if err := fs.restore("/snapshot/s1/d", "/active/d", "adm"); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := testReadFile(t, fs, "/active/d/x"); got != "hello" {
+		t.Errorf("restored x: got %q", got)
+	}
+	if got := testReadFile(t, fs, "/active/d/big"); got != strings.Join(big, "") {
+		t.Errorf("restored big: got %d bytes", len(got))
+	}
+	if got := testReadFile(t, fs, "/active/d/sub/y"); got != "why" {
+		t.Errorf("restored y: got %q", got)
+	}
+
+	// blocks shared with the active tree are grafted as they are
+	if err := fs.restore("/snapshot/s1/d", "/active/d2", "adm"); err != nil {
+		t.Fatalf("second restore: %v", err)
+	}
+	if got := testReadFile(t, fs, "/active/d2/big"); got != strings.Join(big, "") {
+		t.Errorf("restored big again: got %d bytes", len(got))
+	}
+	testExec(t, "fsys testfs remove /active/d2/sub/y /active/d2/sub /active/d2/x /active/d2/big /active/d2")
+	if err := fs.restore("/active/d/x", "/active/x", "adm"); err == nil {
+		t.Errorf("restore from active succeeded")
+	}
+	if err := fs.restore("/snapshot/s1/d/x", "/active/d/x", "adm"); err == nil {
+		t.Errorf("restore over existing file succeeded")
+	}
+	testCheck(t, fs)
+
+	// writes to the restored tree copy on write
+	testWrite(t, "active", "d/x", 0, "HELLO")
+	if got := testReadFile(t, fs, "/snapshot/s1/d/x"); got != "hello" {
+		t.Errorf("snapshot x: got %q", got)
+	}
+
+	// an older version of a file still in the active tree
+	testWrite(t, "active", "d/big", 0, "CHANGED")
+	if err := fs.restore("/snapshot/s1/d/big", "/active/oldbig", "adm"); err != nil {
+		t.Fatalf("restore old version: %v", err)
+	}
+	if got := testReadFile(t, fs, "/active/oldbig"); got != strings.Join(big, "") {
+		t.Errorf("restored old big: got %d bytes", len(got))
+	}
+	testCheck(t, fs)
+
+	// the restored blocks outlive the snapshot
+	testExec(t, "fsys testfs clri /snapshot/s1", "fsys testfs snapclean 0")
+	want := "CHANGED" + strings.Join(big, "")[7:]
+	if got := testReadFile(t, fs, "/active/d/big"); got != want {
+		t.Errorf("restored big after snapclean: got %d bytes", len(got))
+	}
+	testExec(t, "fsys testfs remove /active/d/big")
+	fs.cache.flushUnlinks()
+	testExec(t, "fsys testfs create /active/other adm adm 664")
+	testWrite(t, "active", "other", 0, big...)
+	if got := testReadFile(t, fs, "/active/oldbig"); got != strings.Join(big, "") {
+		t.Errorf("restored old big after snapclean: got %d bytes", len(got))
+	}
+	if got := testReadFile(t, fs, "/active/d/x"); got != "HELLO" {
+		t.Errorf("restored x after snapclean: got %q", got)
+	}
+	testCheck(t, fs)
+
+	cons, _ := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, "fsys testfs restore /active/d /active/e"); err == nil {
+		t.Errorf("console restore from active succeeded")
+	}
+}
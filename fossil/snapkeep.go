@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * Retention policies for the temporary snapshots in /snapshot.
+ * Instead of a single age, a policy keeps the newest snapshot
+ * of each of the last n hours, days, weeks and months that have
+ * one, so that snapshots thin out as they get older. A snapshot
+ * kept by any of the tiers is kept; the others have expired.
+ * Archival snapshots are never expired.
+ *
+ * Snapshots are bucketed by the modification time of their
+ * directory, in UTC, like the schedule of (*Snap).event.
+ */
+
+// A snapKeep is a snapshot retention policy: the number of
+// hourly, daily, weekly and monthly snapshots to keep.
+type snapKeep struct {
+	hourly  int
+	daily   int
+	weekly  int
+	monthly int
+}
+
+// set reports whether k keeps anything; the zero policy
+// leaves cleanup to the snapshot lifetime.
+func (k snapKeep) set() bool {
+	return k.hourly > 0 || k.daily > 0 || k.weekly > 0 || k.monthly > 0
+}
+
+func (k snapKeep) String() string {
+	return fmt.Sprintf("-h %d -d %d -w %d -m %d", k.hourly, k.daily, k.weekly, k.monthly)
+}
+
+// expired returns the snapshots in snaps, sorted oldest first,
+// that k does not keep.
+func (k snapKeep) expired(snaps []snap) []snap {
+	tiers := []struct {
+		n      int
+		bucket func(t time.Time) int
+	}{
+		{k.hourly, func(t time.Time) int { return int(t.Unix() / 3600) }},
+		{k.daily, func(t time.Time) int { return int(t.Unix() / 86400) }},
+		{k.weekly, func(t time.Time) int { y, w := t.ISOWeek(); return y*100 + w }},
+		{k.monthly, func(t time.Time) int { return t.Year()*12 + int(t.Month()) }},
+	}
+
+	keep := make([]bool, len(snaps))
+	for _, tier := range tiers {
+		n, last := 0, -1
+		for i := len(snaps) - 1; i >= 0 && n < tier.n; i-- {
+			b := tier.bucket(time.Unix(int64(snaps[i].mtime), 0).UTC())
+			if b == last {
+				continue
+			}
+			keep[i] = true
+			last = b
+			n++
+		}
+	}
+
+	var old []snap
+	for i, s := range snaps {
+		if !keep[i] {
+			old = append(old, s)
+		}
+	}
+	return old
+}
+
+// snapshotExpire removes the snapshots in /snapshot that keep
+// does not keep, then advances the low epoch past them. It
+// returns the paths of the snapshots removed or, if dryrun is
+// set, of those that would be.
+func (fs *Fs) snapshotExpire(keep snapKeep, dryrun bool) ([]string, error) {
+	fs.elk.RLock()
+	var snaps []snap
+	for _, s := range fs.snapshots() {
+		if strings.HasPrefix(s.path, "/snapshot/") {
+			snaps = append(snaps, s)
+		}
+	}
+	var paths []string
+	for _, s := range keep.expired(snaps) {
+		paths = append(paths, s.path)
+	}
+	if dryrun || len(paths) == 0 {
+		fs.elk.RUnlock()
+		return paths, nil
+	}
+
+	var err error
+	for i, p := range paths {
+		if err = fs.fileClriPath(p, uidadm); err != nil {
+			paths = paths[:i]
+			err = fmt.Errorf("%s: %v", p, err)
+			break
+		}
+	}
+
+	/*
+	 * As in snapshotCleanup, but every snapshot left
+	 * is to be kept, whatever its age.
+	 */
+	lo := fs.ehi
+	fs.esearch("/archive", time.Unix(0, 0), &lo)
+	fs.esearch("/snapshot", time.Unix(0, 0), &lo)
+	fs.elk.RUnlock()
+
+	fs.epochLow(lo)
+	fs.snapshotRemove()
+	return paths, err
+}
+
+func (s *Snap) getKeep() snapKeep {
+	if s == nil {
+		return snapKeep{}
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return s.keep
+}
+
+func (s *Snap) setKeep(keep snapKeep) {
+	if s == nil {
+		return
+	}
+
+	s.lk.Lock()
+	s.keep = keep
+	s.lk.Unlock()
+}
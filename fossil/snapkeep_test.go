@@ -0,0 +1,121 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func TestSnapKeepExpired(t *testing.T) {
+	// a snapshot every 6 hours for 60 days, ending on a Sunday
+	end := time.Date(2024, 3, 31, 18, 0, 0, 0, time.UTC)
+	var snaps []snap
+	for at := end.Add(-60 * 24 * time.Hour); !at.After(end); at = at.Add(6 * time.Hour) {
+		snaps = append(snaps, snap{at.Format("/snapshot/2006/0102/1504"), uint32(at.Unix())})
+	}
+	kept := func(k snapKeep) []string {
+		old := make(map[string]bool)
+		for _, s := range k.expired(snaps) {
+			old[s.path] = true
+		}
+		var paths []string
+		for _, s := range snaps {
+			if !old[s.path] {
+				paths = append(paths, s.path)
+			}
+		}
+		return paths
+	}
+
+	for _, tt := range []struct {
+		keep snapKeep
+		want []string
+	}{
+		{snapKeep{hourly: 3}, []string{"/snapshot/2024/0331/0600", "/snapshot/2024/0331/1200", "/snapshot/2024/0331/1800"}},
+		{snapKeep{daily: 2}, []string{"/snapshot/2024/0330/1800", "/snapshot/2024/0331/1800"}},
+		{snapKeep{weekly: 2}, []string{"/snapshot/2024/0324/1800", "/snapshot/2024/0331/1800"}},
+		{snapKeep{monthly: 3}, []string{"/snapshot/2024/0131/1800", "/snapshot/2024/0229/1800", "/snapshot/2024/0331/1800"}},
+		{snapKeep{hourly: 2, daily: 2}, []string{"/snapshot/2024/0330/1800", "/snapshot/2024/0331/1200", "/snapshot/2024/0331/1800"}},
+	} {
+		if got := kept(tt.keep); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("keep %v: got %q, want %q", tt.keep, got, tt.want)
+		}
+	}
+	if got := kept(snapKeep{monthly: 100}); len(got) != 3 {
+		t.Errorf("monthly beyond the oldest: kept %d", len(got))
+	}
+}
+
+func TestSnapKeep(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	cons, out := testCons()
+	defer cons.Close()
+	exec := func(cmd string) string {
+		out.Reset()
+		if err := console.Exec(cons, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+		return out.String()
+	}
+
+	exec("fsys testfs create /active/x adm adm 664")
+	for _, name := range []string{"s1", "s2", "s3"} {
+		if err := fs.snapshot("", "/snapshot/"+name, false); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+	}
+	lo := fs.ehi - 1
+
+	if got := exec("fsys testfs snapkeep"); got != "\tsnapkeep -h 0 -d 0 -w 0 -m 0\n" {
+		t.Errorf("snapkeep: got %q", got)
+	}
+	exec("fsys testfs snapkeep -h 1 -w 2")
+	if got := exec("fsys testfs snapkeep"); got != "\tsnapkeep -h 1 -d 0 -w 2 -m 0\n" {
+		t.Errorf("snapkeep: got %q", got)
+	}
+
+	// all three were taken within the same hour and week
+	if got := exec("fsys testfs snapclean -n"); got != "\t/snapshot/s1\n\t/snapshot/s2\n" {
+		t.Errorf("snapclean -n: got %q", got)
+	}
+	if got := testReadFile(t, fs, "/snapshot/s1/x"); got != "" {
+		t.Errorf("s1 after dry run: got %q", got)
+	}
+
+	exec("fsys testfs snapclean")
+	for _, p := range []string{"/snapshot/s1", "/snapshot/s2"} {
+		fs.elk.RLock()
+		if f, err := fs.openFile(p); err == nil {
+			f.decRef()
+			t.Errorf("%s survived cleanup", p)
+		}
+		fs.elk.RUnlock()
+	}
+	testReadFile(t, fs, "/snapshot/s3/x")
+	if fs.elo != lo {
+		t.Errorf("low epoch %d, want %d", fs.elo, lo)
+	}
+	if got := exec("fsys testfs snapclean -n"); got != "" {
+		t.Errorf("snapclean -n after cleanup: got %q", got)
+	}
+	testCheck(t, fs)
+
+	if err := console.Exec(cons, "fsys testfs snapkeep -d -1"); err == nil {
+		t.Errorf("snapkeep -d -1 succeeded")
+	}
+	exec("fsys testfs snapkeep -h 0 -w 0")
+	if got := exec("fsys testfs snapclean -n 0"); !strings.Contains(got, "/snapshot/s3") {
+		time.Sleep(time.Second)
+		if got := exec("fsys testfs snapclean -n 0"); got != "\t/snapshot/s3\n" {
+			t.Errorf("snapclean -n 0: got %q", got)
+		}
+	}
+}
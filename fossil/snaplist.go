@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+)
+
+/*
+ * Listing snapshots with the space they hold. A block is alive
+ * in the epochs from that of its label up to, but not including,
+ * its close epoch, or for good if it has not been closed. The
+ * trees holding blocks are the active tree, the snapshots not
+ * yet archived, at the epochs they were taken, and the clones,
+ * at their floors. A closed block alive in the epoch of one of
+ * them only is unique to it: removing that tree would free it.
+ */
+
+// A snapInfo describes a snapshot.
+type snapInfo struct {
+	path    string
+	mtime   uint32
+	epoch   uint32       /* zero once archived */
+	archive bool         /* an archival snapshot */
+	score   *venti.Score /* of the archive's root, once archived */
+	unique  int64        /* bytes held by no other tree */
+}
+
+func (si *snapInfo) String() string {
+	mtime := time.Unix(int64(si.mtime), 0).Format("2006/01/02 15:04:05")
+	if si.score != nil {
+		return fmt.Sprintf("%s %s archived %v", mtime, si.path, si.score)
+	}
+	s := fmt.Sprintf("%s %s epoch %d unique %s", mtime, si.path, si.epoch, fmtComma(si.unique))
+	if si.archive {
+		s += " archive pending"
+	}
+	return s
+}
+
+// snapList describes the snapshots in /snapshot and /archive,
+// oldest first. Assumes hold elk.
+func (fs *Fs) snapList() ([]*snapInfo, error) {
+	list, err := fs.snapInfos()
+	if err != nil {
+		return nil, err
+	}
+	holders := make(map[uint32]int)
+	for _, si := range list {
+		if si.epoch != 0 {
+			holders[si.epoch]++
+		}
+	}
+	for _, floor := range fs.cloneFloors() {
+		holders[floor]++
+	}
+
+	unique, err := fs.uniqueSpace(holders)
+	if err != nil {
+		return nil, err
+	}
+	var roots map[string]venti.Score
+	for _, si := range list {
+		if si.epoch != 0 {
+			si.unique = unique[si.epoch]
+			continue
+		}
+		if roots == nil {
+			if roots, err = fs.archiveRoots(); err != nil {
+				return nil, err
+			}
+		}
+		if score, ok := roots[si.path]; ok {
+			si.score = &score
+		}
+	}
+	return list, nil
+}
+
+// snapInfos is snapList without the unique space and the
+// scores of the archives.
+func (fs *Fs) snapInfos() ([]*snapInfo, error) {
+	var list []*snapInfo
+	for _, s := range fs.snapshots() {
+		f, err := fs.openFile(s.path)
+		if err != nil {
+			return nil, err
+		}
+		e, _, err := f.getSources()
+		f.decRef()
+		if err != nil {
+			return nil, err
+		}
+		si := &snapInfo{path: s.path, mtime: s.mtime, epoch: e.snap, archive: e.archive}
+		if e.flags&venti.EntryLocal == 0 {
+			si.archive = true
+		}
+		list = append(list, si)
+	}
+	return list, nil
+}
+
+/*
+ * The entry of an archived snapshot points at the copy of its
+ * tree in venti, not at the root block of the archive, which is
+ * what openArchive and vac take. The archive chain from
+ * super.last has that, named by the snapshot it was made from.
+ * The archiver clears EntryLocal before it writes the root, so
+ * for a moment an archived snapshot may be missing from it.
+ */
+
+// archiveRoots maps the paths of the archival snapshots in the
+// archive chain to the root scores of their archives. Assumes
+// hold elk.
+func (fs *Fs) archiveRoots() (map[string]venti.Score, error) {
+	last, err := fs.lastArchive()
+	if err != nil {
+		return nil, err
+	}
+	archives, err := vac.History(fs.z, &last, 0)
+	if err != nil {
+		return nil, err
+	}
+	roots := make(map[string]venti.Score)
+	for _, a := range archives {
+		if _, ok := roots[a.Name]; !ok {
+			roots[a.Name] = a.Score
+		}
+	}
+	return roots, nil
+}
+
+// uniqueSpace returns the bytes unique to each epoch among
+// holders, which counts the trees holding blocks at each epoch
+// besides the active tree. Assumes hold elk.
+func (fs *Fs) uniqueSpace(holders map[uint32]int) (map[uint32]int64, error) {
+	var epochs []uint32
+	for epoch := range holders {
+		epochs = append(epochs, epoch)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+
+	unique := make(map[uint32]int64)
+	err := fs.cache.scanLabels(fs.elo, func(addr uint32, l *Label) {
+		if l.state&BsClosed == 0 {
+			/* in the active tree */
+			return
+		}
+		i := sort.Search(len(epochs), func(i int) bool { return epochs[i] >= l.epoch })
+		if i == len(epochs) || epochs[i] >= l.epochClose {
+			return
+		}
+		if i+1 < len(epochs) && epochs[i+1] < l.epochClose {
+			return
+		}
+		if holders[epochs[i]] == 1 {
+			unique[epochs[i]] += int64(fs.blockSize)
+		}
+	})
+	return unique, err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func TestSnapList(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	list := func() []*snapInfo {
+		fs.metaFlush()
+		fs.cache.flushUnlinks()
+		fs.elk.RLock()
+		defer fs.elk.RUnlock()
+		l, err := fs.snapList()
+		if err != nil {
+			t.Fatalf("snap list: %v", err)
+		}
+		return l
+	}
+
+	// five blocks of data only in s1, five only in s2
+	testExec(t, "fsys testfs create /active/x adm adm 664",
+		"fsys testfs create /active/y adm adm 664")
+	testWrite(t, "active", "x", 0, testFill("a", 5)...)
+	testWrite(t, "active", "y", 0, testFill("y", 5)...)
+	if err := fs.snapshot("", "/snapshot/s1", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	testWrite(t, "active", "x", 0, testFill("b", 5)...)
+	if err := fs.snapshot("", "/snapshot/s2", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	testExec(t, "fsys testfs remove /active/x")
+
+	l := list()
+	if len(l) != 2 || l[0].path != "/snapshot/s1" || l[1].path != "/snapshot/s2" {
+		t.Fatalf("snap list: got %v", l)
+	}
+	for _, si := range l {
+		if si.epoch == 0 || si.archive || si.score != nil {
+			t.Errorf("%s: got %v", si.path, si)
+		}
+		// the five data blocks, and the pointer, dir and meta
+		// blocks from x up to the root that were copied when x
+		// changed: 12 to 14 blocks
+		if si.unique < 5*int64(fs.blockSize) || si.unique > 15*int64(fs.blockSize) {
+			t.Errorf("%s: unique %d bytes", si.path, si.unique)
+		}
+	}
+	if l[0].epoch >= l[1].epoch {
+		t.Errorf("epochs out of order: %d, %d", l[0].epoch, l[1].epoch)
+	}
+
+	// y, unchanged since s1, is in both snapshots
+	testExec(t, "fsys testfs remove /active/y")
+	if l2 := list(); l2[0].unique != l[0].unique || l2[1].unique > l[1].unique+int64(fs.blockSize) {
+		t.Errorf("after removing y: unique %d, %d bytes, was %d, %d", l2[0].unique, l2[1].unique, l[0].unique, l[1].unique)
+	}
+
+	// a clone shares the blocks of its snapshot
+	if err := fs.clone("/snapshot/s2", "c", "adm"); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if l := list(); l[1].unique != 0 {
+		t.Errorf("s2 with a clone: unique %d bytes", l[1].unique)
+	}
+
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	l = list()
+	if len(l) != 3 || !strings.HasPrefix(l[2].path, "/archive/") || !l[2].archive || l[2].score == nil {
+		t.Fatalf("snap list after archive: got %v", l)
+	}
+
+	// the score is that of the archive's root
+	fs.elk.RLock()
+	f, err := fs.openArchive(l[2].score)
+	if err == nil {
+		var ff *File
+		if ff, err = f.walk("active"); err == nil {
+			ff.decRef()
+		}
+		f.decRef()
+	}
+	fs.elk.RUnlock()
+	if err != nil {
+		t.Errorf("open archive %v: %v", l[2].score, err)
+	}
+
+	cons, out := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, "fsys testfs snaplist"); err != nil {
+		t.Fatalf("snaplist: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("snaplist: got %q", out.String())
+	}
+	if want := fmt.Sprintf(" /snapshot/s1 epoch %d unique %s", l[0].epoch, fmtComma(l[0].unique)); !strings.HasSuffix(lines[0], want) {
+		t.Errorf("snaplist: got %q, want suffix %q", lines[0], want)
+	}
+	if want := fmt.Sprintf(" %s archived %v", l[2].path, l[2].score); !strings.HasSuffix(lines[2], want) {
+		t.Errorf("snaplist: got %q, want suffix %q", lines[2], want)
+	}
+}
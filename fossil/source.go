@@ -38,6 +38,11 @@ type Source struct {
 	epb        int         /* immutable: entries per block in parent */
 	tag        uint32      /* immutable: tag of parent */
 	offset     uint32      /* immutable: entry offset in parent */
+	// for sources in a clone, the epoch of the snapshot it was
+	// made from: blocks of that epoch or older are shared with
+	// the snapshot, and perhaps the active tree, so they are
+	// copied on write but never unlinked.
+	floor uint32
 }
 
 func (r *Source) isLocked() bool {
@@ -103,6 +108,11 @@ func (fs *Fs) allocSource(b *Block, p *Source, offset uint32, mode int, issnapsh
 		return nil, EBadEntry
 	}
 
+	floor := e.clone
+	if floor == 0 && p != nil {
+		floor = p.floor
+	}
+
 	epoch := b.l.epoch
 	if mode == OReadWrite {
 		if e.snap != 0 {
@@ -134,6 +144,7 @@ func (fs *Fs) allocSource(b *Block, p *Source, offset uint32, mode int, issnapsh
 		offset:     offset,
 		epb:        epb,
 		tag:        b.l.tag,
+		floor:      floor,
 	}
 	if p != nil {
 		p.lk.Lock()
@@ -230,6 +241,7 @@ func (r *Source) create(dsize int, dir bool, offset uint32) (*Source, error) {
 				e.tag = 0
 				e.snap = 0
 				e.archive = false
+				e.clone = 0
 
 				e.pack(b.data, i)
 				b.dirty()
@@ -298,7 +310,7 @@ func (r *Source) kill(doremove bool) error {
 	e.pack(b.data, int(r.offset%uint32(r.epb)))
 	b.dirty()
 	if addr != NilBlock {
-		b.removeLink(addr, typ, tag, true)
+		b.removeLink(addr, typ, tag, true, r.floor)
 	}
 	b.put()
 
@@ -366,7 +378,7 @@ func (r *Source) shrinkSize(e *Entry, size uint64) error {
 			copy(b.data[i*venti.ScoreSize:], zscore[:])
 			b.dirty()
 			if addr != NilBlock {
-				b.removeLink(addr, typ-1, e.tag, true)
+				b.removeLink(addr, typ-1, e.tag, true, r.floor)
 			}
 		}
 
@@ -502,7 +514,7 @@ func (r *Source) setEntry(e *Entry) error {
 	return nil
 }
 
-func (p *Block) walk(index, mode int, fs *Fs, e *Entry) (*Block, error) {
+func (p *Block) walk(index, mode int, fs *Fs, e *Entry, floor uint32) (*Block, error) {
 	var b *Block
 	var typ BlockType
 	var err error
@@ -547,7 +559,8 @@ func (p *Block) walk(index, mode int, fs *Fs, e *Entry) (*Block, error) {
 	}
 
 	addr := b.addr
-	b, err = b.copy(e.tag, fs.ehi, fs.elo)
+	shared := b.l.epoch <= floor
+	b, err = b.copy(e.tag, fs.ehi, fs.elo, shared)
 	if err != nil {
 		return nil, err
 	}
@@ -568,8 +581,8 @@ func (p *Block) walk(index, mode int, fs *Fs, e *Entry) (*Block, error) {
 
 	p.dirty()
 
-	if addr != NilBlock {
-		p.removeLink(addr, typ, e.tag, false)
+	if addr != NilBlock && !shared {
+		p.removeLink(addr, typ, e.tag, false, 0)
 	}
 
 	return b, nil
@@ -712,7 +725,7 @@ func (r *Source) shrinkDepth(p *Block, e *Entry, depth int) error {
 
 	/* (iii) */
 	if rb.addr != NilBlock {
-		p.removeLink(rb.addr, rb.l.typ, rb.l.tag, true)
+		p.removeLink(rb.addr, rb.l.typ, rb.l.tag, true, r.floor)
 	}
 
 	rb.put()
@@ -790,7 +803,7 @@ func (r *Source) _block(bn uint32, mode, early int, tag uint32) (*Block, error)
 	index[e.depth] = int(r.offset % uint32(r.epb))
 
 	for i := int(e.depth); i >= early; i-- {
-		bb, err := b.walk(index[i], m, r.fs, e)
+		bb, err := b.walk(index[i], m, r.fs, e, r.floor)
 		b.put()
 		if err != nil {
 			return nil, fmt.Errorf("walk: %v", err)
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+ * Where the disk went. As in snaplist, a closed block is alive
+ * in a range of epochs; here the blocks are totalled by range,
+ * with the snapshots and clones taken in it, which are what keep
+ * it from being freed. Blocks not closed are the active tree.
+ *
+ * Raising the low epoch to e frees the closed blocks whose close
+ * epoch is e or older: that is what dropping the snapshots older
+ * than e comes to, unless a clone, or an archival snapshot not
+ * yet in venti, keeps the low epoch down.
+ */
+
+// A spaceRange is the space held by the closed blocks alive
+// from epoch up to, but not including, epochClose.
+type spaceRange struct {
+	epoch      uint32
+	epochClose uint32
+	size       int64
+	holders    []string /* snapshots and clones alive in the range */
+}
+
+func (r *spaceRange) String() string {
+	holders := "(none)"
+	if len(r.holders) > 0 {
+		holders = strings.Join(r.holders, " ")
+	}
+	return fmt.Sprintf("epochs %d-%d: %s %s", r.epoch, r.epochClose-1, fmtComma(r.size), holders)
+}
+
+// A spaceUsage is the space in use, by the epochs it is alive in.
+type spaceUsage struct {
+	active int64 /* blocks not closed */
+	ranges []*spaceRange
+}
+
+// spaceUsage scans the labels of the blocks in use, totalling
+// them by the range of epochs they are alive in, oldest first.
+// Assumes hold elk.
+func (fs *Fs) spaceUsage() (*spaceUsage, error) {
+	infos, err := fs.snapInfos()
+	if err != nil {
+		return nil, err
+	}
+	type holder struct {
+		epoch uint32
+		path  string
+	}
+	var holders []holder
+	for _, si := range infos {
+		if si.epoch != 0 {
+			holders = append(holders, holder{si.epoch, si.path})
+		}
+	}
+	for path, floor := range fs.cloneFloors() {
+		holders = append(holders, holder{floor, path})
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		if holders[i].epoch != holders[j].epoch {
+			return holders[i].epoch < holders[j].epoch
+		}
+		return holders[i].path < holders[j].path
+	})
+
+	u := new(spaceUsage)
+	ranges := make(map[[2]uint32]*spaceRange)
+	err = fs.cache.scanLabels(fs.elo, func(addr uint32, l *Label) {
+		if l.state&BsClosed == 0 {
+			u.active += int64(fs.blockSize)
+			return
+		}
+		k := [2]uint32{l.epoch, l.epochClose}
+		r := ranges[k]
+		if r == nil {
+			r = &spaceRange{epoch: l.epoch, epochClose: l.epochClose}
+			ranges[k] = r
+			u.ranges = append(u.ranges, r)
+		}
+		r.size += int64(fs.blockSize)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(u.ranges, func(i, j int) bool {
+		ri, rj := u.ranges[i], u.ranges[j]
+		if ri.epoch != rj.epoch {
+			return ri.epoch < rj.epoch
+		}
+		return ri.epochClose < rj.epochClose
+	})
+	for _, r := range u.ranges {
+		for _, h := range holders {
+			if r.epoch <= h.epoch && h.epoch < r.epochClose {
+				r.holders = append(r.holders, h.path)
+			}
+		}
+	}
+	return u, nil
+}
+
+// reclaim returns the space dropping the snapshots older than
+// epoch would free, with the low epoch that would leave. If that
+// is below epoch, held names the clone or archival snapshot
+// keeping it there. Assumes hold elk.
+func (fs *Fs) reclaim(u *spaceUsage, epoch uint32) (size int64, low uint32, held string, err error) {
+	low = epoch
+	if low > fs.ehi {
+		low = fs.ehi
+	}
+	infos, err := fs.snapInfos()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	for _, si := range infos {
+		if si.archive && si.epoch != 0 && si.epoch < low {
+			low, held = si.epoch, si.path
+		}
+	}
+	for path, floor := range fs.cloneFloors() {
+		if floor < low {
+			low, held = floor, path
+		}
+	}
+
+	for _, r := range u.ranges {
+		if r.epochClose <= low {
+			size += r.size
+		}
+	}
+	return size, low, held, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func TestSnapSpace(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	defer srv.Close()
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	usage := func() *spaceUsage {
+		fs.metaFlush()
+		fs.cache.flushUnlinks()
+		fs.elk.RLock()
+		defer fs.elk.RUnlock()
+		u, err := fs.spaceUsage()
+		if err != nil {
+			t.Fatalf("space usage: %v", err)
+		}
+		return u
+	}
+	reclaim := func(u *spaceUsage, epoch uint32) (int64, uint32, string) {
+		fs.elk.RLock()
+		defer fs.elk.RUnlock()
+		size, low, held, err := fs.reclaim(u, epoch)
+		if err != nil {
+			t.Fatalf("reclaim: %v", err)
+		}
+		return size, low, held
+	}
+	held := func(u *spaceUsage, path string) int64 {
+		var n int64
+		for _, r := range u.ranges {
+			for _, h := range r.holders {
+				if h == path {
+					n += r.size
+				}
+			}
+		}
+		return n
+	}
+
+	testExec(t, "fsys testfs create /active/x adm adm 664")
+	testWrite(t, "active", "x", 0, testFill("a", 5)...)
+	if err := fs.snapshot("", "/snapshot/s1", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	testWrite(t, "active", "x", 0, testFill("b", 5)...)
+	if err := fs.snapshot("", "/snapshot/s2", false); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	testExec(t, "fsys testfs remove /active/x")
+
+	u := usage()
+	if u.active == 0 {
+		t.Errorf("no active space")
+	}
+	for _, s := range []string{"/snapshot/s1", "/snapshot/s2"} {
+		if n := held(u, s); n < 5*int64(fs.blockSize) {
+			t.Errorf("%s holds %d bytes", s, n)
+		}
+	}
+
+	fs.elk.RLock()
+	infos, err := fs.snapInfos()
+	fs.elk.RUnlock()
+	if err != nil || len(infos) != 2 {
+		t.Fatalf("snap infos: %v, %v", infos, err)
+	}
+	e1, e2 := infos[0].epoch, infos[1].epoch
+
+	// dropping s1 frees its data, dropping s2 as well frees more
+	n1, low, _ := reclaim(u, e1+1)
+	if low != e1+1 || n1 < 5*int64(fs.blockSize) {
+		t.Errorf("dropping s1: %d bytes, low epoch %d", n1, low)
+	}
+	n2, _, _ := reclaim(u, e2+1)
+	if n2 < n1+5*int64(fs.blockSize) {
+		t.Errorf("dropping s1 and s2: %d bytes, s1 alone %d", n2, n1)
+	}
+
+	// a clone of s1 keeps the low epoch at its floor
+	if err := fs.clone("/snapshot/s1", "c", "adm"); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	u = usage()
+	n, low, by := reclaim(u, e2+1)
+	if by != "/clone/c" || low > e1 || n >= n1 {
+		t.Errorf("with a clone: %d bytes, low epoch %d held by %q", n, low, by)
+	}
+
+	cons, out := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, fmt.Sprintf("fsys testfs snapspace %d", e2+1)); err != nil {
+		t.Fatalf("snapspace: %v", err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"\tactive: ",
+		fmt.Sprintf("\tdropping snapshots before epoch %d frees %s\n", e2+1, fmtComma(n)),
+		fmt.Sprintf("\t/clone/c keeps the low epoch at %d\n", low),
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("snapspace: got %q, want %q", got, want)
+		}
+	}
+	if !strings.Contains(got, " /snapshot/s1") {
+		t.Errorf("snapspace: no range held by s1 in %q", got)
+	}
+	if err := console.Exec(cons, "fsys testfs snapspace x"); err == nil {
+		t.Errorf("snapspace x succeeded")
+	}
+
+	testExec(t, "fsys testfs remove /clone/c")
+}
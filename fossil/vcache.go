@@ -0,0 +1,191 @@
+/*
+ * On-disk cache of blocks read from venti, kept in the PartVcache
+ * partition when the file system was formatted with -c.  Archived
+ * blocks read once stay on disk across restarts, so browsing old
+ * snapshots does not go back to the network.
+ *
+ * The partition starts with an index, one entry per slot, followed
+ * by the slots, one block each.  A venti block lives in the slot
+ * chosen by its score, replacing whatever was there.  Slots are
+ * written before their index entries, and blocks are checked
+ * against their scores when read back, so a crash part way through
+ * costs no more than a miss.
+ */
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/floren/fs/internal/pack"
+	"github.com/floren/fs/venti"
+)
+
+const VcacheEntrySize = 24
+
+type VcacheEntry struct {
+	score venti.Score
+	typ   uint8
+	size  uint16
+}
+
+func (e *VcacheEntry) pack(p []byte) {
+	copy(p, e.score[:])
+	p[venti.ScoreSize] = e.typ
+	p[venti.ScoreSize+1] = 0
+	pack.PutUint16(p[venti.ScoreSize+2:], e.size)
+}
+
+func unpackVcacheEntry(p []byte) *VcacheEntry {
+	e := new(VcacheEntry)
+	copy(e.score[:], p)
+	e.typ = p[venti.ScoreSize]
+	e.size = pack.GetUint16(p[venti.ScoreSize+2:])
+	return e
+}
+
+type Vcache struct {
+	lk     sync.Mutex // serializes updates of index blocks
+	nindex uint32     // index blocks
+	nslot  uint32     // slots, after the index
+
+	hits   uint64
+	misses uint64
+}
+
+/*
+ * Size the index and the slots to fill the n blocks
+ * of the partition, as partition does for the labels.
+ */
+func vcacheLayout(n uint32, bsize int) (nindex, nslot uint32) {
+	epb := uint32(bsize / VcacheEntrySize)
+	nslot = uint32(uint64(epb) * uint64(n) / uint64(epb+1))
+	nindex = (nslot + epb - 1) / epb
+	return nindex, nslot
+}
+
+func (d *Disk) vcacheInit() {
+	if d.h.vcache == 0 {
+		return
+	}
+	nindex, nslot := vcacheLayout(d.size(PartVcache), d.blockSize())
+	if nslot == 0 {
+		return
+	}
+	d.vc = &Vcache{nindex: nindex, nslot: nslot}
+}
+
+func (d *Disk) vcacheSlot(score *venti.Score) uint32 {
+	return pack.GetUint32(score[:]) % d.vc.nslot
+}
+
+/*
+ * Read the block with the given score and type from the venti
+ * cache into p, reporting whether it was there.
+ */
+func (d *Disk) vcacheRead(score *venti.Score, typ venti.BlockType, p []byte) (int, bool) {
+	if d.vc == nil {
+		return 0, false
+	}
+
+	bsize := d.blockSize()
+	epb := uint32(bsize / VcacheEntrySize)
+	slot := d.vcacheSlot(score)
+	buf := make([]byte, bsize)
+
+	if err := d.readRaw(PartVcache, slot/epb, buf); err != nil {
+		logf("vcache: read index %d: %v\n", slot/epb, err)
+		atomic.AddUint64(&d.vc.misses, 1)
+		return 0, false
+	}
+	e := unpackVcacheEntry(buf[(slot%epb)*VcacheEntrySize:])
+	if e.score != *score || venti.BlockType(e.typ) != typ || int(e.size) > len(p) || int(e.size) > bsize {
+		atomic.AddUint64(&d.vc.misses, 1)
+		return 0, false
+	}
+
+	if err := d.readRaw(PartVcache, d.vc.nindex+slot, buf); err != nil {
+		logf("vcache: read slot %d: %v\n", slot, err)
+		atomic.AddUint64(&d.vc.misses, 1)
+		return 0, false
+	}
+	n := int(e.size)
+	if !score.Check(buf[:n]) {
+		/* torn write, or a damaged disk */
+		atomic.AddUint64(&d.vc.misses, 1)
+		return 0, false
+	}
+	copy(p, buf[:n])
+	atomic.AddUint64(&d.vc.hits, 1)
+	return n, true
+}
+
+/*
+ * Save the block p, just read from venti, in the venti cache.
+ * Failures are logged but otherwise ignored; the block can
+ * always be read from venti again.
+ */
+func (d *Disk) vcacheWrite(score *venti.Score, typ venti.BlockType, p []byte) {
+	if d.vc == nil || len(p) > d.blockSize() {
+		return
+	}
+
+	bsize := d.blockSize()
+	epb := uint32(bsize / VcacheEntrySize)
+	slot := d.vcacheSlot(score)
+	buf := make([]byte, bsize)
+
+	d.vc.lk.Lock()
+	defer d.vc.lk.Unlock()
+
+	/* invalidate the slot while its contents change */
+	if err := d.readRaw(PartVcache, slot/epb, buf); err != nil {
+		logf("vcache: read index %d: %v\n", slot/epb, err)
+		return
+	}
+	ep := buf[(slot%epb)*VcacheEntrySize:]
+	if unpackVcacheEntry(ep).score == *score {
+		return
+	}
+	memset(ep[:VcacheEntrySize], 0)
+	if err := d.writeRaw(PartVcache, slot/epb, buf); err != nil {
+		logf("vcache: write index %d: %v\n", slot/epb, err)
+		return
+	}
+
+	data := make([]byte, bsize)
+	copy(data, p)
+	if err := d.writeRaw(PartVcache, d.vc.nindex+slot, data); err != nil {
+		logf("vcache: write slot %d: %v\n", slot, err)
+		return
+	}
+
+	e := VcacheEntry{score: *score, typ: uint8(typ), size: uint16(len(p))}
+	e.pack(ep)
+	if err := d.writeRaw(PartVcache, slot/epb, buf); err != nil {
+		logf("vcache: write index %d: %v\n", slot/epb, err)
+	}
+}
+
+// vcacheStats returns the size of the venti cache in blocks,
+// and its hits and misses since the disk was opened.
+func (d *Disk) vcacheStats() (nslot uint32, hits, misses uint64) {
+	if d.vc == nil {
+		return 0, 0, 0
+	}
+	return d.vc.nslot, atomic.LoadUint64(&d.vc.hits), atomic.LoadUint64(&d.vc.misses)
+}
+
+/*
+ * Clear the index of a new venti cache.
+ */
+func (d *Disk) vcacheFormat(buf []byte) {
+	if d.vc == nil {
+		return
+	}
+	memset(buf, 0)
+	for bn := uint32(0); bn < d.vc.nindex; bn++ {
+		d.blockWrite(PartVcache, bn, buf)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+func testFormatVcache(t *testing.T) string {
+	path, err := testTempPartition()
+	if err != nil {
+		t.Fatalf("create partition: %v", err)
+	}
+	if err := formatDisk(path, 8*1024, 1024*1024, "vfs", nil, ""); err != nil {
+		os.Remove(path)
+		t.Fatalf("format: %v", err)
+	}
+	return path
+}
+
+func TestVcache(t *testing.T) {
+	path := testFormatVcache(t)
+	defer os.Remove(path)
+
+	fd, err := syscall.Open(path, syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	disk, err := allocDisk(fd)
+	if err != nil {
+		syscall.Close(fd)
+		t.Fatalf("alloc disk: %v", err)
+	}
+	defer disk.free()
+
+	nslot, _, _ := disk.vcacheStats()
+	if nslot == 0 || nslot > 128 {
+		t.Fatalf("venti cache has %d slots, want at most 128", nslot)
+	}
+	if disk.h.end != disk.h.vcache {
+		t.Errorf("venti cache at %d, want %d after data", disk.h.vcache, disk.h.end)
+	}
+
+	data := []byte("cached block")
+	score := venti.Sha1(data)
+	buf := make([]byte, disk.blockSize())
+	if _, ok := disk.vcacheRead(score, venti.DataType, buf); ok {
+		t.Fatalf("read of empty venti cache succeeded")
+	}
+	disk.vcacheWrite(score, venti.DataType, data)
+	n, ok := disk.vcacheRead(score, venti.DataType, buf)
+	if !ok {
+		t.Fatalf("cached block not found")
+	}
+	if string(buf[:n]) != string(data) {
+		t.Errorf("cached block: got %q, want %q", buf[:n], data)
+	}
+	if _, ok := disk.vcacheRead(score, venti.DirType, buf); ok {
+		t.Errorf("cached block found with the wrong type")
+	}
+
+	// a damaged slot is a miss
+	memset(buf, 0xff)
+	if err := disk.writeRaw(PartVcache, disk.vc.nindex+disk.vcacheSlot(score), buf); err != nil {
+		t.Fatalf("write slot: %v", err)
+	}
+	if _, ok := disk.vcacheRead(score, venti.DataType, buf); ok {
+		t.Errorf("damaged block found in venti cache")
+	}
+
+	if _, hits, misses := disk.vcacheStats(); hits != 1 || misses != 3 {
+		t.Errorf("got %d hits, %d misses; want 1, 3", hits, misses)
+	}
+}
+
+func TestFsVcache(t *testing.T) {
+	srv, addr := testServeVenti(t, venti.NewMemStore(), "127.0.0.1:0")
+	fs, done := testOpenPath(t, testFormatVcache(t), addr)
+	defer done()
+
+	data := []byte("kept on disk")
+	score, err := fs.z.Write(venti.DataType, data)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("write: %v", err)
+	}
+	b, err := fs.cache.global(score, BtData, 0, OReadOnly)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("read venti block: %v", err)
+	}
+	b.put()
+
+	// after a restart, the block is still there with venti gone
+	srv.Close()
+	for _, cmd := range []string{
+		"fsys testfs close",
+		"fsys testfs open -AWP",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	fsys, err := getFsys("testfs")
+	if err != nil {
+		t.Fatalf("get fsys: %v", err)
+	}
+	fs = fsys.getFs()
+	fsys.put()
+
+	b, err = fs.cache.global(score, BtData, 0, OReadOnly)
+	if err != nil {
+		t.Fatalf("read cached block with venti down: %v", err)
+	}
+	if string(b.data[:len(data)]) != string(data) {
+		t.Errorf("read cached block: got %q, want %q", b.data[:len(data)], data)
+	}
+	b.put()
+
+	if _, err := fs.cache.global(venti.Sha1([]byte("uncached")), BtData, 0, OReadOnly); !errors.Is(err, EVentiDown) {
+		t.Errorf("read uncached block with venti down: got %v, want %v", err, EVentiDown)
+	}
+
+	cons, out := testCons()
+	defer cons.Close()
+	if err := console.Exec(cons, "fsys testfs df"); err != nil {
+		t.Fatalf("df: %v", err)
+	}
+	if !strings.Contains(out.String(), "venti cache:") || !strings.Contains(out.String(), "1 hits") {
+		t.Errorf("df: venti cache not reported: %q", out.String())
+	}
+}
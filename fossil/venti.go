@@ -0,0 +1,328 @@
+/*
+ * Connection to the Venti server.  If the server goes away, the
+ * connection is redialed in the background, with backoff, until it
+ * comes back.  Meanwhile calls fail with EVentiDown, so the file
+ * system keeps serving blocks held on local disk and the archiver
+ * waits to continue.
+ *
+ * Instead of a server, blocks may be kept in a local directory,
+ * named by an address of the form dir:/path.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+const (
+	ventiTimeout     = 2 * time.Minute // limit on a single venti call
+	ventiRedialDelay = 1 * time.Second // first wait between redials
+	ventiRedialMax   = 1 * time.Minute // longest wait between redials
+)
+
+var _ venti.Store = (*Venti)(nil)
+
+// A Venti is a connection to a venti server which survives
+// the server going away.
+type Venti struct {
+	lk        sync.Mutex
+	host      string
+	z         *venti.Session // nil while the server is down
+	err       error          // why the server is down
+	up        chan struct{}  // closed when z is connected
+	quit      chan struct{}  // closed by close
+	redialing bool
+	closed    bool
+}
+
+// openStore opens the venti store at addr: a local directory if
+// addr has the form dir:/path, otherwise a server as for dialVenti.
+func openStore(addr string) (venti.Store, error) {
+	if dir, ok := venti.StoreDir(addr); ok {
+		s, err := venti.OpenDirStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return dialVenti(addr)
+}
+
+func closeStore(z venti.Store) {
+	switch z := z.(type) {
+	case *Venti:
+		z.close()
+	case io.Closer:
+		z.Close()
+	}
+}
+
+// dialVenti connects to the venti server at host. If the server
+// cannot be reached, dialVenti returns the error along with a Venti
+// which keeps trying to connect in the background.
+func dialVenti(host string) (*Venti, error) {
+	v := &Venti{
+		host: host,
+		up:   make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+	z, err := venti.Dial(host)
+	if err != nil {
+		v.err = err
+		v.redialing = true
+		go v.redialThread()
+		return v, err
+	}
+	v.z = z
+	close(v.up)
+	return v, nil
+}
+
+// session returns the current connection to the server.
+func (v *Venti) session() (*venti.Session, error) {
+	if v == nil {
+		return nil, errors.New("no venti session")
+	}
+
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if v.closed {
+		return nil, errors.New("venti session is closed")
+	}
+	if v.z == nil {
+		return nil, fmt.Errorf("%w: %v", EVentiDown, v.err)
+	}
+	return v.z, nil
+}
+
+// check examines the error from a call on z. If the connection has
+// failed or the call timed out, z is dropped and redialing begins.
+func (v *Venti) check(z *venti.Session, err error) error {
+	if err == nil {
+		return nil
+	}
+	if z.Err() == nil && !errors.Is(err, context.DeadlineExceeded) {
+		/* the server is answering; e.g. a missing block */
+		return err
+	}
+
+	v.lk.Lock()
+	if v.z == z {
+		logf("venti %s: connection lost: %v\n", v.host, err)
+		v.z = nil
+		v.err = err
+		v.up = make(chan struct{})
+		go z.Close()
+		if !v.redialing && !v.closed {
+			v.redialing = true
+			go v.redialThread()
+		}
+	}
+	v.lk.Unlock()
+
+	return fmt.Errorf("%w: %v", EVentiDown, err)
+}
+
+func (v *Venti) redialThread() {
+	delay := ventiRedialDelay
+	for {
+		select {
+		case <-v.quit:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > ventiRedialMax {
+			delay = ventiRedialMax
+		}
+
+		v.lk.Lock()
+		host := v.host
+		v.lk.Unlock()
+
+		z, err := venti.Dial(host)
+
+		v.lk.Lock()
+		if v.closed || v.z != nil {
+			/* closed, or redialed from the console meanwhile */
+			v.redialing = false
+			v.lk.Unlock()
+			if z != nil {
+				z.Close()
+			}
+			return
+		}
+		if err != nil {
+			dprintf("venti %s: redial: %v\n", host, err)
+			v.err = err
+			v.lk.Unlock()
+			continue
+		}
+		v.z = z
+		v.err = nil
+		v.redialing = false
+		close(v.up)
+		v.lk.Unlock()
+
+		logf("venti %s: reconnected\n", host)
+		return
+	}
+}
+
+// redial drops the current connection and dials host, or the
+// previous host if host is empty.
+func (v *Venti) redial(host string) error {
+	v.lk.Lock()
+	if host != "" {
+		v.host = host
+	}
+	host = v.host
+	if v.z != nil {
+		v.z.Close()
+		v.z = nil
+		v.up = make(chan struct{})
+	}
+	v.lk.Unlock()
+
+	z, err := venti.Dial(host)
+
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if v.closed {
+		if z != nil {
+			z.Close()
+		}
+		return errors.New("venti session is closed")
+	}
+	if err != nil {
+		v.err = err
+		if !v.redialing {
+			v.redialing = true
+			go v.redialThread()
+		}
+		return err
+	}
+	if v.z != nil {
+		/* the redial thread won */
+		z.Close()
+		return nil
+	}
+	v.z = z
+	v.err = nil
+	close(v.up)
+	return nil
+}
+
+// ready returns a channel which is closed when the server
+// is reachable.
+func (v *Venti) ready() <-chan struct{} {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	return v.up
+}
+
+func (v *Venti) close() {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if v.closed {
+		return
+	}
+	v.closed = true
+	close(v.quit)
+	if v.z != nil {
+		v.z.Close()
+		v.z = nil
+	}
+}
+
+func (v *Venti) Read(score *venti.Score, typ venti.BlockType, p []byte) (int, error) {
+	// as with every venti.Store, the zero score is the empty block
+	if score.IsZero() {
+		return 0, nil
+	}
+	z, err := v.session()
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ventiTimeout)
+	defer cancel()
+	n, err := z.ReadContext(ctx, score, typ, p)
+	return n, v.check(z, err)
+}
+
+func (v *Venti) Write(typ venti.BlockType, p []byte) (*venti.Score, error) {
+	z, err := v.session()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ventiTimeout)
+	defer cancel()
+	score, err := z.WriteContext(ctx, typ, p)
+	return score, v.check(z, err)
+}
+
+// A ventiWrite is a block write started by writeAsync.
+type ventiWrite struct {
+	v      *Venti
+	z      *venti.Session
+	w      *venti.PendingWrite
+	cancel context.CancelFunc
+	score  *venti.Score
+	err    error
+}
+
+// writeAsync starts writing p to z. Only writes to a Venti
+// are pipelined; to other stores, the write is done at once.
+func writeAsync(z venti.Store, typ venti.BlockType, p []byte) *ventiWrite {
+	if v, ok := z.(*Venti); ok {
+		return v.writeAsync(typ, p)
+	}
+	score, err := z.Write(typ, p)
+	return &ventiWrite{score: score, err: err}
+}
+
+// writeAsync starts writing p without waiting for the server;
+// see venti.Session.WriteAsync.
+func (v *Venti) writeAsync(typ venti.BlockType, p []byte) *ventiWrite {
+	z, err := v.session()
+	if err != nil {
+		return &ventiWrite{err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ventiTimeout)
+	return &ventiWrite{
+		v:      v,
+		z:      z,
+		w:      z.WriteAsync(ctx, typ, p),
+		cancel: cancel,
+	}
+}
+
+func (w *ventiWrite) wait() (*venti.Score, error) {
+	if w.w == nil {
+		return w.score, w.err
+	}
+	score, err := w.w.Wait()
+	w.cancel()
+	return score, w.v.check(w.z, err)
+}
+
+func (v *Venti) Sync() error {
+	z, err := v.session()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ventiTimeout)
+	defer cancel()
+	return v.check(z, z.SyncContext(ctx))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/fossil/console"
+	"github.com/floren/fs/venti"
+)
+
+// testServeVenti serves store at addr
+// and returns the server and its address.
+func testServeVenti(t *testing.T, store venti.Store, addr string) (*venti.Server, string) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := venti.NewServer(store)
+	go srv.Serve(l)
+	return srv, l.Addr().String()
+}
+
+func testWaitVenti(t *testing.T, v *Venti) {
+	select {
+	case <-v.ready():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("venti did not reconnect")
+	}
+}
+
+func TestVentiReconnect(t *testing.T) {
+	srv, addr := testServeVenti(t, testVentiStore, "127.0.0.1:0")
+	v, err := dialVenti(addr)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("dial: %v", err)
+	}
+	defer v.close()
+
+	data := []byte("reconnect")
+	score, err := v.Write(venti.DataType, data)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	srv.Close()
+	buf := make([]byte, 100)
+	for i := 0; i < 2; i++ {
+		if _, err := v.Read(score, venti.DataType, buf); !errors.Is(err, EVentiDown) {
+			t.Errorf("read %d with venti down: got %v, want %v", i, err, EVentiDown)
+		}
+	}
+
+	srv, _ = testServeVenti(t, testVentiStore, addr)
+	defer srv.Close()
+	testWaitVenti(t, v)
+
+	n, err := v.Read(score, venti.DataType, buf)
+	if err != nil {
+		t.Fatalf("read after reconnect: %v", err)
+	}
+	if string(buf[:n]) != string(data) {
+		t.Errorf("read after reconnect: got %q, want %q", buf[:n], data)
+	}
+}
+
+func TestFsVentiDown(t *testing.T) {
+	srv, addr := testServeVenti(t, testVentiStore, "127.0.0.1:0")
+	fs, done := testOpenFresh(t, addr)
+	defer done()
+
+	data := []byte("only on venti")
+	score, err := fs.z.Write(venti.DataType, data)
+	if err != nil {
+		srv.Close()
+		t.Fatalf("write: %v", err)
+	}
+
+	srv.Close()
+
+	// local blocks are still served and written
+	for _, cmd := range []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/active",
+		"9p Twalk 0 1",
+		"9p Tcreate 1 ventidown 0644 2",
+		"9p Twrite 1 0 degraded",
+		"9p Tclunk 1",
+		"9p Twalk 0 1 ventidown",
+		"9p Topen 1 0",
+		"9p Tread 1 0 100",
+		"9p Tclunk 1",
+		"9p Tclunk 0",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%s with venti down: %v", cmd, err)
+		}
+	}
+
+	// blocks only on venti are not
+	if _, err := fs.cache.global(score, BtData, 0, OReadOnly); !errors.Is(err, EVentiDown) {
+		t.Errorf("read of venti block with venti down: got %v, want %v", err, EVentiDown)
+	}
+
+	// archival snapshots wait for venti to return
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot with venti down: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if super := testSuper(t, fs); super.current == NilBlock && super.next == NilBlock {
+		t.Errorf("archival snapshot completed with venti down")
+	}
+
+	srv, _ = testServeVenti(t, testVentiStore, addr)
+	defer srv.Close()
+	testWaitVenti(t, fs.z.(*Venti))
+
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.cache.global(score, BtData, 0, OReadOnly)
+	if err != nil {
+		t.Fatalf("read of venti block after reconnect: %v", err)
+	}
+	if string(b.data[:len(data)]) != string(data) {
+		t.Errorf("read of venti block after reconnect: got %q, want %q", b.data[:len(data)], data)
+	}
+	b.put()
+}
+
+func TestFsDirStore(t *testing.T) {
+	dir := t.TempDir()
+	fs, done := testOpenFresh(t, venti.DirPrefix+dir)
+	defer done()
+
+	for _, cmd := range []string{
+		"9p Tversion 8192 9P2000",
+		"9p Tattach 0 ~1 nobody testfs/active",
+		"9p Twalk 0 1",
+		"9p Tcreate 1 local 0644 2",
+		"9p Twrite 1 0 archived",
+		"9p Tclunk 1",
+		"9p Tclunk 0",
+	} {
+		if err := console.Exec(nil, cmd); err != nil {
+			t.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	if err := fs.snapshot("", "", true); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	if err := testWaitArch(fs, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := venti.OpenDirStore(dir)
+	if err != nil {
+		t.Fatalf("open dir store: %v", err)
+	}
+	last := testSuper(t, fs).last
+	buf := make([]byte, venti.RootSize)
+	if _, err := store.Read(&last, venti.RootType, buf); err != nil {
+		t.Fatalf("read archived root: %v", err)
+	}
+	if _, err := venti.UnpackRoot(buf); err != nil {
+		t.Errorf("unpack archived root: %v", err)
+	}
+}
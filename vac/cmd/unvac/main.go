@@ -0,0 +1,153 @@
+// Unvac extracts a vac archive from venti into a directory,
+// restoring the permissions and modification times of its files
+// and its symbolic links.
+//
+// The venti server is named by -h, by $venti, or is the local
+// host; a host of the form dir:/path names a directory of blocks
+// as served by venti -d.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-h host] [-v] vacfile [dir]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var (
+		hflag = flag.String("h", "", "Read from the venti server at `host`.")
+		vflag = flag.Bool("v", false, "Print the names of the files extracted.")
+	)
+	flag.Parse()
+	if flag.NArg() < 1 || flag.NArg() > 2 {
+		flag.Usage()
+	}
+	dst := "."
+	if flag.NArg() == 2 {
+		dst = flag.Arg(1)
+	}
+	log.SetFlags(0)
+	log.SetPrefix("unvac: ")
+
+	score, err := vac.ParseScore(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("bad archive: %v", err)
+	}
+	z, err := venti.OpenStore(*hflag)
+	if err != nil {
+		log.Fatalf("open venti: %v", err)
+	}
+	v, err := vac.Open(z, score)
+	if err != nil {
+		log.Fatalf("open archive: %v", err)
+	}
+
+	nerr, err := unvac(v, dst, *vflag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if nerr > 0 {
+		os.Exit(1)
+	}
+}
+
+// unvac extracts v into dst, logging the files it fails to
+// extract, and returns how many that was.
+func unvac(v *vac.FS, dst string, verbose bool) (int, error) {
+	/*
+	 * Directories are created writable and get their own
+	 * modes and times on the way back out, after their
+	 * contents have been written.
+	 */
+	type dirAttr struct {
+		name  string
+		mode  fs.FileMode
+		mtime time.Time
+	}
+	var dirs []dirAttr
+	nerr := 0
+	err := fs.WalkDir(v, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Print(err)
+			nerr++
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, filepath.FromSlash(name))
+		if verbose && name != "." {
+			fmt.Println(name)
+		}
+		if err := extract(v, name, out, fi); err != nil {
+			log.Print(err)
+			nerr++
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			dirs = append(dirs, dirAttr{out, fi.Mode().Perm(), fi.ModTime()})
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i].name, dirs[i].mode); err != nil {
+			log.Print(err)
+			nerr++
+		}
+		os.Chtimes(dirs[i].name, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nerr, err
+}
+
+// extract writes the file name in v to out.
+func extract(v *vac.FS, name, out string, fi fs.FileInfo) error {
+	mode := fi.Mode()
+	switch mode.Type() {
+	case fs.ModeDir:
+		return os.MkdirAll(out, 0700)
+	case fs.ModeSymlink:
+		target, err := fs.ReadFile(v, name)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), out)
+	}
+
+	f, err := v.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0200)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		w.Close()
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(out, mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(out, fi.ModTime(), fi.ModTime())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+)
+
+func TestUnvac(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	m := fstest.MapFS{
+		"hello":      {Data: []byte("hello, world\n"), Mode: 0644, ModTime: mtime},
+		"ro":         {Mode: fs.ModeDir | 0555, ModTime: mtime},
+		"ro/file":    {Data: []byte("read only\n"), Mode: 0444, ModTime: mtime},
+		"ro/sub":     {Mode: fs.ModeDir | 0500, ModTime: mtime},
+		"ro/sub/x":   {Data: []byte("x"), Mode: 0400, ModTime: mtime},
+		"ro/sub/dir": {Mode: fs.ModeDir | 0555, ModTime: mtime},
+	}
+	z := venti.NewMemStore()
+	w := vac.NewWriter(z)
+	w.Owner = func(fs.FileInfo) (string, string) { return "glenda", "sys" }
+	score, err := w.Write(m, ".", "test")
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	v, err := vac.Open(z, score)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	dst := t.TempDir()
+	t.Cleanup(func() {
+		filepath.WalkDir(dst, func(name string, d fs.DirEntry, err error) error {
+			if err == nil && d.IsDir() {
+				os.Chmod(name, 0755)
+			}
+			return nil
+		})
+	})
+	if nerr, err := unvac(v, dst, false); nerr != 0 || err != nil {
+		t.Fatalf("unvac: %d errors, %v", nerr, err)
+	}
+
+	for name, f := range m {
+		out := filepath.Join(dst, filepath.FromSlash(name))
+		fi, err := os.Stat(out)
+		if err != nil {
+			t.Errorf("stat %s: %v", name, err)
+			continue
+		}
+		if fi.Mode() != f.Mode {
+			t.Errorf("%s: mode %v, want %v", name, fi.Mode(), f.Mode)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, want %v", name, fi.ModTime(), mtime)
+		}
+		if f.Mode.IsDir() {
+			continue
+		}
+		if data, err := os.ReadFile(out); err != nil || string(data) != string(f.Data) {
+			t.Errorf("%s: got %q, %v, want %q", name, data, err, f.Data)
+		}
+	}
+}
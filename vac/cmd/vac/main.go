@@ -0,0 +1,117 @@
+// Vac archives a directory tree to venti and prints the score
+// of the archive, in the form vac:score.
+//
+// Given a previous archive of the same tree with -d, files whose
+// size, mode and modification time are unchanged are not read
+// again: their blocks are taken from the previous archive, which
+// the new one points back to.
+//
+// The venti server is named by -h, by $venti, or is the local
+// host; a host of the form dir:/path names a directory of blocks
+// as served by venti -d.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/floren/fs/vac"
+	"github.com/floren/fs/venti"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-b blocksize] [-d vacfile] [-h host] [-n name] [-v] dir\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var (
+		bflag = flag.Int("b", 8192, "Write blocks of `blocksize` bytes.")
+		dflag = flag.String("d", "", "Reuse the unchanged files of the previous archive `vac:score`.")
+		hflag = flag.String("h", "", "Write to the venti server at `host`.")
+		nflag = flag.String("n", "", "Name the archive `name`. (default the directory's name)")
+		vflag = flag.Bool("v", false, "Print the files skipped and a summary.")
+	)
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	root := flag.Arg(0)
+	log.SetFlags(0)
+	log.SetPrefix("vac: ")
+
+	z, err := venti.OpenStore(*hflag)
+	if err != nil {
+		log.Fatalf("open venti: %v", err)
+	}
+
+	w := vac.NewWriter(z)
+	w.BlockSize = *bflag
+	w.Owner = owner
+	w.Readlink = func(name string) (string, error) {
+		return os.Readlink(filepath.Join(root, filepath.FromSlash(name)))
+	}
+	w.Warn = func(name string, err error) {
+		if *vflag {
+			log.Printf("%s: %v", name, err)
+		}
+	}
+	if *dflag != "" {
+		score, err := vac.ParseScore(*dflag)
+		if err != nil {
+			log.Fatalf("bad previous archive: %v", err)
+		}
+		if w.Prev, err = vac.Open(z, score); err != nil {
+			log.Fatalf("open previous archive: %v", err)
+		}
+	}
+
+	name := *nflag
+	if name == "" {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		name = filepath.Base(abs)
+	}
+	score, err := w.Write(os.DirFS(root), ".", name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *vflag {
+		log.Printf("%d files, %d unchanged", w.Files, w.Reused)
+	}
+	fmt.Printf("%s%v\n", vac.Prefix, score)
+}
+
+var names = make(map[string]string)
+
+// owner returns the names of the owner and group of a file.
+func owner(fi fs.FileInfo) (uid, gid string) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "none", "none"
+	}
+	uid = strconv.Itoa(int(st.Uid))
+	if n, ok := names["u"+uid]; ok {
+		uid = n
+	} else if u, err := user.LookupId(uid); err == nil {
+		names["u"+uid] = u.Username
+		uid = u.Username
+	}
+	gid = strconv.Itoa(int(st.Gid))
+	if n, ok := names["g"+gid]; ok {
+		gid = n
+	} else if g, err := user.LookupGroupId(gid); err == nil {
+		names["g"+gid] = g.Name
+		gid = g.Name
+	}
+	return uid, gid
+}
@@ -0,0 +1,274 @@
+package vac
+
+import (
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/floren/fs/internal/pack"
+	"github.com/floren/fs/venti"
+)
+
+const (
+	metaMagic      = 0x5656fc7a
+	metaHeaderSize = 12
+	metaIndexSize  = 4
+	dirMagic       = 0x1c4d9072
+)
+
+// Mode bits of a DirEntry.
+const (
+	ModeOtherExec  = 1 << 0
+	ModeOtherWrite = 1 << 1
+	ModeOtherRead  = 1 << 2
+	ModeGroupExec  = 1 << 3
+	ModeGroupWrite = 1 << 4
+	ModeGroupRead  = 1 << 5
+	ModeOwnerExec  = 1 << 6
+	ModeOwnerWrite = 1 << 7
+	ModeOwnerRead  = 1 << 8
+	ModeSticky     = 1 << 9
+	ModeSetUid     = 1 << 10
+	ModeSetGid     = 1 << 11
+	ModeAppend     = 1 << 12 // append only file
+	ModeExclusive  = 1 << 13 // lock file - plan 9
+	ModeLink       = 1 << 14 // sym link
+	ModeDir        = 1 << 15
+	ModeHidden     = 1 << 16 // MS-DOS
+	ModeSystem     = 1 << 17 // MS-DOS
+	ModeArchive    = 1 << 18 // MS-DOS
+	ModeTemporary  = 1 << 19 // MS-DOS
+	ModeSnapshot   = 1 << 20 // read only snapshot
+)
+
+// optional directory entry fields
+const (
+	dePlan9 = 1 + iota // not valid in version >= 9
+	deNT               // not valid in version >= 9
+	deQidSpace
+	deGen // not valid in version >= 9
+)
+
+var errBadMeta = errors.New("corrupted meta data")
+
+// A DirEntry is the metadata of a file in a vac archive.
+type DirEntry struct {
+	Elem   string // path element
+	Entry  uint32 // entry in directory for data
+	Gen    uint32 // generation of data entry
+	MEntry uint32 // entry in directory for meta
+	MGen   uint32 // generation of meta entry
+	Size   uint64 // size of file
+	Qid    uint64 // unique file id
+
+	Uid    string // owner id
+	Gid    string // group id
+	Mid    string // last modified by
+	Mtime  uint32 // last modified time
+	Mcount uint32 // number of modifications: can wrap!
+	Ctime  uint32 // directory entry last changed
+	Atime  uint32 // last time accessed
+	Mode   uint32 // mode bits, as above
+
+	// sub space of qid
+	QidSpace  bool
+	QidOffset uint64 // qid offset
+	QidMax    uint64 // qid maximum
+}
+
+// IsDir reports whether d describes a directory.
+func (d *DirEntry) IsDir() bool {
+	return d.Mode&ModeDir != 0
+}
+
+// FileMode returns the mode bits of d as an fs.FileMode.
+func (d *DirEntry) FileMode() fs.FileMode {
+	m := fs.FileMode(d.Mode & 0777)
+	for _, b := range []struct {
+		vac  uint32
+		mode fs.FileMode
+	}{
+		{ModeDir, fs.ModeDir},
+		{ModeAppend, fs.ModeAppend},
+		{ModeExclusive, fs.ModeExclusive},
+		{ModeLink, fs.ModeSymlink},
+		{ModeTemporary, fs.ModeTemporary},
+		{ModeSetUid, fs.ModeSetuid},
+		{ModeSetGid, fs.ModeSetgid},
+		{ModeSticky, fs.ModeSticky},
+	} {
+		if d.Mode&b.vac != 0 {
+			m |= b.mode
+		}
+	}
+	return m
+}
+
+// fileInfo presents a DirEntry as an fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	d *DirEntry
+}
+
+func (fi fileInfo) Name() string               { return fi.d.Elem }
+func (fi fileInfo) Size() int64                { return int64(fi.d.Size) }
+func (fi fileInfo) Mode() fs.FileMode          { return fi.d.FileMode() }
+func (fi fileInfo) Type() fs.FileMode          { return fi.d.FileMode().Type() }
+func (fi fileInfo) ModTime() time.Time         { return time.Unix(int64(fi.d.Mtime), 0) }
+func (fi fileInfo) IsDir() bool                { return fi.d.IsDir() }
+func (fi fileInfo) Sys() interface{}           { return fi.d }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// unpackMetaBlock returns the directory entries in
+// the meta data block p.
+func unpackMetaBlock(p []byte) ([]*DirEntry, error) {
+	magic := pack.GetUint32(p)
+	if magic == 0 && pack.GetUint16(p[10:]) == 0 {
+		// an unused block
+		return nil, nil
+	}
+	if magic != metaMagic && magic != metaMagic-1 {
+		return nil, errBadMeta
+	}
+	size := int(pack.GetUint16(p[4:]))
+	maxindex := int(pack.GetUint16(p[8:]))
+	nindex := int(pack.GetUint16(p[10:]))
+	if size > len(p) || nindex > maxindex {
+		return nil, errBadMeta
+	}
+	omin := metaHeaderSize + maxindex*metaIndexSize
+	if len(p) < omin {
+		return nil, errBadMeta
+	}
+
+	var dirs []*DirEntry
+	for i := 0; i < nindex; i++ {
+		q := p[metaHeaderSize+i*metaIndexSize:]
+		eo := int(pack.GetUint16(q))
+		en := int(pack.GetUint16(q[2:]))
+		if eo < omin || eo+en > size || en < 8 {
+			return nil, errBadMeta
+		}
+		d, err := unpackDirEntry(p[eo : eo+en])
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, d)
+	}
+	return dirs, nil
+}
+
+func unpackDirEntry(p []byte) (*DirEntry, error) {
+	dir := new(DirEntry)
+
+	/* magic */
+	if len(p) < 4 || pack.GetUint32(p) != dirMagic {
+		return nil, errBadMeta
+	}
+	p = p[4:]
+
+	/* version */
+	if len(p) < 2 {
+		return nil, errBadMeta
+	}
+	version := int(pack.GetUint16(p))
+	if version < 7 || version > 9 {
+		return nil, errBadMeta
+	}
+	p = p[2:]
+
+	/* elem */
+	s, err := pack.UnpackString(&p)
+	if err != nil {
+		return nil, errBadMeta
+	}
+	dir.Elem = s
+
+	/* entry */
+	if len(p) < 4 {
+		return nil, errBadMeta
+	}
+	dir.Entry = pack.GetUint32(p)
+	p = p[4:]
+
+	if version < 9 {
+		dir.Gen = 0
+		dir.MEntry = dir.Entry + 1
+		dir.MGen = 0
+	} else {
+		if len(p) < 3*4 {
+			return nil, errBadMeta
+		}
+		dir.Gen = pack.GetUint32(p)
+		dir.MEntry = pack.GetUint32(p[4:])
+		dir.MGen = pack.GetUint32(p[8:])
+		p = p[3*4:]
+	}
+
+	/* qid */
+	if len(p) < 8 {
+		return nil, errBadMeta
+	}
+	dir.Qid = pack.GetUint64(p)
+	p = p[8:]
+
+	/* skip replacement */
+	if version == 7 {
+		if len(p) < venti.ScoreSize {
+			return nil, errBadMeta
+		}
+		p = p[venti.ScoreSize:]
+	}
+
+	/* uid, gid, mid */
+	for _, s := range []*string{&dir.Uid, &dir.Gid, &dir.Mid} {
+		if *s, err = pack.UnpackString(&p); err != nil {
+			return nil, errBadMeta
+		}
+	}
+
+	if len(p) < 5*4 {
+		return nil, errBadMeta
+	}
+	dir.Mtime = pack.GetUint32(p)
+	dir.Mcount = pack.GetUint32(p[4:])
+	dir.Ctime = pack.GetUint32(p[8:])
+	dir.Atime = pack.GetUint32(p[12:])
+	dir.Mode = pack.GetUint32(p[16:])
+	p = p[5*4:]
+
+	/* optional meta data */
+	for len(p) > 0 {
+		if len(p) < 3 {
+			return nil, errBadMeta
+		}
+		t := int(p[0])
+		n := int(pack.GetUint16(p[1:]))
+		p = p[3:]
+		if len(p) < n {
+			return nil, errBadMeta
+		}
+		switch t {
+		case dePlan9:
+			/* not valid in version >= 9 */
+			if version >= 9 {
+				break
+			}
+			if n != 12 {
+				return nil, errBadMeta
+			}
+			if dir.Mcount == 0 {
+				dir.Mcount = pack.GetUint32(p[8:])
+			}
+		case deQidSpace:
+			if dir.QidSpace || n != 16 {
+				return nil, errBadMeta
+			}
+			dir.QidSpace = true
+			dir.QidOffset = pack.GetUint64(p)
+			dir.QidMax = pack.GetUint64(p[8:])
+		}
+		p = p[n:]
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,151 @@
+package vac
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// A File is an open file or directory in a vac archive.
+// Its data are read from venti as needed.
+type File struct {
+	fs   *FS
+	name string
+	de   *DirEntry
+	src  *source // data, for files
+	dir  *dir    // for directories
+
+	mu      sync.Mutex
+	offset  int64
+	dirents []*DirEntry // remaining for ReadDir
+	dirread bool
+	closed  bool
+}
+
+// Stat returns the directory entry of f.
+func (f *File) Stat() (fs.FileInfo, error) {
+	return fileInfo{f.de}, nil
+}
+
+// DirEntry returns the vac directory entry of f.
+func (f *File) DirEntry() *DirEntry {
+	return f.de
+}
+
+// Close closes f.
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// ReadAt reads len(p) bytes from f starting at byte offset off.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if f.src == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+
+	size := int64(f.src.e.Size)
+	dsize := int64(f.src.e.Dsize)
+	n := 0
+	for n < len(p) {
+		if off >= size {
+			return n, io.EOF
+		}
+		b, err := f.src.block(uint64(off / dsize))
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: f.name, Err: err}
+		}
+		b = b[off%dsize:]
+		if rest := size - off; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+		m := copy(p[n:], b)
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// Read reads up to len(p) bytes from f.
+func (f *File) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrClosed}
+	}
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.de.Size)
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// ReadDir reads the entries of the directory f, sorted by name.
+// It behaves as described for fs.ReadDirFile.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.dir == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.dirread {
+		des, err := f.fs.readDir(f.dir)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		sortDirEntries(des)
+		f.dirents = des
+		f.dirread = true
+	}
+
+	m := len(f.dirents)
+	if n > 0 && m > n {
+		m = n
+	}
+	if n > 0 && m == 0 {
+		return nil, io.EOF
+	}
+	list := make([]fs.DirEntry, m)
+	for i, de := range f.dirents[:m] {
+		list[i] = fileInfo{de}
+	}
+	f.dirents = f.dirents[m:]
+	return list, nil
+}
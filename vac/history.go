@@ -0,0 +1,122 @@
+package vac
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+// An Archive describes one of a chain of archives,
+// each of whose root blocks points to the one before.
+type Archive struct {
+	Score venti.Score
+	Root  venti.Root
+
+	// Name is the path of the archival snapshot, such as
+	// /archive/2021/0314, for archives written by fossil,
+	// and the name in the root block otherwise.
+	Name string
+
+	// Time is when the archive was made, as nearly as can be
+	// told: the modification time of the archival snapshot,
+	// or of the archive's root directory.
+	Time time.Time
+}
+
+// History returns the archives in the chain starting at score,
+// newest first, following the Prev scores of their root blocks.
+// If n > 0, at most n archives are returned. If an archive cannot
+// be read, History returns those newer than it along with the
+// error.
+func History(z venti.Store, score *venti.Score, n int) ([]*Archive, error) {
+	var list []*Archive
+	s := *score
+	for s != (venti.Score{}) && !s.IsZero() {
+		if n > 0 && len(list) == n {
+			break
+		}
+		v, err := Open(z, &s)
+		if err != nil {
+			return list, fmt.Errorf("%s%v: %v", Prefix, &s, err)
+		}
+		list = append(list, v.Archive())
+		s = v.root.Prev
+	}
+	return list, nil
+}
+
+// Archive describes v.
+func (v *FS) Archive() *Archive {
+	a := &Archive{
+		Score: v.score,
+		Root:  v.root,
+		Name:  v.root.Name,
+		Time:  time.Unix(int64(v.top.de.Mtime), 0),
+	}
+	if v.root.Name == "fossil" {
+		if name, de := v.archSnapshot(); de != nil {
+			a.Name = name
+			a.Time = time.Unix(int64(de.Mtime), 0)
+		}
+	}
+	return a
+}
+
+/*
+ * Fossil archives the whole file system just after taking
+ * the archival snapshot, so the snapshot is the newest one
+ * in the archive, in the latest year's directory.
+ */
+func (v *FS) archSnapshot() (string, *DirEntry) {
+	var year *DirEntry
+	des, err := v.readDir(v.top)
+	if err != nil {
+		return "", nil
+	}
+	for _, de := range des {
+		if de.Elem != "archive" || !de.IsDir() {
+			continue
+		}
+		d, err := v.openDir(v.top, de)
+		if err != nil {
+			return "", nil
+		}
+		years, err := v.readDir(d)
+		if err != nil {
+			return "", nil
+		}
+		y := -1
+		for _, yde := range years {
+			if n, err := strconv.Atoi(yde.Elem); err == nil && n > y && yde.IsDir() {
+				y, year = n, yde
+			}
+		}
+		if year == nil {
+			return "", nil
+		}
+		if d, err = v.openDir(d, year); err != nil {
+			return "", nil
+		}
+		days, err := v.readDir(d)
+		if err != nil {
+			return "", nil
+		}
+		var snap *DirEntry
+		for _, dde := range days {
+			if dde.Mode&ModeSnapshot == 0 {
+				continue
+			}
+			if snap == nil || dde.Mtime > snap.Mtime || dde.Mtime == snap.Mtime && dde.Elem > snap.Elem {
+				snap = dde
+			}
+		}
+		if snap == nil {
+			return "", nil
+		}
+		return path.Join("/archive", year.Elem, snap.Elem), snap
+	}
+	return "", nil
+}
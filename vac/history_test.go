@@ -0,0 +1,61 @@
+package vac
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+func TestHistory(t *testing.T) {
+	z := venti.NewMemStore()
+	var scores []*venti.Score
+	var prev *FS
+	for i := 0; i < 3; i++ {
+		mtime := time.Unix(1600000000+int64(i)*86400, 0)
+		m := fstest.MapFS{
+			"file": {Data: []byte{byte(i)}, ModTime: mtime},
+			".":    {Mode: fs.ModeDir | 0755, ModTime: mtime},
+		}
+		w := NewWriter(z)
+		w.Prev = prev
+		score, err := w.Write(m, ".", "test")
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		if prev, err = Open(z, score); err != nil {
+			t.Fatalf("open %d: %v", i, err)
+		}
+		scores = append(scores, score)
+	}
+
+	list, err := History(z, scores[2], 0)
+	if err != nil {
+		t.Fatalf("history: %v", err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("history: got %d archives, want 3", len(list))
+	}
+	for i, a := range list {
+		want := scores[2-i]
+		if a.Score != *want || a.Name != "test" || a.Time.Unix() != 1600000000+int64(2-i)*86400 {
+			t.Errorf("history[%d]: got %v %q %v, want %v", i, &a.Score, a.Name, a.Time, want)
+		}
+	}
+
+	if list, err := History(z, scores[2], 2); err != nil || len(list) != 2 {
+		t.Errorf("history of 2: got %d archives, %v", len(list), err)
+	}
+
+	// lose the oldest root
+	lossy := &lossyStore{Store: z, lost: scores[0]}
+	list, err = History(lossy, scores[2], 0)
+	if err == nil {
+		t.Errorf("history with missing root succeeded")
+	}
+	if len(list) != 2 {
+		t.Errorf("history with missing root: got %d archives, want 2", len(list))
+	}
+}
@@ -0,0 +1,118 @@
+package vac
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/floren/fs/venti"
+)
+
+// A source is a tree of venti blocks described by an entry:
+// pointer blocks above leaves of file data, metadata or,
+// for directories, more entries.
+type source struct {
+	z   venti.Store
+	e   venti.Entry
+	dir bool // leaves are venti.DirType blocks of entries
+}
+
+func (s *source) leafType() venti.BlockType {
+	if s.dir {
+		return venti.DirType
+	}
+	return venti.DataType
+}
+
+// nblocks returns the number of leaves in s.
+func (s *source) nblocks() uint64 {
+	return (s.e.Size + uint64(s.e.Dsize) - 1) / uint64(s.e.Dsize)
+}
+
+// block returns leaf bn of s, zero-extended to the full block size.
+func (s *source) block(bn uint64) ([]byte, error) {
+	if bn >= s.nblocks() {
+		return nil, fmt.Errorf("block %d beyond end of source", bn)
+	}
+
+	ppb := uint64(s.e.Psize) / venti.ScoreSize
+	depth := int(s.e.Depth)
+	if depth > venti.PointerDepth {
+		return nil, fmt.Errorf("bad source depth %d", depth)
+	}
+	idx := make([]int, depth)
+	for i := 0; i < depth; i++ {
+		idx[i] = int(bn % ppb)
+		bn /= ppb
+	}
+	if bn != 0 {
+		return nil, errors.New("source too deep for its size")
+	}
+
+	score := s.e.Score
+	for d := depth; d > 0; d-- {
+		p, err := readBlock(s.z, &score, venti.PointerType0+venti.BlockType(d-1), int(s.e.Psize))
+		if err != nil {
+			return nil, err
+		}
+		copy(score[:], p[idx[d-1]*venti.ScoreSize:])
+	}
+	return readBlock(s.z, &score, s.leafType(), int(s.e.Dsize))
+}
+
+// entry returns entry i of the directory source s.
+func (s *source) entry(i uint32) (*venti.Entry, error) {
+	if !s.dir {
+		return nil, errors.New("source is not a directory")
+	}
+	if uint64(i+1)*venti.EntrySize > s.e.Size {
+		return nil, fmt.Errorf("entry %d beyond end of directory", i)
+	}
+	epb := uint32(s.e.Dsize) / venti.EntrySize
+	b, err := s.block(uint64(i / epb))
+	if err != nil {
+		return nil, err
+	}
+	return venti.UnpackEntry(b, int(i%epb))
+}
+
+// open returns the source described by entry i of s,
+// which must have the given generation and kind.
+func (s *source) open(i, gen uint32, dir bool) (*source, error) {
+	e, err := s.entry(i)
+	if err != nil {
+		return nil, err
+	}
+	if e.Flags&venti.EntryActive == 0 {
+		return nil, fmt.Errorf("entry %d is not active", i)
+	}
+	if e.Gen != gen {
+		return nil, fmt.Errorf("entry %d: generation %d, want %d", i, e.Gen, gen)
+	}
+	if e.Flags&venti.EntryLocal != 0 {
+		return nil, fmt.Errorf("entry %d is not archived", i)
+	}
+	if (e.Flags&venti.EntryDir != 0) != dir {
+		return nil, fmt.Errorf("entry %d: wrong kind of source", i)
+	}
+	return &source{z: s.z, e: *e, dir: dir}, nil
+}
+
+// readBlock reads the block with the given score and type,
+// checking it and zero-extending it to size bytes.
+func readBlock(z venti.Store, score *venti.Score, typ venti.BlockType, size int) ([]byte, error) {
+	buf := make([]byte, size)
+	n := 0
+	if !score.IsZero() {
+		var err error
+		if n, err = z.Read(score, typ, buf); err != nil {
+			return nil, fmt.Errorf("read %v block %v: %w", typ, score, err)
+		}
+		if !score.Check(buf[:n]) {
+			return nil, fmt.Errorf("read %v block %v: wrong score", typ, score)
+		}
+	}
+	if err := venti.ZeroExtend(typ, buf, n, size); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
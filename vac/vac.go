@@ -0,0 +1,263 @@
+// Package vac reads vac archives, the trees of venti blocks
+// written by vac and by fossil's archiver.
+//
+// An archive is named by the score of its root block, written
+// vac:score. Open returns an FS for the archive, through which
+// its directories may be listed and its files read, without
+// the help of a fossil.
+package vac // import "github.com/floren/fs/vac"
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/floren/fs/venti"
+)
+
+// Prefix is the prefix of the textual form of an archive's score.
+const Prefix = "vac:"
+
+// ParseScore parses the score of an archive,
+// with or without the vac: prefix.
+func ParseScore(s string) (*venti.Score, error) {
+	return venti.ParseScore(strings.TrimPrefix(s, Prefix))
+}
+
+// An FS is a vac archive. It implements fs.FS, fs.StatFS
+// and fs.ReadDirFS, and is safe for concurrent use.
+type FS struct {
+	z     venti.Store
+	score venti.Score
+	root  venti.Root
+	top   *dir
+}
+
+// dir is an open directory: its entry, and the sources holding
+// the entries and meta data of its children.
+type dir struct {
+	de   *DirEntry
+	src  *source // entries of the children
+	msrc *source // meta data of the children
+}
+
+// Open reads the archive with the given root score from z.
+func Open(z venti.Store, score *venti.Score) (*FS, error) {
+	buf, err := readBlock(z, score, venti.RootType, venti.RootSize)
+	if err != nil {
+		return nil, err
+	}
+	root, err := venti.UnpackRoot(buf)
+	if err != nil {
+		return nil, fmt.Errorf("bad root: %v", err)
+	}
+
+	/*
+	 * Fossil's vac archives start with an extra layer of source,
+	 * but vac's don't.
+	 */
+	top := &source{
+		z: z,
+		e: venti.Entry{
+			Psize: root.BlockSize,
+			Dsize: root.BlockSize,
+			Flags: venti.EntryActive | venti.EntryDir,
+			Size:  venti.EntrySize,
+			Score: root.Score,
+		},
+		dir: true,
+	}
+	b, err := top.block(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(venti.ZeroTruncate(venti.DirType, b)) <= 2*venti.EntrySize {
+		e, err := venti.UnpackEntry(b, 0)
+		if err != nil {
+			return nil, fmt.Errorf("bad root: top entry: %v", err)
+		}
+		top = &source{z: z, e: *e, dir: true}
+	} else {
+		top.e.Size = 3 * venti.EntrySize
+	}
+
+	/*
+	 * There should be three root sources here: the entries and
+	 * the meta data of the root directory's children, and the
+	 * meta data of the root directory itself.
+	 */
+	var r [3]*source
+	for i := range r {
+		e, err := top.entry(uint32(i))
+		if err != nil {
+			return nil, fmt.Errorf("bad root: entry %d: %v", i, err)
+		}
+		if e.Flags&venti.EntryActive == 0 || e.Flags&venti.EntryLocal != 0 {
+			return nil, fmt.Errorf("bad root: entry %d", i)
+		}
+		r[i] = &source{z: z, e: *e, dir: e.Flags&venti.EntryDir != 0}
+	}
+	if !r[0].dir || r[1].dir || r[2].dir {
+		return nil, errors.New("bad root: wrong kind of source")
+	}
+	mb, err := r[2].block(0)
+	if err != nil {
+		return nil, err
+	}
+	des, err := unpackMetaBlock(mb)
+	if err != nil {
+		return nil, fmt.Errorf("bad root: %v", err)
+	}
+	if len(des) == 0 {
+		return nil, errors.New("bad root: no directory entry")
+	}
+
+	return &FS{
+		z:     z,
+		score: *score,
+		root:  *root,
+		top:   &dir{de: des[0], src: r[0], msrc: r[1]},
+	}, nil
+}
+
+// Score returns the score of the archive.
+func (v *FS) Score() venti.Score {
+	return v.score
+}
+
+// Root returns the root block of the archive, which records
+// its name and the score of the previous archive.
+func (v *FS) Root() venti.Root {
+	return v.root
+}
+
+// readDir returns the entries of the children of d, in the
+// order they are stored.
+func (v *FS) readDir(d *dir) ([]*DirEntry, error) {
+	var des []*DirEntry
+	for bn := uint64(0); bn < d.msrc.nblocks(); bn++ {
+		b, err := d.msrc.block(bn)
+		if err != nil {
+			return nil, err
+		}
+		mdes, err := unpackMetaBlock(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range mdes {
+			if !de.IsDir() {
+				e, err := d.src.entry(de.Entry)
+				if err != nil {
+					return nil, err
+				}
+				de.Size = e.Size
+			}
+			des = append(des, de)
+		}
+	}
+	return des, nil
+}
+
+// walk returns the directory entry named by the slash-separated
+// path name, along with the directory holding it.
+func (v *FS) walk(op, name string) (*dir, *DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return nil, v.top.de, nil
+	}
+
+	d := v.top
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		des, err := v.readDir(d)
+		if err != nil {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		var de *DirEntry
+		for _, x := range des {
+			if x.Elem == elem {
+				de = x
+				break
+			}
+		}
+		if de == nil {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if i == len(elems)-1 {
+			return d, de, nil
+		}
+		if !de.IsDir() {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: errors.New("not a directory")}
+		}
+		if d, err = v.openDir(d, de); err != nil {
+			return nil, nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+	panic("not reached")
+}
+
+// openDir opens the child directory de of d.
+func (v *FS) openDir(d *dir, de *DirEntry) (*dir, error) {
+	src, err := d.src.open(de.Entry, de.Gen, true)
+	if err != nil {
+		return nil, err
+	}
+	msrc, err := d.src.open(de.MEntry, de.MGen, false)
+	if err != nil {
+		return nil, err
+	}
+	return &dir{de: de, src: src, msrc: msrc}, nil
+}
+
+// Stat returns the directory entry of the named file.
+func (v *FS) Stat(name string) (fs.FileInfo, error) {
+	_, de, err := v.walk("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{de}, nil
+}
+
+// ReadDir returns the entries of the named directory,
+// sorted by name.
+func (v *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f, err := v.open("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.ReadDir(-1)
+}
+
+// Open opens the named file or directory for reading.
+// The file returned is a *File.
+func (v *FS) Open(name string) (fs.File, error) {
+	return v.open("open", name)
+}
+
+func (v *FS) open(op, name string) (*File, error) {
+	parent, de, err := v.walk(op, name)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{fs: v, name: name, de: de}
+	switch {
+	case parent == nil:
+		f.dir = v.top
+	case de.IsDir():
+		f.dir, err = v.openDir(parent, de)
+	default:
+		f.src, err = parent.src.open(de.Entry, de.Gen, false)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return f, nil
+}
+
+func sortDirEntries(des []*DirEntry) {
+	sort.Slice(des, func(i, j int) bool { return des[i].Elem < des[j].Elem })
+}
@@ -0,0 +1,350 @@
+package vac
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+
+	"github.com/floren/fs/internal/pack"
+	"github.com/floren/fs/venti"
+)
+
+const testBlockSize = 512
+
+// A testNode is a file or directory to be written to venti
+// as part of a test archive.
+type testNode struct {
+	name string
+	data []byte      // for files
+	kids []*testNode // for directories
+	dir  bool
+	qid  uint64
+}
+
+func testTree() *testNode {
+	big := make([]byte, 40*testBlockSize+100)
+	for i := range big {
+		big[i] = byte(i * 7)
+	}
+	return &testNode{
+		dir: true,
+		kids: []*testNode{
+			{name: "hello", data: []byte("hello, world\n")},
+			{name: "big", data: big},
+			{name: "sub", dir: true, kids: []*testNode{
+				{name: "empty"},
+				{name: "zeros", data: make([]byte, 3*testBlockSize)},
+			}},
+		},
+	}
+}
+
+// testWriteSource writes data as a source of blocks of testBlockSize.
+func testWriteSource(t *testing.T, z venti.Store, data []byte, dir bool) venti.Entry {
+	leaf := venti.DataType
+	if dir {
+		leaf = venti.DirType
+	}
+	var scores []venti.Score
+	for off := 0; off < len(data); off += testBlockSize {
+		end := off + testBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		scores = append(scores, testWrite(t, z, leaf, data[off:end]))
+	}
+	if len(scores) == 0 {
+		scores = append(scores, venti.ZeroScore())
+	}
+
+	depth := 0
+	ppb := testBlockSize / venti.ScoreSize
+	for len(scores) > 1 {
+		var up []venti.Score
+		for i := 0; i < len(scores); i += ppb {
+			var p []byte
+			for j := i; j < i+ppb && j < len(scores); j++ {
+				p = append(p, scores[j][:]...)
+			}
+			up = append(up, testWrite(t, z, venti.PointerType0+venti.BlockType(depth), p))
+		}
+		scores = up
+		depth++
+	}
+
+	flags := uint8(venti.EntryActive)
+	if dir {
+		flags |= venti.EntryDir
+	}
+	return venti.Entry{
+		Psize: testBlockSize,
+		Dsize: testBlockSize,
+		Depth: uint8(depth),
+		Flags: flags,
+		Size:  uint64(len(data)),
+		Score: scores[0],
+	}
+}
+
+func testWrite(t *testing.T, z venti.Store, typ venti.BlockType, p []byte) venti.Score {
+	score, err := z.Write(typ, venti.ZeroTruncate(typ, p))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return *score
+}
+
+func testPackDirEntry(d *DirEntry) []byte {
+	var p []byte
+	u32 := func(v uint32) {
+		var b [4]byte
+		pack.PutUint32(b[:], v)
+		p = append(p, b[:]...)
+	}
+	u32(dirMagic)
+	p = append(p, 0, 9)
+	p = append(p, pack.PackString(d.Elem)...)
+	u32(d.Entry)
+	u32(d.Gen)
+	u32(d.MEntry)
+	u32(d.MGen)
+	var q [8]byte
+	pack.PutUint64(q[:], d.Qid)
+	p = append(p, q[:]...)
+	p = append(p, pack.PackString(d.Uid)...)
+	p = append(p, pack.PackString(d.Gid)...)
+	p = append(p, pack.PackString(d.Mid)...)
+	for _, v := range []uint32{d.Mtime, d.Mcount, d.Ctime, d.Atime, d.Mode} {
+		u32(v)
+	}
+	return p
+}
+
+// testPackMetaBlock packs des, which must fit, into one meta block.
+func testPackMetaBlock(t *testing.T, des []*DirEntry) []byte {
+	sort.Slice(des, func(i, j int) bool { return des[i].Elem < des[j].Elem })
+	p := make([]byte, testBlockSize)
+	o := metaHeaderSize + len(des)*metaIndexSize
+	for i, de := range des {
+		e := testPackDirEntry(de)
+		if o+len(e) > len(p) {
+			t.Fatalf("meta block overflow")
+		}
+		copy(p[o:], e)
+		pack.PutUint16(p[metaHeaderSize+i*metaIndexSize:], uint16(o))
+		pack.PutUint16(p[metaHeaderSize+i*metaIndexSize+2:], uint16(len(e)))
+		o += len(e)
+	}
+	pack.PutUint32(p, metaMagic)
+	pack.PutUint16(p[4:], uint16(o))
+	pack.PutUint16(p[8:], uint16(len(des)))
+	pack.PutUint16(p[10:], uint16(len(des)))
+	return p
+}
+
+// testWriteDir writes the children of n, returning the sources
+// holding their entries and their meta data.
+func testWriteDir(t *testing.T, z venti.Store, n *testNode, qid *uint64) (src, msrc venti.Entry) {
+	var entries []byte
+	var des []*DirEntry
+	add := func(e venti.Entry) uint32 {
+		buf := make([]byte, venti.EntrySize)
+		e.Pack(buf, 0)
+		entries = append(entries, buf...)
+		return uint32(len(entries)/venti.EntrySize - 1)
+	}
+	for _, kid := range n.kids {
+		*qid++
+		kid.qid = *qid
+		de := &DirEntry{Elem: kid.name, Qid: kid.qid, Uid: "glenda", Gid: "glenda", Mid: "glenda", Mtime: 1000, Mode: 0644}
+		if kid.dir {
+			de.Mode = ModeDir | 0755
+			ksrc, kmsrc := testWriteDir(t, z, kid, qid)
+			de.Entry = add(ksrc)
+			de.MEntry = add(kmsrc)
+		} else {
+			de.Entry = add(testWriteSource(t, z, kid.data, false))
+		}
+		des = append(des, de)
+	}
+	return testWriteSource(t, z, entries, true), testWriteSource(t, z, testPackMetaBlock(t, des), false)
+}
+
+// testWriteArchive writes n as an archive, in the layout of
+// vac or, if fossil is set, of fossil, and returns its score.
+func testWriteArchive(t *testing.T, z venti.Store, n *testNode, fossil bool) *venti.Score {
+	var qid uint64
+	src, msrc := testWriteDir(t, z, n, &qid)
+	root := &DirEntry{Elem: "/", Uid: "adm", Gid: "adm", Mid: "adm", Mode: ModeDir | 0555}
+	rmsrc := testWriteSource(t, z, testPackMetaBlock(t, []*DirEntry{root}), false)
+
+	top := make([]byte, 3*venti.EntrySize)
+	for i, e := range []venti.Entry{src, msrc, rmsrc} {
+		e.Pack(top, i)
+	}
+	score := testWrite(t, z, venti.DirType, top)
+	if fossil {
+		e := venti.Entry{
+			Psize: testBlockSize,
+			Dsize: testBlockSize,
+			Flags: venti.EntryActive | venti.EntryDir,
+			Size:  uint64(len(top)),
+			Score: score,
+		}
+		top = make([]byte, venti.EntrySize)
+		e.Pack(top, 0)
+		score = testWrite(t, z, venti.DirType, top)
+	}
+
+	r := venti.Root{
+		Version:   venti.RootVersion,
+		Name:      "test",
+		Type:      "vac",
+		Score:     score,
+		BlockSize: testBlockSize,
+	}
+	buf := make([]byte, venti.RootSize)
+	r.Pack(buf)
+	rs := testWrite(t, z, venti.RootType, buf)
+	return &rs
+}
+
+func TestParseScore(t *testing.T) {
+	s := "vac:da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	score, err := ParseScore(s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	if !score.IsZero() {
+		t.Errorf("parse %q: got %v", s, score)
+	}
+	if _, err := ParseScore("vac:bogus"); err == nil {
+		t.Errorf("parse of bad score succeeded")
+	}
+}
+
+func TestFS(t *testing.T) {
+	for _, fossil := range []bool{false, true} {
+		z := venti.NewMemStore()
+		tree := testTree()
+		v, err := Open(z, testWriteArchive(t, z, tree, fossil))
+		if err != nil {
+			t.Fatalf("open (fossil=%v): %v", fossil, err)
+		}
+		if r := v.Root(); r.Name != "test" || r.Type != "vac" {
+			t.Errorf("root: got %v", &r)
+		}
+
+		if err := fstest.TestFS(v, "hello", "big", "sub", "sub/empty", "sub/zeros"); err != nil {
+			t.Errorf("fossil=%v: %v", fossil, err)
+		}
+
+		for _, n := range []*testNode{tree.kids[0], tree.kids[1], tree.kids[2].kids[1]} {
+			name := n.name
+			if n == tree.kids[2].kids[1] {
+				name = "sub/" + name
+			}
+			data, err := fs.ReadFile(v, name)
+			if err != nil {
+				t.Errorf("read %s: %v", name, err)
+				continue
+			}
+			if !bytes.Equal(data, n.data) {
+				t.Errorf("read %s: got %d bytes, want %d", name, len(data), len(n.data))
+			}
+		}
+
+		fi, err := fs.Stat(v, "sub")
+		if err != nil {
+			t.Fatalf("stat sub: %v", err)
+		}
+		de := fi.Sys().(*DirEntry)
+		if !fi.IsDir() || de.Uid != "glenda" || de.Qid != tree.kids[2].qid {
+			t.Errorf("stat sub: got %+v", de)
+		}
+	}
+}
+
+func TestFileReadAt(t *testing.T) {
+	z := venti.NewMemStore()
+	tree := testTree()
+	v, err := Open(z, testWriteArchive(t, z, tree, false))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ff, err := v.Open("big")
+	if err != nil {
+		t.Fatalf("open big: %v", err)
+	}
+	defer ff.Close()
+	f := ff.(*File)
+
+	data := tree.kids[1].data
+	buf := make([]byte, 3*testBlockSize)
+	for _, off := range []int64{0, 1, testBlockSize - 1, 30 * testBlockSize, int64(len(data)) - 10} {
+		n, err := f.ReadAt(buf, off)
+		want := data[off:]
+		if len(want) > len(buf) {
+			want = want[:len(buf)]
+		} else if err != io.EOF {
+			t.Errorf("read at %d: got %v at end of file, want %v", off, err, io.EOF)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("read at %d: wrong data", off)
+		}
+	}
+
+	if _, err := f.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatalf("seek: %v", err)
+	}
+	rest, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(rest, data[len(data)-5:]) {
+		t.Errorf("read after seek: got %q, %v", rest, err)
+	}
+}
+
+func TestFSDamaged(t *testing.T) {
+	z := venti.NewMemStore()
+	tree := testTree()
+	score := testWriteArchive(t, z, tree, false)
+
+	if _, err := Open(z, venti.Sha1([]byte("no such root"))); err == nil {
+		t.Errorf("open of missing root succeeded")
+	}
+
+	// lose a data block of big
+	lossy := &lossyStore{Store: z, lost: venti.Sha1(tree.kids[1].data[:testBlockSize])}
+	v, err := Open(lossy, score)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := fs.ReadFile(v, "hello"); err != nil {
+		t.Errorf("read undamaged file: %v", err)
+	}
+	if _, err := fs.ReadFile(v, "big"); err == nil {
+		t.Errorf("read of damaged file succeeded")
+	}
+	if _, err := fs.Stat(v, "nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat nonexistent: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if _, err := fs.Stat(v, "hello/x"); err == nil {
+		t.Errorf("walk through a file succeeded")
+	}
+}
+
+// A lossyStore has lost one block.
+type lossyStore struct {
+	venti.Store
+	lost *venti.Score
+}
+
+func (s *lossyStore) Read(score *venti.Score, typ venti.BlockType, p []byte) (int, error) {
+	if *score == *s.lost {
+		return 0, errors.New("no such block")
+	}
+	return s.Store.Read(score, typ, p)
+}
@@ -0,0 +1,527 @@
+package vac
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"github.com/floren/fs/internal/pack"
+	"github.com/floren/fs/venti"
+)
+
+// A Writer writes trees of files to a venti store as archives,
+// in the layout fossil and vac use. Its exported fields may be
+// set before calling Write.
+type Writer struct {
+	// BlockSize is the size of the blocks written.
+	// If zero, 8192 is used.
+	BlockSize int
+
+	// Prev is an earlier archive of the same tree. Files with
+	// the same name, size, mode and modification time as in Prev
+	// are assumed unchanged, and their blocks are not written
+	// again. The root of the new archive points back to Prev.
+	Prev *FS
+
+	// Owner returns the owner and group of a file.
+	// If nil, every file is owned by "none".
+	Owner func(fi fs.FileInfo) (uid, gid string)
+
+	// Readlink returns the target of the named symbolic link.
+	// If nil, symbolic links are skipped.
+	Readlink func(name string) (string, error)
+
+	// Warn is called, if not nil, for files which are skipped.
+	Warn func(name string, err error)
+
+	// Files and Reused count the files written by Write,
+	// and those of them reused from Prev.
+	Files, Reused int
+
+	z   venti.Store
+	qid uint64
+}
+
+// NewWriter returns a Writer which writes to z.
+func NewWriter(z venti.Store) *Writer {
+	return &Writer{z: z}
+}
+
+// Write writes the tree of files at root in fsys as an
+// archive named name, and returns the score of the archive.
+func (w *Writer) Write(fsys fs.FS, root, name string) (*venti.Score, error) {
+	if w.BlockSize == 0 {
+		w.BlockSize = 8192
+	}
+	if w.BlockSize < 256 || w.BlockSize > venti.MaxBlockSize {
+		return nil, fmt.Errorf("bad block size %d", w.BlockSize)
+	}
+	w.qid = 0
+
+	fi, err := fs.Stat(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s: not a directory", root)
+	}
+	var prev *dir
+	if w.Prev != nil {
+		prev = w.Prev.top
+	}
+	de := w.dirEntry(fi, name)
+	src, msrc, err := w.writeDir(fsys, root, prev)
+	if err != nil {
+		return nil, err
+	}
+	de.QidSpace = true
+	de.QidMax = w.qid + 1
+
+	/*
+	 * The root source holds three entries: the root directory's
+	 * entries and meta data, and a meta data block for the root
+	 * directory itself, as written by fossil's mkVac.
+	 */
+	mw := w.newSourceWriter(false)
+	if err := mw.write(packMetaBlock([]*DirEntry{de})); err != nil {
+		return nil, err
+	}
+	rmsrc, err := mw.close()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 3*venti.EntrySize)
+	src.Pack(buf, 0)
+	msrc.Pack(buf, 1)
+	rmsrc.Pack(buf, 2)
+	score, err := w.writeBlock(venti.DirType, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	r := venti.Root{
+		Version:   venti.RootVersion,
+		Name:      name,
+		Type:      "vac",
+		Score:     *score,
+		BlockSize: uint16(w.BlockSize),
+	}
+	if w.Prev != nil {
+		r.Prev = w.Prev.score
+	}
+	buf = make([]byte, venti.RootSize)
+	r.Pack(buf)
+	if score, err = w.writeBlock(venti.RootType, buf); err != nil {
+		return nil, err
+	}
+	if err := w.z.Sync(); err != nil {
+		return nil, err
+	}
+	return score, nil
+}
+
+func (w *Writer) dirEntry(fi fs.FileInfo, name string) *DirEntry {
+	uid, gid := "none", "none"
+	if w.Owner != nil {
+		uid, gid = w.Owner(fi)
+	}
+	mtime := uint32(fi.ModTime().Unix())
+	de := &DirEntry{
+		Elem:  name,
+		Qid:   w.qid,
+		Uid:   uid,
+		Gid:   gid,
+		Mid:   uid,
+		Mtime: mtime,
+		Ctime: mtime,
+		Atime: mtime,
+		Mode:  vacMode(fi.Mode()),
+	}
+	w.qid++
+	return de
+}
+
+func vacMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	for _, b := range []struct {
+		mode fs.FileMode
+		vac  uint32
+	}{
+		{fs.ModeDir, ModeDir},
+		{fs.ModeAppend, ModeAppend},
+		{fs.ModeExclusive, ModeExclusive},
+		{fs.ModeSymlink, ModeLink},
+		{fs.ModeTemporary, ModeTemporary},
+		{fs.ModeSetuid, ModeSetUid},
+		{fs.ModeSetgid, ModeSetGid},
+		{fs.ModeSticky, ModeSticky},
+	} {
+		if m&b.mode != 0 {
+			mode |= b.vac
+		}
+	}
+	return mode
+}
+
+// writeDir writes the children of the directory name, returning
+// the sources of their entries and meta data. Prev is the same
+// directory in the previous archive, or nil.
+func (w *Writer) writeDir(fsys fs.FS, name string, prev *dir) (src, msrc *venti.Entry, err error) {
+	list, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	old := make(map[string]*DirEntry)
+	if prev != nil {
+		des, err := w.Prev.readDir(prev)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: previous archive: %v", name, err)
+		}
+		for _, de := range des {
+			old[de.Elem] = de
+		}
+	}
+
+	sw := w.newSourceWriter(true)
+	var des []*DirEntry
+	for _, d := range list {
+		kid := path.Join(name, d.Name())
+		fi, err := d.Info()
+		if err != nil {
+			w.warn(kid, err)
+			continue
+		}
+		de := w.dirEntry(fi, d.Name())
+		var e, me *venti.Entry
+		switch fi.Mode().Type() {
+		case fs.ModeDir:
+			var pd *dir
+			if o := old[d.Name()]; o != nil && o.IsDir() {
+				if pd, err = w.Prev.openDir(prev, o); err != nil {
+					w.warn(kid, fmt.Errorf("previous archive: %v", err))
+					pd = nil
+				}
+			}
+			e, me, err = w.writeDir(fsys, kid, pd)
+		case 0:
+			e, err = w.writeFile(fsys, kid, fi, prev, old[d.Name()])
+		case fs.ModeSymlink:
+			if w.Readlink == nil {
+				w.warn(kid, errors.New("symbolic link skipped"))
+				continue
+			}
+			var target string
+			if target, err = w.Readlink(kid); err == nil {
+				e, err = w.writeData([]byte(target))
+			}
+		default:
+			w.warn(kid, errors.New("special file skipped"))
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if de.Entry, err = sw.addEntry(e); err != nil {
+			return nil, nil, err
+		}
+		if me != nil {
+			if de.MEntry, err = sw.addEntry(me); err != nil {
+				return nil, nil, err
+			}
+		}
+		des = append(des, de)
+	}
+	if src, err = sw.close(); err != nil {
+		return nil, nil, err
+	}
+
+	mw := w.newSourceWriter(false)
+	mw.padTo = w.BlockSize
+	sortDirEntries(des)
+	for len(des) > 0 {
+		n := 0
+		size := metaHeaderSize
+		for n < len(des) {
+			m := metaIndexSize + des[n].packedSize()
+			if size+m > w.BlockSize {
+				break
+			}
+			size += m
+			n++
+		}
+		if n == 0 {
+			return nil, nil, fmt.Errorf("%s: directory entry too big", path.Join(name, des[0].Elem))
+		}
+		if err := mw.write(packMetaBlock(des[:n])); err != nil {
+			return nil, nil, err
+		}
+		des = des[n:]
+	}
+	if msrc, err = mw.close(); err != nil {
+		return nil, nil, err
+	}
+	return src, msrc, nil
+}
+
+// writeFile writes the regular file name, or reuses the
+// source of old, its entry in the previous archive.
+func (w *Writer) writeFile(fsys fs.FS, name string, fi fs.FileInfo, prev *dir, old *DirEntry) (*venti.Entry, error) {
+	w.Files++
+	if old != nil && !old.IsDir() && old.Size == uint64(fi.Size()) &&
+		old.Mtime == uint32(fi.ModTime().Unix()) && old.Mode == vacMode(fi.Mode()) {
+		src, err := prev.src.open(old.Entry, old.Gen, false)
+		if err == nil {
+			w.Reused++
+			return &src.e, nil
+		}
+		w.warn(name, fmt.Errorf("previous archive: %v", err))
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sw := w.newSourceWriter(false)
+	buf := make([]byte, w.BlockSize)
+	for {
+		n, err := io.ReadFull(f, buf)
+		if n > 0 {
+			if err := sw.write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return sw.close()
+}
+
+func (w *Writer) writeData(p []byte) (*venti.Entry, error) {
+	sw := w.newSourceWriter(false)
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.BlockSize {
+			n = w.BlockSize
+		}
+		if err := sw.write(p[:n]); err != nil {
+			return nil, err
+		}
+		p = p[n:]
+	}
+	return sw.close()
+}
+
+func (w *Writer) warn(name string, err error) {
+	if w.Warn != nil {
+		w.Warn(name, err)
+	}
+}
+
+func (w *Writer) writeBlock(typ venti.BlockType, p []byte) (*venti.Score, error) {
+	p = venti.ZeroTruncate(typ, p)
+	score, err := w.z.Write(typ, p)
+	if err != nil {
+		return nil, err
+	}
+	if !score.Check(p) {
+		return nil, errors.New("score check failed")
+	}
+	return score, nil
+}
+
+// A sourceWriter writes a source a leaf at a time, building
+// the pointer blocks above the leaves as it goes.
+type sourceWriter struct {
+	w       *Writer
+	dir     bool
+	size    uint64
+	nleaf   uint64
+	levels  [][]byte // pointer blocks being filled, from the bottom
+	entries []byte   // for directories, the leaf being filled
+	padTo   int      // count each leaf as this long, if set
+}
+
+func (w *Writer) newSourceWriter(dir bool) *sourceWriter {
+	return &sourceWriter{w: w, dir: dir}
+}
+
+// write adds the leaf p, which must be no bigger than a block.
+func (s *sourceWriter) write(p []byte) error {
+	typ := venti.DataType
+	if s.dir {
+		typ = venti.DirType
+	}
+	score, err := s.w.writeBlock(typ, p)
+	if err != nil {
+		return err
+	}
+	s.nleaf++
+	if s.padTo > len(p) {
+		s.size += uint64(s.padTo)
+	} else {
+		s.size += uint64(len(p))
+	}
+	return s.addScore(0, score)
+}
+
+func (s *sourceWriter) addScore(level int, score *venti.Score) error {
+	if level == len(s.levels) {
+		s.levels = append(s.levels, nil)
+	}
+	s.levels[level] = append(s.levels[level], score[:]...)
+	if len(s.levels[level]) == s.w.BlockSize/venti.ScoreSize*venti.ScoreSize {
+		return s.flush(level)
+	}
+	return nil
+}
+
+func (s *sourceWriter) flush(level int) error {
+	score, err := s.w.writeBlock(venti.PointerType0+venti.BlockType(level), s.levels[level])
+	if err != nil {
+		return err
+	}
+	s.levels[level] = s.levels[level][:0]
+	return s.addScore(level+1, score)
+}
+
+// addEntry adds e to the directory source s,
+// returning its index.
+func (s *sourceWriter) addEntry(e *venti.Entry) (uint32, error) {
+	epb := s.w.BlockSize / venti.EntrySize
+	i := uint32(s.nleaf)*uint32(epb) + uint32(len(s.entries)/venti.EntrySize)
+	buf := make([]byte, venti.EntrySize)
+	e.Pack(buf, 0)
+	s.entries = append(s.entries, buf...)
+	if len(s.entries) == epb*venti.EntrySize {
+		if err := s.write(s.entries); err != nil {
+			return 0, err
+		}
+		s.entries = s.entries[:0]
+	}
+	return i, nil
+}
+
+// close finishes the source and returns its entry.
+func (s *sourceWriter) close() (*venti.Entry, error) {
+	if len(s.entries) > 0 {
+		if err := s.write(s.entries); err != nil {
+			return nil, err
+		}
+	}
+	e := &venti.Entry{
+		Psize: uint16(s.w.BlockSize),
+		Dsize: uint16(s.w.BlockSize),
+		Flags: venti.EntryActive,
+		Size:  s.size,
+	}
+	if s.dir {
+		e.Flags |= venti.EntryDir
+		e.Dsize = uint16(s.w.BlockSize / venti.EntrySize * venti.EntrySize)
+	}
+
+	switch {
+	case s.nleaf == 0:
+		e.Score = venti.ZeroScore()
+		return e, nil
+	case s.nleaf == 1:
+		copy(e.Score[:], s.levels[0])
+		return e, nil
+	}
+
+	/* write the partial pointer blocks, up to a single score */
+	depth := 0
+	ppb := uint64(s.w.BlockSize / venti.ScoreSize)
+	for n := uint64(1); n < s.nleaf; n *= ppb {
+		depth++
+	}
+	for level := 0; level < depth; level++ {
+		if len(s.levels[level]) > 0 {
+			if err := s.flush(level); err != nil {
+				return nil, err
+			}
+		}
+	}
+	e.Depth = uint8(depth)
+	copy(e.Score[:], s.levels[depth])
+	return e, nil
+}
+
+func (d *DirEntry) packedSize() int {
+	n := 4 + 2 + 4 + 4 + 4 + 4 + 8 + 5*4
+	n += 2 + len(d.Elem)
+	n += 2 + len(d.Uid)
+	n += 2 + len(d.Gid)
+	n += 2 + len(d.Mid)
+	if d.QidSpace {
+		n += 3 + 8 + 8
+	}
+	return n
+}
+
+func (d *DirEntry) pack(p []byte) {
+	pack.PutUint32(p, dirMagic)
+	pack.PutUint16(p[4:], 9) /* version */
+	p = p[6:]
+
+	p = p[pack.PackStringBuf(d.Elem, p):]
+
+	pack.PutUint32(p, d.Entry)
+	pack.PutUint32(p[4:], d.Gen)
+	pack.PutUint32(p[8:], d.MEntry)
+	pack.PutUint32(p[12:], d.MGen)
+	pack.PutUint64(p[16:], d.Qid)
+	p = p[24:]
+
+	p = p[pack.PackStringBuf(d.Uid, p):]
+	p = p[pack.PackStringBuf(d.Gid, p):]
+	p = p[pack.PackStringBuf(d.Mid, p):]
+
+	pack.PutUint32(p, d.Mtime)
+	pack.PutUint32(p[4:], d.Mcount)
+	pack.PutUint32(p[8:], d.Ctime)
+	pack.PutUint32(p[12:], d.Atime)
+	pack.PutUint32(p[16:], d.Mode)
+	p = p[5*4:]
+
+	if d.QidSpace {
+		pack.PutUint8(p, deQidSpace)
+		pack.PutUint16(p[1:], 2*8)
+		p = p[3:]
+		pack.PutUint64(p, d.QidOffset)
+		pack.PutUint64(p[8:], d.QidMax)
+	}
+}
+
+// packMetaBlock packs des, which must be sorted and fit
+// in a block, into a meta data block.
+func packMetaBlock(des []*DirEntry) []byte {
+	size := metaHeaderSize + len(des)*metaIndexSize
+	for _, de := range des {
+		size += de.packedSize()
+	}
+	p := make([]byte, size)
+	pack.PutUint32(p, metaMagic)
+	pack.PutUint16(p[4:], uint16(size))
+	pack.PutUint16(p[6:], 0) /* free */
+	pack.PutUint16(p[8:], uint16(len(des)))
+	pack.PutUint16(p[10:], uint16(len(des)))
+
+	o := metaHeaderSize + len(des)*metaIndexSize
+	for i, de := range des {
+		n := de.packedSize()
+		de.pack(p[o:])
+		pack.PutUint16(p[metaHeaderSize+i*metaIndexSize:], uint16(o))
+		pack.PutUint16(p[metaHeaderSize+i*metaIndexSize+2:], uint16(n))
+		o += n
+	}
+	return p
+}
@@ -0,0 +1,178 @@
+package vac
+
+import (
+	"bytes"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+func testMapFS() fstest.MapFS {
+	mtime := time.Unix(1600000000, 0)
+	big := make([]byte, 700*testBlockSize+3)
+	for i := range big {
+		big[i] = byte(i*13 + i/testBlockSize)
+	}
+	m := fstest.MapFS{
+		"hello":         {Data: []byte("hello, world\n"), Mode: 0644, ModTime: mtime},
+		"big":           {Data: big, Mode: 0600, ModTime: mtime},
+		"empty":         {Mode: 0644, ModTime: mtime},
+		"dir/sub/file":  {Data: []byte("deep"), Mode: 0444, ModTime: mtime},
+		"dir/emptydir":  {Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"dir/zeros":     {Data: make([]byte, 2*testBlockSize), Mode: 0644, ModTime: mtime},
+		"dir/sub":       {Mode: fs.ModeDir | 0700, ModTime: mtime},
+		"dir":           {Mode: fs.ModeDir | 0755, ModTime: mtime},
+		"dir/exec file": {Data: []byte("#!/bin/rc\n"), Mode: 0755, ModTime: mtime},
+	}
+	// enough entries to need several meta blocks
+	for i := 0; i < 50; i++ {
+		m["many/"+string(rune('a'+i%26))+string(rune('a'+i/26))] = &fstest.MapFile{Data: []byte{byte(i)}, ModTime: mtime}
+	}
+	return m
+}
+
+func testCompareFS(t *testing.T, v *FS, m fstest.MapFS) {
+	var names []string
+	for name, f := range m {
+		if !f.Mode.IsDir() {
+			names = append(names, name)
+		}
+	}
+	if err := fstest.TestFS(v, names...); err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range m {
+		fi, err := fs.Stat(v, name)
+		if err != nil {
+			t.Errorf("stat %s: %v", name, err)
+			continue
+		}
+		if fi.Mode() != f.Mode && !(f.Mode == 0 && fi.Mode() == 0) {
+			t.Errorf("stat %s: mode %v, want %v", name, fi.Mode(), f.Mode)
+		}
+		if !fi.ModTime().Equal(f.ModTime) {
+			t.Errorf("stat %s: mtime %v, want %v", name, fi.ModTime(), f.ModTime)
+		}
+		if f.Mode.IsDir() {
+			continue
+		}
+		data, err := fs.ReadFile(v, name)
+		if err != nil {
+			t.Errorf("read %s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(data, f.Data) {
+			t.Errorf("read %s: got %d bytes, want %d", name, len(data), len(f.Data))
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	z := venti.NewMemStore()
+	m := testMapFS()
+	w := NewWriter(z)
+	w.BlockSize = testBlockSize
+	w.Owner = func(fs.FileInfo) (string, string) { return "glenda", "sys" }
+	score, err := w.Write(m, ".", "test")
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	nfiles := 0
+	for _, f := range m {
+		if !f.Mode.IsDir() {
+			nfiles++
+		}
+	}
+	if w.Files != nfiles || w.Reused != 0 {
+		t.Errorf("wrote %d files, %d reused; want %d, 0", w.Files, w.Reused, nfiles)
+	}
+
+	v, err := Open(z, score)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if r := v.Root(); r.Name != "test" || r.Type != "vac" || r.Prev != (venti.Score{}) {
+		t.Errorf("root: got %v", &r)
+	}
+	testCompareFS(t, v, m)
+
+	fi, err := fs.Stat(v, "dir/sub/file")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if de := fi.Sys().(*DirEntry); de.Uid != "glenda" || de.Gid != "sys" {
+		t.Errorf("stat: owner %s, group %s", de.Uid, de.Gid)
+	}
+
+	// the same files give the same scores
+	w2 := NewWriter(z)
+	w2.BlockSize = testBlockSize
+	w2.Owner = w.Owner
+	if score2, err := w2.Write(m, ".", "test"); err != nil || *score2 != *score {
+		t.Errorf("rewrite: got %v, %v; want %v", score2, err, score)
+	}
+}
+
+func TestWriterIncremental(t *testing.T) {
+	z := venti.NewMemStore()
+	m := testMapFS()
+	w := NewWriter(z)
+	w.BlockSize = testBlockSize
+	score, err := w.Write(m, ".", "test")
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	prev, err := Open(z, score)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	later := m["hello"].ModTime.Add(time.Hour)
+	m["hello"] = &fstest.MapFile{Data: []byte("goodbye\n"), Mode: 0644, ModTime: later}
+	m["dir/sub/new"] = &fstest.MapFile{Data: []byte("new"), Mode: 0644, ModTime: later}
+	delete(m, "empty")
+
+	// the unchanged files are not read again
+	counted := &countFS{MapFS: m}
+	w = NewWriter(z)
+	w.BlockSize = testBlockSize
+	w.Prev = prev
+	score, err = w.Write(counted, ".", "test")
+	if err != nil {
+		t.Fatalf("incremental write: %v", err)
+	}
+	if w.Reused != w.Files-2 {
+		t.Errorf("reused %d of %d files, want %d", w.Reused, w.Files, w.Files-2)
+	}
+	if counted.opens["big"] != 0 || counted.opens["hello"] != 1 {
+		t.Errorf("opened big %d times and hello %d times, want 0 and 1", counted.opens["big"], counted.opens["hello"])
+	}
+
+	v, err := Open(z, score)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if r := v.Root(); r.Prev != prev.Score() {
+		t.Errorf("root prev: got %v, want %v", &r.Prev, prev.Score())
+	}
+	testCompareFS(t, v, m)
+}
+
+// A countFS counts the files opened in it.
+type countFS struct {
+	fstest.MapFS
+	opens map[string]int
+}
+
+func (c *countFS) Open(name string) (fs.File, error) {
+	if c.opens == nil {
+		c.opens = make(map[string]int)
+	}
+	if fi, err := c.MapFS.Stat(name); err == nil && !fi.IsDir() {
+		c.opens[name]++
+	}
+	return c.MapFS.Open(name)
+}
@@ -0,0 +1,712 @@
+package venti
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/floren/fs/internal/pack"
+)
+
+/*
+ * On-disk formats of plan9port's venti, as written by fmtarenas,
+ * fmtisect and fmtindex.
+ *
+ * An arena partition starts with partBlank untouched bytes, then
+ * the partition header, then a text table mapping arena names to
+ * byte ranges of the partition. Each arena is a header block, a log
+ * of clumps growing up from the start of the arena, a directory of
+ * clump info entries growing down from the end, and a trailer block
+ * holding the arena's statistics.
+ */
+const (
+	partBlank    = 256 * 1024
+	headSize     = 512
+	aNameSize    = 64
+	aBlockLog    = 9
+	indexBase    = 1024 * 1024
+	minArenaSize = 1024 * 1024
+	maxDiskBlock = 64 * 1024
+
+	arenaPartMagic = 0xa9e4a5e7
+	arenaMagic     = 0xf2a14ead
+	arenaHeadMagic = 0xd15c4ead
+	oldClumpMagic  = 0xd15cb10c
+
+	arenaPartVersion = 3
+	arenaVersion4    = 4
+	arenaVersion5    = 5
+
+	clumpEErr      = 0
+	clumpENone     = 1
+	clumpECompress = 2
+
+	arenaPartSize  = 4 * 4
+	arenaSize4     = 2*8 + 6*4 + aNameSize + 1
+	arenaSize5     = arenaSize4 + 4
+	arenaSize5a    = arenaSize5 + 2*1 + 2*4 + 2*8
+	arenaHeadSize4 = 8 + 3*4 + aNameSize
+	arenaHeadSize5 = arenaHeadSize4 + 4
+	clumpInfoSize  = 1 + 2*2 + ScoreSize
+	clumpSize      = clumpInfoSize + 1 + 3*4
+)
+
+var errArenaFull = errors.New("arena is full")
+
+// An arenaMap names a range of bytes, either in a partition or
+// in the address space of an index.
+type arenaMap struct {
+	name        string
+	start, stop uint64
+}
+
+type arenaPart struct {
+	f         *os.File
+	file      string
+	blockSize uint32
+	size      uint64
+	tabBase   uint64
+	tabSize   uint64
+	arenaBase uint64
+	amap      []arenaMap
+	arenas    []*arena
+}
+
+type arenaStats struct {
+	clumps  uint32
+	cclumps uint32
+	used    uint64
+	uncsize uint64
+	sealed  bool
+}
+
+type arena struct {
+	part       *arenaPart
+	name       string
+	version    uint32
+	blockSize  uint32
+	clumpMagic uint32
+	clumpMax   uint32
+	base       uint64 // start of the clump log
+	size       uint64 // size of the clump log and directory
+	ctime      uint32
+	wtime      uint32
+
+	// diskStats describes the clumps which are in the index,
+	// memStats all the clumps in the arena.
+	diskStats arenaStats
+	memStats  arenaStats
+
+	score Score // set once the arena is sealed
+}
+
+// A clumpInfo is an entry in an arena's clump directory.
+type clumpInfo struct {
+	typ     BlockType
+	size    uint16 // size on disk
+	uncsize uint16 // size after decompression
+	score   Score
+}
+
+func openArenaPart(file string) (*arenaPart, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	ap, err := readArenaPart(f, file)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("arena partition %s: %v", file, err)
+	}
+	return ap, nil
+}
+
+func readArenaPart(f *os.File, file string) (*arenaPart, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, headSize)
+	if err := readFull(f, buf, partBlank); err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+	if m := pack.GetUint32(buf); m != arenaPartMagic {
+		return nil, fmt.Errorf("bad magic %#x", m)
+	}
+	if v := pack.GetUint32(buf[4:]); v != arenaPartVersion {
+		return nil, fmt.Errorf("unknown version %d", v)
+	}
+	ap := &arenaPart{
+		f:         f,
+		file:      file,
+		blockSize: pack.GetUint32(buf[8:]),
+		arenaBase: uint64(pack.GetUint32(buf[12:])),
+	}
+	if !isPow2(ap.blockSize) || ap.blockSize > maxDiskBlock {
+		return nil, fmt.Errorf("bad block size %d", ap.blockSize)
+	}
+	ap.size = uint64(fi.Size()) &^ uint64(ap.blockSize-1)
+	ap.tabBase = roundUp(partBlank+headSize, uint64(ap.blockSize))
+	if ap.arenaBase < ap.tabBase || ap.arenaBase > ap.size {
+		return nil, fmt.Errorf("bad arena base %d", ap.arenaBase)
+	}
+	ap.tabSize = ap.arenaBase - ap.tabBase
+
+	tab := make([]byte, ap.tabSize)
+	if err := readFull(f, tab, int64(ap.tabBase)); err != nil {
+		return nil, fmt.Errorf("read arena map: %v", err)
+	}
+	if ap.amap, err = parseArenaMap(tab); err != nil {
+		return nil, fmt.Errorf("arena map: %v", err)
+	}
+
+	for _, m := range ap.amap {
+		if m.start < ap.arenaBase || m.stop > ap.size || m.stop < m.start+2*uint64(ap.blockSize) {
+			return nil, fmt.Errorf("arena %s has bad range [%d,%d)", m.name, m.start, m.stop)
+		}
+		a, err := openArena(ap, m)
+		if err != nil {
+			return nil, err
+		}
+		ap.arenas = append(ap.arenas, a)
+	}
+
+	return ap, nil
+}
+
+func (ap *arenaPart) writeHeader() error {
+	buf := make([]byte, headSize)
+	pack.PutUint32(buf, arenaPartMagic)
+	pack.PutUint32(buf[4:], arenaPartVersion)
+	pack.PutUint32(buf[8:], ap.blockSize)
+	pack.PutUint32(buf[12:], uint32(ap.arenaBase))
+	if _, err := ap.f.WriteAt(buf, partBlank); err != nil {
+		return err
+	}
+
+	tab := formatArenaMap(ap.amap)
+	if uint64(len(tab)) > ap.tabSize {
+		return fmt.Errorf("arena map too big: %d > %d", len(tab), ap.tabSize)
+	}
+	buf = make([]byte, ap.tabSize)
+	copy(buf, tab)
+	_, err := ap.f.WriteAt(buf, int64(ap.tabBase))
+	return err
+}
+
+func (ap *arenaPart) close() error {
+	return ap.f.Close()
+}
+
+// parseArenaMap parses the text form of an arena map: a count
+// followed by that many name, start, stop triples.
+func parseArenaMap(buf []byte) ([]arenaMap, error) {
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	amap, rest, err := parseArenaMapFields(strings.Fields(string(buf)))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("junk after map: %q", rest[0])
+	}
+	return amap, nil
+}
+
+func parseArenaMapFields(f []string) ([]arenaMap, []string, error) {
+	if len(f) < 1 {
+		return nil, nil, errors.New("missing entry count")
+	}
+	n, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad entry count: %v", err)
+	}
+	f = f[1:]
+	if uint64(len(f)) < 3*n {
+		return nil, nil, fmt.Errorf("short map: %d entries, want %d", len(f)/3, n)
+	}
+	amap := make([]arenaMap, n)
+	for i := range amap {
+		amap[i].name = f[0]
+		if amap[i].start, err = strconv.ParseUint(f[1], 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("bad start for %s: %v", f[0], err)
+		}
+		if amap[i].stop, err = strconv.ParseUint(f[2], 10, 64); err != nil {
+			return nil, nil, fmt.Errorf("bad stop for %s: %v", f[0], err)
+		}
+		if amap[i].stop < amap[i].start {
+			return nil, nil, fmt.Errorf("bad range for %s", f[0])
+		}
+		f = f[3:]
+	}
+	return amap, f, nil
+}
+
+func formatArenaMap(amap []arenaMap) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n", len(amap))
+	for _, m := range amap {
+		fmt.Fprintf(&b, "%s\t%d\t%d\n", m.name, m.start, m.stop)
+	}
+	return b.String()
+}
+
+func openArena(ap *arenaPart, m arenaMap) (*arena, error) {
+	a := &arena{
+		part:      ap,
+		name:      m.name,
+		blockSize: ap.blockSize,
+		clumpMax:  ap.blockSize / clumpInfoSize,
+		base:      m.start + uint64(ap.blockSize),
+		size:      m.stop - m.start - 2*uint64(ap.blockSize),
+	}
+
+	buf := make([]byte, a.blockSize)
+	if err := readFull(ap.f, buf, int64(a.base+a.size)); err != nil {
+		return nil, fmt.Errorf("arena %s: read trailer: %v", a.name, err)
+	}
+	if err := a.unpackTrailer(buf); err != nil {
+		return nil, fmt.Errorf("arena %s: %v", m.name, err)
+	}
+	if a.name != m.name {
+		return nil, fmt.Errorf("arena %s: trailer has name %s", m.name, a.name)
+	}
+
+	if err := readFull(ap.f, buf, int64(a.base)-int64(a.blockSize)); err != nil {
+		return nil, fmt.Errorf("arena %s: read header: %v", a.name, err)
+	}
+	if err := a.checkHead(buf); err != nil {
+		return nil, fmt.Errorf("arena %s: %v", a.name, err)
+	}
+
+	return a, nil
+}
+
+func (a *arena) unpackTrailer(buf []byte) error {
+	if m := pack.GetUint32(buf); m != arenaMagic {
+		return fmt.Errorf("bad trailer magic %#x", m)
+	}
+	a.version = pack.GetUint32(buf[4:])
+	a.name = cString(buf[8 : 8+aNameSize])
+	p := buf[8+aNameSize:]
+	a.diskStats.clumps = pack.GetUint32(p)
+	a.diskStats.cclumps = pack.GetUint32(p[4:])
+	a.ctime = pack.GetUint32(p[8:])
+	a.wtime = pack.GetUint32(p[12:])
+	p = p[16:]
+	switch a.version {
+	case arenaVersion4:
+		a.clumpMagic = oldClumpMagic
+	case arenaVersion5:
+		a.clumpMagic = pack.GetUint32(p)
+		p = p[4:]
+	default:
+		return fmt.Errorf("unknown version %d", a.version)
+	}
+	a.diskStats.used = pack.GetUint64(p)
+	a.diskStats.uncsize = pack.GetUint64(p[8:])
+	a.diskStats.sealed = p[16] != 0
+	p = p[17:]
+
+	/*
+	 * Newer versions of venti append the statistics for the
+	 * clumps not yet in the index.
+	 */
+	if p[0] != 0 {
+		a.memStats.clumps = pack.GetUint32(p[1:])
+		a.memStats.cclumps = pack.GetUint32(p[5:])
+		a.memStats.used = pack.GetUint64(p[9:])
+		a.memStats.uncsize = pack.GetUint64(p[17:])
+		a.memStats.sealed = p[25] != 0
+	} else {
+		a.memStats = a.diskStats
+	}
+	copy(a.score[:], buf[len(buf)-ScoreSize:])
+
+	if a.memStats.used > a.size {
+		return fmt.Errorf("bad used size %d", a.memStats.used)
+	}
+	return nil
+}
+
+func (a *arena) packTrailer(buf []byte) {
+	memset(buf, 0)
+	pack.PutUint32(buf, arenaMagic)
+	pack.PutUint32(buf[4:], a.version)
+	copy(buf[8:8+aNameSize], a.name)
+	p := buf[8+aNameSize:]
+	pack.PutUint32(p, a.diskStats.clumps)
+	pack.PutUint32(p[4:], a.diskStats.cclumps)
+	pack.PutUint32(p[8:], a.ctime)
+	pack.PutUint32(p[12:], a.wtime)
+	p = p[16:]
+	if a.version == arenaVersion5 {
+		pack.PutUint32(p, a.clumpMagic)
+		p = p[4:]
+	}
+	pack.PutUint64(p, a.diskStats.used)
+	pack.PutUint64(p[8:], a.diskStats.uncsize)
+	p[16] = bool2byte(a.diskStats.sealed)
+	p = p[17:]
+	if a.memStats != a.diskStats {
+		p[0] = 1
+		pack.PutUint32(p[1:], a.memStats.clumps)
+		pack.PutUint32(p[5:], a.memStats.cclumps)
+		pack.PutUint64(p[9:], a.memStats.used)
+		pack.PutUint64(p[17:], a.memStats.uncsize)
+		p[25] = bool2byte(a.memStats.sealed)
+	}
+	copy(buf[len(buf)-ScoreSize:], a.score[:])
+}
+
+func (a *arena) writeTrailer() error {
+	buf := make([]byte, a.blockSize)
+	a.packTrailer(buf)
+	_, err := a.part.f.WriteAt(buf, int64(a.base+a.size))
+	return err
+}
+
+func (a *arena) checkHead(buf []byte) error {
+	if m := pack.GetUint32(buf); m != arenaHeadMagic {
+		return fmt.Errorf("bad header magic %#x", m)
+	}
+	if v := pack.GetUint32(buf[4:]); v != a.version {
+		return fmt.Errorf("header version %d != trailer version %d", v, a.version)
+	}
+	if name := cString(buf[8 : 8+aNameSize]); name != a.name {
+		return fmt.Errorf("header has name %s", name)
+	}
+	p := buf[8+aNameSize:]
+	if bs := pack.GetUint32(p); bs != a.blockSize {
+		return fmt.Errorf("header block size %d != partition block size %d", bs, a.blockSize)
+	}
+	if size := pack.GetUint64(p[4:]); size != a.size+2*uint64(a.blockSize) {
+		return fmt.Errorf("header size %d does not match map", size)
+	}
+	if a.version == arenaVersion5 {
+		if m := pack.GetUint32(p[12:]); m != a.clumpMagic {
+			return fmt.Errorf("header clump magic %#x != trailer clump magic %#x", m, a.clumpMagic)
+		}
+	}
+	return nil
+}
+
+func (a *arena) writeHead() error {
+	buf := make([]byte, a.blockSize)
+	pack.PutUint32(buf, arenaHeadMagic)
+	pack.PutUint32(buf[4:], a.version)
+	copy(buf[8:8+aNameSize], a.name)
+	p := buf[8+aNameSize:]
+	pack.PutUint32(p, a.blockSize)
+	pack.PutUint64(p[4:], a.size+2*uint64(a.blockSize))
+	if a.version == arenaVersion5 {
+		pack.PutUint32(p[12:], a.clumpMagic)
+	}
+	_, err := a.part.f.WriteAt(buf, int64(a.base)-int64(a.blockSize))
+	return err
+}
+
+// dirSize returns the space taken by the directory of an arena
+// holding n clumps.
+func (a *arena) dirSize(n uint32) uint64 {
+	return uint64(n/a.clumpMax+1) * uint64(a.blockSize)
+}
+
+// clumpInfoAddr returns the partition offset of the directory
+// entry for clump n.
+func (a *arena) clumpInfoAddr(n uint32) int64 {
+	block := n / a.clumpMax
+	off := (n - block*a.clumpMax) * clumpInfoSize
+	return int64(a.base+a.size-uint64(block+1)*uint64(a.blockSize)) + int64(off)
+}
+
+func (a *arena) readClumpInfo(n uint32) (*clumpInfo, error) {
+	buf := make([]byte, clumpInfoSize)
+	if err := readFull(a.part.f, buf, a.clumpInfoAddr(n)); err != nil {
+		return nil, err
+	}
+	return unpackClumpInfo(buf), nil
+}
+
+func unpackClumpInfo(buf []byte) *clumpInfo {
+	ci := &clumpInfo{
+		typ:     BlockType(buf[0]),
+		size:    pack.GetUint16(buf[1:]),
+		uncsize: pack.GetUint16(buf[3:]),
+	}
+	copy(ci.score[:], buf[5:])
+	return ci
+}
+
+func packClumpInfo(ci *clumpInfo, buf []byte) {
+	buf[0] = uint8(ci.typ)
+	pack.PutUint16(buf[1:], ci.size)
+	pack.PutUint16(buf[3:], ci.uncsize)
+	copy(buf[5:], ci.score[:])
+}
+
+// readClumpHeader reads the header of the clump at offset aa
+// in the clump log.
+func (a *arena) readClumpHeader(aa uint64) (*clumpInfo, uint8, error) {
+	if aa+clumpSize > a.size {
+		return nil, 0, fmt.Errorf("clump address %d out of range", aa)
+	}
+	buf := make([]byte, clumpSize)
+	if err := readFull(a.part.f, buf, int64(a.base+aa)); err != nil {
+		return nil, 0, err
+	}
+	if m := pack.GetUint32(buf); m != a.clumpMagic {
+		return nil, 0, fmt.Errorf("bad clump magic %#x at %s:%d", m, a.name, aa)
+	}
+	ci := unpackClumpInfo(buf[4:])
+	return ci, buf[4+clumpInfoSize], nil
+}
+
+// readClump reads the clump at offset aa in the clump log into p,
+// checking that it has the given type and score.
+func (a *arena) readClump(aa uint64, score *Score, typ BlockType, p []byte) (int, error) {
+	ci, encoding, err := a.readClumpHeader(aa)
+	if err != nil {
+		return 0, err
+	}
+	if ci.typ != typ || ci.score != *score {
+		return 0, fmt.Errorf("clump at %s:%d is %v/%d, want %v/%d", a.name, aa, &ci.score, ci.typ, score, typ)
+	}
+	if aa+clumpSize+uint64(ci.size) > a.size {
+		return 0, fmt.Errorf("clump at %s:%d overflows arena", a.name, aa)
+	}
+	if err := checkRead(score, typ, int(ci.uncsize), p); err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, ci.size)
+	if err := readFull(a.part.f, data, int64(a.base+aa+clumpSize)); err != nil {
+		return 0, err
+	}
+	switch encoding {
+	case clumpENone:
+		if ci.size != ci.uncsize {
+			return 0, fmt.Errorf("clump at %s:%d has size %d != uncompressed size %d", a.name, aa, ci.size, ci.uncsize)
+		}
+		copy(p, data)
+	case clumpECompress:
+		n, err := unwhack(p[:ci.uncsize], data)
+		if err != nil {
+			return 0, fmt.Errorf("clump at %s:%d: %v", a.name, aa, err)
+		}
+		if n != int(ci.uncsize) {
+			return 0, fmt.Errorf("clump at %s:%d decompressed to %d bytes, want %d", a.name, aa, n, ci.uncsize)
+		}
+	default:
+		return 0, fmt.Errorf("clump at %s:%d has unknown encoding %d", a.name, aa, encoding)
+	}
+	if !score.Check(p[:ci.uncsize]) {
+		return 0, fmt.Errorf("clump at %s:%d fails score check", a.name, aa)
+	}
+	return int(ci.uncsize), nil
+}
+
+// writeClump appends p to the clump log and directory, returning
+// its offset in the log. If the arena has no room for the clump,
+// it is sealed and errArenaFull is returned.
+func (a *arena) writeClump(typ BlockType, score *Score, p []byte, now uint32) (uint64, error) {
+	if a.memStats.sealed {
+		return 0, errArenaFull
+	}
+	n := uint64(clumpSize + len(p) + 4)
+	aa := a.memStats.used
+	if aa+n+4+a.dirSize(a.memStats.clumps+1) > a.size {
+		a.memStats.sealed = true
+		if err := a.writeTrailer(); err != nil {
+			return 0, err
+		}
+		return 0, errArenaFull
+	}
+
+	/*
+	 * The clump is followed by a zero magic number, which
+	 * terminates the log until the next clump is written.
+	 */
+	ci := &clumpInfo{
+		typ:     typ,
+		size:    uint16(len(p)),
+		uncsize: uint16(len(p)),
+		score:   *score,
+	}
+	buf := make([]byte, n)
+	pack.PutUint32(buf, a.clumpMagic)
+	packClumpInfo(ci, buf[4:])
+	buf[4+clumpInfoSize] = clumpENone
+	pack.PutUint32(buf[4+clumpInfoSize+1+4:], now)
+	copy(buf[clumpSize:], p)
+	if _, err := a.part.f.WriteAt(buf, int64(a.base+aa)); err != nil {
+		return 0, err
+	}
+
+	cbuf := make([]byte, clumpInfoSize)
+	packClumpInfo(ci, cbuf)
+	if _, err := a.part.f.WriteAt(cbuf, a.clumpInfoAddr(a.memStats.clumps)); err != nil {
+		return 0, err
+	}
+
+	a.memStats.used += uint64(clumpSize + len(p))
+	a.memStats.uncsize += uint64(len(p))
+	a.memStats.clumps++
+	a.wtime = now
+	if a.ctime == 0 {
+		a.ctime = now
+	}
+	if err := a.writeTrailer(); err != nil {
+		return 0, err
+	}
+
+	return aa, nil
+}
+
+// seal computes the score of a full arena, once all of its
+// clumps are in the index.
+func (a *arena) seal() error {
+	buf := make([]byte, a.blockSize)
+	h := sha1.New()
+	for off := a.base - uint64(a.blockSize); off < a.base+a.size; off += uint64(a.blockSize) {
+		if err := readFull(a.part.f, buf, int64(off)); err != nil {
+			return err
+		}
+		h.Write(buf)
+	}
+
+	a.diskStats.sealed = true
+	a.memStats.sealed = true
+	a.score = Score{}
+	a.packTrailer(buf)
+	h.Write(buf)
+	copy(a.score[:], h.Sum(nil))
+
+	return a.writeTrailer()
+}
+
+func newArena(ap *arenaPart, name string, start, stop uint64) (*arena, error) {
+	a := &arena{
+		part:      ap,
+		name:      name,
+		version:   arenaVersion5,
+		blockSize: ap.blockSize,
+		clumpMax:  ap.blockSize / clumpInfoSize,
+		base:      start + uint64(ap.blockSize),
+		size:      stop - start - 2*uint64(ap.blockSize),
+	}
+	for a.clumpMagic == 0 || a.clumpMagic == oldClumpMagic {
+		a.clumpMagic = randomMagic()
+	}
+	if err := a.writeTrailer(); err != nil {
+		return nil, err
+	}
+	if err := a.writeHead(); err != nil {
+		return nil, err
+	}
+	if _, err := ap.f.WriteAt(make([]byte, a.blockSize), int64(a.base)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// formatArenas formats file as an arena partition holding arenas of
+// arenaSize bytes named name0, name1, and so on, like fmtarenas.
+func formatArenas(file, name string, blockSize uint32, arenaSize uint64) error {
+	if !isPow2(blockSize) || blockSize > maxDiskBlock {
+		return fmt.Errorf("bad block size %d", blockSize)
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const tabSize = 512 * 1024
+	ap := &arenaPart{
+		f:         f,
+		file:      file,
+		blockSize: blockSize,
+		size:      uint64(fi.Size()) &^ uint64(blockSize-1),
+	}
+	ap.tabBase = roundUp(partBlank+headSize, uint64(blockSize))
+	ap.arenaBase = roundUp(ap.tabBase+tabSize, uint64(blockSize))
+	ap.tabSize = ap.arenaBase - ap.tabBase
+	if ap.arenaBase+minArenaSize > ap.size {
+		return fmt.Errorf("%s: partition too small", file)
+	}
+
+	apsize := ap.size - ap.arenaBase
+	n := apsize / arenaSize
+	if apsize-n*arenaSize >= minArenaSize {
+		n++
+	}
+	addr := ap.arenaBase
+	for i := uint64(0); i < n; i++ {
+		limit := addr + arenaSize
+		if limit >= ap.size || ap.size-limit < minArenaSize {
+			limit = ap.size
+		}
+		m := arenaMap{
+			name:  fmt.Sprintf("%s%d", name, i),
+			start: addr,
+			stop:  limit,
+		}
+		if _, err := newArena(ap, m.name, m.start, m.stop); err != nil {
+			return fmt.Errorf("%s: arena %s: %v", file, m.name, err)
+		}
+		ap.amap = append(ap.amap, m)
+		addr = limit
+	}
+
+	if err := ap.writeHeader(); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return f.Sync()
+}
+
+func readFull(f *os.File, buf []byte, off int64) error {
+	_, err := f.ReadAt(buf, off)
+	return err
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func bool2byte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isPow2(n uint32) bool {
+	return n != 0 && n&(n-1) == 0
+}
+
+func roundUp(n, size uint64) uint64 {
+	return (n + size - 1) &^ (size - 1)
+}
+
+func randomMagic() uint32 {
+	var buf [4]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("random magic: %v", err))
+	}
+	return pack.GetUint32(buf[:])
+}
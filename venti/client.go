@@ -2,30 +2,54 @@ package venti
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-
-	"github.com/floren/fs/internal/pack"
+	"time"
 )
 
-func (z *Session) rpc(tx, rx *fcall) error {
+// rpc sends tx and waits for the response in rx. If ctx is done
+// first, rpc returns ctx.Err(), and the tag is released once the
+// server's response arrives.
+func (z *Session) rpc(ctx context.Context, tx, rx *fcall) error {
+	if err := z.start(ctx, tx, rx); err != nil {
+		return err
+	}
+	return z.finish(ctx, tx, rx)
+}
+
+// start allocates a tag for tx and queues it for transmission.
+func (z *Session) start(ctx context.Context, tx, rx *fcall) error {
 	if z == nil {
 		panic("nil venti.Session")
 	}
 	if z.isClosed() {
 		return errors.New("session is closed")
 	}
+	if err := z.Err(); err != nil {
+		return err
+	}
 
-	tag := z.getTag()
-	defer z.putTag(tag)
+	tag, err := z.getTag(ctx)
+	if err != nil {
+		return fmt.Errorf("get tag: %w", err)
+	}
 	tx.tag = tag
 	rx.tag = tag
 
-	z.transmit(tx)
+	if err := z.transmit(ctx, tx); err != nil {
+		z.putTag(tag)
+		return fmt.Errorf("transmit: %w", err)
+	}
+	return nil
+}
 
-	if err := z.receive(rx); err != nil {
-		return fmt.Errorf("receive: %v", err)
+// finish waits for the response to a call begun by start.
+func (z *Session) finish(ctx context.Context, tx, rx *fcall) error {
+	// receive releases the tag
+	if err := z.receive(ctx, rx); err != nil {
+		return fmt.Errorf("receive: %w", err)
 	}
 
 	if rx.msgtype == rError {
@@ -37,53 +61,88 @@ func (z *Session) rpc(tx, rx *fcall) error {
 	return nil
 }
 
-func (z *Session) transmit(tx *fcall) {
+func (z *Session) transmit(ctx context.Context, tx *fcall) error {
 	dprintf("\t-> %v\n", tx)
-	z.outgoing <- tx
+	select {
+	case z.outgoing <- tx:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (z *Session) transmitThread() {
 	for tx := range z.outgoing {
+		// mark the tag in flight first; the response may
+		// arrive before transmitMessage returns.
+		z.setInflight(tx.tag)
 		if err := z.transmitMessage(tx); err != nil {
-			_ = <-z.incoming[tx.tag]
-			z.incoming[tx.tag] <- internalError(fmt.Errorf("transmit: %v", err))
+			// failInflight may have answered the tag already.
+			if z.takeInflight(tx.tag) {
+				_ = <-z.incoming[tx.tag]
+				z.incoming[tx.tag] <- internalError(fmt.Errorf("transmit: %v", err))
+			}
 			continue
 		}
 		// wake up z.receiveThread
 		z.outstanding <- struct{}{}
 	}
 	dprintf("transmitThread: exiting\n")
+	if err := z.goodbye(); err != nil {
+		dprintf("goodbye: %v\n", err)
+	}
+	z.fail(errors.New("session is closed"))
 	close(z.outstanding)
 }
 
+// transmitMessage writes tx to the connection. An error writing
+// breaks the session.
 func (z *Session) transmitMessage(tx *fcall) error {
+	if err := z.Err(); err != nil {
+		return err
+	}
 	packed, err := tx.pack()
 	if err != nil {
 		return fmt.Errorf("pack: %v", err)
 	}
 
-	buf := make([]byte, 2)
-	pack.PutUint16(buf, uint16(len(packed)+len(tx.data)))
+	buf, err := packLength(z.version, len(packed)+len(tx.data))
+	if err != nil {
+		return err
+	}
 	if _, err := z.c.Write(buf); err != nil {
-		return fmt.Errorf("write message header: %v", err)
+		return z.fail(fmt.Errorf("write message header: %v", err))
 	}
 	if _, err := z.c.Write(packed); err != nil {
-		return fmt.Errorf("write message body: %v", err)
+		return z.fail(fmt.Errorf("write message body: %v", err))
 	}
 
 	if tx.msgtype == tWrite {
 		// write data directly to the network
 		_, err := z.c.Write(tx.data)
 		if err != nil {
-			return fmt.Errorf("write data: %v", err)
+			return z.fail(fmt.Errorf("write data: %v", err))
 		}
 	}
 	return nil
 }
 
-func (z *Session) receive(rx *fcall) error {
-	z.incoming[rx.tag] <- rx
-	rx = <-z.incoming[rx.tag]
+func (z *Session) receive(ctx context.Context, rx *fcall) error {
+	tag := rx.tag
+
+	select {
+	case z.incoming[tag] <- rx:
+	case <-ctx.Done():
+		go z.abandon(tag, &fcall{tag: tag})
+		return ctx.Err()
+	}
+	select {
+	case rx = <-z.incoming[tag]:
+	case <-ctx.Done():
+		go z.abandon(tag, nil)
+		return ctx.Err()
+	}
+	z.putTag(tag)
 
 	if rx.msgtype == tError {
 		return rx.err
@@ -94,12 +153,33 @@ func (z *Session) receive(rx *fcall) error {
 	return nil
 }
 
+// abandon waits for the response to a cancelled call, then
+// releases its tag. If rx is not nil, the receive thread has
+// not yet been given a buffer for the response.
+func (z *Session) abandon(tag uint8, rx *fcall) {
+	if rx != nil {
+		z.incoming[tag] <- rx
+	}
+	rx = <-z.incoming[tag]
+	dprintf("\t<- %v (abandoned)\n", rx)
+	z.putTag(tag)
+}
+
 func (z *Session) receiveThread() {
 	for range z.outstanding {
+		if z.Err() != nil {
+			z.failInflight()
+			continue
+		}
 		length, msgtype, tag, err := z.receiveHeader()
 		if err != nil {
-			_ = <-z.incoming[tag]
-			z.incoming[tag] <- internalError(fmt.Errorf("receive header: %v", err))
+			z.fail(fmt.Errorf("receive header: %v", err))
+			z.failInflight()
+			continue
+		}
+		if !z.takeInflight(tag) {
+			z.fail(fmt.Errorf("received unexpected tag %d", tag))
+			z.failInflight()
 			continue
 		}
 		rx := <-z.incoming[tag]
@@ -113,46 +193,71 @@ func (z *Session) receiveThread() {
 		z.incoming[tag] <- rx
 	}
 	dprintf("receiveThread: exiting\n")
+	z.failInflight()
 	for i := range z.incoming {
 		close(z.incoming[i])
 	}
-	if err := z.goodbye(); err != nil {
-		dprintf("goodbye: %v\n", err)
+}
+
+// failInflight fails all calls waiting for a response
+// on a broken session.
+func (z *Session) failInflight() {
+	z.mu.Lock()
+	tags := z.inflight
+	z.inflight = tagSet{}
+	err := z.err
+	z.mu.Unlock()
+
+	for i := range z.incoming {
+		tag := uint8(i)
+		if tags.has(tag) {
+			_ = <-z.incoming[tag]
+			z.incoming[tag] <- internalError(err)
+		}
 	}
 }
 
-func (z *Session) receiveHeader() (length uint16, msgtype, tag uint8, err error) {
-	buf := make([]byte, 4)
-	var n int
-	n, err = z.c.Read(buf[:])
-	if n < len(buf) && err == nil {
-		err = errors.New("short read")
+func (z *Session) receiveHeader() (length int, msgtype, tag uint8, err error) {
+	n := frameSize(z.version)
+	buf := make([]byte, n+2)
+	if _, err = io.ReadFull(z.c, buf); err != nil {
+		return
+	}
+	length = unpackLength(buf[:n])
+	msgtype = buf[n]
+	tag = buf[n+1]
+	if length < 2 {
+		err = fmt.Errorf("bad message length: %d", length)
+		return
 	}
-	length = pack.GetUint16(buf)
-	msgtype = buf[2]
-	tag = buf[3]
 	length -= 2 // already got msgtype and tag
 	return
 }
 
-func (z *Session) receiveMessage(rx *fcall, length uint16) error {
+func (z *Session) receiveMessage(rx *fcall, length int) error {
 	if rx.msgtype == rRead {
+		if length > len(rx.data) {
+			if _, err := io.CopyN(io.Discard, z.c, int64(length)); err != nil {
+				return z.fail(err)
+			}
+			return fmt.Errorf("data too big for buffer: %d > %d", length, len(rx.data))
+		}
 		// read data directly from the network
 		data := rx.data[:length]
 		for len(data) > 0 {
 			n, err := z.c.Read(data)
 			if err != nil {
-				return err
+				return z.fail(err)
 			}
 			data = data[n:]
 		}
-		rx.count = length
+		rx.count = uint16(length)
 		return nil
 	}
 
 	var buf bytes.Buffer
 	if _, err := io.CopyN(&buf, z.c, int64(length)); err != nil {
-		return err
+		return z.fail(err)
 	}
 	if err := unpackFcall(buf.Bytes(), rx); err != nil {
 		return fmt.Errorf("unpack fcall: %v", err)
@@ -160,29 +265,110 @@ func (z *Session) receiveMessage(rx *fcall, length uint16) error {
 	return nil
 }
 
-func (z *Session) getTag() uint8 {
-	z.mu.Lock()
-	defer z.mu.Unlock()
-
-	for i := uint8(0); i < 64; i++ {
-		if z.tagBitmap&(1<<i) == 0 {
-			z.tagBitmap |= 1 << i
-			return i
-		}
+// getTag allocates a tag for an RPC. If all tags are in use,
+// it waits for one to be released, or for ctx to be done.
+func (z *Session) getTag(ctx context.Context) (uint8, error) {
+	select {
+	case tag := <-z.tags:
+		z.mu.Lock()
+		z.stats.RPCs++
+		z.mu.Unlock()
+		return tag, nil
+	default:
 	}
 
-	panic("out of tags")
+	z.mu.Lock()
+	z.stats.RPCs++
+	z.stats.TagWaits++
+	z.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		z.mu.Lock()
+		z.stats.TagWait += time.Since(start)
+		z.mu.Unlock()
+	}()
+
+	select {
+	case tag := <-z.tags:
+		return tag, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
 }
 
 func (z *Session) putTag(tag uint8) {
-	if tag >= 64 {
+	select {
+	case z.tags <- tag:
+	default:
 		panic("bad tag")
 	}
+}
 
+// Stats returns the counters for z.
+func (z *Session) Stats() SessionStats {
 	z.mu.Lock()
 	defer z.mu.Unlock()
 
-	z.tagBitmap &^= 1 << tag
+	return z.stats
+}
+
+// A tagSet is a set of tags.
+type tagSet [maxTags / 64]uint64
+
+func (s *tagSet) has(tag uint8) bool {
+	return s[tag/64]&(1<<(tag%64)) != 0
+}
+
+func (s *tagSet) add(tag uint8) {
+	s[tag/64] |= 1 << (tag % 64)
+}
+
+func (s *tagSet) remove(tag uint8) {
+	s[tag/64] &^= 1 << (tag % 64)
+}
+
+func (z *Session) setInflight(tag uint8) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.inflight.add(tag)
+}
+
+// takeInflight clears tag from the set of calls waiting for a
+// response, reporting whether it was there.
+func (z *Session) takeInflight(tag uint8) bool {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	ok := z.inflight.has(tag)
+	z.inflight.remove(tag)
+	return ok
+}
+
+// fail records that the connection is broken and closes it,
+// which stops the transmit and receive threads from blocking
+// on it. It returns the error which broke the session.
+func (z *Session) fail(err error) error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.err == nil {
+		dprintf("session failed: %v\n", err)
+		z.err = err
+		z.c.Close()
+	}
+	return z.err
+}
+
+// Err returns the error which broke the connection to the server,
+// or nil if the session is still usable. Once it returns an error,
+// every call on the session fails.
+func (z *Session) Err() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	return z.err
 }
 
 func (z *Session) isClosed() bool {
@@ -193,15 +379,29 @@ func (z *Session) isClosed() bool {
 }
 
 func (z *Session) Ping() error {
+	return z.PingContext(context.Background())
+}
+
+// PingContext is like Ping, but gives up when ctx is done.
+func (z *Session) PingContext(ctx context.Context) error {
 	tx := fcall{
 		msgtype: tPing,
 	}
 	var rx fcall
-	z.rpc(&tx, &rx)
+	if err := z.rpc(ctx, &tx, &rx); err != nil {
+		return fmt.Errorf("rpc: %w", err)
+	}
 	return nil
 }
 
 func (z *Session) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	return z.ReadContext(context.Background(), score, typ, p)
+}
+
+// ReadContext is like Read, but gives up when ctx is done,
+// returning an error wrapping ctx.Err(). The contents of p are
+// undefined after an error.
+func (z *Session) ReadContext(ctx context.Context, score *Score, typ BlockType, p []byte) (int, error) {
 	// TODO(jnj): hack: fossil relies on this working even when z == nil
 	if score.IsZero() {
 		return 0, nil
@@ -215,36 +415,132 @@ func (z *Session) Read(score *Score, typ BlockType, p []byte) (int, error) {
 	rx := fcall{
 		data: p,
 	}
-	if err := z.rpc(&tx, &rx); err != nil {
-		return 0, fmt.Errorf("rpc: %v", err)
+	if z.codec != codecNone {
+		// room for the encoding and uncompressible data
+		rx.data = make([]byte, len(p)+1)
+	} else if ctx.Done() != nil {
+		// the response may arrive after the call is abandoned
+		rx.data = make([]byte, len(p))
+	}
+	if err := z.rpc(ctx, &tx, &rx); err != nil {
+		return 0, fmt.Errorf("rpc: %w", err)
+	}
+	if z.codec != codecNone || ctx.Done() != nil {
+		n, err := decodeData(z.codec, rx.data[:rx.count], p)
+		if err != nil {
+			return 0, fmt.Errorf("decode: %v", err)
+		}
+		return n, nil
 	}
 
 	return int(rx.count), nil
 }
 
 func (z *Session) Write(typ BlockType, p []byte) (*Score, error) {
+	return z.WriteContext(context.Background(), typ, p)
+}
+
+// WriteContext is like Write, but gives up when ctx is done,
+// returning an error wrapping ctx.Err(). The block may still
+// be written to the server.
+func (z *Session) WriteContext(ctx context.Context, typ BlockType, p []byte) (*Score, error) {
+	tx, err := z.writeCall(typ, p)
+	if err != nil {
+		return nil, err
+	}
+	var rx fcall
+	if err := z.rpc(ctx, tx, &rx); err != nil {
+		return nil, fmt.Errorf("rpc: %w", err)
+	}
+	return rx.score, nil
+}
+
+func (z *Session) writeCall(typ BlockType, p []byte) (*fcall, error) {
 	if len(p) > MaxBlockSize {
 		return nil, fmt.Errorf("data exceeds maximum block size: %d > %d", len(p), MaxBlockSize)
 	}
-	tx := fcall{
+	tx := &fcall{
 		msgtype: tWrite,
 		typ:     typ,
 		data:    p,
 	}
-	var rx fcall
-	if err := z.rpc(&tx, &rx); err != nil {
-		return nil, fmt.Errorf("rpc: %v", err)
+	if z.codec != codecNone {
+		data, err := encodeData(z.codec, p)
+		if err != nil {
+			return nil, fmt.Errorf("encode: %v", err)
+		}
+		tx.data = data
 	}
-	return rx.score, nil
+	return tx, nil
+}
+
+// A PendingWrite is a block write started by WriteAsync.
+type PendingWrite struct {
+	done  chan struct{}
+	score *Score
+	err   error
+}
+
+// Wait waits for the write to finish and returns the score of
+// the block, or the error which stopped it.
+func (w *PendingWrite) Wait() (*Score, error) {
+	<-w.done
+	return w.score, w.err
+}
+
+// Done returns a channel which is closed when the write finishes.
+func (w *PendingWrite) Done() <-chan struct{} {
+	return w.done
+}
+
+// WriteAsync starts writing p as a block of type typ and returns
+// without waiting for the server's response, so that many writes
+// may be in flight at once. It blocks only while every tag is in
+// use. The caller must not modify p until the write finishes.
+// As with WriteContext, the write gives up when ctx is done.
+//
+// Writes started by WriteAsync may complete in any order;
+// a Sync after waiting for them makes them all durable.
+func (z *Session) WriteAsync(ctx context.Context, typ BlockType, p []byte) *PendingWrite {
+	w := &PendingWrite{done: make(chan struct{})}
+
+	tx, err := z.writeCall(typ, p)
+	if err != nil {
+		w.err = err
+		close(w.done)
+		return w
+	}
+	rx := new(fcall)
+	if err := z.start(ctx, tx, rx); err != nil {
+		w.err = fmt.Errorf("rpc: %w", err)
+		close(w.done)
+		return w
+	}
+
+	go func() {
+		if err := z.finish(ctx, tx, rx); err != nil {
+			w.err = fmt.Errorf("rpc: %w", err)
+		} else {
+			w.score = rx.score
+		}
+		close(w.done)
+	}()
+	return w
 }
 
 func (z *Session) Sync() error {
+	return z.SyncContext(context.Background())
+}
+
+// SyncContext is like Sync, but gives up when ctx is done,
+// returning an error wrapping ctx.Err().
+func (z *Session) SyncContext(ctx context.Context) error {
 	tx := fcall{
 		msgtype: tSync,
 	}
 	var rx fcall
-	if err := z.rpc(&tx, &rx); err != nil {
-		return fmt.Errorf("rpc: %v", err)
+	if err := z.rpc(ctx, &tx, &rx); err != nil {
+		return fmt.Errorf("rpc: %w", err)
 	}
 	return nil
 }
@@ -2,7 +2,12 @@ package venti
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
@@ -25,6 +30,238 @@ func TestClient(t *testing.T) {
 	})
 }
 
+// A stallStore blocks all requests while its lock is held.
+type stallStore struct {
+	sync.Mutex
+	store Store
+}
+
+func (s *stallStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	s.Lock()
+	s.Unlock()
+	return s.store.Read(score, typ, p)
+}
+
+func (s *stallStore) Write(typ BlockType, p []byte) (*Score, error) {
+	s.Lock()
+	s.Unlock()
+	return s.store.Write(typ, p)
+}
+
+func (s *stallStore) Sync() error {
+	s.Lock()
+	s.Unlock()
+	return s.store.Sync()
+}
+
+func TestClientContext(t *testing.T) {
+	store := &stallStore{store: NewMemStore()}
+	z, done := testServer(t, store)
+	defer done()
+
+	data := []byte("stalled")
+	score, err := z.Write(DataType, data)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := z.ReadContext(ctx, score, DataType, make([]byte, 100)); !errors.Is(err, context.Canceled) {
+		t.Errorf("read with cancelled context: got %v, want %v", err, context.Canceled)
+	}
+
+	store.Lock()
+	calls := []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			_, err := z.ReadContext(ctx, score, DataType, make([]byte, 100))
+			return err
+		},
+		func(ctx context.Context) error {
+			_, err := z.WriteContext(ctx, DataType, []byte("more"))
+			return err
+		},
+		z.SyncContext,
+		z.PingContext,
+	}
+	for i, call := range calls {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err := call(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("call %d on stalled server: got %v, want %v", i, err, context.DeadlineExceeded)
+		}
+	}
+	store.Unlock()
+
+	// the abandoned calls release their tags as the responses arrive
+	deadline := time.Now().Add(5 * time.Second)
+	for len(z.tags) != maxTags {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d tags still in use after server recovered", maxTags-len(z.tags))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	buf := make([]byte, 100)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n, err := z.ReadContext(ctx, score, DataType, buf)
+	if err != nil {
+		t.Fatalf("read after recovery: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("read after recovery: got %q, want %q", buf[:n], data)
+	}
+}
+
+func TestClientBroken(t *testing.T) {
+	store := &stallStore{store: NewMemStore()}
+	srv := NewServer(store)
+	z, done := testServerConfig(t, srv)
+	defer done()
+
+	if err := z.Err(); err != nil {
+		t.Fatalf("new session: unexpected error: %v", err)
+	}
+
+	store.Lock()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := z.Read(Sha1([]byte("pending")), DataType, make([]byte, 100))
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// drop the connection with the read outstanding
+	srv.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Errorf("read on dropped connection succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read on dropped connection did not return")
+	}
+	store.Unlock()
+
+	if z.Err() == nil {
+		t.Errorf("dropped connection not reported by Err")
+	}
+	if err := z.Ping(); err == nil {
+		t.Errorf("ping on broken session succeeded")
+	}
+	if n := maxTags - len(z.tags); n != 0 {
+		t.Errorf("%d tags still in use on broken session", n)
+	}
+}
+
+func TestClientTagWait(t *testing.T) {
+	store := &stallStore{store: NewMemStore()}
+	z, done := testServer(t, store)
+	defer done()
+
+	// use up every tag, and then some
+	const extra = 10
+	store.Lock()
+	var wg sync.WaitGroup
+	errc := make(chan error, maxTags+extra)
+	for i := 0; i < maxTags+extra; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errc <- z.Sync()
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for z.Stats().TagWaits < extra {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d tag waits, want %d", z.Stats().TagWaits, extra)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if err := z.PingContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ping with no free tags: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	cancel()
+
+	store.Unlock()
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Errorf("sync: %v", err)
+		}
+	}
+
+	stats := z.Stats()
+	if stats.TagWaits != extra+1 || stats.TagWait <= 0 {
+		t.Errorf("bad tag wait stats: %+v", stats)
+	}
+	if n := len(z.tags); n != maxTags {
+		t.Errorf("%d tags still in use", maxTags-n)
+	}
+}
+
+func TestClientWriteAsync(t *testing.T) {
+	store := &stallStore{store: NewMemStore()}
+	z, done := testServer(t, store)
+	defer done()
+
+	store.Lock()
+	var writes []*PendingWrite
+	var blocks [][]byte
+	for i := 0; i < 2*maxTags; i++ {
+		data := []byte(fmt.Sprintf("async block %d", i))
+		blocks = append(blocks, data)
+		if i < maxTags {
+			writes = append(writes, z.WriteAsync(context.Background(), DataType, data))
+		}
+	}
+	select {
+	case <-writes[0].Done():
+		t.Fatalf("write finished on stalled server")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// further writes wait for tags
+	go store.Unlock()
+	for _, data := range blocks[maxTags:] {
+		writes = append(writes, z.WriteAsync(context.Background(), DataType, data))
+	}
+
+	for i, w := range writes {
+		score, err := w.Wait()
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		if *score != *Sha1(blocks[i]) {
+			t.Errorf("write %d: got score %v, want %v", i, score, Sha1(blocks[i]))
+		}
+	}
+	if err := z.Sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	for i, data := range blocks {
+		n, err := z.Read(Sha1(data), DataType, buf)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if !bytes.Equal(buf[:n], data) {
+			t.Errorf("read %d: got %q, want %q", i, buf[:n], data)
+		}
+	}
+
+	if _, err := z.WriteAsync(context.Background(), DataType, make([]byte, MaxBlockSize+1)).Wait(); err == nil {
+		t.Errorf("oversized async write succeeded")
+	}
+}
+
 func testPing(t *testing.T, z *Session) {
 	if err := z.Ping(); err != nil {
 		t.Errorf("unexpected error: %v", err)
@@ -0,0 +1,97 @@
+// Venti serves the venti protocol from an in-process block store.
+// Blocks are kept in memory, appended to a single log file, kept
+// as files in a directory, or stored in the arena and index
+// partitions of a plan9port venti, as described by its venti.conf.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/floren/fs/venti"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-a address] [-c venti.conf | -d dir | -f file]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var (
+		aflag = flag.String("a", "", "Listen for venti connections on `address`. (default \":17034\")")
+		cflag = flag.String("c", "", "Store blocks in the arenas and index named in the venti `config` file.")
+		dflag = flag.String("d", "", "Store blocks as files in `dir` instead of in memory.")
+		fflag = flag.String("f", "", "Store blocks in the log `file` instead of in memory.")
+	)
+	flag.Parse()
+	nstore := 0
+	for _, f := range []string{*cflag, *dflag, *fflag} {
+		if f != "" {
+			nstore++
+		}
+	}
+	if flag.NArg() != 0 || nstore > 1 {
+		flag.Usage()
+	}
+
+	addr := *aflag
+	var store venti.Store
+	switch {
+	case *cflag != "":
+		conf, err := venti.ReadDiskConfig(*cflag)
+		if err != nil {
+			log.Fatalf("read config: %v", err)
+		}
+		if addr == "" {
+			if addr, err = conf.ListenAddr(); err != nil {
+				log.Fatalf("config: %v", err)
+			}
+		}
+		ds, err := venti.OpenDiskStoreConfig(conf)
+		if err != nil {
+			log.Fatalf("open store: %v", err)
+		}
+		store = ds
+	case *dflag != "":
+		ds, err := venti.OpenDirStore(*dflag)
+		if err != nil {
+			log.Fatalf("open store: %v", err)
+		}
+		store = ds
+	case *fflag != "":
+		fs, err := venti.OpenFileStore(*fflag)
+		if err != nil {
+			log.Fatalf("open store: %v", err)
+		}
+		store = fs
+	default:
+		store = venti.NewMemStore()
+	}
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", venti.VentiPort)
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	errc := make(chan error, 1)
+	go func() { errc <- venti.ListenAndServe(addr, store) }()
+
+	select {
+	case err := <-errc:
+		log.Printf("serve: %v", err)
+	case sig := <-c:
+		log.Printf("caught %v; exiting", sig)
+	}
+
+	if cl, ok := store.(io.Closer); ok {
+		if err := cl.Close(); err != nil {
+			log.Fatalf("close store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Venticopy copies the tree of blocks under a score from one
+// venti server to another, writing only the blocks the
+// destination lacks. Given the score of a fossil or vac archive,
+// it copies the archive and, unless -P is given, the earlier
+// archives it points back to.
+//
+// A server of the form dir:/path names a directory of blocks
+// as served by venti -d.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-P] [-p parallel] [-v] src dst score [type]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	var (
+		Pflag = flag.Bool("P", false, "Do not follow the previous archives of root blocks.")
+		pflag = flag.Int("p", 8, "Copy `parallel` blocks at once.")
+		vflag = flag.Bool("v", false, "Report progress every second.")
+	)
+	flag.Parse()
+	if flag.NArg() < 3 || flag.NArg() > 4 {
+		flag.Usage()
+	}
+	log.SetFlags(0)
+	log.SetPrefix("venticopy: ")
+
+	s := flag.Arg(2)
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		s = s[i+1:]
+	}
+	score, err := venti.ParseScore(s)
+	if err != nil {
+		log.Fatalf("bad score: %v", err)
+	}
+	typ := venti.RootType
+	if flag.NArg() == 4 {
+		if typ, err = parseType(flag.Arg(3)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	src, err := venti.OpenStore(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("open %s: %v", flag.Arg(0), err)
+	}
+	dst, err := venti.OpenStore(flag.Arg(1))
+	if err != nil {
+		log.Fatalf("open %s: %v", flag.Arg(1), err)
+	}
+
+	c := &venti.Copier{Src: src, Dst: dst, Parallel: *pflag, NoPrev: *Pflag}
+	done := make(chan struct{})
+	if *vflag {
+		go func() {
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					report(c.Stats())
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	err = c.Copy(score, typ)
+	close(done)
+	if *vflag {
+		report(c.Stats())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func report(st venti.CopyStats) {
+	log.Printf("copied %d blocks, %d bytes; skipped %d", st.Copied, st.Bytes, st.Skipped)
+}
+
+// parseType parses a block type, given as a number
+// or as a name such as RootType or root.
+func parseType(s string) (venti.BlockType, error) {
+	if n, err := strconv.Atoi(s); err == nil && n > int(venti.ErrType) && n < int(venti.MaxType) {
+		return venti.BlockType(n), nil
+	}
+	for t := venti.RootType; t < venti.MaxType; t++ {
+		name := t.String()
+		if strings.EqualFold(s, name) || strings.EqualFold(s, strings.TrimSuffix(name, "Type")) {
+			return t, nil
+		}
+	}
+	return venti.ErrType, fmt.Errorf("bad block type %q", s)
+}
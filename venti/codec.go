@@ -0,0 +1,144 @@
+package venti
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/floren/fs/internal/pack"
+)
+
+// Compression codecs, as numbered in Thello and Rhello.
+const (
+	codecNone    = 0
+	codecDeflate = 1
+	codecThwack  = 2 // not supported
+)
+
+// supportedCodecs lists the codecs offered or accepted with
+// protocol version 04, most preferred first.
+var supportedCodecs = []uint8{
+	codecDeflate,
+}
+
+// frameSize returns the size of the length which precedes each
+// message in protocol version.
+func frameSize(version string) int {
+	if version == "02" {
+		return 2
+	}
+	return 4
+}
+
+// packLength returns the length which precedes a message of
+// n bytes in protocol version.
+func packLength(version string, n int) ([]byte, error) {
+	buf := make([]byte, frameSize(version))
+	if len(buf) == 2 {
+		if n >= 1<<16 {
+			return nil, fmt.Errorf("message too large: %d bytes", n)
+		}
+		pack.PutUint16(buf, uint16(n))
+	} else {
+		pack.PutUint32(buf, uint32(n))
+	}
+	return buf, nil
+}
+
+func unpackLength(buf []byte) int {
+	if len(buf) == 2 {
+		return int(pack.GetUint16(buf))
+	}
+	return int(pack.GetUint32(buf))
+}
+
+// chooseCodec returns the first codec in offered which is in
+// supported, or codecNone.
+func chooseCodec(offered, supported []uint8) uint8 {
+	for _, c1 := range offered {
+		for _, c2 := range supported {
+			if c1 == c2 {
+				return c1
+			}
+		}
+	}
+	return codecNone
+}
+
+/*
+ * Once a codec is in use, the data of each Twrite and Rread message
+ * is preceded by a byte giving its encoding: codecNone when the data
+ * did not compress, or the codec itself.
+ */
+
+// encodeData returns p in its encoded form for codec.
+func encodeData(codec uint8, p []byte) ([]byte, error) {
+	switch codec {
+	default:
+		return nil, fmt.Errorf("unsupported codec %d", codec)
+	case codecNone:
+		return p, nil
+	case codecDeflate:
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(codecDeflate)
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if b.Len() < 1+len(p) {
+		return b.Bytes(), nil
+	}
+
+	buf := make([]byte, 1+len(p))
+	buf[0] = codecNone
+	copy(buf[1:], p)
+	return buf, nil
+}
+
+// decodeData decodes buf, encoded for codec, into p and returns
+// the number of bytes in the decoded data.
+func decodeData(codec uint8, buf, p []byte) (int, error) {
+	if codec == codecNone {
+		if len(buf) > len(p) {
+			return 0, fmt.Errorf("data too big for buffer: %d > %d", len(buf), len(p))
+		}
+		return copy(p, buf), nil
+	}
+	if len(buf) < 1 {
+		return 0, fmt.Errorf("missing data encoding")
+	}
+
+	switch buf[0] {
+	default:
+		return 0, fmt.Errorf("bad data encoding %d", buf[0])
+	case codecNone:
+		return decodeData(codecNone, buf[1:], p)
+	case codecDeflate:
+		if codec != codecDeflate {
+			return 0, fmt.Errorf("bad data encoding %d", buf[0])
+		}
+	}
+
+	r := flate.NewReader(bytes.NewReader(buf[1:]))
+	defer r.Close()
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return n, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("inflate: %v", err)
+	}
+	if m, _ := r.Read(make([]byte, 1)); m > 0 {
+		return 0, fmt.Errorf("data too big for buffer: > %d", len(p))
+	}
+	return n, nil
+}
@@ -0,0 +1,77 @@
+package venti
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodec(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("x"),
+		bytes.Repeat([]byte("abc"), 1000),
+	} {
+		for _, codec := range []uint8{codecNone, codecDeflate} {
+			buf, err := encodeData(codec, data)
+			if err != nil {
+				t.Fatalf("encode %d: %v", codec, err)
+			}
+			if codec != codecNone && len(buf) > len(data)+1 {
+				t.Errorf("encode %d: %d bytes grew to %d", codec, len(data), len(buf))
+			}
+			p := make([]byte, len(data))
+			n, err := decodeData(codec, buf, p)
+			if err != nil {
+				t.Fatalf("decode %d: %v", codec, err)
+			}
+			if !bytes.Equal(p[:n], data) {
+				t.Errorf("codec %d: got %d bytes, want %d", codec, n, len(data))
+			}
+			if len(data) > 0 {
+				if _, err := decodeData(codec, buf, p[:len(p)-1]); err == nil {
+					t.Errorf("codec %d: decode into short buffer succeeded", codec)
+				}
+			}
+		}
+	}
+
+	if _, err := encodeData(codecThwack, nil); err == nil {
+		t.Errorf("encode with unsupported codec succeeded")
+	}
+	if _, err := decodeData(codecDeflate, []byte{codecThwack}, nil); err == nil {
+		t.Errorf("decode with bad encoding succeeded")
+	}
+}
+
+func TestChooseCodec(t *testing.T) {
+	for _, test := range []struct {
+		offered, supported []uint8
+		want               uint8
+	}{
+		{nil, supportedCodecs, codecNone},
+		{[]uint8{codecThwack, codecDeflate}, supportedCodecs, codecDeflate},
+		{[]uint8{codecDeflate}, nil, codecNone},
+	} {
+		if got := chooseCodec(test.offered, test.supported); got != test.want {
+			t.Errorf("chooseCodec(%v, %v) = %d, want %d", test.offered, test.supported, got, test.want)
+		}
+	}
+}
+
+func TestPackLength(t *testing.T) {
+	for _, version := range []string{"02", "04"} {
+		buf, err := packLength(version, 1000)
+		if err != nil {
+			t.Fatalf("pack length %s: %v", version, err)
+		}
+		if len(buf) != frameSize(version) || unpackLength(buf) != 1000 {
+			t.Errorf("version %s: bad length %x", version, buf)
+		}
+	}
+	if _, err := packLength("02", 1<<16); err == nil {
+		t.Errorf("02 packed length 1<<16")
+	}
+	if _, err := packLength("04", 1<<16); err != nil {
+		t.Errorf("04 pack length 1<<16: %v", err)
+	}
+}
@@ -0,0 +1,234 @@
+package venti
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// A Copier copies the tree of blocks under a score from one
+// store to another.
+//
+// A block is written to Dst only after all the blocks it points
+// to are there, so a block found in Dst is taken to be the root
+// of a complete subtree, which is not walked again. An
+// interrupted copy can thus be restarted without rereading
+// what was already copied.
+type Copier struct {
+	Src, Dst Store
+
+	// Parallel is the number of blocks copied at once.
+	// If zero, 1 is used.
+	Parallel int
+
+	// NoPrev stops the copy from following the Prev scores
+	// of root blocks to earlier archives.
+	NoPrev bool
+
+	stats CopyStats
+
+	mu   sync.Mutex
+	done map[copyKey]*copyWalk
+	err  error // first error, which stops the copy
+	sem  chan struct{}
+}
+
+// CopyStats counts the progress of a copy.
+type CopyStats struct {
+	Copied  int64 // blocks written to Dst
+	Bytes   int64 // bytes written to Dst
+	Skipped int64 // subtrees already in Dst
+}
+
+type copyKey struct {
+	score Score
+	typ   BlockType
+}
+
+// copyWalk is the walk of a subtree, which is done once
+// however many blocks point to it.
+type copyWalk struct {
+	wait chan struct{}
+	err  error
+}
+
+// Copy copies the tree under score, the score of a block of
+// type typ, from c.Src to c.Dst. It returns the first error
+// encountered.
+func (c *Copier) Copy(score *Score, typ BlockType) error {
+	n := c.Parallel
+	if n < 1 {
+		n = 1
+	}
+	c.mu.Lock()
+	c.done = make(map[copyKey]*copyWalk)
+	c.err = nil
+	c.sem = make(chan struct{}, n-1)
+	c.mu.Unlock()
+
+	if err := c.walk(score, typ, typ); err != nil {
+		return err
+	}
+	return c.Dst.Sync()
+}
+
+// Stats returns the progress of the copy so far.
+// It may be called while Copy is running.
+func (c *Copier) Stats() CopyStats {
+	return CopyStats{
+		Copied:  atomic.LoadInt64(&c.stats.Copied),
+		Bytes:   atomic.LoadInt64(&c.stats.Bytes),
+		Skipped: atomic.LoadInt64(&c.stats.Skipped),
+	}
+}
+
+// walk copies the subtree under score, a block of type typ.
+// Pointer blocks point to blocks of type leaf at the bottom.
+func (c *Copier) walk(score *Score, typ, leaf BlockType) error {
+	if score.IsZero() {
+		return nil
+	}
+
+	c.mu.Lock()
+	if err := c.err; err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	key := copyKey{*score, typ}
+	w, ok := c.done[key]
+	if ok {
+		c.mu.Unlock()
+		<-w.wait
+		return w.err
+	}
+	w = &copyWalk{wait: make(chan struct{})}
+	c.done[key] = w
+	c.mu.Unlock()
+
+	w.err = c.copyBlock(score, typ, leaf)
+	if w.err != nil {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = w.err
+		}
+		c.mu.Unlock()
+	}
+	close(w.wait)
+	return w.err
+}
+
+func (c *Copier) copyBlock(score *Score, typ, leaf BlockType) error {
+	buf := make([]byte, MaxBlockSize)
+	if _, err := c.Dst.Read(score, typ, buf); err == nil {
+		atomic.AddInt64(&c.stats.Skipped, 1)
+		return nil
+	}
+
+	n, err := c.Src.Read(score, typ, buf)
+	if err != nil {
+		return err
+	}
+	buf = buf[:n]
+	if !score.Check(buf) {
+		return fmt.Errorf("block %v/%v: wrong score", score, typ)
+	}
+	if err := c.walkKids(score, buf, typ, leaf); err != nil {
+		return err
+	}
+
+	wscore, err := c.Dst.Write(typ, buf)
+	if err != nil {
+		return err
+	}
+	if *wscore != *score {
+		return fmt.Errorf("block %v/%v: written with score %v", score, typ, wscore)
+	}
+	atomic.AddInt64(&c.stats.Copied, 1)
+	atomic.AddInt64(&c.stats.Bytes, int64(n))
+	return nil
+}
+
+type copyKid struct {
+	score     Score
+	typ, leaf BlockType
+}
+
+// walkKids copies the subtrees pointed to by buf, the block
+// score of type typ, in parallel as far as c.Parallel allows.
+func (c *Copier) walkKids(score *Score, buf []byte, typ, leaf BlockType) error {
+	var kids []copyKid
+	switch {
+	case typ == RootType:
+		r, err := UnpackRoot(buf)
+		if err != nil {
+			return fmt.Errorf("block %v/%v: %v", score, typ, err)
+		}
+		kids = append(kids, copyKid{r.Score, DirType, DirType})
+		if !c.NoPrev && r.Prev != (Score{}) && !r.Prev.IsZero() {
+			kids = append(kids, copyKid{r.Prev, RootType, RootType})
+		}
+	case typ == DirType:
+		for i := 0; i < len(buf)/EntrySize; i++ {
+			e, err := UnpackEntry(buf, i)
+			if err != nil {
+				return fmt.Errorf("block %v/%v: entry %d: %v", score, typ, i, err)
+			}
+			if e.Flags&EntryActive == 0 {
+				continue
+			}
+			if e.Flags&EntryLocal != 0 {
+				return fmt.Errorf("block %v/%v: entry %d: local score %v", score, typ, i, &e.Score)
+			}
+			kid := copyKid{e.Score, DataType, DataType}
+			if e.Flags&EntryDir != 0 {
+				kid.typ, kid.leaf = DirType, DirType
+			}
+			if e.Depth > 0 {
+				kid.typ = PointerType0 + BlockType(e.Depth-1)
+			}
+			kids = append(kids, kid)
+		}
+	case typ >= PointerType0 && typ <= PointerType9:
+		kt := leaf
+		if typ > PointerType0 {
+			kt = typ - 1
+		}
+		for i := 0; i+ScoreSize <= len(buf); i += ScoreSize {
+			var kid copyKid
+			copy(kid.score[:], buf[i:])
+			kid.typ, kid.leaf = kt, leaf
+			kids = append(kids, kid)
+		}
+	case typ == DataType:
+	default:
+		return fmt.Errorf("block %v/%v: unknown block type", score, typ)
+	}
+
+	/*
+	 * Kids are walked in new goroutines while there are
+	 * free slots, and otherwise in this one.
+	 */
+	var wg sync.WaitGroup
+	errs := make([]error, len(kids))
+	for i := range kids {
+		k := &kids[i]
+		select {
+		case c.sem <- struct{}{}:
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = c.walk(&k.score, k.typ, k.leaf)
+				<-c.sem
+			}(i)
+		default:
+			errs[i] = c.walk(&k.score, k.typ, k.leaf)
+		}
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package venti
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// testCopyTree writes an archive to s: a root pointing to a
+// directory of a data source two levels deep and a directory
+// source one level deep, and returns the root's score.
+func testCopyTree(t *testing.T, s Store, name string, prev *Score) *Score {
+	const bsize = 256
+	write := func(typ BlockType, p []byte) Score {
+		score, err := s.Write(typ, ZeroTruncate(typ, p))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		return *score
+	}
+	ptrs := func(typ BlockType, scores []Score) []Score {
+		var up []Score
+		ppb := bsize / ScoreSize
+		for i := 0; i < len(scores); i += ppb {
+			var p []byte
+			for j := i; j < i+ppb && j < len(scores); j++ {
+				p = append(p, scores[j][:]...)
+			}
+			up = append(up, write(typ, p))
+		}
+		return up
+	}
+
+	var data []Score
+	for i := 0; i < 30; i++ {
+		data = append(data, write(DataType, []byte(fmt.Sprintf("%s block %d", name, i%20))))
+	}
+	data = ptrs(PointerType1, ptrs(PointerType0, data))
+
+	var dirs []Score
+	for i := 0; i < 10; i++ {
+		e := Entry{Psize: bsize, Dsize: bsize, Flags: EntryActive, Size: 5, Score: *Sha1([]byte("hello"))}
+		write(DataType, []byte("hello"))
+		buf := make([]byte, EntrySize)
+		e.Pack(buf, 0)
+		dirs = append(dirs, write(DirType, buf))
+	}
+	dirs = ptrs(PointerType0, dirs)
+
+	entries := []Entry{
+		{Psize: bsize, Dsize: bsize, Depth: 2, Flags: EntryActive, Size: 30 * bsize, Score: data[0]},
+		{Psize: bsize, Dsize: bsize, Depth: 1, Flags: EntryActive | EntryDir, Size: 10 * EntrySize, Score: dirs[0]},
+		{},
+	}
+	buf := make([]byte, len(entries)*EntrySize)
+	for i := range entries {
+		entries[i].Pack(buf, i)
+	}
+	r := Root{Version: RootVersion, Name: name, Type: "vac", Score: write(DirType, buf), BlockSize: bsize}
+	if prev != nil {
+		r.Prev = *prev
+	}
+	buf = make([]byte, RootSize)
+	r.Pack(buf)
+	score := write(RootType, buf)
+	return &score
+}
+
+// A countStore counts the blocks read from it.
+type countStore struct {
+	Store
+	mu    sync.Mutex
+	reads int
+}
+
+func (s *countStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	s.mu.Lock()
+	s.reads++
+	s.mu.Unlock()
+	return s.Store.Read(score, typ, p)
+}
+
+func TestCopy(t *testing.T) {
+	src := NewMemStore()
+	first := testCopyTree(t, src, "first", nil)
+	second := testCopyTree(t, src, "second", first)
+
+	for _, parallel := range []int{0, 1, 8} {
+		dst := NewMemStore()
+		c := &Copier{Src: src, Dst: dst, Parallel: parallel}
+		if err := c.Copy(second, RootType); err != nil {
+			t.Fatalf("copy (parallel=%d): %v", parallel, err)
+		}
+		if dst.Len() != src.Len() {
+			t.Errorf("copy (parallel=%d): copied %d blocks, want %d", parallel, dst.Len(), src.Len())
+		}
+		if st := c.Stats(); st.Copied != int64(src.Len()) || st.Skipped != 0 {
+			t.Errorf("copy (parallel=%d): stats %+v", parallel, st)
+		}
+
+		// a second copy finds the whole tree in dst
+		csrc := &countStore{Store: src}
+		c = &Copier{Src: csrc, Dst: dst, Parallel: parallel}
+		if err := c.Copy(second, RootType); err != nil {
+			t.Fatalf("recopy: %v", err)
+		}
+		if st := c.Stats(); st.Copied != 0 || st.Skipped != 1 || csrc.reads != 0 {
+			t.Errorf("recopy (parallel=%d): stats %+v, %d reads", parallel, st, csrc.reads)
+		}
+	}
+}
+
+func TestCopyIncremental(t *testing.T) {
+	src := NewMemStore()
+	first := testCopyTree(t, src, "first", nil)
+	dst := NewMemStore()
+	if err := (&Copier{Src: src, Dst: dst}).Copy(first, RootType); err != nil {
+		t.Fatalf("copy first: %v", err)
+	}
+	n := dst.Len()
+
+	second := testCopyTree(t, src, "second", first)
+	c := &Copier{Src: src, Dst: dst, Parallel: 4}
+	if err := c.Copy(second, RootType); err != nil {
+		t.Fatalf("copy second: %v", err)
+	}
+	if dst.Len() != src.Len() {
+		t.Errorf("copied %d blocks, want %d", dst.Len(), src.Len())
+	}
+	if st := c.Stats(); st.Copied != int64(src.Len()-n) || st.Skipped == 0 {
+		t.Errorf("stats %+v, want %d copied", st, src.Len()-n)
+	}
+
+	// without the history, only the second archive
+	dst = NewMemStore()
+	c = &Copier{Src: src, Dst: dst, NoPrev: true}
+	if err := c.Copy(second, RootType); err != nil {
+		t.Fatalf("copy without prev: %v", err)
+	}
+	if buf := make([]byte, RootSize); dst.Len() >= src.Len() {
+		t.Errorf("copied %d blocks of %d", dst.Len(), src.Len())
+	} else if _, err := dst.Read(first, RootType, buf); err == nil {
+		t.Errorf("previous root copied")
+	}
+}
+
+// A loseStore has lost a block.
+type loseStore struct {
+	Store
+	lost Score
+}
+
+func (s *loseStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	if *score == s.lost {
+		return 0, errNoBlock(score, typ)
+	}
+	return s.Store.Read(score, typ, p)
+}
+
+func TestCopyMissing(t *testing.T) {
+	src := NewMemStore()
+	root := testCopyTree(t, src, "test", nil)
+	lost := *Sha1([]byte("test block 7"))
+
+	dst := NewMemStore()
+	c := &Copier{Src: &loseStore{Store: src, lost: lost}, Dst: dst, Parallel: 4}
+	if err := c.Copy(root, RootType); err == nil {
+		t.Fatalf("copy with missing block succeeded")
+	}
+
+	// nothing above the missing block was copied, so a
+	// second copy finishes the job
+	buf := make([]byte, RootSize)
+	if _, err := dst.Read(root, RootType, buf); err == nil {
+		t.Errorf("root copied despite missing block")
+	}
+	if err := (&Copier{Src: src, Dst: dst}).Copy(root, RootType); err != nil {
+		t.Fatalf("recopy: %v", err)
+	}
+	if dst.Len() != src.Len() {
+		t.Errorf("copied %d blocks, want %d", dst.Len(), src.Len())
+	}
+}
@@ -0,0 +1,427 @@
+package venti
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A DiskConfig names the partitions of a venti server, as read
+// from a plan9port venti.conf file.
+type DiskConfig struct {
+	Index  string   // name of the index
+	ISects []string // index section partitions, in order
+	Arenas []string // arena partitions, in order
+	Addr   string   // listen address, in dial string form, if given
+}
+
+// ReadDiskConfig parses the venti configuration file at path.
+// Settings which only tune plan9port's venti, such as cache sizes,
+// are ignored.
+func ReadDiskConfig(path string) (*DiskConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	conf := new(DiskConfig)
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case "index", "isect", "arenas", "addr":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: usage: %s value", path, line, fields[0])
+			}
+		}
+		switch fields[0] {
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown command %q", path, line, fields[0])
+		case "index":
+			if conf.Index != "" {
+				return nil, fmt.Errorf("%s:%d: duplicate index", path, line)
+			}
+			conf.Index = fields[1]
+		case "isect":
+			conf.ISects = append(conf.ISects, fields[1])
+		case "arenas":
+			conf.Arenas = append(conf.Arenas, fields[1])
+		case "addr":
+			conf.Addr = fields[1]
+		case "bloom":
+			return nil, fmt.Errorf("%s:%d: bloom filters are not supported", path, line)
+		case "mem", "bcmem", "icmem", "queuewrites", "httpaddr", "webroot":
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if conf.Index == "" {
+		return nil, fmt.Errorf("%s: no index", path)
+	}
+	if len(conf.ISects) == 0 {
+		return nil, fmt.Errorf("%s: no index sections", path)
+	}
+	if len(conf.Arenas) == 0 {
+		return nil, fmt.Errorf("%s: no arenas", path)
+	}
+	return conf, nil
+}
+
+// ListenAddr converts the dial string in Addr, such as
+// tcp!*!venti, to a host:port address. It returns the empty
+// string if Addr is not set.
+func (conf *DiskConfig) ListenAddr() (string, error) {
+	if conf.Addr == "" {
+		return "", nil
+	}
+	f := strings.Split(conf.Addr, "!")
+	switch len(f) {
+	case 1:
+		return f[0], nil
+	case 3:
+		if f[0] != "tcp" && f[0] != "net" {
+			return "", fmt.Errorf("unsupported network in %q", conf.Addr)
+		}
+	default:
+		return "", fmt.Errorf("bad dial string %q", conf.Addr)
+	}
+	host, port := f[1], f[2]
+	if host == "*" {
+		host = ""
+	}
+	if port == "venti" {
+		port = fmt.Sprint(VentiPort)
+	}
+	return host + ":" + port, nil
+}
+
+// DiskStore is a Store kept in the arena and index partitions
+// formatted by plan9port's fmtarenas, fmtisect and fmtindex.
+// Blocks written by plan9port's venti, including compressed ones,
+// can be read, and blocks are appended in a form it can read.
+type DiskStore struct {
+	mu     sync.RWMutex
+	parts  []*arenaPart
+	sects  []*isect
+	ix     *index
+	alloc  int // first arena which may have room
+	closed bool
+}
+
+// OpenDiskStore opens the partitions named in the venti
+// configuration file at path.
+func OpenDiskStore(path string) (*DiskStore, error) {
+	conf, err := ReadDiskConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return OpenDiskStoreConfig(conf)
+}
+
+// OpenDiskStoreConfig opens the partitions named in conf.
+// Clumps written to the arenas but missing from the index,
+// because a server crashed, are added to the index.
+func OpenDiskStoreConfig(conf *DiskConfig) (*DiskStore, error) {
+	s := new(DiskStore)
+	if err := s.open(conf); err != nil {
+		s.closeParts()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *DiskStore) open(conf *DiskConfig) error {
+	arenas := make(map[string]*arena)
+	for _, file := range conf.Arenas {
+		ap, err := openArenaPart(file)
+		if err != nil {
+			return err
+		}
+		s.parts = append(s.parts, ap)
+		for _, a := range ap.arenas {
+			if arenas[a.name] != nil {
+				return fmt.Errorf("duplicate arena name %s in %s", a.name, file)
+			}
+			arenas[a.name] = a
+		}
+	}
+	for _, file := range conf.ISects {
+		is, err := openISect(file)
+		if err != nil {
+			return err
+		}
+		s.sects = append(s.sects, is)
+	}
+
+	ix, err := readIndex(conf.Index, s.sects, arenas)
+	if err != nil {
+		return err
+	}
+	s.ix = ix
+
+	for i, a := range ix.arenas {
+		if err := s.syncArena(i); err != nil {
+			return fmt.Errorf("arena %s: %v", a.name, err)
+		}
+	}
+	return s.flush()
+}
+
+// syncArena adds the clumps which are in arena i but not in the
+// index to the index.
+func (s *DiskStore) syncArena(i int) error {
+	a := s.ix.arenas[i]
+	if a.diskStats.clumps == a.memStats.clumps {
+		return nil
+	}
+	dprintf("DiskStore: indexing %d clumps in arena %s\n", a.memStats.clumps-a.diskStats.clumps, a.name)
+
+	aa := a.diskStats.used
+	for n := a.diskStats.clumps; n < a.memStats.clumps; n++ {
+		ci, _, err := a.readClumpHeader(aa)
+		if err != nil {
+			return err
+		}
+		dci, err := a.readClumpInfo(n)
+		if err != nil {
+			return err
+		}
+		if *dci != *ci {
+			return fmt.Errorf("clump %d at %d does not match directory", n, aa)
+		}
+		ia := &indexAddr{
+			addr:   s.ix.amap[i].start + aa,
+			size:   ci.uncsize,
+			typ:    ci.typ,
+			blocks: clumpBlocks(ci.size),
+		}
+		if err := s.ix.insert(&ci.score, ia); err != nil {
+			return err
+		}
+		aa += uint64(clumpSize) + uint64(ci.size)
+	}
+	if aa != a.memStats.used {
+		return fmt.Errorf("clumps use %d bytes, arena says %d", aa, a.memStats.used)
+	}
+	return nil
+}
+
+func clumpBlocks(size uint16) uint8 {
+	return uint8((uint32(size) + clumpSize + 1<<aBlockLog - 1) >> aBlockLog)
+}
+
+func (s *DiskStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	if score.IsZero() {
+		return 0, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return 0, errors.New("store is closed")
+	}
+	ia, err := s.ix.lookup(score, typ)
+	if err != nil {
+		return 0, err
+	}
+	if ia == nil {
+		return 0, errNoBlock(score, typ)
+	}
+	i, aa, err := s.ix.arena(ia.addr)
+	if err != nil {
+		return 0, err
+	}
+	return s.ix.arenas[i].readClump(aa, score, typ, p)
+}
+
+func (s *DiskStore) Write(typ BlockType, p []byte) (*Score, error) {
+	if len(p) > MaxBlockSize {
+		return nil, fmt.Errorf("data exceeds maximum block size: %d > %d", len(p), MaxBlockSize)
+	}
+	score := Sha1(p)
+	if len(p) == 0 {
+		return score, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errors.New("store is closed")
+	}
+	ia, err := s.ix.lookup(score, typ)
+	if err != nil {
+		return nil, err
+	}
+	if ia != nil {
+		return score, nil
+	}
+
+	now := uint32(time.Now().Unix())
+	for ; s.alloc < len(s.ix.arenas); s.alloc++ {
+		a := s.ix.arenas[s.alloc]
+		aa, err := a.writeClump(typ, score, p, now)
+		if err == errArenaFull {
+			if err := s.sealArena(a); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("arena %s: %v", a.name, err)
+		}
+		ia := &indexAddr{
+			addr:   s.ix.amap[s.alloc].start + aa,
+			size:   uint16(len(p)),
+			typ:    typ,
+			blocks: clumpBlocks(uint16(len(p))),
+		}
+		if err := s.ix.insert(score, ia); err != nil {
+			return nil, err
+		}
+		return score, nil
+	}
+	return nil, errors.New("no space left in arenas")
+}
+
+// sealArena writes out the index entries for a full arena and
+// records its score.
+func (s *DiskStore) sealArena(a *arena) error {
+	if a.diskStats.sealed {
+		return nil
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	dprintf("DiskStore: sealing arena %s\n", a.name)
+	if err := a.seal(); err != nil {
+		return fmt.Errorf("seal arena %s: %v", a.name, err)
+	}
+	return a.part.f.Sync()
+}
+
+func (s *DiskStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("store is closed")
+	}
+	return s.flush()
+}
+
+// flush makes the arenas and index stable, then records in each
+// arena trailer that its clumps are all in the index.
+func (s *DiskStore) flush() error {
+	for _, ap := range s.parts {
+		if err := ap.f.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, is := range s.sects {
+		if err := is.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	dirty := make(map[*arenaPart]bool)
+	for _, a := range s.ix.arenas {
+		if a.diskStats == a.memStats {
+			continue
+		}
+		a.diskStats = a.memStats
+		if err := a.writeTrailer(); err != nil {
+			return fmt.Errorf("arena %s: %v", a.name, err)
+		}
+		dirty[a.part] = true
+	}
+	for ap := range dirty {
+		if err := ap.f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close syncs and closes the partitions.
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errors.New("store is closed")
+	}
+	err := s.flush()
+	if err1 := s.closeParts(); err == nil {
+		err = err1
+	}
+	s.closed = true
+	return err
+}
+
+func (s *DiskStore) closeParts() error {
+	var err error
+	for _, ap := range s.parts {
+		if err1 := ap.close(); err == nil {
+			err = err1
+		}
+	}
+	for _, is := range s.sects {
+		if err1 := is.close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// formatIndex divides the index buckets among the index sections
+// named in conf and places the arenas in the index address space,
+// like fmtindex does for a new index.
+func formatIndex(conf *DiskConfig) error {
+	var arenas []*arena
+	var parts []*arenaPart
+	var sects []*isect
+	defer func() {
+		for _, ap := range parts {
+			ap.close()
+		}
+		for _, is := range sects {
+			is.close()
+		}
+	}()
+
+	for _, file := range conf.Arenas {
+		ap, err := openArenaPart(file)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, ap)
+		arenas = append(arenas, ap.arenas...)
+	}
+	for _, file := range conf.ISects {
+		is, err := openISect(file)
+		if err != nil {
+			return err
+		}
+		sects = append(sects, is)
+	}
+
+	ix, err := newIndex(conf.Index, sects)
+	if err != nil {
+		return err
+	}
+	if err := ix.setArenas(arenas); err != nil {
+		return err
+	}
+	return ix.writeConfig()
+}
@@ -0,0 +1,407 @@
+package venti
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// formatTestDisk creates and formats arena and index partitions in
+// dir and returns the path of a venti.conf describing them.
+func formatTestDisk(t *testing.T, dir string, arenaSize uint64) string {
+	arenas := filepath.Join(dir, "arenas.part")
+	isect := filepath.Join(dir, "isect.part")
+	for _, p := range []struct {
+		file string
+		size int64
+	}{
+		{arenas, 8192 * 400},
+		{isect, 8192 * 100},
+	} {
+		f, err := os.Create(p.file)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if err := f.Truncate(p.size); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+		f.Close()
+	}
+	if err := formatArenas(arenas, "arenas", 8192, arenaSize); err != nil {
+		t.Fatalf("format arenas: %v", err)
+	}
+	if err := formatISect(isect, "isect", 8192); err != nil {
+		t.Fatalf("format isect: %v", err)
+	}
+
+	config := filepath.Join(dir, "venti.conf")
+	text := fmt.Sprintf("# test venti\nindex main\nisect %s\narenas %s\naddr tcp!*!venti\nmem 10M\n", isect, arenas)
+	if err := os.WriteFile(config, []byte(text), 0666); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	conf, err := ReadDiskConfig(config)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if err := formatIndex(conf); err != nil {
+		t.Fatalf("format index: %v", err)
+	}
+	return config
+}
+
+func TestDiskStore(t *testing.T) {
+	config := formatTestDisk(t, t.TempDir(), 1024*1024)
+	s, err := OpenDiskStore(config)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s, err = OpenDiskStore(config)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	buf := make([]byte, 100)
+	for _, data := range []string{"foo", "bar"} {
+		n, err := s.Read(Sha1([]byte(data)), DataType, buf)
+		if err != nil {
+			t.Errorf("read %q after reopen: %v", data, err)
+			continue
+		}
+		if string(buf[:n]) != data {
+			t.Errorf("read after reopen: got %q, want %q", buf[:n], data)
+		}
+	}
+	if got := s.ix.arenas[0].memStats.clumps; got != 2 {
+		t.Errorf("bad clump count: got %d, want 2", got)
+	}
+}
+
+func TestDiskConfig(t *testing.T) {
+	config := formatTestDisk(t, t.TempDir(), 1024*1024)
+	conf, err := ReadDiskConfig(config)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	if conf.Index != "main" || len(conf.ISects) != 1 || len(conf.Arenas) != 1 {
+		t.Errorf("bad config: %+v", conf)
+	}
+	addr, err := conf.ListenAddr()
+	if err != nil {
+		t.Fatalf("listen address: %v", err)
+	}
+	if want := fmt.Sprintf(":%d", VentiPort); addr != want {
+		t.Errorf("bad listen address: got %q, want %q", addr, want)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.conf")
+	os.WriteFile(bad, []byte("index main\nbloom bloom.part\n"), 0666)
+	if _, err := ReadDiskConfig(bad); err == nil {
+		t.Errorf("config with bloom filter accepted")
+	}
+}
+
+func TestDiskStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	config := formatTestDisk(t, dir, 1024*1024)
+	s, err := OpenDiskStore(config)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	var scores []*Score
+	for i := 0; i < 10; i++ {
+		score, err := s.Write(DataType, []byte(fmt.Sprintf("block %d", i)))
+		if err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		scores = append(scores, score)
+	}
+
+	// crash before the index is flushed, losing the index entries
+	s.closeParts()
+	is, err := openISect(filepath.Join(dir, "isect.part"))
+	if err != nil {
+		t.Fatalf("open isect: %v", err)
+	}
+	zero := make([]byte, int(is.blocks)*int(is.blockSize))
+	if _, err := is.f.WriteAt(zero, int64(is.blockBase)); err != nil {
+		t.Fatalf("clear index: %v", err)
+	}
+	is.close()
+
+	s, err = OpenDiskStore(config)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	buf := make([]byte, 100)
+	for i, score := range scores {
+		n, err := s.Read(score, DataType, buf)
+		if err != nil {
+			t.Errorf("read block %d after recovery: %v", i, err)
+			continue
+		}
+		if want := fmt.Sprintf("block %d", i); string(buf[:n]) != want {
+			t.Errorf("read block %d: got %q, want %q", i, buf[:n], want)
+		}
+	}
+}
+
+func TestDiskStoreFull(t *testing.T) {
+	config := formatTestDisk(t, t.TempDir(), 1024*1024)
+	s, err := OpenDiskStore(config)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer s.Close()
+	if len(s.ix.arenas) < 2 {
+		t.Fatalf("want at least 2 arenas, got %d", len(s.ix.arenas))
+	}
+
+	data := make([]byte, 8192)
+	var scores []*Score
+	for i := 0; s.alloc == 0; i++ {
+		data[0], data[1] = byte(i), byte(i>>8)
+		score, err := s.Write(DataType, data)
+		if err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		scores = append(scores, score)
+	}
+
+	a := s.ix.arenas[0]
+	if !a.diskStats.sealed || a.score.IsZero() {
+		t.Errorf("full arena not sealed")
+	}
+	buf := make([]byte, len(data))
+	for i, score := range scores {
+		n, err := s.Read(score, DataType, buf)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		data[0], data[1] = byte(i), byte(i>>8)
+		if !bytes.Equal(buf[:n], data) {
+			t.Fatalf("read %d: wrong data", i)
+		}
+	}
+}
+
+/*
+ * A fixture laid out by hand as plan9port's fmtarenas, fmtisect
+ * and fmtindex, and its venti, would leave it, following the
+ * pack routines of venti/srv/conv.c rather than this package's
+ * formatting code: a partition with a version 4 and a version 5
+ * arena, and a version 2 index section. The last clump of the
+ * second arena is not yet in the index.
+ */
+type p9Clump struct {
+	typ     BlockType
+	data    string
+	indexed bool
+}
+
+func writeP9Fixture(t *testing.T, dir string) (*DiskConfig, []p9Clump) {
+	be := binary.BigEndian
+	const (
+		bs        = 8192
+		arenaBase = 97 * bs /* after the 512K map */
+		arenaLen  = 16 * bs
+		clumpMgc  = 0x5ca1ab1e
+	)
+	clumps := [][]p9Clump{
+		{{DataType, "plan9port data", true}, {DirType, string(make([]byte, 40)) + "a dir", true}},
+		{{RootType, "a root block", true}, {DataType, "not yet indexed", false}},
+	}
+
+	apart := make([]byte, arenaBase+2*arenaLen)
+	be.PutUint32(apart[262144:], 0xa9e4a5e7) /* ArenaPartMagic */
+	be.PutUint32(apart[262148:], 3)
+	be.PutUint32(apart[262152:], bs)
+	be.PutUint32(apart[262156:], arenaBase)
+	copy(apart[33*bs:], fmt.Sprintf("2\narena0\t%d\t%d\narena1\t%d\t%d\n",
+		arenaBase, arenaBase+arenaLen, arenaBase+arenaLen, arenaBase+2*arenaLen))
+
+	type ientry struct {
+		score Score
+		addr  uint64
+		size  uint16
+		typ   BlockType
+		nblk  uint8
+	}
+	var entries []ientry
+	for i, list := range clumps {
+		version, magic := uint32(4), uint32(0xd15cb10c)
+		if i == 1 {
+			version, magic = 5, clumpMgc
+		}
+		start := arenaBase + i*arenaLen
+		name := fmt.Sprintf("arena%d", i)
+
+		/* packarenahead */
+		h := apart[start:]
+		be.PutUint32(h, 0xd15c4ead)
+		be.PutUint32(h[4:], version)
+		copy(h[8:72], name)
+		be.PutUint32(h[72:], bs)
+		be.PutUint64(h[76:], arenaLen)
+		if version == 5 {
+			be.PutUint32(h[84:], magic)
+		}
+
+		/* packclump and packclumpinfo */
+		var used, uncsize, iused, iuncsize uint64
+		var n, in uint32
+		for _, c := range list {
+			score := Sha1([]byte(c.data))
+			cl := apart[start+bs+int(used):]
+			be.PutUint32(cl, magic)
+			cl[4] = byte(c.typ)
+			be.PutUint16(cl[5:], uint16(len(c.data)))
+			be.PutUint16(cl[7:], uint16(len(c.data)))
+			copy(cl[9:29], score[:])
+			cl[29] = 1 /* ClumpENone */
+			be.PutUint32(cl[34:], 1136073600)
+			copy(cl[38:], c.data)
+
+			ci := apart[start+arenaLen-2*bs+int(n)*25:]
+			ci[0] = byte(c.typ)
+			be.PutUint16(ci[1:], uint16(len(c.data)))
+			be.PutUint16(ci[3:], uint16(len(c.data)))
+			copy(ci[5:25], score[:])
+
+			if c.indexed {
+				entries = append(entries, ientry{*score, 1024*1024 + uint64(i)*(arenaLen-2*bs) + used,
+					uint16(len(c.data)), c.typ, uint8((38 + len(c.data) + 511) >> 9)})
+			}
+			used += 38 + uint64(len(c.data))
+			uncsize += uint64(len(c.data))
+			n++
+			if c.indexed {
+				iused, iuncsize, in = used, uncsize, n
+			}
+		}
+
+		/* packarena, with the memory statistics of 2008 */
+		tr := apart[start+arenaLen-bs:]
+		be.PutUint32(tr, 0xf2a14ead)
+		be.PutUint32(tr[4:], version)
+		copy(tr[8:72], name)
+		be.PutUint32(tr[72:], in)
+		be.PutUint32(tr[80:], 1136073600)
+		be.PutUint32(tr[84:], 1136073600)
+		p := tr[88:]
+		if version == 5 {
+			be.PutUint32(p, magic)
+			p = p[4:]
+		}
+		be.PutUint64(p, iused)
+		be.PutUint64(p[8:], iuncsize)
+		if n != in {
+			p[17] = 1
+			be.PutUint32(p[18:], n)
+			be.PutUint64(p[26:], used)
+			be.PutUint64(p[34:], uncsize)
+		}
+	}
+
+	/* packisect, the index map of wbindex, and packibucket */
+	const buckets = 8
+	isect := make([]byte, arenaBase+buckets*bs)
+	h := isect[262144:]
+	be.PutUint32(h, 0xd15c5ec7)
+	be.PutUint32(h[4:], 2)
+	copy(h[8:72], "isect0")
+	copy(h[72:136], "main")
+	be.PutUint32(h[136:], bs)
+	be.PutUint32(h[140:], arenaBase)
+	be.PutUint32(h[144:], buckets)
+	be.PutUint32(h[148:], 0)
+	be.PutUint32(h[152:], buckets)
+	be.PutUint32(h[156:], 0xb0c4e7)
+	copy(isect[33*bs:], fmt.Sprintf("main\n1\n%d\n%d\n1\nisect0\t0\t%d\n2\narena0\t%d\t%d\narena1\t%d\t%d\n",
+		bs, buckets, buckets, 1024*1024, 1024*1024+arenaLen-2*bs, 1024*1024+arenaLen-2*bs, 1024*1024+2*(arenaLen-2*bs)))
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].score[:], entries[j].score[:]) < 0 })
+	for _, e := range entries {
+		b := isect[arenaBase+int(be.Uint32(e.score[:])/(1<<29))*bs:]
+		n := be.Uint16(b)
+		be.PutUint16(b, n+1)
+		be.PutUint32(b[2:], 0xb0c4e7)
+		ie := b[6+int(n)*38:]
+		copy(ie, e.score[:])
+		be.PutUint64(ie[26:], e.addr)
+		be.PutUint16(ie[34:], e.size)
+		ie[36] = byte(e.typ)
+		ie[37] = e.nblk
+	}
+
+	conf := &DiskConfig{Index: "main"}
+	for _, p := range []struct {
+		file string
+		data []byte
+		list *[]string
+	}{
+		{"arenas.part", apart, &conf.Arenas},
+		{"isect.part", isect, &conf.ISects},
+	} {
+		file := filepath.Join(dir, p.file)
+		if err := os.WriteFile(file, p.data, 0666); err != nil {
+			t.Fatalf("write fixture: %v", err)
+		}
+		*p.list = append(*p.list, file)
+	}
+	return conf, append(clumps[0], clumps[1]...)
+}
+
+func TestDiskStorePlan9port(t *testing.T) {
+	conf, clumps := writeP9Fixture(t, t.TempDir())
+	s, err := OpenDiskStoreConfig(conf)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if a := s.ix.arenas[0]; a.version != 4 || a.clumpMagic != 0xd15cb10c || a.memStats.clumps != 2 {
+		t.Errorf("arena0: version %d, clump magic %#x, %d clumps", a.version, a.clumpMagic, a.memStats.clumps)
+	}
+	if a := s.ix.arenas[1]; a.version != 5 || a.clumpMagic != 0x5ca1ab1e || a.memStats.clumps != 2 {
+		t.Errorf("arena1: version %d, clump magic %#x, %d clumps", a.version, a.clumpMagic, a.memStats.clumps)
+	}
+
+	buf := make([]byte, 100)
+	read := func(when string) {
+		for _, c := range clumps {
+			n, err := s.Read(Sha1([]byte(c.data)), c.typ, buf)
+			if err != nil {
+				t.Errorf("%s: read %q: %v", when, c.data, err)
+				continue
+			}
+			if string(buf[:n]) != c.data {
+				t.Errorf("%s: read %q: got %q", when, c.data, buf[:n])
+			}
+		}
+	}
+	read("open")
+
+	score, err := s.Write(DataType, []byte("appended"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if s, err = OpenDiskStoreConfig(conf); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+	read("reopen")
+	if n, err := s.Read(score, DataType, buf); err != nil || string(buf[:n]) != "appended" {
+		t.Errorf("read appended block: %q, %v", buf[:n], err)
+	}
+}
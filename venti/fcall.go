@@ -107,7 +107,34 @@ func unpackFcall(buf []byte, f *fcall) error {
 			return fmt.Errorf("unpack err: %v", err)
 		}
 		f.err = errors.New(s)
+	case tPing:
 	case rPing:
+	case tHello:
+		var err error
+		if f.version, err = pack.UnpackString(&buf); err != nil {
+			return fmt.Errorf("unpack version: %v", err)
+		}
+		if f.uid, err = pack.UnpackString(&buf); err != nil {
+			return fmt.Errorf("unpack uid: %v", err)
+		}
+		if len(buf) < 2 {
+			return errors.New("short hello")
+		}
+		f.strength = buf[0]
+		f.ncrypto = uint(buf[1])
+		buf = buf[2:]
+		if uint(len(buf)) < f.ncrypto+1 {
+			return errors.New("short hello")
+		}
+		f.crypto = buf[:f.ncrypto]
+		buf = buf[f.ncrypto:]
+		f.ncodec = uint(buf[0])
+		buf = buf[1:]
+		if uint(len(buf)) < f.ncodec {
+			return errors.New("short hello")
+		}
+		f.codec = buf[:f.ncodec]
+		buf = buf[f.ncodec:]
 	case rHello:
 		var err error
 		f.sid, err = pack.UnpackString(&buf)
@@ -117,15 +144,35 @@ func unpackFcall(buf []byte, f *fcall) error {
 		f.rcrypto = buf[0]
 		f.rcodec = buf[1]
 		buf = buf[2:]
+	case tGoodbye:
 	case rGoodbye:
+	case tAuth0, tAuth1:
+		f.auth = buf
+		f.nauth = uint(len(buf))
 	case rAuth0:
 	case rAuth1:
+	case tRead:
+		if len(buf) < ScoreSize+4 {
+			return errors.New("short read request")
+		}
+		f.score = new(Score)
+		buf = buf[copy(f.score[:], buf):]
+		f.typ = BlockType(buf[0])
+		f.count = pack.GetUint16(buf[2:])
+		buf = buf[4:]
 	case rRead:
 		// to be read directly from the network into user-provided buffer
+	case tWrite:
+		if len(buf) < 4 {
+			return errors.New("short write request")
+		}
+		f.typ = BlockType(buf[0])
+		f.data = buf[4:]
 	case rWrite:
 		f.score = new(Score)
 		n := copy(f.score[:], buf)
 		buf = buf[n:]
+	case tSync:
 	case rSync:
 	default:
 		return fmt.Errorf("unrecognized message type: %d", f.msgtype)
@@ -141,7 +188,10 @@ func (f *fcall) pack() ([]byte, error) {
 	}
 
 	switch f.msgtype {
+	case rError:
+		buf = append(buf, pack.PackString(f.err.Error())...)
 	case tPing:
+	case rPing:
 	case tHello:
 		buf = append(buf, pack.PackString(f.version)...)
 		buf = append(buf, pack.PackString(f.uid)...)
@@ -150,6 +200,10 @@ func (f *fcall) pack() ([]byte, error) {
 		buf = append(buf, f.crypto...)
 		buf = append(buf, uint8(f.ncodec))
 		buf = append(buf, f.codec...)
+	case rHello:
+		buf = append(buf, pack.PackString(f.sid)...)
+		buf = append(buf, f.rcrypto)
+		buf = append(buf, f.rcodec)
 	case tGoodbye:
 	case tAuth0:
 	case tAuth1:
@@ -165,7 +219,12 @@ func (f *fcall) pack() ([]byte, error) {
 		buf = append(buf, 0) // pad
 		buf = append(buf, 0) // pad
 		// to be written directly to the network from user-provided buffer
+	case rRead:
+		// to be written directly to the network from the store's buffer
+	case rWrite:
+		buf = append(buf, f.score[:]...)
 	case tSync:
+	case rSync:
 	default:
 		return nil, fmt.Errorf("unrecognized message type: %d", f.msgtype)
 	}
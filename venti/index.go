@@ -0,0 +1,501 @@
+package venti
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/floren/fs/internal/pack"
+)
+
+/*
+ * The index maps scores to clump addresses. It is a hash table
+ * of fixed-size buckets spread over one or more index sections.
+ * Each section starts, like an arena partition, with partBlank
+ * untouched bytes and a header, followed by a text table describing
+ * the whole index, followed by the buckets. Index addresses
+ * place the arenas end to end starting at indexBase.
+ */
+const (
+	isectMagic    = 0xd15c5ec7
+	isectVersion1 = 1
+	isectVersion2 = 2
+	indexVersion  = 1
+
+	isectSize1  = 7*4 + 2*aNameSize
+	isectSize2  = isectSize1 + 4
+	ibucketSize = 4 + 2
+	ientrySize  = ScoreSize + 4 + 2 + 8 + 2 + 1 + 1
+
+	ientryAddrOff = ScoreSize + 4 + 2
+	ientryTypeOff = ientryAddrOff + 8 + 2
+)
+
+type isect struct {
+	f           *os.File
+	file        string
+	version     uint32
+	name        string
+	index       string // name of the index this section is part of
+	blockSize   uint32
+	blockBase   uint32 // offset of the first bucket
+	blocks      uint32
+	start       uint32 // first bucket in this section
+	stop        uint32
+	bucketMagic uint32
+	tabBase     uint32
+	tabSize     uint32
+	buckMax     int // entries per bucket
+}
+
+// An indexAddr locates a clump in the address space of an index.
+type indexAddr struct {
+	addr   uint64
+	size   uint16 // uncompressed size of the block
+	typ    BlockType
+	blocks uint8 // size of the clump in 1<<aBlockLog units
+}
+
+type index struct {
+	name      string
+	version   uint32
+	blockSize uint32
+	buckets   uint32
+	div       uint32
+	tabSize   uint32
+	sects     []*isect
+	smap      []arenaMap
+	amap      []arenaMap
+	arenas    []*arena
+}
+
+func openISect(file string) (*isect, error) {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	is, err := readISect(f, file)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("index section %s: %v", file, err)
+	}
+	return is, nil
+}
+
+func readISect(f *os.File, file string) (*isect, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, headSize)
+	if err := readFull(f, buf, partBlank); err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+	if m := pack.GetUint32(buf); m != isectMagic {
+		return nil, fmt.Errorf("bad magic %#x", m)
+	}
+	is := &isect{
+		f:       f,
+		file:    file,
+		version: pack.GetUint32(buf[4:]),
+		name:    cString(buf[8 : 8+aNameSize]),
+		index:   cString(buf[8+aNameSize : 8+2*aNameSize]),
+	}
+	p := buf[8+2*aNameSize:]
+	is.blockSize = pack.GetUint32(p)
+	is.blockBase = pack.GetUint32(p[4:])
+	is.blocks = pack.GetUint32(p[8:])
+	is.start = pack.GetUint32(p[12:])
+	is.stop = pack.GetUint32(p[16:])
+	switch is.version {
+	case isectVersion1:
+	case isectVersion2:
+		is.bucketMagic = pack.GetUint32(p[20:])
+	default:
+		return nil, fmt.Errorf("unknown version %d", is.version)
+	}
+
+	if !isPow2(is.blockSize) || is.blockSize > maxDiskBlock {
+		return nil, fmt.Errorf("bad block size %d", is.blockSize)
+	}
+	is.buckMax = int(is.blockSize-ibucketSize) / ientrySize
+	is.tabBase = uint32(roundUp(partBlank+headSize, uint64(is.blockSize)))
+	if is.tabBase >= is.blockBase {
+		return nil, errors.New("config table overlaps bucket storage")
+	}
+	is.tabSize = is.blockBase - is.tabBase
+	if uint64(is.blockBase)+uint64(is.blocks)*uint64(is.blockSize) > uint64(fi.Size()) {
+		return nil, fmt.Errorf("%d blocks overflow partition", is.blocks)
+	}
+	if is.start > is.stop || is.stop-is.start > is.blocks {
+		return nil, fmt.Errorf("bad bucket range [%d,%d)", is.start, is.stop)
+	}
+
+	return is, nil
+}
+
+func (is *isect) writeHeader() error {
+	buf := make([]byte, headSize)
+	pack.PutUint32(buf, isectMagic)
+	pack.PutUint32(buf[4:], is.version)
+	copy(buf[8:8+aNameSize], is.name)
+	copy(buf[8+aNameSize:8+2*aNameSize], is.index)
+	p := buf[8+2*aNameSize:]
+	pack.PutUint32(p, is.blockSize)
+	pack.PutUint32(p[4:], is.blockBase)
+	pack.PutUint32(p[8:], is.blocks)
+	pack.PutUint32(p[12:], is.start)
+	pack.PutUint32(p[16:], is.stop)
+	if is.version == isectVersion2 {
+		pack.PutUint32(p[20:], is.bucketMagic)
+	}
+	_, err := is.f.WriteAt(buf, partBlank)
+	return err
+}
+
+func (is *isect) close() error {
+	return is.f.Close()
+}
+
+// formatISect formats file as an empty index section, like fmtisect.
+func formatISect(file, name string, blockSize uint32) error {
+	if !isPow2(blockSize) || blockSize > maxDiskBlock {
+		return fmt.Errorf("bad block size %d", blockSize)
+	}
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	const tabSize = 512 * 1024
+	is := &isect{
+		f:         f,
+		file:      file,
+		version:   isectVersion2,
+		name:      name,
+		blockSize: blockSize,
+	}
+	is.tabBase = uint32(roundUp(partBlank+headSize, uint64(blockSize)))
+	is.blockBase = uint32(roundUp(uint64(is.tabBase)+tabSize, uint64(blockSize)))
+	if uint64(fi.Size()) <= uint64(is.blockBase) {
+		return fmt.Errorf("%s: partition too small", file)
+	}
+	is.blocks = uint32(uint64(fi.Size())/uint64(blockSize) - uint64(is.blockBase/blockSize))
+	for is.bucketMagic == 0 {
+		is.bucketMagic = randomMagic()
+	}
+	if err := is.writeHeader(); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return f.Sync()
+}
+
+// newIndex divides the buckets of an index among its sections,
+// as fmtindex does.
+func newIndex(name string, sects []*isect) (*index, error) {
+	if len(sects) == 0 {
+		return nil, fmt.Errorf("index %s has no sections", name)
+	}
+
+	var nb uint64
+	for _, is := range sects {
+		if is.index != "" && is.index != name {
+			return nil, fmt.Errorf("index section %s is already part of index %s", is.name, is.index)
+		}
+		if is.blockSize != sects[0].blockSize {
+			return nil, errors.New("mismatched block sizes in index sections")
+		}
+		if is.tabSize != sects[0].tabSize {
+			return nil, errors.New("mismatched config table sizes in index sections")
+		}
+		nb += uint64(is.blocks)
+	}
+	if nb >= 1<<32 {
+		nb = 1<<32 - 1
+	}
+	div := (1<<32 + nb - 1) / nb
+	if div < 100 {
+		div = 100
+		nb = (1<<32 - 1) / (100 - 1)
+	}
+	ub := (1<<32-1)/div + 1
+	if ub > nb {
+		return nil, errors.New("index initialization math wrong")
+	}
+	xb := nb - ub
+
+	ix := &index{
+		name:      name,
+		version:   indexVersion,
+		blockSize: sects[0].blockSize,
+		buckets:   uint32(ub),
+		div:       uint32(div),
+		tabSize:   sects[0].tabSize,
+		sects:     sects,
+	}
+	var start uint32
+	for i, is := range sects {
+		stop := start + is.blocks - uint32(xb/uint64(len(sects)))
+		if i == len(sects)-1 {
+			stop = uint32(ub)
+		}
+		is.start = start
+		is.stop = stop
+		is.index = name
+		ix.smap = append(ix.smap, arenaMap{name: is.name, start: uint64(start), stop: uint64(stop)})
+		start = stop
+	}
+	return ix, nil
+}
+
+// setArenas appends the arenas not already in the index to its
+// address space.
+func (ix *index) setArenas(arenas []*arena) error {
+	addr := uint64(indexBase)
+	for i, a := range arenas {
+		if i < len(ix.amap) {
+			if ix.amap[i].name != a.name {
+				return fmt.Errorf("mismatched arenas %s and %s at slot %d", a.name, ix.amap[i].name, i)
+			}
+			if ix.amap[i].start != addr {
+				return fmt.Errorf("mis-located arena %s in index %s", a.name, ix.name)
+			}
+			addr = ix.amap[i].stop
+			continue
+		}
+		ix.amap = append(ix.amap, arenaMap{name: a.name, start: addr, stop: addr + a.size})
+		addr += a.size
+	}
+	ix.arenas = arenas
+	return nil
+}
+
+// writeConfig writes the index table and header to each section.
+func (ix *index) writeConfig() error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n%d\n%d\n%d\n", ix.name, ix.version, ix.blockSize, ix.buckets)
+	b.WriteString(formatArenaMap(ix.smap))
+	b.WriteString(formatArenaMap(ix.amap))
+	if uint32(b.Len()) > ix.tabSize {
+		return fmt.Errorf("index configuration too big: %d > %d", b.Len(), ix.tabSize)
+	}
+	buf := make([]byte, ix.tabSize)
+	copy(buf, b.String())
+	for _, is := range ix.sects {
+		if _, err := is.f.WriteAt(buf, int64(is.tabBase)); err != nil {
+			return fmt.Errorf("index section %s: %v", is.name, err)
+		}
+		if err := is.writeHeader(); err != nil {
+			return fmt.Errorf("index section %s: %v", is.name, err)
+		}
+		if err := is.f.Sync(); err != nil {
+			return fmt.Errorf("index section %s: %v", is.name, err)
+		}
+	}
+	return nil
+}
+
+// readIndex reads the index configuration stored in sects and
+// checks it against the sections and arenas.
+func readIndex(name string, sects []*isect, arenas map[string]*arena) (*index, error) {
+	if len(sects) == 0 {
+		return nil, fmt.Errorf("index %s has no sections", name)
+	}
+	is := sects[0]
+	buf := make([]byte, is.tabSize)
+	if err := readFull(is.f, buf, int64(is.tabBase)); err != nil {
+		return nil, fmt.Errorf("read index configuration: %v", err)
+	}
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	f := strings.Fields(string(buf))
+	if len(f) < 4 {
+		return nil, errors.New("short index configuration")
+	}
+
+	ix := &index{
+		name:    f[0],
+		tabSize: is.tabSize,
+	}
+	for i, p := range []*uint32{&ix.version, &ix.blockSize, &ix.buckets} {
+		v, err := strconv.ParseUint(f[i+1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad index configuration: %v", err)
+		}
+		*p = uint32(v)
+	}
+	var err error
+	if ix.smap, f, err = parseArenaMapFields(f[4:]); err != nil {
+		return nil, fmt.Errorf("index section map: %v", err)
+	}
+	if ix.amap, f, err = parseArenaMapFields(f); err != nil {
+		return nil, fmt.Errorf("index arena map: %v", err)
+	}
+
+	if ix.name != name {
+		return nil, fmt.Errorf("index is named %s, not %s", ix.name, name)
+	}
+	if ix.version != indexVersion {
+		return nil, fmt.Errorf("index %s has unknown version %d", name, ix.version)
+	}
+	if ix.buckets == 0 {
+		return nil, fmt.Errorf("index %s has no buckets", name)
+	}
+	ix.div = uint32((1<<32 + uint64(ix.buckets) - 1) / uint64(ix.buckets))
+	if (1<<32-1)/uint64(ix.div)+1 != uint64(ix.buckets) {
+		return nil, fmt.Errorf("inconsistent math for divisor and buckets in %s", name)
+	}
+
+	if len(ix.smap) != len(sects) {
+		return nil, fmt.Errorf("index %s has %d sections, configured with %d", name, len(ix.smap), len(sects))
+	}
+	for i, m := range ix.smap {
+		is := sects[i]
+		if is.name != m.name || is.index != name {
+			return nil, fmt.Errorf("index section %s (of index %q) does not match %s in index %s", is.name, is.index, m.name, name)
+		}
+		if uint64(is.start) != m.start || uint64(is.stop) != m.stop {
+			return nil, fmt.Errorf("index section %s has bad range", is.name)
+		}
+		if is.blockSize != ix.blockSize {
+			return nil, fmt.Errorf("index section %s has bad block size", is.name)
+		}
+		if i > 0 && m.start != ix.smap[i-1].stop || i == len(ix.smap)-1 && m.stop != uint64(ix.buckets) {
+			return nil, fmt.Errorf("index section %s leaves a gap in the buckets", is.name)
+		}
+	}
+	ix.sects = sects
+
+	for _, m := range ix.amap {
+		a, ok := arenas[m.name]
+		if !ok {
+			return nil, fmt.Errorf("index %s refers to unknown arena %s", name, m.name)
+		}
+		if m.stop-m.start != a.size {
+			return nil, fmt.Errorf("arena %s has size %d, index expects %d", a.name, a.size, m.stop-m.start)
+		}
+		ix.arenas = append(ix.arenas, a)
+	}
+
+	return ix, nil
+}
+
+// bucket returns the index section and partition offset of the
+// bucket holding score.
+func (ix *index) bucket(score *Score) (*isect, int64) {
+	buck := pack.GetUint32(score[:]) / ix.div
+	i := sort.Search(len(ix.sects), func(i int) bool {
+		return ix.sects[i].stop > buck
+	})
+	is := ix.sects[i]
+	return is, int64(is.blockBase) + int64(buck-is.start)*int64(is.blockSize)
+}
+
+func (ix *index) readBucket(score *Score) (*isect, int64, []byte, int, error) {
+	is, off := ix.bucket(score)
+	buf := make([]byte, is.blockSize)
+	if err := readFull(is.f, buf, off); err != nil {
+		return nil, 0, nil, 0, fmt.Errorf("read index bucket: %v", err)
+	}
+	n := int(pack.GetUint16(buf))
+	if is.bucketMagic != 0 && pack.GetUint32(buf[2:]) != is.bucketMagic {
+		n = 0
+	}
+	if n > is.buckMax {
+		return nil, 0, nil, 0, fmt.Errorf("index bucket at %s:%d has %d entries", is.name, off, n)
+	}
+	return is, off, buf, n, nil
+}
+
+// bucketLook returns the offset of the entry for score and typ in the
+// bucket entries data, and whether it is present.
+func bucketLook(score *Score, typ BlockType, data []byte, n int) (int, bool) {
+	i := sort.Search(n, func(i int) bool {
+		e := data[i*ientrySize:]
+		if c := bytes.Compare(e[:ScoreSize], score[:]); c != 0 {
+			return c > 0
+		}
+		return BlockType(e[ientryTypeOff]) >= typ
+	})
+	h := i * ientrySize
+	if i < n {
+		e := data[h:]
+		return h, bytes.Equal(e[:ScoreSize], score[:]) && BlockType(e[ientryTypeOff]) == typ
+	}
+	return h, false
+}
+
+func (ix *index) lookup(score *Score, typ BlockType) (*indexAddr, error) {
+	_, _, buf, n, err := ix.readBucket(score)
+	if err != nil {
+		return nil, err
+	}
+	data := buf[ibucketSize:]
+	h, ok := bucketLook(score, typ, data, n)
+	if !ok {
+		return nil, nil
+	}
+	e := data[h:]
+	return &indexAddr{
+		addr:   pack.GetUint64(e[ientryAddrOff:]),
+		size:   pack.GetUint16(e[ientryAddrOff+8:]),
+		typ:    BlockType(e[ientryTypeOff]),
+		blocks: e[ientryTypeOff+1],
+	}, nil
+}
+
+// insert adds an entry for score to the index, unless one is
+// already present.
+func (ix *index) insert(score *Score, ia *indexAddr) error {
+	is, off, buf, n, err := ix.readBucket(score)
+	if err != nil {
+		return err
+	}
+	data := buf[ibucketSize:]
+	h, ok := bucketLook(score, ia.typ, data, n)
+	if ok {
+		return nil
+	}
+	if n >= is.buckMax {
+		return fmt.Errorf("index bucket at %s:%d is full", is.name, off)
+	}
+
+	copy(data[h+ientrySize:(n+1)*ientrySize], data[h:n*ientrySize])
+	e := data[h : h+ientrySize]
+	memset(e, 0)
+	copy(e, score[:])
+	pack.PutUint64(e[ientryAddrOff:], ia.addr)
+	pack.PutUint16(e[ientryAddrOff+8:], ia.size)
+	e[ientryTypeOff] = uint8(ia.typ)
+	e[ientryTypeOff+1] = ia.blocks
+
+	pack.PutUint16(buf, uint16(n+1))
+	pack.PutUint32(buf[2:], is.bucketMagic)
+	if _, err := is.f.WriteAt(buf, off); err != nil {
+		return fmt.Errorf("write index bucket: %v", err)
+	}
+	return nil
+}
+
+// arena returns the arena holding index address addr and the
+// offset of addr in its clump log.
+func (ix *index) arena(addr uint64) (int, uint64, error) {
+	i := sort.Search(len(ix.amap), func(i int) bool {
+		return ix.amap[i].stop > addr
+	})
+	if i == len(ix.amap) || addr < ix.amap[i].start {
+		return 0, 0, fmt.Errorf("index address %d is not in any arena", addr)
+	}
+	return i, addr - ix.amap[i].start, nil
+}
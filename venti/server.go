@@ -0,0 +1,306 @@
+package venti
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A Server answers venti protocol requests on behalf of a Store.
+type Server struct {
+	store    Store
+	versions []string
+	codecs   []uint8
+
+	mu     sync.Mutex
+	ln     map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	nsid   int
+	closed bool
+}
+
+// NewServer returns a Server which reads and writes blocks in store.
+func NewServer(store Store) *Server {
+	return &Server{
+		store:    store,
+		versions: supportedVersions,
+		codecs:   supportedCodecs,
+		ln:       make(map[net.Listener]struct{}),
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves
+// requests for blocks in store. If addr has no port,
+// VentiPort is used.
+func ListenAndServe(addr string, store Store) error {
+	if !strings.Contains(addr, ":") {
+		addr += fmt.Sprintf(":%d", VentiPort)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return NewServer(store).Serve(l)
+}
+
+// Serve accepts connections on l, serving each in a new goroutine.
+// It returns when l fails or the server is closed.
+func (srv *Server) Serve(l net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		l.Close()
+		return errors.New("server is closed")
+	}
+	srv.ln[l] = struct{}{}
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.ln, l)
+		srv.mu.Unlock()
+	}()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			if err := srv.ServeConn(c); err != nil {
+				dprintf("server: %v: %v\n", c.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn answers requests on c until the client says goodbye,
+// the connection fails, or the server is closed. It closes c
+// before returning.
+func (srv *Server) ServeConn(c net.Conn) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		c.Close()
+		return errors.New("server is closed")
+	}
+	srv.conns[c] = struct{}{}
+	srv.nsid++
+	sid := fmt.Sprintf("%d", srv.nsid)
+	srv.mu.Unlock()
+
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, c)
+		srv.mu.Unlock()
+		c.Close()
+	}()
+
+	sc := &serverConn{
+		srv: srv,
+		c:   c,
+		r:   bufio.NewReader(c),
+		sid: sid,
+	}
+	if err := sc.negotiateVersion(); err != nil {
+		return fmt.Errorf("version: %v", err)
+	}
+	err := sc.serve()
+	if err == io.EOF || srv.isClosed() {
+		err = nil
+	}
+	return err
+}
+
+// Close stops all listeners and closes all connections.
+// It does not close the underlying Store.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.closed {
+		return errors.New("server is closed")
+	}
+	srv.closed = true
+	for l := range srv.ln {
+		l.Close()
+	}
+	for c := range srv.conns {
+		c.Close()
+	}
+	return nil
+}
+
+func (srv *Server) isClosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.closed
+}
+
+type serverConn struct {
+	srv     *Server
+	c       net.Conn
+	r       *bufio.Reader
+	sid     string
+	version string
+	codec   uint8
+}
+
+func (sc *serverConn) negotiateVersion() error {
+	out := "venti-" + strings.Join(sc.srv.versions, ":") + "-github.com/floren/fs/venti\n"
+	if _, err := sc.c.Write([]byte(out)); err != nil {
+		return fmt.Errorf("write version: %v", err)
+	}
+
+	in, err := sc.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("read version: %v", err)
+	}
+	dprintf("\t<- version string: %s\n", in[:len(in)-1])
+
+	if strings.Count(in, "-") < 2 {
+		return fmt.Errorf("couldn't parse version string: %q", in)
+	}
+	versions := strings.Split(strings.Split(in, "-")[1], ":")
+	for _, v1 := range versions {
+		for _, v2 := range sc.srv.versions {
+			if v1 == v2 {
+				sc.version = v1
+				return nil
+			}
+		}
+	}
+
+	return errors.New("unable to negotiate version")
+}
+
+func (sc *serverConn) serve() error {
+	for {
+		tx, err := sc.readMessage()
+		if err != nil {
+			return err
+		}
+		dprintf("\t<- %v\n", tx)
+
+		if tx.msgtype == tGoodbye {
+			return nil
+		}
+
+		rx := sc.handle(tx)
+		rx.tag = tx.tag
+		if err := sc.writeMessage(rx); err != nil {
+			return err
+		}
+	}
+}
+
+func (sc *serverConn) handle(tx *fcall) *fcall {
+	store := sc.srv.store
+
+	rx := &fcall{msgtype: tx.msgtype + 1}
+	switch tx.msgtype {
+	default:
+		return rerror(fmt.Errorf("unsupported message type: %d", tx.msgtype))
+	case tPing:
+	case tHello:
+		if tx.version != sc.version {
+			return rerror(fmt.Errorf("bad version in hello: %q != %q", tx.version, sc.version))
+		}
+		rx.sid = sc.sid
+		if sc.version != "02" {
+			sc.codec = chooseCodec(tx.codec, sc.srv.codecs)
+			rx.rcodec = sc.codec
+		}
+	case tRead:
+		rx.data = make([]byte, tx.count)
+		n, err := store.Read(tx.score, tx.typ, rx.data)
+		if err != nil {
+			return rerror(err)
+		}
+		if rx.data, err = encodeData(sc.codec, rx.data[:n]); err != nil {
+			return rerror(err)
+		}
+	case tWrite:
+		data := tx.data
+		if sc.codec != codecNone {
+			data = make([]byte, MaxBlockSize)
+			n, err := decodeData(sc.codec, tx.data, data)
+			if err != nil {
+				return rerror(err)
+			}
+			data = data[:n]
+		}
+		score, err := store.Write(tx.typ, data)
+		if err != nil {
+			return rerror(err)
+		}
+		rx.score = score
+	case tSync:
+		if err := store.Sync(); err != nil {
+			return rerror(err)
+		}
+	}
+	return rx
+}
+
+func rerror(err error) *fcall {
+	return &fcall{
+		msgtype: rError,
+		err:     err,
+	}
+}
+
+func (sc *serverConn) readMessage() (*fcall, error) {
+	buf := make([]byte, frameSize(sc.version))
+	if _, err := io.ReadFull(sc.r, buf); err != nil {
+		return nil, err
+	}
+	length := unpackLength(buf)
+	if length < 2 || length > 2*MaxBlockSize {
+		return nil, fmt.Errorf("bad message length: %d", length)
+	}
+	buf = make([]byte, length)
+	if _, err := io.ReadFull(sc.r, buf); err != nil {
+		return nil, fmt.Errorf("read message: %v", err)
+	}
+
+	tx := &fcall{
+		msgtype: buf[0],
+		tag:     buf[1],
+	}
+	if err := unpackFcall(buf[2:], tx); err != nil {
+		return nil, fmt.Errorf("unpack fcall: %v", err)
+	}
+	return tx, nil
+}
+
+func (sc *serverConn) writeMessage(rx *fcall) error {
+	dprintf("\t-> %v\n", rx)
+
+	packed, err := rx.pack()
+	if err != nil {
+		return fmt.Errorf("pack: %v", err)
+	}
+	if rx.msgtype == rRead {
+		packed = append(packed, rx.data...)
+	}
+
+	buf, err := packLength(sc.version, len(packed))
+	if err != nil {
+		return err
+	}
+	buf = append(buf, packed...)
+	if _, err := sc.c.Write(buf); err != nil {
+		return fmt.Errorf("write message: %v", err)
+	}
+	return nil
+}
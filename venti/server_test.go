@@ -0,0 +1,143 @@
+package venti
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func testServer(t *testing.T, store Store) (*Session, func()) {
+	return testServerConfig(t, NewServer(store))
+}
+
+func testServerConfig(t *testing.T, srv *Server) (*Session, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go srv.Serve(l)
+
+	z, err := Dial(l.Addr().String())
+	if err != nil {
+		srv.Close()
+		t.Fatalf("dial: %v", err)
+	}
+	return z, func() {
+		z.Close()
+		srv.Close()
+	}
+}
+
+func TestServerMem(t *testing.T) {
+	z, done := testServer(t, NewMemStore())
+	defer done()
+
+	t.Run("ping", func(t *testing.T) { testPing(t, z) })
+	t.Run("write+read", func(t *testing.T) { testWriteRead(t, z) })
+	t.Run("sync", func(t *testing.T) { testSync(t, z) })
+	t.Run("errors", func(t *testing.T) { testServerErrors(t, z) })
+}
+
+func TestServerVersions(t *testing.T) {
+	for _, test := range []struct {
+		versions []string
+		codecs   []uint8
+		version  string
+		codec    uint8
+	}{
+		{supportedVersions, supportedCodecs, "04", codecDeflate},
+		{[]string{"04"}, nil, "04", codecNone},
+		{[]string{"04"}, []uint8{codecThwack}, "04", codecNone},
+		{[]string{"02"}, supportedCodecs, "02", codecNone},
+	} {
+		srv := NewServer(NewMemStore())
+		srv.versions = test.versions
+		srv.codecs = test.codecs
+		z, done := testServerConfig(t, srv)
+		if z.version != test.version || z.codec != test.codec {
+			t.Errorf("server %v/%v: negotiated version %s codec %d, want %s codec %d",
+				test.versions, test.codecs, z.version, z.codec, test.version, test.codec)
+		}
+		testWriteRead(t, z)
+
+		// compressible and uncompressible blocks
+		for _, data := range [][]byte{bytes.Repeat([]byte("venti"), 5000), Sha1(nil)[:]} {
+			score, err := z.Write(DataType, data)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			buf := make([]byte, len(data))
+			n, err := z.Read(score, DataType, buf)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if !bytes.Equal(buf[:n], data) {
+				t.Errorf("read %d bytes, want %d", n, len(data))
+			}
+			if _, err := z.Read(score, DataType, buf[:len(buf)-1]); err == nil {
+				t.Errorf("read into short buffer succeeded")
+			}
+		}
+		done()
+	}
+}
+
+func TestServerFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks")
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("open file store: %v", err)
+	}
+	defer store.Close()
+
+	z, done := testServer(t, store)
+	defer done()
+
+	t.Run("write+read", func(t *testing.T) { testWriteRead(t, z) })
+	t.Run("sync", func(t *testing.T) { testSync(t, z) })
+	t.Run("errors", func(t *testing.T) { testServerErrors(t, z) })
+}
+
+func TestServerDisk(t *testing.T) {
+	store, err := OpenDiskStore(formatTestDisk(t, t.TempDir(), 1024*1024))
+	if err != nil {
+		t.Fatalf("open disk store: %v", err)
+	}
+	defer store.Close()
+
+	z, done := testServer(t, store)
+	defer done()
+
+	t.Run("write+read", func(t *testing.T) { testWriteRead(t, z) })
+	t.Run("sync", func(t *testing.T) { testSync(t, z) })
+	t.Run("errors", func(t *testing.T) { testServerErrors(t, z) })
+}
+
+func testServerErrors(t *testing.T, z *Session) {
+	score, err := z.Write(DataType, []byte("typed"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 8192)
+	if _, err := z.Read(score, PointerType0, buf); err == nil {
+		t.Errorf("read with wrong type succeeded")
+	}
+	missing := Sha1([]byte("missing"))
+	if _, err := z.Read(missing, DataType, buf); err == nil {
+		t.Errorf("read of missing block succeeded")
+	}
+	if _, err := z.Read(score, DataType, buf[:2]); err == nil {
+		t.Errorf("read into short buffer succeeded")
+	}
+
+	// the session should still be usable after errors
+	n, err := z.Read(score, DataType, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("typed")) {
+		t.Errorf("read: got %q, want %q", buf[:n], "typed")
+	}
+}
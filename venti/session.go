@@ -2,18 +2,28 @@ package venti
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 const VentiPort = 17034
 
+// maxTags is the number of RPCs a Session can have in flight,
+// the size of the 8-bit tag space.
+const maxTags = 256
+
+// supportedVersions lists the protocol versions spoken by Session
+// and Server, most preferred first. Each side chooses the first
+// version in the other's list which it supports, so both lists
+// must be in the same order.
 var supportedVersions = []string{
-	//"04",
+	"04",
 	"02",
 }
 
@@ -23,14 +33,25 @@ type Session struct {
 	version string
 	uid     string
 	sid     string
+	codec   uint8
 
 	outgoing    chan *fcall
 	outstanding chan struct{}
-	incoming    [64]chan *fcall
+	incoming    [maxTags]chan *fcall
+	tags        chan uint8 // free tags
+
+	mu       sync.Mutex
+	inflight tagSet // tags awaiting a response
+	stats    SessionStats
+	err      error // set once the connection breaks
+	closed   bool
+}
 
-	mu        sync.Mutex
-	tagBitmap uint64
-	closed    bool
+// SessionStats holds counters describing the use of a Session.
+type SessionStats struct {
+	RPCs     uint64        // RPCs started
+	TagWaits uint64        // RPCs which had to wait for a free tag
+	TagWait  time.Duration // total time spent waiting for tags
 }
 
 func Dial(addr string) (*Session, error) {
@@ -52,13 +73,16 @@ func Dial(addr string) (*Session, error) {
 	z := &Session{
 		c:           c,
 		outgoing:    make(chan *fcall),
-		outstanding: make(chan struct{}, 64),
+		outstanding: make(chan struct{}, maxTags),
+		tags:        make(chan uint8, maxTags),
 	}
 	for i := range z.incoming {
 		z.incoming[i] = make(chan *fcall, 0)
+		z.tags <- uint8(i)
 	}
 
 	if err := z.connect(); err != nil {
+		c.Close()
 		return nil, fmt.Errorf("connect: %v", err)
 	}
 
@@ -129,11 +153,19 @@ func (z *Session) hello() error {
 	if tx.uid == "" {
 		tx.uid = "anonymous"
 	}
+	if z.version != "02" {
+		tx.codec = supportedCodecs
+		tx.ncodec = uint(len(tx.codec))
+	}
 	var rx fcall
-	if err := z.rpc(&tx, &rx); err != nil {
+	if err := z.rpc(context.Background(), &tx, &rx); err != nil {
 		return fmt.Errorf("rpc: %v", err)
 	}
 	z.sid = rx.sid
+	if rx.rcodec != codecNone && chooseCodec([]uint8{rx.rcodec}, tx.codec) == codecNone {
+		return fmt.Errorf("server chose unoffered codec %d", rx.rcodec)
+	}
+	z.codec = rx.rcodec
 
 	return nil
 }
@@ -0,0 +1,446 @@
+package venti
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/floren/fs/internal/pack"
+)
+
+// A Store holds venti blocks, addressed by score and type.
+// Its methods have the same semantics as the corresponding
+// methods of Session, so a Session is itself a Store.
+type Store interface {
+	// Read reads the block with the given score and type into p,
+	// returning the number of bytes read.
+	Read(score *Score, typ BlockType, p []byte) (int, error)
+
+	// Write stores p as a block of the given type and
+	// returns its score.
+	Write(typ BlockType, p []byte) (*Score, error)
+
+	// Sync blocks until all previous writes are stable.
+	Sync() error
+}
+
+var _ Store = (*Session)(nil)
+
+func errNoBlock(score *Score, typ BlockType) error {
+	return fmt.Errorf("no block with score %v/%d exists", score, typ)
+}
+
+func checkRead(score *Score, typ BlockType, n int, p []byte) error {
+	if n > len(p) {
+		return fmt.Errorf("block %v/%d too big for buffer: %d > %d", score, typ, n, len(p))
+	}
+	return nil
+}
+
+// MemStore is a Store which keeps all blocks in memory.
+type MemStore struct {
+	mu     sync.RWMutex
+	blocks map[Score]memBlock
+}
+
+type memBlock struct {
+	typ  BlockType
+	data []byte
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		blocks: make(map[Score]memBlock),
+	}
+}
+
+func (s *MemStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	if score.IsZero() {
+		return 0, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, ok := s.blocks[*score]
+	if !ok || b.typ != typ {
+		return 0, errNoBlock(score, typ)
+	}
+	if err := checkRead(score, typ, len(b.data), p); err != nil {
+		return 0, err
+	}
+	return copy(p, b.data), nil
+}
+
+func (s *MemStore) Write(typ BlockType, p []byte) (*Score, error) {
+	if len(p) > MaxBlockSize {
+		return nil, fmt.Errorf("data exceeds maximum block size: %d > %d", len(p), MaxBlockSize)
+	}
+	score := Sha1(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blocks[*score]; !ok {
+		data := make([]byte, len(p))
+		copy(data, p)
+		s.blocks[*score] = memBlock{typ: typ, data: data}
+	}
+	return score, nil
+}
+
+func (s *MemStore) Sync() error {
+	return nil
+}
+
+// Len returns the number of blocks in the store.
+func (s *MemStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.blocks)
+}
+
+/*
+ * A FileStore keeps blocks in a single append-only log file.
+ * Each block is stored as a header followed by the block data:
+ *
+ *	magic[4] score[20] type[1] size[2] data[size]
+ *
+ * The index from score to file offset is kept in memory and
+ * rebuilt by scanning the log when the store is opened.
+ * A partially written block at the end of the log (from a crash)
+ * is discarded.
+ */
+const (
+	fileStoreMagic      = 0x5ec7a1e0
+	fileStoreHeaderSize = 4 + ScoreSize + 1 + 2
+)
+
+// FileStore is a Store which appends blocks to a log file.
+type FileStore struct {
+	mu    sync.RWMutex
+	f     *os.File
+	end   int64
+	index map[Score]fileBlock
+}
+
+type fileBlock struct {
+	typ    BlockType
+	offset int64 // offset of the block data
+	size   uint16
+}
+
+// OpenFileStore opens the log file at path, creating it if necessary.
+func OpenFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		f:     f,
+		index: make(map[Score]fileBlock),
+	}
+	if err := s.scan(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("scan %s: %v", path, err)
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) scan() error {
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+
+	hdr := make([]byte, fileStoreHeaderSize)
+	var off int64
+	for off+fileStoreHeaderSize <= size {
+		if _, err := s.f.ReadAt(hdr, off); err != nil {
+			return err
+		}
+		if pack.GetUint32(hdr) != fileStoreMagic {
+			break
+		}
+		var b fileBlock
+		var score Score
+		copy(score[:], hdr[4:])
+		b.typ = BlockType(hdr[4+ScoreSize])
+		b.size = pack.GetUint16(hdr[4+ScoreSize+1:])
+		b.offset = off + fileStoreHeaderSize
+		if b.offset+int64(b.size) > size {
+			break
+		}
+		s.index[score] = b
+		off = b.offset + int64(b.size)
+	}
+
+	if off != size {
+		dprintf("FileStore: discarding %d bytes of partial block at offset %d\n", size-off, off)
+		if err := s.f.Truncate(off); err != nil {
+			return err
+		}
+	}
+	s.end = off
+
+	return nil
+}
+
+func (s *FileStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	if score.IsZero() {
+		return 0, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.f == nil {
+		return 0, errors.New("store is closed")
+	}
+	b, ok := s.index[*score]
+	if !ok || b.typ != typ {
+		return 0, errNoBlock(score, typ)
+	}
+	if err := checkRead(score, typ, int(b.size), p); err != nil {
+		return 0, err
+	}
+	n, err := s.f.ReadAt(p[:b.size], b.offset)
+	if err == io.EOF && n == int(b.size) {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *FileStore) Write(typ BlockType, p []byte) (*Score, error) {
+	if len(p) > MaxBlockSize {
+		return nil, fmt.Errorf("data exceeds maximum block size: %d > %d", len(p), MaxBlockSize)
+	}
+	score := Sha1(p)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil, errors.New("store is closed")
+	}
+	if _, ok := s.index[*score]; ok {
+		return score, nil
+	}
+
+	buf := make([]byte, fileStoreHeaderSize+len(p))
+	pack.PutUint32(buf, fileStoreMagic)
+	copy(buf[4:], score[:])
+	buf[4+ScoreSize] = uint8(typ)
+	pack.PutUint16(buf[4+ScoreSize+1:], uint16(len(p)))
+	copy(buf[fileStoreHeaderSize:], p)
+	if _, err := s.f.WriteAt(buf, s.end); err != nil {
+		return nil, err
+	}
+
+	s.index[*score] = fileBlock{
+		typ:    typ,
+		offset: s.end + fileStoreHeaderSize,
+		size:   uint16(len(p)),
+	}
+	s.end += int64(len(buf))
+
+	return score, nil
+}
+
+func (s *FileStore) Sync() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.f == nil {
+		return errors.New("store is closed")
+	}
+	return s.f.Sync()
+}
+
+// Close syncs and closes the log file.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return errors.New("store is closed")
+	}
+	err := s.f.Sync()
+	if err1 := s.f.Close(); err == nil {
+		err = err1
+	}
+	s.f = nil
+	return err
+}
+
+/*
+ * A DirStore keeps each block in its own file in a directory tree,
+ * named by its score and fanned out by the score's first byte:
+ *
+ *	dir/ab/abcdef...
+ *
+ * Each file holds the block type followed by the block data.
+ * Blocks are written to a temporary file and renamed into place,
+ * so a crash never leaves a partial block.
+ */
+
+// DirStore is a Store which keeps blocks as files in a directory.
+type DirStore struct {
+	dir string
+
+	mu      sync.Mutex
+	pending map[string]bool // files and directories to sync
+}
+
+// DirPrefix starts a store address naming a directory of blocks.
+const DirPrefix = "dir:"
+
+// StoreDir returns the directory named by a store address of the
+// form dir:/path, and whether addr has that form.
+func StoreDir(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, DirPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, DirPrefix), true
+}
+
+// OpenStore opens the store at addr: a DirStore if addr has the
+// form dir:/path, otherwise a Session with the server at addr.
+func OpenStore(addr string) (Store, error) {
+	if dir, ok := StoreDir(addr); ok {
+		s, err := OpenDirStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	z, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// OpenDirStore opens the store in dir, creating it if necessary.
+func OpenDirStore(dir string) (*DirStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &DirStore{
+		dir:     dir,
+		pending: make(map[string]bool),
+	}, nil
+}
+
+func (s *DirStore) path(score *Score) string {
+	name := score.String()
+	return filepath.Join(s.dir, name[:2], name)
+}
+
+func (s *DirStore) Read(score *Score, typ BlockType, p []byte) (int, error) {
+	if score.IsZero() {
+		return 0, nil
+	}
+
+	buf, err := os.ReadFile(s.path(score))
+	if os.IsNotExist(err) || err == nil && (len(buf) < 1 || BlockType(buf[0]) != typ) {
+		return 0, errNoBlock(score, typ)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := checkRead(score, typ, len(buf)-1, p); err != nil {
+		return 0, err
+	}
+	return copy(p, buf[1:]), nil
+}
+
+func (s *DirStore) Write(typ BlockType, p []byte) (*Score, error) {
+	if len(p) > MaxBlockSize {
+		return nil, fmt.Errorf("data exceeds maximum block size: %d > %d", len(p), MaxBlockSize)
+	}
+	score := Sha1(p)
+	path := s.path(score)
+	if _, err := os.Stat(path); err == nil {
+		return score, nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(append([]byte{uint8(typ)}, p...))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.pending[path] = true
+	s.pending[dir] = true
+	s.mu.Unlock()
+
+	return score, nil
+}
+
+// Sync flushes the blocks written since the last Sync,
+// and the directories naming them, to stable storage.
+func (s *DirStore) Sync() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string]bool)
+	s.mu.Unlock()
+
+	var paths []string
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	// files before the directories holding them
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	for _, path := range paths {
+		if err := syncPath(path); err != nil {
+			s.mu.Lock()
+			for path := range pending {
+				s.pending[path] = true
+			}
+			s.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
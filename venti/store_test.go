@@ -0,0 +1,143 @@
+package venti
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	testStore(t, s)
+	if s.Len() != 2 {
+		t.Errorf("bad block count: got %d, want 2", s.Len())
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks")
+	s, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testStore(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// simulate a crash in the middle of appending a block
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open log: %v", err)
+	}
+	f.Write([]byte{0x5e, 0xc7, 0xa1, 0xe0, 1, 2, 3})
+	f.Close()
+
+	s, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	buf := make([]byte, 100)
+	for _, data := range []string{"foo", "bar"} {
+		n, err := s.Read(Sha1([]byte(data)), DataType, buf)
+		if err != nil {
+			t.Errorf("read %q after reopen: %v", data, err)
+			continue
+		}
+		if string(buf[:n]) != data {
+			t.Errorf("read after reopen: got %q, want %q", buf[:n], data)
+		}
+	}
+	if _, err := s.Write(DataType, []byte("baz")); err != nil {
+		t.Errorf("write after reopen: %v", err)
+	}
+}
+
+func TestDirStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blocks")
+	s, err := OpenDirStore(dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testStore(t, s)
+
+	s, err = OpenDirStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	buf := make([]byte, 100)
+	n, err := s.Read(Sha1([]byte("bar")), DataType, buf)
+	if err != nil {
+		t.Fatalf("read after reopen: %v", err)
+	}
+	if string(buf[:n]) != "bar" {
+		t.Errorf("read after reopen: got %q, want %q", buf[:n], "bar")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("got files %q, want 2 blocks", files)
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "blocks")
+	if got, ok := StoreDir("dir:" + dir); !ok || got != dir {
+		t.Errorf("StoreDir(dir:%s) = %q, %v", dir, got, ok)
+	}
+	if _, ok := StoreDir("localhost:17034"); ok {
+		t.Errorf("StoreDir of a server address succeeded")
+	}
+
+	s, err := OpenStore("dir:" + dir)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if _, ok := s.(*DirStore); !ok {
+		t.Errorf("open dir:%s: got a %T", dir, s)
+	}
+	if s, err := OpenStore("127.0.0.1:1"); err == nil || s != nil {
+		t.Errorf("open of a missing server: got %v, %v", s, err)
+	}
+}
+
+func testStore(t *testing.T, s Store) {
+	for _, data := range []string{"foo", "bar", "foo"} {
+		score, err := s.Write(DataType, []byte(data))
+		if err != nil {
+			t.Fatalf("write %q: %v", data, err)
+		}
+		if !score.Check([]byte(data)) {
+			t.Errorf("write %q: bad score %v", data, score)
+		}
+	}
+	if err := s.Sync(); err != nil {
+		t.Errorf("sync: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	n, err := s.Read(Sha1([]byte("foo")), DataType, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], []byte("foo")) {
+		t.Errorf("read: got %q, want %q", buf[:n], "foo")
+	}
+
+	zero := ZeroScore()
+	if n, err := s.Read(&zero, DataType, buf); n != 0 || err != nil {
+		t.Errorf("read zero score: got %d, %v; want 0, nil", n, err)
+	}
+	if _, err := s.Read(Sha1([]byte("foo")), DirType, buf); err == nil {
+		t.Errorf("read with wrong type succeeded")
+	}
+	if _, err := s.Write(DataType, make([]byte, MaxBlockSize+1)); err == nil {
+		t.Errorf("write of oversized block succeeded")
+	}
+}
@@ -2,22 +2,21 @@ package venti
 
 import (
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
-	if err := exec.Command("../test/venti.sh").Run(); err != nil {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", VentiPort))
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting venti server for testing: %v\n", err)
-		exec.Command("../test/clean.sh").Run()
 		os.Exit(1)
 	}
+	srv := NewServer(NewMemStore())
+	go srv.Serve(l)
 
-	defer os.Exit(m.Run())
-
-	if err := exec.Command("../test/clean.sh").Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "error stopping venti server: %v\n", err)
-		os.Exit(1)
-	}
+	code := m.Run()
+	srv.Close()
+	os.Exit(code)
 }
@@ -0,0 +1,210 @@
+// Package ventitest provides venti stores and servers which
+// misbehave on request, for testing clients of venti.
+package ventitest
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+// ErrInjected is the error returned by writes which are made to fail.
+var ErrInjected = errors.New("injected write error")
+
+// A FaultStore wraps a venti.Store, injecting faults into
+// the requests made of it.
+type FaultStore struct {
+	store venti.Store
+
+	mu         sync.Mutex
+	latency    time.Duration
+	corrupt    map[venti.Score]bool
+	failWrites map[venti.Score]bool
+	writes     int
+	failed     int
+}
+
+// NewFaultStore returns a FaultStore passing requests to store.
+// Until told otherwise, it injects no faults.
+func NewFaultStore(store venti.Store) *FaultStore {
+	return &FaultStore{
+		store:      store,
+		corrupt:    make(map[venti.Score]bool),
+		failWrites: make(map[venti.Score]bool),
+	}
+}
+
+// SetLatency delays every request by d.
+func (s *FaultStore) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = d
+}
+
+// Corrupt sets whether reads of the block with the given score
+// return damaged data, which does not match the score.
+func (s *FaultStore) Corrupt(score *venti.Score, corrupt bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if corrupt {
+		s.corrupt[*score] = true
+	} else {
+		delete(s.corrupt, *score)
+	}
+}
+
+// FailWrites sets whether writes of the block with the given
+// score fail with ErrInjected.
+func (s *FaultStore) FailWrites(score *venti.Score, fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fail {
+		s.failWrites[*score] = true
+	} else {
+		delete(s.failWrites, *score)
+	}
+}
+
+// Writes returns the number of writes attempted, and the
+// number of those which failed with ErrInjected.
+func (s *FaultStore) Writes() (n, failed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writes, s.failed
+}
+
+func (s *FaultStore) delay() {
+	s.mu.Lock()
+	d := s.latency
+	s.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (s *FaultStore) Read(score *venti.Score, typ venti.BlockType, p []byte) (int, error) {
+	s.delay()
+	n, err := s.store.Read(score, typ, p)
+	if err != nil {
+		return n, err
+	}
+
+	s.mu.Lock()
+	corrupt := s.corrupt[*score]
+	s.mu.Unlock()
+
+	if corrupt {
+		if n == 0 {
+			if len(p) == 0 {
+				return 0, errors.New("cannot corrupt empty block")
+			}
+			n = 1
+		}
+		p[0] ^= 0xff
+	}
+	return n, nil
+}
+
+func (s *FaultStore) Write(typ venti.BlockType, p []byte) (*venti.Score, error) {
+	s.delay()
+
+	s.mu.Lock()
+	s.writes++
+	fail := s.failWrites[*venti.Sha1(p)]
+	if fail {
+		s.failed++
+	}
+	s.mu.Unlock()
+
+	if fail {
+		return nil, ErrInjected
+	}
+	return s.store.Write(typ, p)
+}
+
+func (s *FaultStore) Sync() error {
+	s.delay()
+	return s.store.Sync()
+}
+
+// A Server serves a store on a local TCP port, and can
+// drop its client connections on request.
+type Server struct {
+	srv *venti.Server
+	l   net.Listener
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// NewServer serves store on a free port of the loopback address.
+func NewServer(store venti.Store) (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		srv:   venti.NewServer(store),
+		l:     l,
+		conns: make(map[net.Conn]bool),
+	}
+	go s.srv.Serve(&trackListener{Listener: l, s: s})
+	return s, nil
+}
+
+// Addr returns the address on which s is listening.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// DropConns closes every client connection, as if the network had
+// failed. The server keeps listening for new connections.
+func (s *Server) DropConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+type trackListener struct {
+	net.Listener
+	s *Server
+}
+
+func (l *trackListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.s.mu.Lock()
+	l.s.conns[c] = true
+	l.s.mu.Unlock()
+	return &trackConn{Conn: c, s: l.s}, nil
+}
+
+type trackConn struct {
+	net.Conn
+	s *Server
+}
+
+func (c *trackConn) Close() error {
+	c.s.mu.Lock()
+	delete(c.s.conns, c.Conn)
+	c.s.mu.Unlock()
+	return c.Conn.Close()
+}
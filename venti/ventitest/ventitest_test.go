@@ -0,0 +1,95 @@
+package ventitest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/floren/fs/venti"
+)
+
+func TestFaultStore(t *testing.T) {
+	s := NewFaultStore(venti.NewMemStore())
+
+	data := []byte("fault")
+	score, err := s.Write(venti.DataType, data)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	buf := make([]byte, 100)
+	s.Corrupt(score, true)
+	n, err := s.Read(score, venti.DataType, buf)
+	if err != nil {
+		t.Fatalf("read corrupt block: %v", err)
+	}
+	if score.Check(buf[:n]) {
+		t.Errorf("corrupt block passed score check")
+	}
+	s.Corrupt(score, false)
+	n, err = s.Read(score, venti.DataType, buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Errorf("read: got %q, want %q", buf[:n], data)
+	}
+
+	other := []byte("other")
+	s.FailWrites(venti.Sha1(other), true)
+	if _, err := s.Write(venti.DataType, other); !errors.Is(err, ErrInjected) {
+		t.Errorf("failed write: got %v, want %v", err, ErrInjected)
+	}
+	if _, err := s.Write(venti.DataType, data); err != nil {
+		t.Errorf("write: %v", err)
+	}
+	s.FailWrites(venti.Sha1(other), false)
+	if _, err := s.Write(venti.DataType, other); err != nil {
+		t.Errorf("write after clearing fault: %v", err)
+	}
+	if n, failed := s.Writes(); n != 4 || failed != 1 {
+		t.Errorf("writes: got %d, %d failed; want 4, 1 failed", n, failed)
+	}
+
+	s.SetLatency(20 * time.Millisecond)
+	start := time.Now()
+	if err := s.Sync(); err != nil {
+		t.Errorf("sync: %v", err)
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("sync took %v, want at least %v", d, 20*time.Millisecond)
+	}
+}
+
+func TestServerDropConns(t *testing.T) {
+	srv, err := NewServer(venti.NewMemStore())
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	defer srv.Close()
+
+	z, err := venti.Dial(srv.Addr())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer z.Close()
+	if err := z.Ping(); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+
+	srv.DropConns()
+	if err := z.Ping(); err == nil {
+		t.Errorf("ping on dropped connection succeeded")
+	}
+
+	// new connections are still accepted
+	z2, err := venti.Dial(srv.Addr())
+	if err != nil {
+		t.Fatalf("dial after drop: %v", err)
+	}
+	defer z2.Close()
+	if err := z2.Ping(); err != nil {
+		t.Errorf("ping after drop: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package venti
+
+import "errors"
+
+/*
+ * Decompression of clumps compressed by plan9port's venti, a
+ * translation of its unwhack.c. Literals and back references are
+ * packed most significant bit first; literals that look like text
+ * get shorter codes.
+ */
+const (
+	whackMinDecode = 8 // minimum bits to decode a match or literal
+	dMaxFastLen    = 7
+	dBigLenCode    = 0x3c // minimum code for large length encoding
+	dBigLenBits    = 6
+	dBigLenBase    = 1 // starting items to encode for big lengths
+)
+
+var whackLenVal = [1 << (dBigLenBits - 1)]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	3, 3, 3, 3, 3, 3, 3, 3,
+	4, 4, 4, 4,
+	5,
+	6,
+	255,
+	255,
+}
+
+var whackLenBits = [...]uint8{
+	0, 0, 0,
+	2, 3, 5, 5,
+}
+
+var whackOffBits = [16]uint8{
+	5, 5, 5, 5, 6, 6, 7, 7,
+	8, 8, 9, 9, 10, 10, 12, 13,
+}
+
+var whackOffBase = [16]uint16{
+	0, 0x20,
+	0x40, 0x60,
+	0x80, 0xc0,
+	0x100, 0x180,
+	0x200, 0x300,
+	0x400, 0x600,
+	0x800, 0xc00,
+	0x1000,
+	0x2000,
+}
+
+// unwhack decompresses src into dst, returning the number of
+// bytes written.
+func unwhack(dst, src []byte) (int, error) {
+	var (
+		d        int
+		bits     uint64
+		nbits    int
+		overbits int
+		lithist  = ^uint32(0)
+	)
+	for len(src) > 0 || nbits-overbits >= whackMinDecode {
+		for nbits <= 24 {
+			bits <<= 8
+			if len(src) > 0 {
+				bits |= uint64(src[0])
+				src = src[1:]
+			} else {
+				overbits += 8
+			}
+			nbits += 8
+		}
+
+		/*
+		 * literal
+		 */
+		length := int(whackLenVal[(bits>>uint(nbits-5))&0x1f])
+		if length == 0 {
+			var lit uint32
+			if lithist&0xf != 0 {
+				nbits -= 9
+				lit = uint32(bits>>uint(nbits)) & 0xff
+			} else {
+				nbits -= 8
+				lit = uint32(bits>>uint(nbits)) & 0x7f
+				if lit < 32 {
+					if lit < 24 {
+						nbits -= 2
+						lit = lit<<2 | uint32(bits>>uint(nbits))&3
+					} else {
+						nbits -= 3
+						lit = lit<<3 | uint32(bits>>uint(nbits))&7
+					}
+					lit = (lit - 64) & 0xff
+				}
+			}
+			if d >= len(dst) {
+				return 0, errors.New("unwhack: too much output")
+			}
+			dst[d] = uint8(lit)
+			d++
+			lithist <<= 1
+			if lit < 32 || lit > 127 {
+				lithist |= 1
+			}
+			continue
+		}
+
+		/*
+		 * length
+		 */
+		if length < 255 {
+			nbits -= int(whackLenBits[length])
+		} else {
+			nbits -= dBigLenBits
+			code := int(bits>>uint(nbits))&(1<<dBigLenBits-1) - dBigLenCode
+			length = dMaxFastLen
+			use := dBigLenBase
+			shift := (dBigLenBits & 1) ^ 1
+			for code >= use {
+				length += use
+				code -= use
+				code <<= 1
+				nbits--
+				if nbits < 0 {
+					return 0, errors.New("unwhack: length out of range")
+				}
+				code |= int(bits>>uint(nbits)) & 1
+				use <<= uint(shift)
+				shift ^= 1
+			}
+			length += code
+
+			for nbits <= 24 {
+				bits <<= 8
+				if len(src) > 0 {
+					bits |= uint64(src[0])
+					src = src[1:]
+				} else {
+					overbits += 8
+				}
+				nbits += 8
+			}
+		}
+
+		/*
+		 * offset
+		 */
+		nbits -= 4
+		i := (bits >> uint(nbits)) & 0xf
+		off := int(whackOffBase[i])
+		nbits -= int(whackOffBits[i])
+		off |= int(bits>>uint(nbits)) & (1<<whackOffBits[i] - 1)
+		off++
+
+		if off > d {
+			return 0, errors.New("unwhack: offset out of range")
+		}
+		if d+length > len(dst) {
+			return 0, errors.New("unwhack: length out of range")
+		}
+		for j := 0; j < length; j++ {
+			dst[d+j] = dst[d-off+j]
+		}
+		d += length
+	}
+	if nbits < overbits {
+		return 0, errors.New("unwhack: compressed data overrun")
+	}
+	return d, nil
+}
@@ -0,0 +1,59 @@
+package venti
+
+import "testing"
+
+type bitWriter struct {
+	buf   []byte
+	nbits int
+}
+
+func (w *bitWriter) put(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v&(1<<uint(i)) != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> uint(w.nbits%8)
+		}
+		w.nbits++
+	}
+}
+
+func TestUnwhack(t *testing.T) {
+	var w bitWriter
+
+	// The first literals use 9 bits; once four text-like literals
+	// have been seen, 8 bits, with longer codes for control bytes.
+	for _, c := range "abcd" {
+		w.put(uint32(c), 9)
+	}
+	w.put(16, 8)
+	w.put(1, 2)
+
+	// a match of length 6 at offset 5
+	w.put(0x1d, 5)
+	w.put(0, 4)
+	w.put(4, 5)
+
+	dst := make([]byte, 100)
+	n, err := unwhack(dst, w.buf)
+	if err != nil {
+		t.Fatalf("unwhack: %v", err)
+	}
+	if want := "abcd\x01abcd\x01a"; string(dst[:n]) != want {
+		t.Errorf("unwhack: got %q, want %q", dst[:n], want)
+	}
+
+	if _, err := unwhack(dst[:3], w.buf); err == nil {
+		t.Errorf("unwhack into short buffer succeeded")
+	}
+
+	w = bitWriter{}
+	w.put('a', 9)
+	w.put(0x1d, 5)
+	w.put(0, 4)
+	w.put(4, 5)
+	if _, err := unwhack(dst, w.buf); err == nil {
+		t.Errorf("unwhack with bad offset succeeded")
+	}
+}